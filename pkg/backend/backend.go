@@ -51,6 +51,18 @@ func (e StackAlreadyExistsError) Error() string {
 	return fmt.Sprintf("stack '%v' already exists", e.StackName)
 }
 
+// StackNotEmptyError is returned from RemoveStack when the stack still contains resources
+// and the removal isn't forced.
+type StackNotEmptyError struct {
+	StackName     string
+	ResourceCount int
+}
+
+func (e StackNotEmptyError) Error() string {
+	return fmt.Sprintf("refusing to remove stack '%v' because it still contains %d resources",
+		e.StackName, e.ResourceCount)
+}
+
 // OverStackLimitError is returned from CreateStack when the organization is billed per-stack and
 // is over its stack limit.
 type OverStackLimitError struct {
@@ -395,8 +407,11 @@ func (c *backendClient) GetStackResourceOutputs(
 // which do not support the teams feature.
 var ErrTeamsNotSupported = errors.New("teams are not supported")
 
+// ErrInitialConfigNotSupported is returned by backends
+// which can't create a stack with initial configuration.
+var ErrInitialConfigNotSupported = errors.New("creating a stack with initial configuration is not supported")
+
 // CreateStackOptions provides options for stack creation.
-// At present, options only apply to the Service.
 type CreateStackOptions struct {
 	// Teams is a list of teams who should have access to
 	// the newly created stack.
@@ -406,4 +421,13 @@ type CreateStackOptions struct {
 	// The backend may return ErrTeamsNotSupported
 	// if Teams is specified but not supported.
 	Teams []string
+
+	// Config is the initial configuration of the stack.
+	// It's returned by GetLatestConfiguration until the stack is first updated.
+	// This option is only appropriate for backends
+	// which store configuration with the stack's history (i.e. the self-managed backends).
+	//
+	// The backend may return ErrInitialConfigNotSupported
+	// if Config is specified but not supported.
+	Config config.Map
 }
@@ -98,7 +98,7 @@ func RenderDiffEvent(event engine.Event, seen map[resource.URN]engine.StepEventM
 	switch event.Type {
 	case engine.CancelEvent:
 		return ""
-	case engine.PolicyLoadEvent:
+	case engine.PolicyLoadEvent, engine.PermalinkUnavailableEvent:
 		return ""
 
 		// Currently, prelude, summary, and stdout events are printed the same for both the diff and
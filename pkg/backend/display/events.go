@@ -171,6 +171,16 @@ func ConvertEngineEvent(e engine.Event, showSecrets bool) (apitype.EngineEvent,
 	case engine.PolicyLoadEvent:
 		apiEvent.PolicyLoadEvent = &apitype.PolicyLoadEvent{}
 
+	case engine.PermalinkUnavailableEvent:
+		p, ok := e.Payload().(engine.PermalinkUnavailableEventPayload)
+		if !ok {
+			return apiEvent, eventTypePayloadMismatch
+		}
+		apiEvent.PermalinkUnavailableEvent = &apitype.PermalinkUnavailableEvent{
+			Stack: p.Stack,
+			Error: p.Error,
+		}
+
 	default:
 		return apiEvent, fmt.Errorf("unknown event type %q", e.Type)
 	}
@@ -380,6 +390,13 @@ func ConvertJSONEvent(apiEvent apitype.EngineEvent) (engine.Event, error) {
 	case apiEvent.PolicyLoadEvent != nil:
 		event = engine.NewEvent(engine.PolicyLoadEventPayload{})
 
+	case apiEvent.PermalinkUnavailableEvent != nil:
+		p := apiEvent.PermalinkUnavailableEvent
+		event = engine.NewEvent(engine.PermalinkUnavailableEventPayload{
+			Stack: p.Stack,
+			Error: p.Error,
+		})
+
 	default:
 		return event, errors.New("unknown event type")
 	}
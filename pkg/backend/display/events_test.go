@@ -20,6 +20,7 @@ import (
 	"testing"
 
 	"github.com/pulumi/pulumi/pkg/v3/engine"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +40,23 @@ func TestRemoveANSI(t *testing.T) {
 	assert.NoError(t, err, "unable to convert engine event")
 	assert.Equal(t, expected, res.DiagnosticEvent.Message)
 }
+
+func TestConvertPermalinkUnavailableEvent(t *testing.T) {
+	t.Parallel()
+
+	e := engine.NewEvent(engine.PermalinkUnavailableEventPayload{
+		Stack: "organization/proj/dev",
+		Error: "signing not supported",
+	})
+
+	res, err := ConvertEngineEvent(e, false /* showSecrets */)
+	assert.NoError(t, err, "unable to convert engine event")
+	assert.Equal(t, &apitype.PermalinkUnavailableEvent{
+		Stack: "organization/proj/dev",
+		Error: "signing not supported",
+	}, res.PermalinkUnavailableEvent)
+
+	back, err := ConvertJSONEvent(res)
+	assert.NoError(t, err, "unable to convert JSON event")
+	assert.Equal(t, e, back)
+}
@@ -93,8 +93,13 @@ func ShowJSONEvents(events <-chan engine.Event, done chan<- bool, opts Options)
 	// Ensure we close the done channel before exiting.
 	defer func() { close(done) }()
 
+	stdout := opts.Stdout
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+
 	sequence := 0
-	encoder := json.NewEncoder(os.Stdout)
+	encoder := json.NewEncoder(stdout)
 	encoder.SetEscapeHTML(false)
 	for e := range events {
 		if err := logJSONEvent(encoder, e, opts, sequence); err != nil {
@@ -206,6 +211,9 @@ func ShowPreviewDigest(events <-chan engine.Event, done chan<- bool, opts Option
 		case engine.PolicyLoadEvent:
 			// At this point in time, we don't handle policy events in JSON serialization
 			continue
+		case engine.PermalinkUnavailableEvent:
+			// Permalinks aren't part of the digest.
+			continue
 		case engine.SummaryEvent:
 			// At the end of the preview, a summary event indicates the final conclusions.
 			p := e.Payload().(engine.SummaryEventPayload)
@@ -854,6 +854,9 @@ func (display *ProgressDisplay) processNormalEvent(event engine.Event) {
 			display.shownPolicyLoadEvent = true
 		}
 		return
+	case engine.PermalinkUnavailableEvent:
+		// The backend reports this to the user itself.
+		return
 	case engine.SummaryEvent:
 		// keep track of the summary event so that we can display it after all other
 		// resource-related events we receive.
@@ -19,10 +19,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -59,6 +62,7 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 )
@@ -80,15 +84,262 @@ type UpgradeOptions struct {
 	// If this function is not specified,
 	// stacks without projects will be skipped during the upgrade.
 	ProjectsForDetachedStacks func(stacks []tokens.StackName) (projects []tokens.Name, err error)
+
+	// DryRun reports the moves the upgrade would make
+	// without modifying the bucket.
+	DryRun bool
+
+	// Progress is an optional function that is called
+	// after each legacy stack has been processed by the upgrade,
+	// whether it was moved, skipped, or failed to upgrade.
+	//
+	// done is the number of stacks processed so far,
+	// total is the number of legacy stacks found in the bucket,
+	// and current is the name of the stack that was just processed.
+	//
+	// Calls are serialized, but may come from different goroutines.
+	// It is not called for dry runs.
+	Progress func(done, total int, current string)
+}
+
+// UpgradeMove describes how an upgrade moves a single stack
+// from the legacy layout to the project layout.
+type UpgradeMove struct {
+	// Old is the reference to the stack in the legacy layout.
+	Old backend.StackReference
+
+	// New is the reference to the stack in the project layout.
+	//
+	// This is nil if no project could be determined for the stack.
+	// Such stacks are skipped during the upgrade.
+	New backend.StackReference
+}
+
+// HistoryFilter selects the updates returned by GetHistoryFiltered.
+// An update has to match all the criteria that are set; the zero value matches every update.
+type HistoryFilter struct {
+	// Message selects updates whose message contains the given substring.
+	Message string
+
+	// Environment selects updates whose environment has all the given keys set to the given values.
+	Environment map[string]string
+
+	// Kinds selects updates of any of the given kinds, e.g. apitype.UpdateUpdate.
+	Kinds []apitype.UpdateKind
+
+	// Match is an optional predicate for criteria not covered by the other fields.
+	Match func(backend.UpdateInfo) bool
+}
+
+// matches reports whether the given update matches all the criteria of the filter.
+func (f *HistoryFilter) matches(update backend.UpdateInfo) bool {
+	if f.Message != "" && !strings.Contains(update.Message, f.Message) {
+		return false
+	}
+	for k, v := range f.Environment {
+		if actual, ok := update.Environment[k]; !ok || actual != v {
+			return false
+		}
+	}
+	if len(f.Kinds) > 0 {
+		found := false
+		for _, kind := range f.Kinds {
+			if kind == update.Kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return f.Match == nil || f.Match(update)
 }
 
 // Backend extends the base backend interface with specific information about local backends.
+//
+// Backends on S3-compatible services like MinIO or Ceph are configured
+// with the following query parameters of the s3:// URL:
+//
+//   - endpoint: URL of the service, e.g. "http://localhost:9000"
+//   - disableSSL: whether to use HTTP instead of HTTPS if the endpoint has no scheme
+//   - s3ForcePathStyle: whether to address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>
+//   - region: region of the bucket; defaults to "us-east-1" if an endpoint is set
+//
+// For example:
+//
+//	s3://my-bucket?endpoint=minio.example.com:9000&disableSSL=true&s3ForcePathStyle=true
 type Backend interface {
 	backend.Backend
 	local() // at the moment, no local specific info, so just use a marker function.
 
 	// Upgrade to the latest state store version.
-	Upgrade(ctx context.Context, opts *UpgradeOptions) error
+	//
+	// Returns the moves planned for each stack in the legacy layout.
+	// If opts.DryRun is set, the bucket is left untouched,
+	// and stacks without a project are reported with a nil New reference
+	// instead of asking opts.ProjectsForDetachedStacks for one.
+	Upgrade(ctx context.Context, opts *UpgradeOptions) ([]UpgradeMove, error)
+
+	// PruneHistory deletes update records from the history of the given stack.
+	//
+	// Records beyond the keepLast most recent ones,
+	// or older than olderThan, are deleted.
+	// A zero value for either disables that criteria; negative values are rejected.
+	// The current checkpoint of the stack is never touched.
+	//
+	// Returns the keys of the deleted objects.
+	// If dryRun is set, nothing is deleted,
+	// and the keys that would have been deleted are returned instead.
+	PruneHistory(
+		ctx context.Context, stackRef backend.StackReference,
+		keepLast int, olderThan time.Duration, dryRun bool,
+	) ([]string, error)
+
+	// ExportDeploymentAt exports the deployment archived with an earlier update of the given stack.
+	//
+	// updateIndex indexes into the updates returned by GetHistory,
+	// so 0 is the most recent update.
+	// Returns backend.ErrNoPreviousDeployment if there is no such update.
+	ExportDeploymentAt(ctx context.Context, stk backend.Stack, updateIndex int) (*apitype.UntypedDeployment, error)
+
+	// ImportDeploymentReader is like ImportDeployment,
+	// but decodes the untyped deployment from the given reader.
+	// Deployments with an unsupported version are rejected.
+	ImportDeploymentReader(ctx context.Context, stk backend.Stack, r io.Reader) error
+
+	// EnsureStack returns the given stack, creating it first if it doesn't exist,
+	// and reports whether it was created.
+	// Unlike CreateStack, it doesn't fail if the stack already exists.
+	//
+	// It holds the lock of the stack while doing so, waiting for other processes to release it,
+	// so concurrent calls create the stack exactly once.
+	EnsureStack(
+		ctx context.Context, stackRef backend.StackReference, opts *backend.CreateStackOptions,
+	) (backend.Stack, bool, error)
+
+	// ImportDeploymentPreview reports how importing the given deployment with ImportDeployment
+	// would change the resources of the stack, without changing anything.
+	ImportDeploymentPreview(
+		ctx context.Context, stk backend.Stack, deployment *apitype.UntypedDeployment,
+	) (*DeploymentDiff, error)
+
+	// CopyStack copies the current checkpoint of srcRef to a new stack dstRef,
+	// rewriting the URNs inside it to use the name and project of dstRef.
+	// The history and tags of srcRef are not copied.
+	//
+	// Returns an error if dstRef already exists.
+	CopyStack(ctx context.Context, srcRef, dstRef backend.StackReference) error
+
+	// ExportProject writes a bundle of the latest checkpoints of all stacks in the given project to w.
+	// The bundle is a tar archive that ImportProject can read.
+	ExportProject(ctx context.Context, project tokens.Name, w io.Writer) error
+
+	// ImportProject recreates the stacks of a bundle written by ExportProject.
+	// Returns an error without importing anything if any of the stacks already exists.
+	ImportProject(ctx context.Context, r io.Reader) error
+
+	// GetRawCheckpoint returns the checkpoint of the given stack exactly as stored in the bucket,
+	// after decompression, along with its format.
+	// The format is the markup of the checkpoint, e.g. "json",
+	// followed by "+" and the compression codec if it was compressed, e.g. "json+gzip".
+	GetRawCheckpoint(ctx context.Context, stackRef backend.StackReference) ([]byte, string, error)
+
+	// Stats reports the number of operations made against the bucket
+	// since the backend was created.
+	Stats() BucketStats
+
+	// WatchWithFilter is like Watch, but only updates the stack for the changes selected by opts.
+	// See backend.WatchOptions.
+	WatchWithFilter(ctx context.Context, stk backend.Stack, op backend.UpdateOperation,
+		paths []string, opts backend.WatchOptions) result.Result
+
+	// GetStackSecretsProvider returns the type and state of the secrets provider used by the given stack,
+	// or nil if the stack doesn't use one.
+	// This never includes the key, so the stack's secrets can't be decrypted with it.
+	GetStackSecretsProvider(ctx context.Context, stackRef backend.StackReference) (*apitype.SecretsProvidersV1, error)
+
+	// RotateSecretsProvider re-encrypts the secrets in the checkpoint of the given stack with newManager,
+	// and records newManager as the secrets provider of the stack.
+	//
+	// The secrets are decrypted with the secrets provider currently recorded in the checkpoint,
+	// so its key (e.g. the old passphrase) must still be available.
+	// The stack is locked while its checkpoint is rewritten.
+	// Stack configuration lives with the project, not in the bucket,
+	// so secrets in it are not affected.
+	RotateSecretsProvider(ctx context.Context, stackRef backend.StackReference, newManager secrets.Manager) error
+
+	// RotateAllSecretsProviders calls RotateSecretsProvider for every stack in the bucket.
+	// It stops at the first stack that fails to rotate;
+	// stacks rotated before that keep the new secrets provider.
+	RotateAllSecretsProviders(ctx context.Context, newManager secrets.Manager) error
+
+	// ListProjects lists the names of the projects in the bucket.
+	//
+	// Returns an empty list if the bucket uses the legacy layout,
+	// which doesn't support projects.
+	ListProjects(ctx context.Context) ([]tokens.Name, error)
+
+	// ListLocks lists the locks held on all the stacks in the bucket,
+	// including those left behind by processes that crashed.
+	ListLocks(ctx context.Context) ([]LockInfo, error)
+
+	// PruneStaleLocks deletes the locks in the bucket that were taken more than olderThan ago,
+	// and returns the deleted locks. olderThan must be positive.
+	//
+	// Locks held by this backend are never deleted.
+	// Locks that can't be read have no timestamp, so they're aged by when they were written.
+	PruneStaleLocks(ctx context.Context, olderThan time.Duration) ([]LockInfo, error)
+
+	// DeleteProject removes the directories of a project from the bucket,
+	// along with any backups left behind in them.
+	// Locks are only removed if they're stale or their stack no longer exists.
+	//
+	// It fails if the project still has stacks, unless force is set,
+	// in which case those stacks are locked and their state is removed too.
+	DeleteProject(ctx context.Context, project tokens.Name, force bool) error
+
+	// GetHistoryPage is like GetHistory,
+	// but also returns the total number of updates in the history of the stack
+	// so that callers can tell whether there are more pages.
+	GetHistoryPage(
+		ctx context.Context, stackRef backend.StackReference, pageSize int, page int,
+	) (_ []backend.UpdateInfo, total int, _ error)
+
+	// GetHistoryFiltered is like GetHistory,
+	// but only returns the updates that match the given filter.
+	// Pages are made up of matching updates only,
+	// and history records are read only until the requested page is full.
+	GetHistoryFiltered(
+		ctx context.Context, stackRef backend.StackReference, filter HistoryFilter, pageSize int, page int,
+	) ([]backend.UpdateInfo, error)
+
+	// VerifyAll verifies the integrity of every stack in the bucket.
+	//
+	// Failures of individual stacks are reported in the results
+	// rather than aborting the verification.
+	// Stacks that no longer have a checkpoint are reported
+	// only if they left lock or backup files behind.
+	VerifyAll(ctx context.Context) ([]StackVerifyResult, error)
+
+	// RenameProject moves every stack of oldProject to newProject,
+	// rewriting the URNs in their checkpoints to match.
+	//
+	// All stacks of the project are locked for the duration of the rename.
+	// The old stacks are only removed after all new checkpoints are written;
+	// if writing any of them fails, the ones already written are removed again.
+	RenameProject(ctx context.Context, oldProject, newProject tokens.Name) error
+
+	// Backup writes the current checkpoint, the tags, secrets provider and initial configuration,
+	// and the update history of the given stack to w as a single tar archive.
+	Backup(ctx context.Context, stackRef backend.StackReference, w io.Writer) error
+
+	// Restore restores a stack from an archive written by Backup.
+	// A stack restored under another name or project is renamed in its checkpoint.
+	//
+	// Restore refuses to overwrite an existing stack unless force is set,
+	// in which case the existing stack is removed first.
+	Restore(ctx context.Context, stackRef backend.StackReference, r io.Reader, force bool) error
 }
 
 type localBackend struct {
@@ -103,12 +354,68 @@ type localBackend struct {
 	bucket Bucket
 	mutex  sync.Mutex
 
+	// stats counts the operations made against the bucket.
+	stats *bucketStats
+
 	lockID string
 
-	gzip bool
+	// ensureStackMu guards ensureStackLocks.
+	ensureStackMu sync.Mutex
+	// ensureStackLocks serializes calls to EnsureStack for the same stack,
+	// keyed by the fully qualified name of the stack. See lockEnsureStack.
+	ensureStackLocks map[tokens.QName]*ensureStackLock
+
+	// lockTTL is the age after which locks held by other processes are considered stale.
+	// Zero means locks never go stale.
+	lockTTL time.Duration
+
+	// disableBackups is set when no .bak copies of state files should be written
+	// before they are replaced or removed.
+	disableBackups bool
+
+	// readonly is set when the backend must not modify the state.
+	// Mutating operations fail with ErrReadOnlyBackend.
+	readonly bool
+
+	// maxNameLength is the maximum length of project and stack names.
+	maxNameLength int
+
+	// caseInsensitive is set when the bucket may not tell apart names that differ only by case.
+	// See checkCaseCollision.
+	caseInsensitive bool
+
+	// checkpointBatchSize and checkpointFlushInterval control how often
+	// snapshots are written out during an update. See localSnapshotPersister.
+	checkpointBatchSize     int
+	checkpointFlushInterval time.Duration
+
+	// permalinkExpiry is how long signed permalinks to state files stay valid.
+	// Zero means the default of the bucket driver.
+	permalinkExpiry time.Duration
+
+	// atomicWrites is set when the bucket never exposes partially written objects to readers.
+	// See writeAtomic.
+	atomicWrites bool
+
+	// compression is the codec used when writing new state files.
+	compression compression
+
+	// markupExt is the extension of the markup used when writing new state files,
+	// e.g. ".json" or ".yaml".
+	markupExt string
+
+	// organizations are the organization names configured for this backend, if any.
+	// See readOrganizations.
+	organizations []string
+
+	// orgDirs is set when each of the organizations has a directory of its own.
+	orgDirs bool
 
 	Env env.Env
 
+	// clock tells the time for all the timestamps recorded by the backend.
+	clock Clock
+
 	// The current project, if any.
 	currentProject atomic.Pointer[workspace.Project]
 
@@ -123,6 +430,10 @@ type localBackendReference struct {
 	name    tokens.StackName
 	project tokens.Name
 
+	// org is the organization of the stack if it has a directory of its own,
+	// and empty for the default organization.
+	org string
+
 	// A thread-safe way to get the current project.
 	// The function reference or the pointer returned by the function may be nil.
 	currentProject func() *workspace.Project
@@ -141,6 +452,11 @@ func (r *localBackendReference) String() string {
 		return r.name.String()
 	}
 
+	// Stacks of other organizations must always be qualified with their organization.
+	if r.org != "" {
+		return fmt.Sprintf("%s/%s/%s", r.org, r.project, r.name)
+	}
+
 	if r.currentProject != nil {
 		proj := r.currentProject()
 		// For project scoped references when stringifying backend references,
@@ -167,7 +483,11 @@ func (r *localBackendReference) FullyQualifiedName() tokens.QName {
 	if r.project == "" {
 		return r.name.Q()
 	}
-	return tokens.QName(fmt.Sprintf("organization/%s/%s", r.project, r.name))
+	org := r.org
+	if org == "" {
+		org = defaultOrganization
+	}
+	return tokens.QName(fmt.Sprintf("%s/%s/%s", org, r.project, r.name))
 }
 
 // Helper methods that delegate to the underlying referenceStore.
@@ -187,12 +507,64 @@ func IsFileStateBackendURL(urlstr string) bool {
 
 const FilePathPrefix = "file://"
 
+// ErrReadOnlyBackend is returned by operations that would modify the state
+// of a backend opened in read-only mode with PULUMI_SELF_MANAGED_READONLY.
+var ErrReadOnlyBackend = errors.New("the self-managed backend is read-only")
+
+// maxPermalinkExpiry is the longest validity of a signed permalink.
+// This is the limit for presigned URLs on both S3 and Google Cloud Storage.
+const maxPermalinkExpiry = 7 * 24 * time.Hour
+
+// maxNameLengthLimit is the largest value accepted for PULUMI_SELF_MANAGED_MAX_NAME_LENGTH.
+//
+// Stack names become file names in the bucket,
+// and most file systems limit those to 255 bytes.
+// This leaves room for the extensions added to state files,
+// e.g. "foo.json.gz.tmp-1700000000000000000".
+const maxNameLengthLimit = 200
+
 // New constructs a new filestate backend,
 // using the given URL as the root for storage.
 // The URL must use one of the schemes supported by the go-cloud blob package.
 // Thes inclue: file, s3, gs, azblob.
-func New(ctx context.Context, d diag.Sink, originalURL string, project *workspace.Project) (Backend, error) {
-	return newLocalBackend(ctx, d, originalURL, project, nil)
+func New(
+	ctx context.Context, d diag.Sink, originalURL string, project *workspace.Project, opts ...Option,
+) (Backend, error) {
+	var o localBackendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return newLocalBackend(ctx, d, originalURL, project, &o)
+}
+
+// Option customizes a backend built by New.
+type Option func(*localBackendOptions)
+
+// WithBaseDir makes the backend resolve relative file:// URLs against the given directory,
+// e.g. the project root, instead of the current working directory.
+func WithBaseDir(dir string) Option {
+	return func(o *localBackendOptions) {
+		o.BaseDir = dir
+	}
+}
+
+// WithClock makes the backend take all the timestamps it records from the given clock.
+// Defaults to the system clock.
+func WithClock(clock Clock) Option {
+	return func(o *localBackendOptions) {
+		o.Clock = clock
+	}
+}
+
+// WithLockIDProvider makes the backend get the ID that identifies its locks from the given function,
+// which is called once when the backend is built.
+// The ID names the lock files of the backend, so it must be usable as a file name,
+// and unique among the processes that may lock the same stacks.
+// Defaults to a random UUID.
+func WithLockIDProvider(provider func() (string, error)) Option {
+	return func(o *localBackendOptions) {
+		o.LockIDProvider = provider
+	}
 }
 
 type localBackendOptions struct {
@@ -200,6 +572,30 @@ type localBackendOptions struct {
 	//
 	// Defaults to env.Global
 	Env env.Env
+
+	// Clock tells the time.
+	//
+	// Defaults to the system clock.
+	Clock Clock
+
+	// BaseDir is the directory that relative file:// URLs are resolved against.
+	//
+	// Defaults to the current working directory.
+	BaseDir string
+
+	// LockIDProvider returns the ID of the locks taken by the backend.
+	//
+	// Defaults to newRandomLockID.
+	LockIDProvider func() (string, error)
+}
+
+// newRandomLockID returns a new random UUID to identify the locks of a backend.
+func newRandomLockID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
 }
 
 // newLocalBackend builds a filestate backend implementation
@@ -214,13 +610,19 @@ func newLocalBackend(
 	if opts.Env == nil {
 		opts.Env = env.Global()
 	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if opts.LockIDProvider == nil {
+		opts.LockIDProvider = newRandomLockID
+	}
 
 	if !IsFileStateBackendURL(originalURL) {
 		return nil, fmt.Errorf("local URL %s has an illegal prefix; expected one of: %s",
 			originalURL, strings.Join(blob.DefaultURLMux().BucketSchemes(), ", "))
 	}
 
-	u, err := massageBlobPath(originalURL)
+	u, err := massageBlobPath(originalURL, opts.BaseDir)
 	if err != nil {
 		return nil, err
 	}
@@ -241,31 +643,94 @@ func newLocalBackend(
 		}
 	}
 
-	bucket, err := blobmux.OpenBucket(ctx, u)
+	var bucket *blob.Bucket
+	if isS3CompatibleURL(p) {
+		// Configure S3-compatible services explicitly from the URL
+		// rather than relying on AWS defaults and AWS_* environment variables.
+		bucket, err = openS3CompatibleBucket(ctx, p)
+	} else {
+		bucket, err = blobmux.OpenBucket(ctx, u)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to open bucket %s: %w", u, err)
 	}
 
 	if !strings.HasPrefix(u, FilePathPrefix) {
-		bucketSubDir := strings.TrimLeft(p.Path, "/")
+		bucketSubDir, err := normalizeBucketSubDir(p.Path)
+		if err != nil {
+			contract.IgnoreClose(bucket)
+			return nil, fmt.Errorf("invalid URL %s: %w", originalURL, err)
+		}
 		if bucketSubDir != "" {
-			if !strings.HasSuffix(bucketSubDir, "/") {
-				bucketSubDir += "/"
-			}
-
 			bucket = blob.PrefixedBucket(bucket, bucketSubDir)
 		}
 	}
 
 	// Allocate a unique lock ID for this backend instance.
-	lockID, err := uuid.NewV4()
+	lockID, err := opts.LockIDProvider()
+	if err != nil {
+		return nil, fmt.Errorf("get lock ID: %w", err)
+	}
+	if lockID == "" || strings.ContainsAny(lockID, `/\`) {
+		return nil, fmt.Errorf("invalid lock ID %q: must be a valid file name", lockID)
+	}
+
+	codec, err := compressionFromEnv(opts.Env)
 	if err != nil {
 		return nil, err
 	}
 
-	gzipCompression := opts.Env.GetBool(env.SelfManagedGzip)
+	markupExt, err := stateMarkupFromEnv(opts.Env)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockTTL time.Duration
+	if v := opts.Env.GetString(env.SelfManagedLockTTL); v != "" {
+		lockTTL, err = time.ParseDuration(v)
+		if err != nil || lockTTL < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", env.SelfManagedLockTTL.Var().Name(), v)
+		}
+	}
+
+	maxNameLength := tokens.MaxStackNameLength
+	if n := opts.Env.GetInt(env.SelfManagedMaxNameLength); n != 0 {
+		if n < 0 || n > maxNameLengthLimit {
+			return nil, fmt.Errorf("invalid value for %s: %d; must be between 1 and %d",
+				env.SelfManagedMaxNameLength.Var().Name(), n, maxNameLengthLimit)
+		}
+		maxNameLength = n
+	}
+
+	checkpointBatchSize := opts.Env.GetInt(env.SelfManagedCheckpointBatchSize)
+	if checkpointBatchSize < 0 {
+		return nil, fmt.Errorf("invalid value for %s: %d",
+			env.SelfManagedCheckpointBatchSize.Var().Name(), checkpointBatchSize)
+	}
+
+	var checkpointFlushInterval time.Duration
+	if v := opts.Env.GetString(env.SelfManagedCheckpointFlushInterval); v != "" {
+		checkpointFlushInterval, err = time.ParseDuration(v)
+		if err != nil || checkpointFlushInterval < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", env.SelfManagedCheckpointFlushInterval.Var().Name(), v)
+		}
+	}
 
-	wbucket := &wrappedBucket{bucket: bucket}
+	var permalinkExpiry time.Duration
+	if v := opts.Env.GetString(env.SelfManagedPermalinkExpiry); v != "" {
+		permalinkExpiry, err = time.ParseDuration(v)
+		if err != nil || permalinkExpiry < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %q", env.SelfManagedPermalinkExpiry.Var().Name(), v)
+		}
+		if permalinkExpiry > maxPermalinkExpiry {
+			d.Warningf(diag.Message("", "%s of %v exceeds the maximum of %v allowed by cloud storage; using %v"),
+				env.SelfManagedPermalinkExpiry.Var().Name(), permalinkExpiry, maxPermalinkExpiry, maxPermalinkExpiry)
+			permalinkExpiry = maxPermalinkExpiry
+		}
+	}
+
+	stats := &bucketStats{}
+	wbucket := &wrappedBucket{bucket: bucket, stats: stats}
 	bucket = nil // prevent accidental use of unwrapped bucket
 
 	backend := &localBackend{
@@ -273,19 +738,54 @@ func newLocalBackend(
 		originalURL: originalURL,
 		url:         u,
 		bucket:      wbucket,
-		lockID:      lockID.String(),
-		gzip:        gzipCompression,
+		stats:       stats,
+		lockID:      lockID,
+		lockTTL:     lockTTL,
+		compression: codec,
+		markupExt:   markupExt,
 		Env:         opts.Env,
+		clock:       opts.Clock,
+
+		disableBackups:  opts.Env.GetBool(env.SelfManagedDisableBackups),
+		readonly:        opts.Env.GetBool(env.SelfManagedReadOnly),
+		permalinkExpiry: permalinkExpiry,
+		maxNameLength:   maxNameLength,
+		atomicWrites:    hasAtomicWrites(p),
+		caseInsensitive: opts.Env.GetBool(env.SelfManagedCaseInsensitive) ||
+			(strings.HasPrefix(u, FilePathPrefix) && (runtime.GOOS == "darwin" || runtime.GOOS == "windows")),
+
+		checkpointBatchSize:     checkpointBatchSize,
+		checkpointFlushInterval: checkpointFlushInterval,
 	}
 	backend.currentProject.Store(project)
 
 	// Read the Pulumi state metadata
 	// and ensure that it is compatible with this version of the CLI.
 	// The version in the metadata file informs which store we use.
-	meta, err := ensurePulumiMeta(ctx, wbucket, opts.Env)
+	var meta *pulumiMeta
+	if backend.readonly {
+		// Don't write a metadata file to a read-only backend.
+		meta, err = readPulumiMeta(ctx, wbucket)
+		if err == nil && meta == nil {
+			meta, err = newPulumiMeta(ctx, wbucket, opts.Env)
+		}
+	} else {
+		meta, err = ensurePulumiMeta(ctx, wbucket, opts.Env)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	backend.organizations, err = readOrganizations(ctx, wbucket, opts.Env)
 	if err != nil {
 		return nil, err
 	}
+	if opts.Env.GetBool(env.SelfManagedOrgDirs) {
+		if err := validateOrgDirs(backend.organizations); err != nil {
+			return nil, err
+		}
+		backend.orgDirs = true
+	}
 
 	// projectMode tracks whether the current state supports project-scoped stacks.
 	// Historically, the filestate backend did not support this.
@@ -302,9 +802,15 @@ func newLocalBackend(
 	var projectMode bool
 	switch meta.Version {
 	case 0:
-		backend.store = newLegacyReferenceStore(wbucket)
+		store := newLegacyReferenceStore(wbucket)
+		store.maxNameLength = maxNameLength
+		backend.store = store
 	case 1:
-		backend.store = newProjectReferenceStore(wbucket, backend.currentProject.Load)
+		store := newProjectReferenceStore(wbucket, backend.currentProject.Load)
+		store.organizations = backend.organizations
+		store.orgDirs = backend.orgDirs
+		store.maxNameLength = maxNameLength
+		backend.store = store
 		projectMode = true
 	default:
 		return nil, fmt.Errorf(
@@ -313,7 +819,9 @@ func newLocalBackend(
 	}
 
 	// If we're not in project mode, or we've disabled the warning, we're done.
-	if !projectMode || opts.Env.GetBool(env.SelfManagedStateNoLegacyWarning) {
+	if !projectMode ||
+		opts.Env.GetBool(env.SelfManagedStateNoLegacyWarning) ||
+		opts.Env.GetBool(env.SelfManagedSuppressLegacyWarning) {
 		return backend, nil
 	}
 	// Otherwise, warn about any old stack files.
@@ -330,18 +838,18 @@ func newLocalBackend(
 		return backend, nil
 	}
 
+	// Report only the number of files:
+	// large shared buckets may have many of them
+	// and we print this on every command.
 	var msg strings.Builder
-	msg.WriteString("Found legacy stack files in state store:\n")
-	for _, ref := range refs {
-		fmt.Fprintf(&msg, "  - %s\n", ref.Name())
-	}
+	fmt.Fprintf(&msg, "Found %d legacy stack file(s) in state store.\n", len(refs))
 	msg.WriteString("Please run 'pulumi state upgrade' to migrate them to the new format.\n")
-	msg.WriteString("Set PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING=1 to disable this warning.")
+	msg.WriteString("Set PULUMI_SELF_MANAGED_SUPPRESS_LEGACY_WARNING=1 to disable this warning.")
 	d.Warningf(diag.Message("", msg.String()))
 	return backend, nil
 }
 
-func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error {
+func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) ([]UpgradeMove, error) {
 	if opts == nil {
 		opts = &UpgradeOptions{}
 	}
@@ -351,7 +859,7 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 	// with new legacy files introduced to it accidentally.
 	olds, err := newLegacyReferenceStore(b.bucket).ListReferences(ctx)
 	if err != nil {
-		return fmt.Errorf("read old references: %w", err)
+		return nil, fmt.Errorf("read old references: %w", err)
 	}
 	sort.Slice(olds, func(i, j int) bool {
 		return olds[i].Name().String() < olds[j].Name().String()
@@ -367,8 +875,16 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 	// projects[i] is the project name for olds[i].
 	projects := make([]tokens.Name, len(olds))
 	for idx, old := range olds {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		idx, old := idx, old
 		pool.Enqueue(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			project, err := b.guessProject(ctx, old)
 			if err != nil {
 				return fmt.Errorf("guess stack %s project: %w", old.Name(), err)
@@ -382,13 +898,14 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 	}
 
 	if err := pool.Wait(); err != nil {
-		return err
+		return nil, err
 	}
 
 	// If there are any stacks without projects
 	// and the user provided a callback to fill them,
 	// use it to fill in the missing projects.
-	if opts.ProjectsForDetachedStacks != nil {
+	// A dry run doesn't ask, and reports those stacks as skipped.
+	if opts.ProjectsForDetachedStacks != nil && !opts.DryRun {
 		var (
 			// Names of stacks in 'olds' that don't have a project
 			detached []tokens.StackName
@@ -412,7 +929,7 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 		if len(detached) != 0 {
 			detachedProjects, err := opts.ProjectsForDetachedStacks(detached)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			contract.Assertf(len(detached) == len(detachedProjects),
 				"ProjectsForDetachedStacks returned the wrong number of projects: "+
@@ -424,6 +941,25 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 		}
 	}
 
+	newStore := newProjectReferenceStore(b.bucket, b.currentProject.Load)
+	newStore.organizations = b.organizations
+	newStore.orgDirs = b.orgDirs
+	newStore.maxNameLength = b.maxNameLength
+
+	moves := make([]UpgradeMove, len(olds))
+	for idx, old := range olds {
+		moves[idx].Old = old
+		if project := projects[idx]; project != "" {
+			moves[idx].New = newStore.newReference(project, old.Name())
+		}
+	}
+	if opts.DryRun {
+		return moves, nil
+	}
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+
 	// It's important that we attempt to write the new metadata file
 	// before we attempt the upgrade.
 	// This ensures that if permissions are borked for any reason,
@@ -435,15 +971,40 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 		fmt.Fprintf(&s, "Could not write new state metadata file: %v\n", err)
 		fmt.Fprintf(&s, "Please verify that the storage is writable, and try again.")
 		b.d.Errorf(diag.RawMessage("", s.String()))
-		return errors.New("state upgrade failed")
+		return nil, errors.New("state upgrade failed")
+	}
+
+	// reportProgress reports that the given stack has been processed
+	// to opts.Progress, if set.
+	var (
+		progressMu sync.Mutex
+		processed  int
+	)
+	reportProgress := func(old *localBackendReference) {
+		if opts.Progress == nil {
+			return
+		}
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		processed++
+		opts.Progress(processed, len(olds), old.Name().String())
 	}
 
-	newStore := newProjectReferenceStore(b.bucket, b.currentProject.Load)
-
 	var upgraded atomic.Int64 // number of stacks successfully upgraded
 	for idx, old := range olds {
+		// Stop between stacks if the operation was cancelled.
+		// Stacks that were already upgraded stay upgraded.
+		if ctx.Err() != nil {
+			break
+		}
+
 		idx, old := idx, old
 		pool.Enqueue(func() error {
+			if ctx.Err() != nil {
+				return nil // reported below
+			}
+			defer reportProgress(old)
+
 			project := projects[idx]
 			if project == "" {
 				b.d.Warningf(diag.Message("", "Skipping stack %q: no project name found"), old)
@@ -463,9 +1024,14 @@ func (b *localBackend) Upgrade(ctx context.Context, opts *UpgradeOptions) error
 	err = pool.Wait()
 	contract.AssertNoErrorf(err, "pool.Wait should never return an error")
 
+	if err := ctx.Err(); err != nil {
+		b.d.Infoerrf(diag.Message("", "Upgrade cancelled after upgrading %d stack(s)"), upgraded.Load())
+		return nil, err
+	}
+
 	b.store = newStore
 	b.d.Infoerrf(diag.Message("", "Upgraded %d stack(s) to project mode"), upgraded.Load())
-	return nil
+	return moves, nil
 }
 
 // guessProject inspects the checkpoint for the given stack and attempts to
@@ -506,10 +1072,35 @@ func (b *localBackend) upgradeStack(
 	return nil
 }
 
+// normalizeBucketSubDir normalizes the path of a bucket URL
+// into the prefix that the backend's keys are stored under.
+// Leading, trailing, and repeated slashes and "." segments are dropped,
+// and a single trailing slash is added,
+// so that spelling the same URL differently doesn't change where state is stored.
+// It returns "" if the path has no segments, and an error if it contains a ".." segment.
+func normalizeBucketSubDir(urlPath string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(urlPath, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("bucket path %q must not contain '..'", urlPath)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", nil
+	}
+	return strings.Join(segments, "/") + "/", nil
+}
+
 // massageBlobPath takes the path the user provided and converts it to an appropriate form go-cloud
 // can support.  Importantly, s3/azblob/gs paths should not be be touched. This will only affect
 // file:// paths which have a few oddities around them that we want to ensure work properly.
-func massageBlobPath(path string) (string, error) {
+//
+// Relative file:// paths are resolved against baseDir, or the current working directory if it's empty.
+func massageBlobPath(path, baseDir string) (string, error) {
 	if !strings.HasPrefix(path, FilePathPrefix) {
 		// Not a file:// path.  Keep this untouched and pass directly to gocloud.
 		return path, nil
@@ -536,6 +1127,9 @@ func massageBlobPath(path string) (string, error) {
 	}
 
 	// For file:// backend, ensure a relative path is resolved. fileblob only supports absolute paths.
+	if baseDir != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return "", fmt.Errorf("An IO error occurred while building the absolute path: %w", err)
@@ -569,6 +1163,10 @@ func (b *localBackend) getReference(ref backend.StackReference) (*localBackendRe
 
 func (b *localBackend) local() {}
 
+func (b *localBackend) Stats() BucketStats {
+	return b.stats.snapshot()
+}
+
 func (b *localBackend) Name() string {
 	name, err := os.Hostname()
 	contract.IgnoreError(err)
@@ -605,11 +1203,11 @@ func (b *localBackend) ListPolicyPacks(ctx context.Context, orgName string, _ ba
 }
 
 func (b *localBackend) SupportsTags() bool {
-	return false
+	return true
 }
 
 func (b *localBackend) SupportsOrganizations() bool {
-	return false
+	return len(b.organizations) > 0
 }
 
 func (b *localBackend) SupportsProgress() bool {
@@ -630,6 +1228,147 @@ func (b *localBackend) ValidateStackName(stackRef string) error {
 	return err
 }
 
+func (b *localBackend) ListProjects(ctx context.Context) ([]tokens.Name, error) {
+	projStore, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		// Legacy stores don't have projects.
+		return []tokens.Name{}, nil
+	}
+
+	return projStore.ListProjects(ctx)
+}
+
+func (b *localBackend) DeleteProject(ctx context.Context, project tokens.Name, force bool) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	projStore, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		return errors.New("the legacy state layout doesn't support projects")
+	}
+
+	exists, err := projStore.ProjectExists(ctx, string(project))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("project %q does not exist", project)
+	}
+
+	refs, err := projStore.ListProjectReferences(ctx, project)
+	if err != nil {
+		return err
+	}
+	if len(refs) > 0 && !force {
+		return fmt.Errorf("project %q still has %d stack(s); remove them first", project, len(refs))
+	}
+
+	// Don't pull the state out from under operations that are still running on the stacks.
+	var locked []*localBackendReference
+	unlock := func() {
+		for _, ref := range locked {
+			b.Unlock(ctx, ref)
+		}
+		locked = nil
+	}
+	defer unlock()
+	stackLockDirs := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		if err := b.Lock(ctx, ref); err != nil {
+			return err
+		}
+		locked = append(locked, ref)
+		stackLockDirs[filepath.ToSlash(stackLockDir(ref.FullyQualifiedName()))] = true
+	}
+
+	dirs := projStore.projectDirs(project)
+	for _, dir := range dirs {
+		files, err := listBucketRecursive(ctx, b.bucket, dir)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", dir, err)
+		}
+		for _, file := range files {
+			if err := b.bucket.Delete(ctx, file.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("removing %s: %w", file.Key, err)
+			}
+		}
+	}
+
+	var lockDirs []string
+	for _, org := range projStore.orgs() {
+		if org == "" {
+			org = defaultOrganization
+		}
+		lockDirs = append(lockDirs, filepath.ToSlash(stackLockDir(tokens.QName(org+"/"+project.String()))))
+	}
+	for _, dir := range lockDirs {
+		files, err := listBucketRecursive(ctx, b.bucket, dir)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", dir, err)
+		}
+		for _, file := range files {
+			// Our own locks are released below. Lock only succeeds once the other locks on a stack are gone,
+			// so any other lock on the stacks we hold was taken by a process racing us,
+			// which will see our lock and release its own. That leaves the locks of stacks that no longer exist.
+			if path.Base(file.Key) == b.lockID+".json" || stackLockDirs[path.Dir(file.Key)] {
+				continue
+			}
+			if err := b.bucket.Delete(ctx, file.Key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+				return fmt.Errorf("removing %s: %w", file.Key, err)
+			}
+		}
+	}
+	unlock()
+	dirs = append(dirs, lockDirs...)
+
+	// Object stores don't have directories, but the local filesystem does,
+	// and deleting files from it leaves their directories behind.
+	if root, ok := localBucketRoot(b.url); ok {
+		for _, dir := range dirs {
+			removeEmptyDirs(filepath.Join(root, filepath.FromSlash(dir)))
+		}
+	}
+	return nil
+}
+
+// localBucketRoot returns the directory of the local filesystem that holds the bucket
+// of a file:// URL returned by massageBlobPath, or false for other URLs.
+func localBucketRoot(u string) (string, bool) {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "file" {
+		return "", false
+	}
+	root := parsed.Path
+	if os.PathSeparator != '/' {
+		// massageBlobPath adds a leading "/" to Windows paths, e.g. "/C:/state".
+		root = strings.TrimPrefix(root, "/")
+	}
+	return filepath.FromSlash(root), true
+}
+
+// removeEmptyDirs removes dir and the directories under it if they're empty,
+// deepest first, leaving any directory that still has files in it.
+func removeEmptyDirs(dir string) {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logging.V(5).Infof("error walking %s: %v", dir, err)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil {
+			logging.V(5).Infof("not removing directory %s: %v", dirs[i], err)
+		}
+	}
+}
+
 func (b *localBackend) DoesProjectExist(ctx context.Context, _ string, projectName string) (bool, error) {
 	projStore, ok := b.store.(*projectReferenceStore)
 	if !ok {
@@ -671,6 +1410,9 @@ func currentProjectContradictsWorkspace(stack *localBackendReference) bool {
 func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackReference,
 	root string, opts *backend.CreateStackOptions,
 ) (backend.Stack, error) {
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
 	if opts != nil && len(opts.Teams) > 0 {
 		return nil, backend.ErrTeamsNotSupported
 	}
@@ -686,6 +1428,91 @@ func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackRe
 	}
 	defer b.Unlock(ctx, stackRef)
 
+	return b.createStack(ctx, localStackRef, opts)
+}
+
+// ensureStackLockTimeout is how long EnsureStack waits for the lock of a stack held by another process.
+const ensureStackLockTimeout = time.Minute
+
+func (b *localBackend) EnsureStack(ctx context.Context, stackRef backend.StackReference,
+	opts *backend.CreateStackOptions,
+) (backend.Stack, bool, error) {
+	if err := b.checkWritable(); err != nil {
+		return nil, false, err
+	}
+	if opts != nil && len(opts.Teams) > 0 {
+		return nil, false, backend.ErrTeamsNotSupported
+	}
+
+	localStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Callers sharing this backend share its lock ID, so the stack lock doesn't serialize them.
+	unlock := b.lockEnsureStack(localStackRef.FullyQualifiedName())
+	defer unlock()
+
+	if err := b.lockWithRetry(ctx, stackRef, ensureStackLockTimeout); err != nil {
+		return nil, false, err
+	}
+	defer b.Unlock(ctx, stackRef)
+
+	if _, err := b.stackExists(ctx, localStackRef); err == nil {
+		return newStack(localStackRef, b), false, nil
+	} else if !errors.Is(err, errCheckpointNotFound) {
+		return nil, false, err
+	}
+
+	stack, err := b.createStack(ctx, localStackRef, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	return stack, true, nil
+}
+
+// ensureStackLock is the mutex of a single stack in ensureStackLocks.
+type ensureStackLock struct {
+	sync.Mutex
+
+	// waiters is the number of callers holding or waiting for the mutex.
+	waiters int
+}
+
+// lockEnsureStack waits for other calls to EnsureStack for the given stack to finish,
+// and returns a function that lets the next one proceed.
+// Calls for different stacks don't wait for each other.
+func (b *localBackend) lockEnsureStack(name tokens.QName) (unlock func()) {
+	b.ensureStackMu.Lock()
+	if b.ensureStackLocks == nil {
+		b.ensureStackLocks = make(map[tokens.QName]*ensureStackLock)
+	}
+	l, ok := b.ensureStackLocks[name]
+	if !ok {
+		l = &ensureStackLock{}
+		b.ensureStackLocks[name] = l
+	}
+	l.waiters++
+	b.ensureStackMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		b.ensureStackMu.Lock()
+		defer b.ensureStackMu.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(b.ensureStackLocks, name)
+		}
+	}
+}
+
+// createStack creates the stack of localStackRef for CreateStack and EnsureStack.
+// The caller must hold the lock of the stack.
+func (b *localBackend) createStack(ctx context.Context, localStackRef *localBackendReference,
+	opts *backend.CreateStackOptions,
+) (backend.Stack, error) {
 	if currentProjectContradictsWorkspace(localStackRef) {
 		return nil, fmt.Errorf("provided project name %q doesn't match Pulumi.yaml", localStackRef.project)
 	}
@@ -695,21 +1522,57 @@ func (b *localBackend) CreateStack(ctx context.Context, stackRef backend.StackRe
 		return nil, errors.New("invalid empty stack name")
 	}
 
+	if err := b.checkCaseCollision(ctx, localStackRef); err != nil {
+		return nil, err
+	}
 	if _, err := b.stackExists(ctx, localStackRef); err == nil {
 		return nil, &backend.StackAlreadyExistsError{StackName: string(stackName)}
 	}
 
-	_, err = b.saveStack(ctx, localStackRef, nil, nil)
+	_, err := b.saveStack(ctx, localStackRef, nil, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	// The initial configuration is recorded next to the checkpoint rather than in the history,
+	// since no update has run yet; GetLatestConfiguration falls back to it.
+	if opts != nil && len(opts.Config) > 0 {
+		if err := b.saveStackInitialConfig(ctx, localStackRef, opts.Config); err != nil {
+			return nil, fmt.Errorf("save initial configuration: %w", err)
+		}
+	}
+
 	stack := newStack(localStackRef, b)
 	b.d.Infof(diag.Message("", "Created stack '%s'"), stack.Ref())
 
 	return stack, nil
 }
 
+// checkCaseCollision returns an error if the state file of the stack of ref
+// differs only by case from that of an existing stack.
+// On a case-insensitive file system, the two stacks would share the file and clobber each other.
+//
+// It does nothing unless caseInsensitive is set, since it lists every stack in the backend.
+func (b *localBackend) checkCaseCollision(ctx context.Context, ref *localBackendReference) error {
+	if !b.caseInsensitive {
+		return nil
+	}
+
+	refs, err := b.store.ListReferences(ctx)
+	if err != nil {
+		return fmt.Errorf("list stacks: %w", err)
+	}
+	basePath := ref.StackBasePath()
+	for _, other := range refs {
+		otherPath := other.StackBasePath()
+		if otherPath != basePath && strings.EqualFold(otherPath, basePath) {
+			return fmt.Errorf("stack %s differs only by case from the existing stack %s; "+
+				"stack and project names must be unique regardless of case in this backend", ref, other)
+		}
+	}
+	return nil
+}
+
 func (b *localBackend) GetStack(ctx context.Context, stackRef backend.StackReference) (backend.Stack, error) {
 	localStackRef, err := b.getReference(stackRef)
 	if err != nil {
@@ -724,39 +1587,89 @@ func (b *localBackend) GetStack(ctx context.Context, stackRef backend.StackRefer
 		return nil, err
 	}
 
-	return newStack(localStackRef, b), nil
+	tags, err := b.getStackTags(ctx, localStackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	stack := newStack(localStackRef, b)
+	stack.tags = tags
+	return stack, nil
 }
 
 func (b *localBackend) ListStacks(
 	ctx context.Context, filter backend.ListStacksFilter, _ backend.ContinuationToken) (
 	[]backend.StackSummary, backend.ContinuationToken, error,
 ) {
-	stacks, err := b.getLocalStacks(ctx)
+	var stacks []*localBackendReference
+	var err error
+	if projStore, ok := b.store.(*projectReferenceStore); ok && filter.Project != nil && *filter.Project != "" {
+		// If we're filtering by project, only look at that project's stacks
+		// instead of reading every stack in the bucket.
+		stacks, err = projStore.ListProjectReferences(ctx, tokens.Name(*filter.Project))
+	} else {
+		stacks, err = b.getLocalStacks(ctx)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Note that the provided stack filter is only partially honored, since fields like organizations and tags
-	// aren't persisted in the local backend.
-	results := slice.Prealloc[backend.StackSummary](len(stacks))
+	// aren't supported for filtering in the local backend.
+	filtered := slice.Prealloc[*localBackendReference](len(stacks))
 	for _, stackRef := range stacks {
 		// We can check for project name filter here, but be careful about legacy stores where project is always blank.
 		stackProject, hasProject := stackRef.Project()
 		if filter.Project != nil && hasProject && string(stackProject) != *filter.Project {
 			continue
 		}
+		filtered = append(filtered, stackRef)
+	}
 
-		chk, err := b.getCheckpoint(ctx, stackRef)
-		if err != nil {
+	var cache *summaryCache
+	if b.Env.GetBool(env.SelfManagedSummaryCache) {
+		cache = b.loadSummaryCache(ctx)
+	}
+
+	// Read the checkpoints concurrently, as this dominates the time spent listing large buckets.
+	// Each task writes to its own slot so the results keep the order of the stack references.
+	results := make([]backend.StackSummary, len(filtered))
+	pool := newWorkerPool(b.Env.GetInt(env.SelfManagedParallel), len(filtered))
+	defer pool.Close()
+	for i, stackRef := range filtered {
+		if err := ctx.Err(); err != nil {
 			return nil, nil, err
 		}
-		results = append(results, newLocalStackSummary(stackRef, chk))
+
+		i, stackRef := i, stackRef
+		pool.Enqueue(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			summary, err := b.getCachedCheckpointSummary(ctx, cache, stackRef)
+			if err != nil {
+				return err
+			}
+			results[i] = newLocalStackSummary(stackRef, summary)
+			return nil
+		})
+	}
+	if err := pool.Wait(); err != nil {
+		return nil, nil, err
+	}
+	if cache != nil {
+		// Only a listing of every stack knows which cached stacks no longer exist.
+		b.saveSummaryCache(ctx, cache, filter.Project == nil)
 	}
 
 	return results, nil, nil
 }
 
 func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, force bool) (bool, error) {
+	if err := b.checkWritable(); err != nil {
+		return false, err
+	}
 	localStackRef, err := b.getReference(stack.Ref())
 	if err != nil {
 		return false, err
@@ -775,7 +1688,16 @@ func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, for
 
 	// Don't remove stacks that still have resources.
 	if !force && checkpoint != nil && checkpoint.Latest != nil && len(checkpoint.Latest.Resources) > 0 {
-		return true, errors.New("refusing to remove stack because it still contains resources")
+		return true, &backend.StackNotEmptyError{
+			StackName:     string(localStackRef.FullyQualifiedName()),
+			ResourceCount: len(checkpoint.Latest.Resources),
+		}
+	}
+
+	// Without a backup, the removal can't be undone.
+	if !force && b.disableBackups {
+		return false, fmt.Errorf("refusing to remove stack without --force because %s is set",
+			env.SelfManagedDisableBackups.Var().Name())
 	}
 
 	return false, b.removeStack(ctx, localStackRef)
@@ -784,6 +1706,9 @@ func (b *localBackend) RemoveStack(ctx context.Context, stack backend.Stack, for
 func (b *localBackend) RenameStack(ctx context.Context, stack backend.Stack,
 	newName tokens.QName,
 ) (backend.StackReference, error) {
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
 	localStackRef, err := b.getReference(stack.Ref())
 	if err != nil {
 		return nil, err
@@ -795,6 +1720,11 @@ func (b *localBackend) RenameStack(ctx context.Context, stack backend.Stack,
 		return nil, err
 	}
 
+	// A bare stack name stays in the organization of the stack being renamed.
+	if !strings.Contains(string(newName), "/") {
+		newRef.org = localStackRef.org
+	}
+
 	err = b.renameStack(ctx, localStackRef, newRef)
 	if err != nil {
 		return nil, err
@@ -812,6 +1742,10 @@ func (b *localBackend) renameStack(ctx context.Context, oldRef *localBackendRefe
 	}
 	defer b.Unlock(ctx, oldRef)
 
+	if err := b.checkCaseCollision(ctx, newRef); err != nil {
+		return err
+	}
+
 	// Ensure the destination stack does not already exist.
 	hasExisting, err := b.bucket.Exists(ctx, b.stackPath(ctx, newRef))
 	if err != nil {
@@ -851,7 +1785,22 @@ func (b *localBackend) renameStack(ctx context.Context, oldRef *localBackendRefe
 
 	// To remove the old stack, just make a backup of the file and don't write out anything new.
 	file := b.stackPath(ctx, oldRef)
-	backupTarget(ctx, b.bucket, file, false)
+	b.backupTarget(ctx, file, false)
+	b.removeChecksum(ctx, file)
+
+	// Move the tags over to the new stack.
+	tags, err := b.getStackTags(ctx, oldRef)
+	if err != nil {
+		return err
+	}
+	if err := b.saveStackTags(ctx, newRef, tags); err != nil {
+		return err
+	}
+	b.removeStackTags(ctx, oldRef)
+	b.removeStackSecretsProvider(ctx, oldRef)
+	if err := b.moveStackInitialConfig(ctx, oldRef, newRef); err != nil {
+		return err
+	}
 
 	// And rename the history folder as well.
 	if err = b.renameHistory(ctx, oldRef, newRef); err != nil {
@@ -860,6 +1809,43 @@ func (b *localBackend) renameStack(ctx context.Context, oldRef *localBackendRefe
 	return err
 }
 
+func (b *localBackend) CopyStack(ctx context.Context, srcRef, dstRef backend.StackReference) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	src, err := b.getReference(srcRef)
+	if err != nil {
+		return err
+	}
+	dst, err := b.getReference(dstRef)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Lock(ctx, src); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, src)
+
+	// Ensure the source stack exists and the destination stack does not.
+	hasSource, err := b.bucket.Exists(ctx, b.stackPath(ctx, src))
+	if err != nil {
+		return err
+	}
+	if !hasSource {
+		return fmt.Errorf("no stack named %s found", src.String())
+	}
+	hasExisting, err := b.bucket.Exists(ctx, b.stackPath(ctx, dst))
+	if err != nil {
+		return err
+	}
+	if hasExisting {
+		return fmt.Errorf("a stack named %s already exists", dst.String())
+	}
+
+	return b.copyStackToProject(ctx, src, dst)
+}
+
 func (b *localBackend) GetLatestConfiguration(ctx context.Context,
 	stack backend.Stack,
 ) (config.Map, error) {
@@ -868,7 +1854,19 @@ func (b *localBackend) GetLatestConfiguration(ctx context.Context,
 		return nil, err
 	}
 	if len(hist) == 0 {
-		return nil, backend.ErrNoPreviousDeployment
+		// Until the stack is first updated, its configuration is the one it was created with, if any.
+		ref, err := b.getReference(stack.Ref())
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := b.getStackInitialConfig(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		if cfg == nil {
+			return nil, backend.ErrNoPreviousDeployment
+		}
+		return cfg, nil
 	}
 
 	return hist[0].Config, nil
@@ -952,6 +1950,41 @@ func (b *localBackend) Watch(ctx context.Context, stk backend.Stack,
 	return backend.Watch(ctx, b, stk, op, b.apply, paths)
 }
 
+func (b *localBackend) WatchWithFilter(ctx context.Context, stk backend.Stack,
+	op backend.UpdateOperation, paths []string, opts backend.WatchOptions,
+) result.Result {
+	return backend.WatchWithOptions(ctx, b, stk, op, b.apply, paths, opts)
+}
+
+// checkWritable returns ErrReadOnlyBackend if the backend is in read-only mode.
+func (b *localBackend) checkWritable() error {
+	if b.readonly {
+		return ErrReadOnlyBackend
+	}
+	return nil
+}
+
+// signedURLOptions returns the options used to sign permalinks to state files.
+func (b *localBackend) signedURLOptions() *blob.SignedURLOptions {
+	if b.permalinkExpiry == 0 {
+		return nil
+	}
+	return &blob.SignedURLOptions{Expiry: b.permalinkExpiry}
+}
+
+// permalink returns a link to the stack's checkpoint.
+// Note we get a real signed link for aws/azure/gcp links.  But no such option exists for
+// file:// links so we manually create the link ourselves.
+func (b *localBackend) permalink(ctx context.Context, ref *localBackendReference) (string, error) {
+	chkpath := b.stackPath(ctx, ref)
+	if strings.HasPrefix(b.url, FilePathPrefix) {
+		u, _ := url.Parse(b.url)
+		u.Path = filepath.ToSlash(path.Join(u.Path, chkpath))
+		return u.String(), nil
+	}
+	return b.bucket.SignedURL(ctx, chkpath, b.signedURLOptions())
+}
+
 // apply actually performs the provided type of update on a locally hosted stack.
 func (b *localBackend) apply(
 	ctx context.Context, kind apitype.UpdateKind, stack backend.Stack,
@@ -968,6 +2001,12 @@ func (b *localBackend) apply(
 		return nil, nil, result.Errorf("provided project name %q doesn't match Pulumi.yaml", localStackRef.project)
 	}
 
+	if !opts.DryRun && kind != apitype.PreviewUpdate {
+		if err := b.checkWritable(); err != nil {
+			return nil, nil, result.FromError(err)
+		}
+	}
+
 	actionLabel := backend.ActionLabel(kind, opts.DryRun)
 
 	if !(op.Opts.Display.JSONDisplay || op.Opts.Display.Type == display.DisplayWatch) {
@@ -994,9 +2033,30 @@ func (b *localBackend) apply(
 
 	scope := op.Scopes.NewScope(engineEvents, opts.DryRun)
 	eventsDone := make(chan bool)
+	showLink := !op.Opts.Display.SuppressPermalink && opts.ShowLink
+	var link string
+	var linkErr error
 	go func() {
 		// Pull in all events from the engine and send them to the two listeners.
+		linked := false
 		for e := range engineEvents {
+			// The display stops at the engine's final cancellation event, so work out the permalink
+			// before passing that on. That way JSON consumers still hear about a link that couldn't be made.
+			if e.Type == engine.CancelEvent && showLink && !linked {
+				linked = true
+				link, linkErr = b.permalink(ctx, localStackRef)
+				if linkErr != nil {
+					unavailable := engine.NewEvent(engine.PermalinkUnavailableEventPayload{
+						Stack: stackRef.String(),
+						Error: linkErr.Error(),
+					})
+					displayEvents <- unavailable
+					if events != nil {
+						events <- unavailable
+					}
+				}
+			}
+
 			displayEvents <- e
 
 			// If the caller also wants to see the events, stream them there also.
@@ -1019,7 +2079,7 @@ func (b *localBackend) apply(
 	}
 
 	// Perform the update
-	start := time.Now().Unix()
+	start := b.clock.Now().Unix()
 	var plan *deploy.Plan
 	var changes sdkDisplay.ResourceChanges
 	var updateErr error
@@ -1038,13 +2098,18 @@ func (b *localBackend) apply(
 		contract.Failf("Unrecognized update kind: %s", kind)
 	}
 	updateRes := result.WrapIfNonNil(updateErr)
-	end := time.Now().Unix()
+	end := b.clock.Now().Unix()
 
 	// Wait for the display to finish showing all the events.
 	<-displayDone
 	scope.Close() // Don't take any cancellations anymore, we're shutting down.
 	close(engineEvents)
 	err = manager.Close()
+	// Write out the final snapshot if the persister is still holding on to it.
+	// This must happen before the update is added to the history below.
+	if flushErr := persister.Flush(); err == nil {
+		err = flushErr
+	}
 	// Historically we ignored this error (using IgnoreClose so it would log to the V11 log).
 	// To minimize the immediate blast radius of this to start with we're just going to write an error to the user.
 	if err != nil {
@@ -1096,32 +2161,17 @@ func (b *localBackend) apply(
 	}
 
 	// Make sure to print a link to the stack's checkpoint before exiting.
-	if !op.Opts.Display.SuppressPermalink && opts.ShowLink && !op.Opts.Display.JSONDisplay {
-		// Note we get a real signed link for aws/azure/gcp links.  But no such option exists for
-		// file:// links so we manually create the link ourselves.
-		var link string
-		if strings.HasPrefix(b.url, FilePathPrefix) {
-			u, _ := url.Parse(b.url)
-			u.Path = filepath.ToSlash(path.Join(u.Path, b.stackPath(ctx, localStackRef)))
-			link = u.String()
-		} else {
-			link, err = b.bucket.SignedURL(ctx, b.stackPath(ctx, localStackRef), nil)
-			if err != nil {
-				// set link to be empty to when there is an error to hide use of Permalinks
-				link = ""
-
-				// we log a warning here rather then returning an error to avoid exiting
-				// pulumi with an error code.
-				// printing a statefile perma link happens after all the providers have finished
-				// deploying the infrastructure, failing the pulumi update because there was a
-				// problem printing a statefile perma link can be missleading in automated CI environments.
-				cmdutil.Diag().Warningf(diag.Message("", "Unable to create signed url for current backend to "+
-					"create a Permalink. Please visit https://www.pulumi.com/docs/troubleshooting/ "+
-					"for more information\n"))
-			}
-		}
-
-		if link != "" {
+	if showLink && !op.Opts.Display.JSONDisplay {
+		if linkErr != nil {
+			// we log a warning here rather then returning an error to avoid exiting
+			// pulumi with an error code.
+			// printing a statefile perma link happens after all the providers have finished
+			// deploying the infrastructure, failing the pulumi update because there was a
+			// problem printing a statefile perma link can be missleading in automated CI environments.
+			cmdutil.Diag().Warningf(diag.Message("", "Unable to create signed url for current backend to "+
+				"create a Permalink. Please visit https://www.pulumi.com/docs/troubleshooting/ "+
+				"for more information\n"))
+		} else if link != "" {
 			fmt.Printf(op.Opts.Display.Color.Colorize(
 				colors.SpecHeadline+"Permalink: "+
 					colors.Underline+colors.BrightBlue+"%s"+colors.Reset+"\n"), link)
@@ -1148,13 +2198,75 @@ func (b *localBackend) GetHistory(
 	if err != nil {
 		return nil, err
 	}
-	updates, err := b.getHistory(ctx, localStackRef, pageSize, page)
+	updates, _, err := b.getHistory(ctx, localStackRef, pageSize, page, nil /*filter*/)
+	if err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+func (b *localBackend) GetHistoryPage(
+	ctx context.Context,
+	stackRef backend.StackReference,
+	pageSize int,
+	page int,
+) ([]backend.UpdateInfo, int, error) {
+	localStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b.getHistory(ctx, localStackRef, pageSize, page, nil /*filter*/)
+}
+
+func (b *localBackend) GetHistoryFiltered(
+	ctx context.Context,
+	stackRef backend.StackReference,
+	filter HistoryFilter,
+	pageSize int,
+	page int,
+) ([]backend.UpdateInfo, error) {
+	localStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+	updates, _, err := b.getHistory(ctx, localStackRef, pageSize, page, &filter)
 	if err != nil {
 		return nil, err
 	}
 	return updates, nil
 }
 
+func (b *localBackend) PruneHistory(
+	ctx context.Context, stackRef backend.StackReference,
+	keepLast int, olderThan time.Duration, dryRun bool,
+) ([]string, error) {
+	if keepLast < 0 {
+		return nil, fmt.Errorf("number of updates to keep must not be negative, got %d", keepLast)
+	}
+	if olderThan < 0 {
+		return nil, fmt.Errorf("update age must not be negative, got %v", olderThan)
+	}
+
+	if !dryRun {
+		if err := b.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	localStackRef, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.Lock(ctx, localStackRef)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Unlock(ctx, localStackRef)
+
+	return b.pruneHistory(ctx, localStackRef, keepLast, olderThan, dryRun)
+}
+
 func (b *localBackend) GetLogs(ctx context.Context,
 	secretsProvider secrets.Provider, stack backend.Stack, cfg backend.StackConfiguration,
 	query operations.LogQuery,
@@ -1219,9 +2331,36 @@ func (b *localBackend) ExportDeployment(ctx context.Context,
 	}, nil
 }
 
+func (b *localBackend) ExportDeploymentAt(ctx context.Context,
+	stk backend.Stack, updateIndex int,
+) (*apitype.UntypedDeployment, error) {
+	localStackRef, err := b.getReference(stk.Ref())
+	if err != nil {
+		return nil, err
+	}
+
+	chk, err := b.getHistoricalCheckpoint(ctx, localStackRef, updateIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := encoding.JSON.Marshal(chk.Latest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apitype.UntypedDeployment{
+		Version:    3,
+		Deployment: json.RawMessage(data),
+	}, nil
+}
+
 func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	deployment *apitype.UntypedDeployment,
 ) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
 	localStackRef, err := b.getReference(stk.Ref())
 	if err != nil {
 		return err
@@ -1243,12 +2382,33 @@ func (b *localBackend) ImportDeployment(ctx context.Context, stk backend.Stack,
 	return err
 }
 
+func (b *localBackend) ImportDeploymentReader(ctx context.Context, stk backend.Stack, r io.Reader) error {
+	// The deployment itself is kept as raw JSON,
+	// so it's only decoded once, when the checkpoint is written.
+	var deployment apitype.UntypedDeployment
+	if err := json.NewDecoder(r).Decode(&deployment); err != nil {
+		return fmt.Errorf("decoding deployment: %w", err)
+	}
+
+	switch {
+	case deployment.Version > apitype.DeploymentSchemaVersionCurrent:
+		return fmt.Errorf("deployment version %d is newer than what this version of the Pulumi CLI understands "+
+			"(%d); please update your version of the Pulumi CLI: %w",
+			deployment.Version, apitype.DeploymentSchemaVersionCurrent, stack.ErrDeploymentSchemaVersionTooNew)
+	case deployment.Version < stack.DeploymentSchemaVersionOldestSupported:
+		return fmt.Errorf("deployment version %d is older than the oldest supported version (%d): %w",
+			deployment.Version, stack.DeploymentSchemaVersionOldestSupported, stack.ErrDeploymentSchemaVersionTooOld)
+	}
+
+	return b.ImportDeployment(ctx, stk, &deployment)
+}
+
 func (b *localBackend) CurrentUser() (string, []string, *workspace.TokenInformation, error) {
 	user, err := user.Current()
 	if err != nil {
 		return "", nil, nil, err
 	}
-	return user.Username, nil, nil, nil
+	return user.Username, b.organizations, nil, nil
 }
 
 func (b *localBackend) getLocalStacks(ctx context.Context) ([]*localBackendReference, error) {
@@ -1259,8 +2419,32 @@ func (b *localBackend) getLocalStacks(ctx context.Context) ([]*localBackendRefer
 func (b *localBackend) UpdateStackTags(ctx context.Context,
 	stack backend.Stack, tags map[apitype.StackTagName]string,
 ) error {
-	// The local backend does not currently persist tags.
-	return errors.New("stack tags not supported in --local mode")
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	localStackRef, err := b.getReference(stack.Ref())
+	if err != nil {
+		return err
+	}
+
+	err = b.Lock(ctx, localStackRef)
+	if err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, localStackRef)
+
+	if _, err := b.stackExists(ctx, localStackRef); err != nil {
+		return err
+	}
+
+	if err := b.saveStackTags(ctx, localStackRef, tags); err != nil {
+		return err
+	}
+
+	if s, ok := stack.(*localStack); ok {
+		s.tags = tags
+	}
+	return nil
 }
 
 func (b *localBackend) CancelCurrentUpdate(ctx context.Context, stackRef backend.StackReference) error {
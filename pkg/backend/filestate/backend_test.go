@@ -7,11 +7,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -19,12 +23,15 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	user "github.com/tweekmonster/luser"
+	"gocloud.dev/blob"
 	"gocloud.dev/blob/fileblob"
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
 	"github.com/pulumi/pulumi/pkg/v3/operations"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
 	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
 	"github.com/pulumi/pulumi/pkg/v3/secrets/b64"
 	"github.com/pulumi/pulumi/pkg/v3/secrets/passphrase"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
@@ -44,7 +51,7 @@ func TestMassageBlobPath(t *testing.T) {
 	t.Parallel()
 
 	testMassagePath := func(t *testing.T, s string, want string) {
-		massaged, err := massageBlobPath(s)
+		massaged, err := massageBlobPath(s, "" /* baseDir */)
 		assert.NoError(t, err)
 		assert.Equal(t, want, massaged,
 			"massageBlobPath(%s) didn't return expected result.\nWant: %q\nGot:  %q", s, want, massaged)
@@ -103,6 +110,95 @@ func TestMassageBlobPath(t *testing.T) {
 
 		testMassagePath(t, FilePathPrefix+"/1/2/3/../4/..", FilePathPrefix+expected)
 	})
+
+	t.Run("RelativeToBaseDir", func(t *testing.T) {
+		t.Parallel()
+
+		// Returns the path in the form massageBlobPath produces.
+		toURL := func(path string) string {
+			path = filepath.ToSlash(path)
+			if path[0] != '/' {
+				path = "/" + path // A leading slash is added on Windows.
+			}
+			return FilePathPrefix + path
+		}
+
+		baseDir := t.TempDir()
+		massaged, err := massageBlobPath(FilePathPrefix+"state/../pulumi-state", baseDir)
+		require.NoError(t, err)
+		assert.Equal(t, toURL(filepath.Join(baseDir, "pulumi-state")), massaged)
+
+		// Without a base directory, relative paths are resolved against the working directory.
+		cwd, err := os.Getwd()
+		require.NoError(t, err)
+		massaged, err = massageBlobPath(FilePathPrefix+"pulumi-state", "")
+		require.NoError(t, err)
+		assert.Equal(t, toURL(filepath.Join(cwd, "pulumi-state")), massaged)
+
+		// The base directory doesn't apply to absolute paths or the home directory.
+		abs, err := filepath.Abs("/1/2")
+		require.NoError(t, err)
+		massaged, err = massageBlobPath(FilePathPrefix+filepath.ToSlash(abs), baseDir)
+		require.NoError(t, err)
+		assert.Equal(t, toURL(abs), massaged)
+
+		usr, err := user.Current()
+		require.NoError(t, err)
+		massaged, err = massageBlobPath(FilePathPrefix+"~/alpha", baseDir)
+		require.NoError(t, err)
+		assert.Equal(t, toURL(filepath.Join(usr.HomeDir, "alpha")), massaged)
+	})
+}
+
+func TestNew_baseDir(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	baseDir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(baseDir, "state"), 0o700))
+
+	b, err := New(ctx, diagtest.LogSink(t), FilePathPrefix+"state", nil, WithBaseDir(baseDir))
+	require.NoError(t, err)
+
+	// The state lives in the base directory rather than the working directory.
+	assert.FileExists(t, filepath.Join(baseDir, "state", ".pulumi", "meta.yaml"))
+	assert.NoDirExists(t, "state")
+	assert.Equal(t, FilePathPrefix+"state", b.(*localBackend).originalURL)
+}
+
+func TestNormalizeBucketSubDir(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give string
+		want string
+	}{
+		{give: "", want: ""},
+		{give: "/", want: ""},
+		{give: "//", want: ""},
+		{give: "/a", want: "a/"},
+		{give: "/a/", want: "a/"},
+		{give: "a/b", want: "a/b/"},
+		{give: "/a//b/", want: "a/b/"},
+		{give: "///a///b///", want: "a/b/"},
+		{give: "/a/./b", want: "a/b/"},
+		{give: "/./", want: ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := normalizeBucketSubDir(tt.give)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, give := range []string{"/..", "/a/../b", "a/b/..", "/a//../"} {
+		_, err := normalizeBucketSubDir(give)
+		assert.ErrorContains(t, err, "must not contain '..'", "path %q", give)
+	}
 }
 
 func TestGetLogsForTargetWithNoSnapshot(t *testing.T) {
@@ -133,7 +229,14 @@ func makeUntypedDeploymentTimestamp(
 	if err != nil {
 		return nil, err
 	}
+	return makeUntypedDeploymentSecretsManager(name, sm, created, modified)
+}
 
+// makeUntypedDeploymentSecretsManager is like makeUntypedDeploymentTimestamp,
+// but encrypts the secret in the deployment with the given secrets manager.
+func makeUntypedDeploymentSecretsManager(
+	name string, sm secrets.Manager, created, modified *time.Time,
+) (*apitype.UntypedDeployment, error) {
 	resources := []*resource.State{
 		{
 			URN:  resource.NewURN("a", "proj", "d:e:f", "a:b:c", name),
@@ -223,6 +326,40 @@ func TestListStacksWithMultiplePassphrases(t *testing.T) {
 	}
 }
 
+//nolint:paralleltest // mutates environment variables
+func TestImportDeployment_passphraseFile(t *testing.T) {
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("organization/project/a")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A new secrets manager has a fresh salt,
+	// so the passphrase can't come from the cache of secrets managers.
+	_, sm, err := passphrase.NewPassphraseSecretsManager("from-a-file")
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeploymentSecretsManager("a", sm, nil, nil)
+	require.NoError(t, err)
+
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(passphraseFile, []byte("from-a-file\n"), 0o600))
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE_FILE", passphraseFile)
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "")
+	require.NoError(t, os.Unsetenv("PULUMI_CONFIG_PASSPHRASE"))
+
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	snap, err := stk.Snapshot(ctx, stack.DefaultSecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 1)
+	secret := snap.Resources[0].Inputs["secret"]
+	require.True(t, secret.IsSecret())
+	assert.Equal(t, "s3cr3t", secret.SecretValue().Element.StringValue())
+}
+
 func TestDrillError(t *testing.T) {
 	t.Parallel()
 
@@ -247,7 +384,8 @@ func TestCancel(t *testing.T) {
 	// Login to a temp dir filestate backend
 	tmpDir := t.TempDir()
 	ctx := context.Background()
-	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil,
+		WithLockIDProvider(func() (string, error) { return "first", nil }))
 	assert.NoError(t, err)
 
 	// Check that trying to cancel a stack that isn't created yet doesn't error
@@ -272,6 +410,7 @@ func TestCancel(t *testing.T) {
 	err = lb.Lock(ctx, aStackRef)
 	assert.NoError(t, err)
 	// check the lock file exists
+	assert.Equal(t, ".pulumi/locks/organization/project/a/first.json", lb.lockPath(aStackRef))
 	lockExists, err := lb.bucket.Exists(ctx, lb.lockPath(aStackRef))
 	assert.NoError(t, err)
 	assert.True(t, lockExists)
@@ -283,12 +422,14 @@ func TestCancel(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, lockExists)
 
-	// Make another filestate backend which will have a different lockId
-	ob, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	// Make another filestate backend with a different lockId
+	ob, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil,
+		WithLockIDProvider(func() (string, error) { return "second", nil }))
 	assert.NoError(t, err)
 	otherBackend, ok := ob.(*localBackend)
 	assert.True(t, ok)
 	assert.NotNil(t, lb)
+	assert.Equal(t, ".pulumi/locks/organization/project/a/second.json", otherBackend.lockPath(aStackRef))
 
 	// Lock the stack with this new backend, then check that checkForLocks on the first backend now errors
 	err = otherBackend.Lock(ctx, aStackRef)
@@ -302,6 +443,31 @@ func TestCancel(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNew_lockIDProvider(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	url := "file://" + filepath.ToSlash(t.TempDir())
+
+	// By default, every backend gets a random lock ID.
+	first, err := newLocalBackend(ctx, diagtest.LogSink(t), url, nil, nil)
+	require.NoError(t, err)
+	second, err := newLocalBackend(ctx, diagtest.LogSink(t), url, nil, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, first.lockID)
+	assert.NotEqual(t, first.lockID, second.lockID)
+
+	for _, id := range []string{"", "a/b", `a\b`} {
+		_, err := New(ctx, diagtest.LogSink(t), url, nil,
+			WithLockIDProvider(func() (string, error) { return id, nil }))
+		assert.ErrorContains(t, err, fmt.Sprintf("invalid lock ID %q", id))
+	}
+
+	_, err = New(ctx, diagtest.LogSink(t), url, nil,
+		WithLockIDProvider(func() (string, error) { return "", errors.New("no ID for you") }))
+	assert.ErrorContains(t, err, "get lock ID: no ID for you")
+}
+
 func TestRemoveMakesBackups(t *testing.T) {
 	t.Parallel()
 
@@ -469,6 +635,159 @@ func TestRenameProjectWorks(t *testing.T) {
 	assert.Equal(t, apitype.DestroyUpdate, history[0].Kind)
 }
 
+func TestRenameProject(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	lb := b.(*localBackend)
+
+	var olds []*localBackendReference
+	for _, name := range []string{"a", "b"} {
+		ref, err := lb.parseStackReference("organization/oldproj/" + name)
+		require.NoError(t, err)
+		snap := deploy.NewSnapshot(deploy.Manifest{}, nil, []*resource.State{
+			{URN: resource.NewURN(tokens.QName(name), "oldproj", "", "a:b:c", "res"), Type: "a:b:c"},
+		}, nil)
+		_, err = lb.saveStack(ctx, ref, snap, nil)
+		require.NoError(t, err)
+		require.NoError(t, lb.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+		olds = append(olds, ref)
+	}
+
+	require.NoError(t, lb.RenameProject(ctx, "oldproj", "newproj"))
+
+	for _, old := range olds {
+		exists, err := lb.bucket.Exists(ctx, lb.stackPath(ctx, old))
+		require.NoError(t, err)
+		assert.False(t, exists, "old stack %v must not exist", old)
+
+		ref, err := lb.parseStackReference("organization/newproj/" + old.name.String())
+		require.NoError(t, err)
+		chk, err := lb.getCheckpoint(ctx, ref)
+		require.NoError(t, err)
+		require.Len(t, chk.Latest.Resources, 1)
+		assert.Equal(t,
+			resource.NewURN(old.name.Q(), "newproj", "", "a:b:c", "res"),
+			chk.Latest.Resources[0].URN)
+
+		history, err := lb.GetHistory(ctx, ref, 10, 0)
+		require.NoError(t, err)
+		assert.Len(t, history, 1)
+	}
+}
+
+func TestCopyStack(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	lb := b.(*localBackend)
+
+	srcRef, err := lb.parseStackReference("organization/proj/src")
+	require.NoError(t, err)
+	snap := deploy.NewSnapshot(deploy.Manifest{}, nil, []*resource.State{
+		{URN: resource.NewURN("src", "proj", "", "a:b:c", "res"), Type: "a:b:c"},
+	}, nil)
+	_, err = lb.saveStack(ctx, srcRef, snap, nil)
+	require.NoError(t, err)
+	require.NoError(t, lb.addToHistory(ctx, srcRef, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+
+	dstRef, err := lb.parseStackReference("organization/otherproj/dst")
+	require.NoError(t, err)
+	require.NoError(t, lb.CopyStack(ctx, srcRef, dstRef))
+
+	chk, err := lb.getCheckpoint(ctx, dstRef)
+	require.NoError(t, err)
+	require.Len(t, chk.Latest.Resources, 1)
+	assert.Equal(t,
+		resource.NewURN("dst", "otherproj", "", "a:b:c", "res"),
+		chk.Latest.Resources[0].URN)
+
+	// The source stack is left untouched.
+	chk, err = lb.getCheckpoint(ctx, srcRef)
+	require.NoError(t, err)
+	require.Len(t, chk.Latest.Resources, 1)
+	assert.Equal(t,
+		resource.NewURN("src", "proj", "", "a:b:c", "res"),
+		chk.Latest.Resources[0].URN)
+
+	// History is not copied.
+	history, err := lb.GetHistory(ctx, dstRef, 10, 0)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	// Copying over an existing stack is refused.
+	err = lb.CopyStack(ctx, srcRef, dstRef)
+	assert.ErrorContains(t, err, "already exists")
+
+	missingRef, err := lb.parseStackReference("organization/proj/missing")
+	require.NoError(t, err)
+	err = lb.CopyStack(ctx, missingRef, dstRef)
+	assert.ErrorContains(t, err, "no stack named")
+}
+
+func TestRenameProject_rollback(t *testing.T) {
+	t.Parallel()
+
+	// Verifies that if one of the stacks can't be renamed,
+	// the stacks that were already written to the new project are removed.
+
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	lb := b.(*localBackend)
+
+	aRef, err := lb.parseStackReference("organization/oldproj/a")
+	require.NoError(t, err)
+	aStack, err := lb.CreateStack(ctx, aRef, "", nil)
+	require.NoError(t, err)
+
+	// Give "a" a secrets provider so that its copy gets a secrets provider record too.
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, lb.ImportDeployment(ctx, aStack, deployment))
+
+	// Stacks are renamed in order, so "b" fails after "a" was written.
+	require.NoError(t, lb.bucket.WriteAll(ctx, ".pulumi/stacks/oldproj/b.json", []byte("{"), nil))
+
+	err = lb.RenameProject(ctx, "oldproj", "newproj")
+	assert.ErrorContains(t, err, "rename organization/oldproj/b to organization/newproj/b")
+
+	for _, file := range []string{".pulumi/stacks/oldproj/a.json", ".pulumi/stacks/oldproj/b.json"} {
+		exists, err := lb.bucket.Exists(ctx, file)
+		require.NoError(t, err)
+		assert.True(t, exists, "file %q must exist", file)
+	}
+	newFiles, err := listBucket(ctx, lb.bucket, ".pulumi/stacks/newproj")
+	if err == nil {
+		assert.Empty(t, newFiles, "nothing may be left behind in the new project")
+	}
+
+	// The old stacks and their destinations must not be left locked.
+	newRef, err := lb.parseStackReference("organization/newproj/a")
+	require.NoError(t, err)
+	for _, ref := range []*localBackendReference{aRef, newRef} {
+		assert.NoError(t, lb.Lock(ctx, ref))
+		lb.Unlock(ctx, ref)
+	}
+
+	// A lock on a destination stack, e.g. one being created, blocks the rename.
+	require.NoError(t, lb.bucket.Delete(ctx, ".pulumi/stacks/oldproj/b.json"))
+	other, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	require.NoError(t, other.(*localBackend).Lock(ctx, newRef))
+	err = lb.RenameProject(ctx, "oldproj", "newproj")
+	assert.ErrorContains(t, err, "locked")
+	other.(*localBackend).Unlock(ctx, newRef)
+}
+
 func TestLoginToNonExistingFolderFails(t *testing.T) {
 	t.Parallel()
 
@@ -574,6 +893,56 @@ func TestLocalBackendRejectsStackInitOptions(t *testing.T) {
 	assert.ErrorIs(t, err, backend.ErrTeamsNotSupported)
 }
 
+func TestCreateStack_initialConfig(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+	require.NoError(t, err)
+
+	cfg := config.Map{
+		config.MustMakeKey("proj", "region"): config.NewValue("us-west-2"),
+		config.MustMakeKey("proj", "count"):  config.NewValue("3"),
+	}
+	ref, err := b.parseStackReference("organization/proj/configured")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", &backend.CreateStackOptions{Config: cfg})
+	require.NoError(t, err)
+
+	got, err := b.GetLatestConfiguration(ctx, stk)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, got)
+
+	// The initial configuration doesn't show up as an update in the history.
+	history, total, err := b.GetHistoryPage(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	assert.Equal(t, 0, total)
+
+	// Once the stack is updated, the configuration of the update takes over.
+	updated := config.Map{config.MustMakeKey("proj", "region"): config.NewValue("eu-west-1")}
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate, Config: updated}))
+	got, err = b.GetLatestConfiguration(ctx, stk)
+	require.NoError(t, err)
+	assert.Equal(t, updated, got)
+
+	// Removing the stack removes its initial configuration.
+	_, err = b.RemoveStack(ctx, stk, true /* force */)
+	require.NoError(t, err)
+	exists, err := b.bucket.Exists(ctx, stackInitialConfigPath(ref))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Without initial configuration, there's nothing to return.
+	ref, err = b.parseStackReference("organization/proj/plain")
+	require.NoError(t, err)
+	stk, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	_, err = b.GetLatestConfiguration(ctx, stk)
+	assert.ErrorIs(t, err, backend.ErrNoPreviousDeployment)
+}
+
 func TestLegacyFolderStructure(t *testing.T) {
 	t.Parallel()
 
@@ -611,6 +980,128 @@ func TestLegacyFolderStructure(t *testing.T) {
 	assert.FileExists(t, path.Join(tmpDir, ".pulumi", "stacks", "b.json"))
 }
 
+func TestListProjects(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"organization/proj1/a", "organization/proj1/b", "organization/proj2/c"} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+	}
+
+	// A directory that isn't a valid project name must be skipped.
+	junk := filepath.Join(tmpDir, ".pulumi", "stacks", "not a project", "x.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(junk), 0o700))
+	require.NoError(t, os.WriteFile(junk, []byte("{}"), 0o600))
+
+	projects, err := b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []tokens.Name{"proj1", "proj2"}, projects)
+}
+
+func TestListProjects_legacy(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := markLegacyStore(t, t.TempDir())
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+
+	projects, err := b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.NotNil(t, projects)
+	assert.Empty(t, projects)
+}
+
+func TestDeleteProject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+
+	var stacks []backend.Stack
+	for _, name := range []string{"organization/proj1/a", "organization/proj2/b"} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		stack, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		stacks = append(stacks, stack)
+	}
+
+	// Projects with stacks are only deleted with force.
+	err = b.DeleteProject(ctx, "proj1", false)
+	assert.ErrorContains(t, err, `project "proj1" still has 1 stack(s)`)
+
+	// Removing the last stack leaves the project behind, with a backup of the stack.
+	_, err = b.RemoveStack(ctx, stacks[0], false)
+	require.NoError(t, err)
+	projects, err := b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []tokens.Name{"proj1", "proj2"}, projects)
+
+	require.NoError(t, b.DeleteProject(ctx, "proj1", false))
+	require.NoError(t, b.DeleteProject(ctx, "proj2", true /* force */))
+
+	projects, err = b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, projects)
+	for _, project := range []string{"proj1", "proj2"} {
+		exists, err := b.DoesProjectExist(ctx, "", project)
+		require.NoError(t, err)
+		assert.False(t, exists)
+		assert.NoDirExists(t, filepath.Join(tmpDir, ".pulumi", "stacks", project))
+		assert.NoDirExists(t, filepath.Join(tmpDir, ".pulumi", "history", project))
+	}
+
+	err = b.DeleteProject(ctx, "proj1", false)
+	assert.ErrorContains(t, err, `project "proj1" does not exist`)
+}
+
+func TestDeleteProject_locks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil, nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("organization/proj/a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A lock left behind by a stack that no longer exists.
+	goneLock := filepath.Join(tmpDir, ".pulumi", "locks", "organization", "proj", "gone", "abc.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(goneLock), 0o755))
+	require.NoError(t, os.WriteFile(goneLock, []byte("{}"), 0o600))
+
+	// A stack that's being updated isn't deleted.
+	require.NoError(t, other.Lock(ctx, ref))
+	err = b.DeleteProject(ctx, "proj", true /* force */)
+	assert.ErrorContains(t, err, "the stack is currently locked")
+	exists, err := b.DoesProjectExist(ctx, "", "proj")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.FileExists(t, goneLock)
+
+	other.Unlock(ctx, ref)
+	require.NoError(t, b.DeleteProject(ctx, "proj", true /* force */))
+	exists, err = b.DoesProjectExist(ctx, "", "proj")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.NoDirExists(t, filepath.Join(tmpDir, ".pulumi", "locks", "organization", "proj"))
+}
+
 func TestListStacksFilter(t *testing.T) {
 	t.Parallel()
 
@@ -642,6 +1133,49 @@ func TestListStacksFilter(t *testing.T) {
 	assert.Equal(t, "organization/proj1/a", stacks[0].Name().String())
 }
 
+func TestListStacksFilter_onlyReadsProject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{
+		"organization/proj1/a",
+		"organization/proj1/b",
+		"organization/proj2/c",
+		"organization/proj3/d",
+	} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+	}
+
+	// Corrupt a checkpoint in another project.
+	// Listing with a project filter must not try to read it.
+	require.NoError(t, os.WriteFile(
+		filepath.Join(tmpDir, ".pulumi", "stacks", "proj3", "d.json"), []byte("not json"), 0o600))
+
+	filter := "proj1"
+	stacks, token, err := b.ListStacks(ctx, backend.ListStacksFilter{
+		Project: &filter,
+	}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Nil(t, token)
+
+	var names []string
+	for _, stack := range stacks {
+		names = append(names, stack.Name().String())
+	}
+	assert.ElementsMatch(t, []string{"organization/proj1/a", "organization/proj1/b"}, names)
+
+	// Without the filter, the corrupt checkpoint is read.
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	assert.Error(t, err)
+}
+
 func TestOptIntoLegacyFolderStructure(t *testing.T) {
 	t.Parallel()
 
@@ -858,7 +1392,7 @@ func TestProjectNameMustMatch(t *testing.T) {
 func TestNew_legacyFileWarning(t *testing.T) {
 	t.Parallel()
 
-	// Verifies the names of files printed in warnings
+	// Verifies the warning printed
 	// when legacy files are found while running in project mode.
 
 	tests := []struct {
@@ -881,11 +1415,9 @@ func TestNew_legacyFileWarning(t *testing.T) {
 				".pulumi/stacks/b.json":     "{}",
 				".pulumi/stacks/c.json.bak": "{}", // should ignore backup files
 			},
-			wantOut: "warning: Found legacy stack files in state store:\n" +
-				"  - a\n" +
-				"  - b\n" +
+			wantOut: "warning: Found 2 legacy stack file(s) in state store.\n" +
 				"Please run 'pulumi state upgrade' to migrate them to the new format.\n" +
-				"Set PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING=1 to disable this warning.\n",
+				"Set PULUMI_SELF_MANAGED_SUPPRESS_LEGACY_WARNING=1 to disable this warning.\n",
 		},
 		{
 			desc: "warning opt-out",
@@ -897,8 +1429,18 @@ func TestNew_legacyFileWarning(t *testing.T) {
 				"PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING": "true",
 			},
 		},
-	}
-
+		{
+			desc: "warning suppressed",
+			files: map[string]string{
+				".pulumi/stacks/a.json": "{}",
+				".pulumi/stacks/b.json": "{}",
+			},
+			env: map[string]string{
+				"PULUMI_SELF_MANAGED_SUPPRESS_LEGACY_WARNING": "true",
+			},
+		},
+	}
+
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.desc, func(t *testing.T) {
@@ -962,7 +1504,7 @@ func TestLegacyUpgrade(t *testing.T) {
 	assert.NotNil(t, lb)
 	assert.IsType(t, &legacyReferenceStore{}, lb.store)
 
-	err = lb.Upgrade(ctx, nil /* opts */)
+	_, err = lb.Upgrade(ctx, nil /* opts */)
 	require.NoError(t, err)
 	assert.IsType(t, &projectReferenceStore{}, lb.store)
 
@@ -988,7 +1530,7 @@ func TestLegacyUpgrade(t *testing.T) {
 	}`), os.ModePerm)
 	require.NoError(t, err)
 
-	err = lb.Upgrade(ctx, nil /* opts */)
+	_, err = lb.Upgrade(ctx, nil /* opts */)
 	require.NoError(t, err)
 
 	// Check that b has been moved
@@ -999,6 +1541,57 @@ func TestLegacyUpgrade(t *testing.T) {
 	assert.True(t, stackFileExists)
 }
 
+func TestLegacyUpgrade_mixedCompression(t *testing.T) {
+	t.Parallel()
+
+	// Legacy stacks written with different compression settings over time.
+	tmpDir := t.TempDir()
+	stacksDir := filepath.Join(tmpDir, ".pulumi", "stacks")
+	require.NoError(t, os.MkdirAll(stacksDir, 0o755))
+	files := map[string]compression{
+		"plain.json":   noCompression,
+		"gzipped.json": gzipCompression,
+		"zstded.json":  zstdCompression,
+	}
+	for name, codec := range files {
+		chk := map[string]interface{}{
+			"latest": map[string]interface{}{
+				"resources": []interface{}{
+					map[string]interface{}{
+						"type": "package:module:resource",
+						"urn":  "urn:pulumi:stack::project::package:module:resource::" + name,
+					},
+				},
+			},
+		}
+		data, err := codec.Wrap(encoding.JSON).Marshal(chk)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(stacksDir, name+codec.Ext()), data, 0o600))
+	}
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(tmpDir), nil, nil)
+	require.NoError(t, err)
+
+	_, err = b.Upgrade(ctx, nil /* opts */)
+	require.NoError(t, err)
+
+	for name := range files {
+		stackName := strings.TrimSuffix(name, ".json")
+		ref, err := b.parseStackReference("organization/project/" + stackName)
+		require.NoError(t, err)
+		chk, err := b.getCheckpoint(ctx, ref)
+		require.NoError(t, err, "stack %v", stackName)
+		require.NotNil(t, chk.Latest)
+		assert.Len(t, chk.Latest.Resources, 1, "stack %v", stackName)
+	}
+
+	// Nothing is left in the legacy location.
+	legacy, err := newLegacyReferenceStore(b.bucket).ListReferences(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, legacy)
+}
+
 func TestLegacyUpgrade_partial(t *testing.T) {
 	t.Parallel()
 
@@ -1030,7 +1623,8 @@ func TestLegacyUpgrade_partial(t *testing.T) {
 	b, err := New(ctx, sink, "file://"+filepath.ToSlash(stateDir), nil)
 	require.NoError(t, err)
 
-	require.NoError(t, b.Upgrade(ctx, nil /* opts */))
+	_, err = b.Upgrade(ctx, nil /* opts */)
+	require.NoError(t, err)
 	assert.Contains(t, buff.String(), `Skipping stack "bar": no project name found`)
 
 	exists, err := bucket.Exists(ctx, ".pulumi/stacks/project/foo.json")
@@ -1042,6 +1636,111 @@ func TestLegacyUpgrade_partial(t *testing.T) {
 	assert.Equal(t, tokens.QName("organization/project/foo"), ref.FullyQualifiedName())
 }
 
+func TestLegacyUpgrade_dryRun(t *testing.T) {
+	t.Parallel()
+
+	// Verifies that a dry run reports the planned moves
+	// without touching the bucket.
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/stacks/foo.json", []byte(`{
+		"latest": {
+			"resources": [
+				{
+					"type": "package:module:resource",
+					"urn": "urn:pulumi:stack::project::package:module:resource::name"
+				}
+			]
+		}
+	}`), nil))
+	require.NoError(t,
+		// no resources, can't guess project name
+		bucket.WriteAll(ctx, ".pulumi/stacks/bar.json",
+			[]byte(`{"latest": {"resources": []}}`), nil))
+
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+
+	moves, err := b.Upgrade(ctx, &UpgradeOptions{
+		DryRun: true,
+		ProjectsForDetachedStacks: func(stacks []tokens.StackName) ([]tokens.Name, error) {
+			t.Errorf("a dry run must not ask for projects, asked for %v", stacks)
+			return make([]tokens.Name, len(stacks)), nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, moves, 2)
+	assert.Equal(t, "bar", moves[0].Old.String())
+	assert.Nil(t, moves[0].New)
+	assert.Equal(t, "foo", moves[1].Old.String())
+	require.NotNil(t, moves[1].New)
+	assert.Equal(t, tokens.QName("organization/project/foo"), moves[1].New.FullyQualifiedName())
+
+	for _, file := range []string{".pulumi/stacks/foo.json", ".pulumi/stacks/bar.json"} {
+		exists, err := bucket.Exists(ctx, file)
+		require.NoError(t, err, "exists(%q)", file)
+		assert.True(t, exists, "file %q must exist", file)
+	}
+	for _, file := range []string{".pulumi/stacks/project/foo.json", filepath.ToSlash(pulumiMetaPath)} {
+		exists, err := bucket.Exists(ctx, file)
+		require.NoError(t, err, "exists(%q)", file)
+		assert.False(t, exists, "file %q must not exist", file)
+	}
+}
+
+func TestLegacyUpgrade_progress(t *testing.T) {
+	t.Parallel()
+
+	// Verifies that the progress callback is called once per stack,
+	// including stacks that are skipped.
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t,
+		bucket.WriteAll(ctx, ".pulumi/stacks/foo.json", []byte(`{
+		"latest": {
+			"resources": [
+				{
+					"type": "package:module:resource",
+					"urn": "urn:pulumi:stack::project::package:module:resource::name"
+				}
+			]
+		}
+	}`), nil))
+	require.NoError(t,
+		// no resources, can't guess project name
+		bucket.WriteAll(ctx, ".pulumi/stacks/bar.json",
+			[]byte(`{"latest": {"resources": []}}`), nil))
+
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+
+	var (
+		dones, totals []int
+		stacks        []string
+	)
+	_, err = b.Upgrade(ctx, &UpgradeOptions{
+		Progress: func(done, total int, current string) {
+			dones = append(dones, done)
+			totals = append(totals, total)
+			stacks = append(stacks, current)
+		},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{1, 2}, dones)
+	assert.Equal(t, []int{2, 2}, totals)
+	assert.ElementsMatch(t, []string{"foo", "bar"}, stacks)
+}
+
 // When a stack project could not be determined,
 // we should fill it in with ProjectsForDetachedStacks.
 func TestLegacyUpgrade_ProjectsForDetachedStacks(t *testing.T) {
@@ -1069,7 +1768,7 @@ func TestLegacyUpgrade_ProjectsForDetachedStacks(t *testing.T) {
 
 	// For the first two stacks, we'll return project names to upgrade them.
 	// For the third stack, we will not set a project name, and it should be skipped.
-	err = b.Upgrade(ctx, &UpgradeOptions{
+	_, err = b.Upgrade(ctx, &UpgradeOptions{
 		ProjectsForDetachedStacks: func(stacks []tokens.StackName) (projects []tokens.Name, err error) {
 			assert.ElementsMatch(t, []tokens.StackName{
 				tokens.MustParseStackName("foo"),
@@ -1145,7 +1844,7 @@ func TestLegacyUpgrade_ProjectsForDetachedStacks_error(t *testing.T) {
 	require.NoError(t, err)
 
 	giveErr := errors.New("canceled operation")
-	err = b.Upgrade(ctx, &UpgradeOptions{
+	_, err = b.Upgrade(ctx, &UpgradeOptions{
 		ProjectsForDetachedStacks: func(stacks []tokens.StackName) (projects []tokens.Name, err error) {
 			assert.Equal(t, []tokens.StackName{
 				tokens.MustParseStackName("bar"),
@@ -1198,7 +1897,8 @@ func TestLegacyUpgrade_writeMetaError(t *testing.T) {
 	b, err := New(ctx, sink, "file://"+filepath.ToSlash(stateDir), nil)
 	require.NoError(t, err)
 
-	require.Error(t, b.Upgrade(ctx, nil /* opts */))
+	_, err = b.Upgrade(ctx, nil /* opts */)
+	require.Error(t, err)
 
 	stderr := buff.String()
 	assert.Contains(t, stderr, "error: Could not write new state metadata file")
@@ -1271,7 +1971,8 @@ func TestUpgrade_manyFailures(t *testing.T) {
 	b, err := New(ctx, sink, "file://"+filepath.ToSlash(tmpDir), nil)
 	require.NoError(t, err)
 
-	require.NoError(t, b.Upgrade(ctx, nil /* opts */))
+	_, err = b.Upgrade(ctx, nil /* opts */)
+	require.NoError(t, err)
 	out := output.String()
 	for i := 0; i < numStacks; i++ {
 		assert.Contains(t, out, fmt.Sprintf(`Skipping stack "stack-%d"`, i))
@@ -1396,3 +2097,2378 @@ func TestDisableIntegrityChecking(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, snap)
 }
+
+func TestGetHistoryPage(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A stack without updates has no history.
+	updates, total, err := b.GetHistoryPage(ctx, ref, 2 /* pageSize */, 1 /* page */)
+	require.NoError(t, err)
+	assert.Empty(t, updates)
+	assert.Equal(t, 0, total)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    apitype.UpdateUpdate,
+			Message: fmt.Sprintf("update %d", i),
+		}))
+	}
+
+	tests := []struct {
+		desc     string
+		page     int
+		messages []string
+	}{
+		{desc: "first page", page: 1, messages: []string{"update 2", "update 1"}},
+		{desc: "last page", page: 2, messages: []string{"update 0"}},
+		{desc: "past the end", page: 3, messages: nil},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			updates, total, err := b.GetHistoryPage(ctx, ref, 2 /* pageSize */, tt.page)
+			require.NoError(t, err)
+			assert.Equal(t, 3, total)
+
+			var messages []string
+			for _, u := range updates {
+				messages = append(messages, u.Message)
+			}
+			assert.Equal(t, tt.messages, messages)
+		})
+	}
+}
+
+func TestGetHistoryFiltered(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	history := []backend.UpdateInfo{
+		{Kind: apitype.UpdateUpdate, Message: "initial deploy", Environment: map[string]string{"REGION": "us"}},
+		{Kind: apitype.PreviewUpdate, Message: "move to eu", Environment: map[string]string{"REGION": "eu"}},
+		{Kind: apitype.UpdateUpdate, Message: "move to eu", Environment: map[string]string{"REGION": "eu"}},
+		{Kind: apitype.RefreshUpdate, Message: "refresh", Environment: map[string]string{"REGION": "eu"}},
+		{Kind: apitype.DestroyUpdate, Message: "teardown"},
+	}
+	for _, update := range history {
+		require.NoError(t, b.addToHistory(ctx, ref, update))
+	}
+
+	tests := []struct {
+		desc     string
+		filter   HistoryFilter
+		pageSize int
+		page     int
+		messages []string
+	}{
+		{
+			desc:     "no criteria",
+			messages: []string{"teardown", "refresh", "move to eu", "move to eu", "initial deploy"},
+		},
+		{
+			desc:     "message",
+			filter:   HistoryFilter{Message: "to eu"},
+			messages: []string{"move to eu", "move to eu"},
+		},
+		{
+			desc:     "environment",
+			filter:   HistoryFilter{Environment: map[string]string{"REGION": "eu"}},
+			messages: []string{"refresh", "move to eu", "move to eu"},
+		},
+		{
+			desc:     "kinds",
+			filter:   HistoryFilter{Kinds: []apitype.UpdateKind{apitype.UpdateUpdate, apitype.DestroyUpdate}},
+			messages: []string{"teardown", "move to eu", "initial deploy"},
+		},
+		{
+			desc: "all criteria",
+			filter: HistoryFilter{
+				Message:     "eu",
+				Environment: map[string]string{"REGION": "eu"},
+				Kinds:       []apitype.UpdateKind{apitype.UpdateUpdate},
+			},
+			messages: []string{"move to eu"},
+		},
+		{
+			desc: "predicate",
+			filter: HistoryFilter{Match: func(u backend.UpdateInfo) bool {
+				return len(u.Environment) == 0
+			}},
+			messages: []string{"teardown"},
+		},
+		{
+			desc:     "no matches",
+			filter:   HistoryFilter{Environment: map[string]string{"REGION": "ap"}},
+			messages: nil,
+		},
+		{
+			desc:     "first page",
+			filter:   HistoryFilter{Environment: map[string]string{"REGION": "eu"}},
+			pageSize: 2,
+			page:     1,
+			messages: []string{"refresh", "move to eu"},
+		},
+		{
+			desc:     "last page",
+			filter:   HistoryFilter{Environment: map[string]string{"REGION": "eu"}},
+			pageSize: 2,
+			page:     2,
+			messages: []string{"move to eu"},
+		},
+		{
+			desc:     "past the end",
+			filter:   HistoryFilter{Environment: map[string]string{"REGION": "eu"}},
+			pageSize: 2,
+			page:     3,
+			messages: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			updates, err := b.GetHistoryFiltered(ctx, ref, tt.filter, tt.pageSize, tt.page)
+			require.NoError(t, err)
+
+			var messages []string
+			for _, u := range updates {
+				messages = append(messages, u.Message)
+			}
+			assert.Equal(t, tt.messages, messages)
+		})
+	}
+
+	// The unfiltered history is unchanged.
+	updates, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Len(t, updates, len(history))
+}
+
+func TestPruneHistory(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Record three updates in the stack's history.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    apitype.UpdateUpdate,
+			Message: fmt.Sprintf("update %d", i),
+		}))
+	}
+
+	// Other files in the history directory should be left alone.
+	strayFile := path.Join(ref.HistoryDir(), "README.txt")
+	require.NoError(t, b.bucket.WriteAll(ctx, strayFile, []byte("hello"), nil))
+
+	// A dry run reports two records, each with a history and a checkpoint file,
+	// but doesn't delete anything.
+	keys, err := b.PruneHistory(ctx, ref, 1 /* keepLast */, 0 /* olderThan */, true /* dryRun */)
+	require.NoError(t, err)
+	assert.Len(t, keys, 4)
+
+	history, err := b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	// Keep only the most recent update.
+	keys, err = b.PruneHistory(ctx, ref, 1 /* keepLast */, 0 /* olderThan */, false /* dryRun */)
+	require.NoError(t, err)
+	assert.Len(t, keys, 4)
+
+	history, err = b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "update 2", history[0].Message)
+
+	// Nothing is older than an hour.
+	keys, err = b.PruneHistory(ctx, ref, 0 /* keepLast */, time.Hour, false /* dryRun */)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	time.Sleep(10 * time.Millisecond)
+	keys, err = b.PruneHistory(ctx, ref, 0 /* keepLast */, time.Millisecond, false /* dryRun */)
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	history, err = b.GetHistory(ctx, ref, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	// The current checkpoint and unrelated files must survive pruning.
+	exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.FileExists(t, filepath.Join(stateDir, strayFile))
+
+	// Negative limits are rejected.
+	_, err = b.PruneHistory(ctx, ref, -1 /* keepLast */, 0 /* olderThan */, true /* dryRun */)
+	assert.ErrorContains(t, err, "number of updates to keep must not be negative")
+	_, err = b.PruneHistory(ctx, ref, 0 /* keepLast */, -time.Hour, true /* dryRun */)
+	assert.ErrorContains(t, err, "update age must not be negative")
+}
+
+func TestCompression_roundTrip(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		env      env.MapStore
+		wantFile string
+	}{
+		{
+			desc:     "none",
+			env:      env.MapStore{"PULUMI_SELF_MANAGED_STATE_COMPRESSION": "none"},
+			wantFile: "foo.json",
+		},
+		{
+			desc:     "gzip",
+			env:      env.MapStore{"PULUMI_SELF_MANAGED_STATE_COMPRESSION": "gzip"},
+			wantFile: "foo.json.gz",
+		},
+		{
+			desc:     "zstd",
+			env:      env.MapStore{"PULUMI_SELF_MANAGED_STATE_COMPRESSION": "zstd"},
+			wantFile: "foo.json.zst",
+		},
+		{
+			desc:     "legacy gzip flag",
+			env:      env.MapStore{"PULUMI_SELF_MANAGED_STATE_GZIP": "true"},
+			wantFile: "foo.json.gz",
+		},
+		{
+			desc: "compression overrides gzip flag",
+			env: env.MapStore{
+				"PULUMI_SELF_MANAGED_STATE_GZIP":        "true",
+				"PULUMI_SELF_MANAGED_STATE_COMPRESSION": "zstd",
+			},
+			wantFile: "foo.json.zst",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			stateDir := t.TempDir()
+			ctx := context.Background()
+			b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+				&workspace.Project{Name: "testproj"},
+				&localBackendOptions{Env: env.NewEnv(tt.env)})
+			require.NoError(t, err)
+
+			ref, err := b.ParseStackReference("foo")
+			require.NoError(t, err)
+			stk, err := b.CreateStack(ctx, ref, "", nil)
+			require.NoError(t, err)
+
+			deployment, err := makeUntypedDeployment("foo", "abc123",
+				"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+			require.NoError(t, err)
+			require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+			assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "testproj", tt.wantFile))
+
+			stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+			require.NoError(t, err)
+			require.Len(t, stacks, 1)
+			assert.Equal(t, "foo", stacks[0].Name().String())
+			require.NotNil(t, stacks[0].ResourceCount())
+			assert.Equal(t, 1, *stacks[0].ResourceCount())
+		})
+	}
+}
+
+func TestCompression_mixedBucket(t *testing.T) {
+	t.Parallel()
+
+	// Files written with one codec must still be readable
+	// after switching the configured codec.
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	for _, codec := range []string{"zstd", "gzip", "none"} {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+			&localBackendOptions{Env: env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_STATE_COMPRESSION": codec,
+			})})
+		require.NoError(t, err)
+
+		ref, err := b.ParseStackReference("stack-" + codec)
+		require.NoError(t, err)
+		stk, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+
+		deployment, err := makeUntypedDeployment("stack-"+codec, "abc123",
+			"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+		require.NoError(t, err)
+		require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 3)
+	for _, stack := range stacks {
+		require.NotNil(t, stack.ResourceCount(), "stack %v", stack.Name())
+		assert.Equal(t, 1, *stack.ResourceCount(), "stack %v", stack.Name())
+	}
+}
+
+func TestGetRawCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		codec      string
+		wantFormat string
+	}{
+		{"none", "json"},
+		{"gzip", "json+gzip"},
+		{"zstd", "json+zstd"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.codec, func(t *testing.T) {
+			t.Parallel()
+
+			stateDir := t.TempDir()
+			ctx := context.Background()
+			b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+				&workspace.Project{Name: "testproj"},
+				&localBackendOptions{Env: env.NewEnv(env.MapStore{
+					"PULUMI_SELF_MANAGED_STATE_COMPRESSION": tt.codec,
+				})})
+			require.NoError(t, err)
+
+			ref, err := b.ParseStackReference("dev")
+			require.NoError(t, err)
+			stk, err := b.CreateStack(ctx, ref, "", nil)
+			require.NoError(t, err)
+			deployment, err := makeUntypedDeployment("dev", "abc123",
+				"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+			require.NoError(t, err)
+			require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+			data, format, err := b.GetRawCheckpoint(ctx, ref)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantFormat, format)
+
+			// The bytes are those written to the bucket, only decompressed.
+			localRef, err := b.getReference(ref)
+			require.NoError(t, err)
+			stored, err := b.bucket.ReadAll(ctx, b.stackPath(ctx, localRef))
+			require.NoError(t, err)
+			codec, err := compressionFromEnv(env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_STATE_COMPRESSION": tt.codec,
+			}))
+			require.NoError(t, err)
+			want, err := codec.Decompress(stored)
+			require.NoError(t, err)
+			assert.Equal(t, want, data)
+
+			var versioned apitype.VersionedCheckpoint
+			require.NoError(t, json.Unmarshal(data, &versioned))
+			assert.Equal(t, apitype.DeploymentSchemaVersionCurrent, versioned.Version)
+		})
+	}
+}
+
+func TestCompression_invalid(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_COMPRESSION": "lz4",
+		})})
+	assert.ErrorContains(t, err, `unsupported value for PULUMI_SELF_MANAGED_STATE_COMPRESSION: "lz4"`)
+}
+
+func TestLock_staleLockTTL(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	// Two backends with different lock IDs,
+	// only the second of which considers locks older than an hour stale.
+	first, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+
+	var output bytes.Buffer
+	sink := diag.DefaultSink(io.Discard, &output, diag.FormatOptions{Color: colors.Never})
+	second, err := newLocalBackend(ctx, sink, "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "1h",
+		})})
+	require.NoError(t, err)
+	require.NotEqual(t, first.lockID, second.lockID)
+
+	ref, err := first.ParseStackReference("foo")
+	require.NoError(t, err)
+	_, err = first.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A fresh lock held by the first backend blocks the second.
+	require.NoError(t, first.Lock(ctx, ref))
+	err = second.Lock(ctx, ref)
+	assert.ErrorContains(t, err, "the stack is currently locked by 1 lock(s)")
+
+	// Backdate the lock so that it has expired.
+	content, err := json.Marshal(&lockContent{
+		Pid:       1234,
+		Username:  "someone",
+		Hostname:  "elsewhere",
+		Timestamp: time.Now().Add(-2 * time.Hour),
+	})
+	require.NoError(t, err)
+	require.NoError(t, first.bucket.WriteAll(ctx, first.lockPath(ref), content, nil))
+
+	// The first backend has no TTL so it still honors the expired lock
+	// (its own lock is ignored, so use a third backend to check).
+	third, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+	assert.Error(t, third.checkForLock(ctx, ref))
+
+	// The second backend breaks the expired lock and takes it.
+	require.NoError(t, second.Lock(ctx, ref))
+	assert.Contains(t, output.String(), "Breaking stale lock")
+	assert.Contains(t, output.String(), "someone@elsewhere (pid 1234)")
+
+	exists, err := first.bucket.Exists(ctx, first.lockPath(ref))
+	require.NoError(t, err)
+	assert.False(t, exists, "stale lock should have been deleted")
+	second.Unlock(ctx, ref)
+}
+
+func TestLock_invalidTTL(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "forever",
+		})})
+	assert.ErrorContains(t, err, `invalid value for PULUMI_SELF_MANAGED_STATE_LOCK_TTL: "forever"`)
+}
+
+func TestListLocks(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+	clock := &fakeClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Clock: clock})
+	require.NoError(t, err)
+
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+
+	// One lock taken now, and one left behind by a crash a day ago.
+	fooRef, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	require.NoError(t, b.Lock(ctx, fooRef))
+
+	barRef, err := b.parseStackReference("bar")
+	require.NoError(t, err)
+	content, err := json.Marshal(&lockContent{
+		Pid:       1234,
+		Username:  "someone",
+		Hostname:  "ci",
+		Timestamp: clock.now.Add(-24 * time.Hour),
+	})
+	require.NoError(t, err)
+	staleKey := path.Join(stackLockDir(barRef.FullyQualifiedName()), "crashed.json")
+	require.NoError(t, b.bucket.WriteAll(ctx, staleKey, content, nil))
+
+	locks, err = b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 2)
+	assert.Equal(t, tokens.QName("organization/testproj/bar"), locks[0].Stack)
+	assert.Equal(t, staleKey, locks[0].Key)
+	assert.Equal(t, 1234, locks[0].Pid)
+	assert.Equal(t, "someone", locks[0].Username)
+	assert.Equal(t, "ci", locks[0].Hostname)
+	assert.True(t, clock.now.Add(-24*time.Hour).Equal(locks[0].Timestamp))
+	assert.Equal(t, tokens.QName("organization/testproj/foo"), locks[1].Stack)
+	assert.Equal(t, b.lockPath(fooRef), locks[1].Key)
+	assert.True(t, clock.now.Equal(locks[1].Timestamp))
+
+	// Only the lock older than an hour is pruned.
+	pruned, err := b.PruneStaleLocks(ctx, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, staleKey, pruned[0].Key)
+
+	locks, err = b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, b.lockPath(fooRef), locks[0].Key)
+
+	b.Unlock(ctx, fooRef)
+	locks, err = b.ListLocks(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestPruneStaleLocks_keepsFreshLocks(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+	clock := &fakeClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Clock: clock})
+	require.NoError(t, err)
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Clock: clock})
+	require.NoError(t, err)
+
+	_, err = b.PruneStaleLocks(ctx, 0)
+	assert.ErrorContains(t, err, "lock age must be positive")
+	_, err = b.PruneStaleLocks(ctx, -time.Hour)
+	assert.ErrorContains(t, err, "lock age must be positive")
+
+	// Our own lock, a lock held by another process, and a lock that can't be read, all taken now.
+	fooRef, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	require.NoError(t, b.Lock(ctx, fooRef))
+
+	barRef, err := other.parseStackReference("bar")
+	require.NoError(t, err)
+	require.NoError(t, other.Lock(ctx, barRef))
+
+	bazRef, err := b.parseStackReference("baz")
+	require.NoError(t, err)
+	garbageKey := path.Join(stackLockDir(bazRef.FullyQualifiedName()), "garbage.json")
+	require.NoError(t, b.bucket.WriteAll(ctx, garbageKey, []byte("not a lock"), nil))
+	require.NoError(t, os.Chtimes(filepath.Join(stateDir, filepath.FromSlash(garbageKey)), clock.now, clock.now))
+
+	pruned, err := b.PruneStaleLocks(ctx, time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	locks, err := b.ListLocks(ctx)
+	require.NoError(t, err)
+	assert.Len(t, locks, 3)
+
+	// Once they're old, only our own lock survives.
+	clock.now = clock.now.Add(2 * time.Hour)
+	pruned, err = b.PruneStaleLocks(ctx, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, pruned, 2)
+	assert.Equal(t, other.lockPath(barRef), pruned[0].Key)
+	assert.Equal(t, garbageKey, pruned[1].Key)
+
+	locks, err = b.ListLocks(ctx)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	assert.Equal(t, b.lockPath(fooRef), locks[0].Key)
+}
+
+func TestEnsureStack(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+
+	// Each goroutine has a backend of its own, like separate processes sharing a bucket,
+	// and they all race to ensure the same stack.
+	const n = 4
+	created := make([]bool, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+		require.NoError(t, err)
+		ref, err := b.ParseStackReference("organization/project/dev")
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, created[i], errs[i] = b.EnsureStack(ctx, ref, nil)
+		}()
+	}
+	wg.Wait()
+
+	createdCount := 0
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		if created[i] {
+			createdCount++
+		}
+	}
+	assert.Equal(t, 1, createdCount, "the stack must be created exactly once")
+
+	// Goroutines sharing a backend are serialized too.
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+	ref, err := b.ParseStackReference("organization/project/prod")
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, created[i], errs[i] = b.EnsureStack(ctx, ref, nil)
+		}()
+	}
+	wg.Wait()
+
+	createdCount = 0
+	for i := 0; i < n; i++ {
+		require.NoError(t, errs[i])
+		if created[i] {
+			createdCount++
+		}
+	}
+	assert.Equal(t, 1, createdCount, "the stack must be created exactly once")
+
+	stk, wasCreated, err := b.EnsureStack(ctx, ref, nil)
+	require.NoError(t, err)
+	assert.False(t, wasCreated)
+	assert.Equal(t, "organization/project/prod", stk.Ref().FullyQualifiedName().String())
+}
+
+func TestEnsureStack_otherStacksDontWait(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+	require.NoError(t, err)
+
+	// Another process holds the lock of one stack, so ensuring that stack waits for it.
+	busyRef, err := b.ParseStackReference("organization/project/busy")
+	require.NoError(t, err)
+	require.NoError(t, other.Lock(ctx, busyRef))
+	busyDone := make(chan error, 1)
+	go func() {
+		_, _, err := b.EnsureStack(ctx, busyRef, nil)
+		busyDone <- err
+	}()
+	require.Eventually(t, func() bool {
+		b.ensureStackMu.Lock()
+		defer b.ensureStackMu.Unlock()
+		return b.ensureStackLocks[busyRef.FullyQualifiedName()] != nil
+	}, time.Minute, time.Millisecond)
+
+	// Ensuring another stack of the same backend doesn't.
+	freeRef, err := b.ParseStackReference("organization/project/free")
+	require.NoError(t, err)
+	_, created, err := b.EnsureStack(ctx, freeRef, nil)
+	require.NoError(t, err)
+	assert.True(t, created)
+	select {
+	case err := <-busyDone:
+		t.Fatalf("EnsureStack returned while the stack was locked: %v", err)
+	default:
+	}
+
+	other.Unlock(ctx, busyRef)
+	require.NoError(t, <-busyDone)
+}
+
+func TestMaxNameLength(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	long := strings.Repeat("a", 150)
+
+	// The default limit matches the service.
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+	_, err = b.parseStackReference(long)
+	assert.ErrorContains(t, err, "a stack name cannot exceed 100 characters")
+	_, err = b.parseStackReference("organization/" + long + "/dev")
+	assert.ErrorContains(t, err, "project names are limited to 100 characters")
+
+	b, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "testproj"},
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_MAX_NAME_LENGTH": "150",
+		})})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/" + long + "/" + long)
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	assert.Equal(t, ref.FullyQualifiedName(), stacks[0].Name().FullyQualifiedName())
+
+	_, err = b.parseStackReference(long + "a")
+	assert.ErrorContains(t, err, "a stack name cannot exceed 150 characters")
+	_, err = b.parseStackReference("not a stack")
+	assert.ErrorContains(t, err, "a stack name may only contain alphanumeric")
+
+	for _, give := range []string{"-1", "1000"} {
+		_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+			&localBackendOptions{Env: env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_MAX_NAME_LENGTH": give,
+			})})
+		assert.ErrorContains(t, err, "invalid value for PULUMI_SELF_MANAGED_MAX_NAME_LENGTH")
+	}
+}
+
+func TestRemoveStack_notEmpty(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	hasResources, err := b.RemoveStack(ctx, stk, false)
+	assert.True(t, hasResources)
+	var notEmpty *backend.StackNotEmptyError
+	require.ErrorAs(t, err, &notEmpty)
+	assert.Equal(t, "organization/project/a", notEmpty.StackName)
+	assert.Equal(t, 1, notEmpty.ResourceCount)
+
+	_, err = b.RemoveStack(ctx, stk, true)
+	assert.NoError(t, err)
+}
+
+func TestCaseInsensitiveCollisions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newBackend := func(caseInsensitive string) *localBackend {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+			&localBackendOptions{Env: env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_STATE_CASE_INSENSITIVE": caseInsensitive,
+			})})
+		require.NoError(t, err)
+		return b
+	}
+	createStack := func(b *localBackend, name string) (backend.Stack, error) {
+		ref, err := b.parseStackReference(name)
+		require.NoError(t, err)
+		return b.CreateStack(ctx, ref, "", nil)
+	}
+
+	b := newBackend("true")
+	_, err := createStack(b, "organization/proj/dev")
+	require.NoError(t, err)
+
+	// A stack name that differs only by case would share the state file of "dev".
+	_, err = createStack(b, "organization/proj/Dev")
+	assert.ErrorContains(t, err, "stack organization/proj/Dev differs only by case from the existing stack")
+
+	// So would a project name that differs only by case.
+	_, err = createStack(b, "organization/Proj/dev")
+	assert.ErrorContains(t, err, "differs only by case")
+
+	// Renames are checked as well.
+	prod, err := createStack(b, "organization/proj/prod")
+	require.NoError(t, err)
+	_, err = b.RenameStack(ctx, prod, "organization/proj/DEV")
+	assert.ErrorContains(t, err, "differs only by case")
+	_, err = b.RenameStack(ctx, prod, "organization/proj/Prod")
+	assert.ErrorContains(t, err, "differs only by case", "renaming a stack to its own name in another case")
+
+	// Names are case-sensitive otherwise.
+	if runtime.GOOS != "darwin" && runtime.GOOS != "windows" {
+		b = newBackend("false")
+		_, err = createStack(b, "organization/proj/dev")
+		require.NoError(t, err)
+		_, err = createStack(b, "organization/proj/Dev")
+		assert.NoError(t, err)
+	}
+}
+
+func TestBackupsDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_DISABLE_BACKUPS": "true",
+		})})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	stack, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Overwriting the checkpoint doesn't make a backup.
+	_, err = b.saveStack(ctx, ref, nil, nil)
+	require.NoError(t, err)
+	backupPath := b.stackPath(ctx, ref) + ".bak"
+	exists, err := b.bucket.Exists(ctx, backupPath)
+	require.NoError(t, err)
+	assert.False(t, exists, "backup should not have been written")
+
+	// Removing the stack requires force since it can't be recovered.
+	_, err = b.RemoveStack(ctx, stack, false)
+	assert.ErrorContains(t, err, "refusing to remove stack without --force")
+	exists, err = b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.True(t, exists, "stack should not have been removed")
+
+	_, err = b.RemoveStack(ctx, stack, true)
+	require.NoError(t, err)
+	exists, err = b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.False(t, exists, "stack should have been removed")
+	exists, err = b.bucket.Exists(ctx, backupPath)
+	require.NoError(t, err)
+	assert.False(t, exists, "backup should not have been written")
+}
+
+func TestReadOnlyBackend(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	project := &workspace.Project{Name: "project"}
+
+	// Create a stack with a writable backend first.
+	writable, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+	ref, err := writable.parseStackReference("organization/project/a")
+	require.NoError(t, err)
+	_, err = writable.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_READONLY": "true",
+		})})
+	require.NoError(t, err)
+
+	// Reads work normally.
+	stack, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, stack)
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+	_, err = b.ExportDeployment(ctx, stack)
+	require.NoError(t, err)
+	_, err = b.GetHistory(ctx, ref, 10, 1)
+	require.NoError(t, err)
+
+	// Writes fail up front.
+	newRef, err := b.parseStackReference("organization/project/b")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, newRef, "", nil)
+	assert.ErrorIs(t, err, ErrReadOnlyBackend)
+	_, err = b.RemoveStack(ctx, stack, true)
+	assert.ErrorIs(t, err, ErrReadOnlyBackend)
+	_, err = b.RenameStack(ctx, stack, "organization/project/b")
+	assert.ErrorIs(t, err, ErrReadOnlyBackend)
+	err = b.ImportDeployment(ctx, stack, &apitype.UntypedDeployment{})
+	assert.ErrorIs(t, err, ErrReadOnlyBackend)
+	_, err = b.Upgrade(ctx, nil)
+	assert.ErrorIs(t, err, ErrReadOnlyBackend)
+
+	// Dry runs don't write anything, so they work.
+	_, err = b.Upgrade(ctx, &UpgradeOptions{DryRun: true})
+	require.NoError(t, err)
+
+	// Locking is a no-op.
+	require.NoError(t, b.Lock(ctx, ref))
+	exists, err := b.bucket.Exists(ctx, b.lockPath(ref))
+	require.NoError(t, err)
+	assert.False(t, exists, "read-only backend should not write locks")
+	b.Unlock(ctx, ref)
+
+	// The stack is untouched.
+	exists, err = b.bucket.Exists(ctx, b.stackPath(ctx, ref))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestReadOnlyBackend_newBucket(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_READONLY": "true",
+		})})
+	require.NoError(t, err)
+
+	// No metadata file is written to a read-only bucket.
+	entries, err := os.ReadDir(stateDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestPermalinkExpiry(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		give     string
+		want     *blob.SignedURLOptions
+		wantWarn string
+	}{
+		{desc: "unset", give: "", want: nil},
+		{desc: "valid", give: "24h", want: &blob.SignedURLOptions{Expiry: 24 * time.Hour}},
+		{
+			desc:     "clamped",
+			give:     "720h",
+			want:     &blob.SignedURLOptions{Expiry: 7 * 24 * time.Hour},
+			wantWarn: "exceeds the maximum of 168h0m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var output bytes.Buffer
+			sink := diag.DefaultSink(io.Discard, &output, diag.FormatOptions{Color: colors.Never})
+			b, err := newLocalBackend(context.Background(), sink, "file://"+filepath.ToSlash(t.TempDir()), nil,
+				&localBackendOptions{Env: env.NewEnv(env.MapStore{
+					"PULUMI_SELF_MANAGED_PERMALINK_EXPIRY": tt.give,
+				})})
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.want, b.signedURLOptions())
+			if tt.wantWarn != "" {
+				assert.Contains(t, output.String(), tt.wantWarn)
+			} else {
+				assert.Empty(t, output.String())
+			}
+		})
+	}
+}
+
+func TestPermalinkExpiry_invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_PERMALINK_EXPIRY": "-1h",
+		})})
+	assert.ErrorContains(t, err, `invalid value for PULUMI_SELF_MANAGED_PERMALINK_EXPIRY: "-1h"`)
+}
+
+func TestApply_jsonPermalinkUnavailable(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj", Runtime: workspace.NewProjectRuntimeInfo("go", nil)}
+
+	// memblob can't sign URLs, so there's never a permalink for its stacks.
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "mem://", project, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	var stdout bytes.Buffer
+	op := backend.UpdateOperation{
+		Proj: project,
+		Root: t.TempDir(),
+		Opts: backend.UpdateOptions{
+			Display: display.Options{JSONDisplay: true, Stdout: &stdout},
+		},
+		SecretsManager:  b64.NewBase64SecretsManager(),
+		SecretsProvider: stack.DefaultSecretsProvider,
+		Scopes:          backend.CancellationScopes,
+	}
+	_, _, res := b.apply(ctx, apitype.RefreshUpdate, stk, op, backend.ApplierOptions{ShowLink: true}, nil)
+	require.Nil(t, res)
+
+	assert.Contains(t, stdout.String(), `"permalinkUnavailableEvent"`)
+}
+
+func TestBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	src, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), project, nil)
+	require.NoError(t, err)
+
+	ref, err := src.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := src.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, src.ImportDeployment(ctx, stk, deployment))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, src.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    apitype.UpdateUpdate,
+			Message: fmt.Sprintf("update %d", i),
+		}))
+	}
+
+	var buff bytes.Buffer
+	require.NoError(t, src.Backup(ctx, ref, &buff))
+	archive := buff.Bytes()
+
+	// Restore into a different bucket.
+	dst, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), project, nil)
+	require.NoError(t, err)
+	dstRef, err := dst.ParseStackReference("foo")
+	require.NoError(t, err)
+	require.NoError(t, dst.Restore(ctx, dstRef, bytes.NewReader(archive), false /* force */))
+
+	dstStack, err := dst.GetStack(ctx, dstRef)
+	require.NoError(t, err)
+	require.NotNil(t, dstStack)
+
+	want, err := src.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+	got, err := dst.ExportDeployment(ctx, dstStack)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want.Deployment), string(got.Deployment))
+
+	history, err := dst.GetHistory(ctx, dstRef, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, "update 1", history[0].Message)
+
+	// Restoring over an existing stack requires force.
+	err = dst.Restore(ctx, dstRef, bytes.NewReader(archive), false /* force */)
+	assert.ErrorContains(t, err, "already exists")
+	require.NoError(t, dst.Restore(ctx, dstRef, bytes.NewReader(archive), true /* force */))
+
+	history, err = dst.GetHistory(ctx, dstRef, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
+
+func TestBackupRestore_otherStack(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), project, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	tags := map[apitype.StackTagName]string{"team": "infra"}
+	require.NoError(t, b.UpdateStackTags(ctx, stk, tags))
+
+	var buff bytes.Buffer
+	require.NoError(t, b.Backup(ctx, ref, &buff))
+
+	// Restore the stack under another name, in another project.
+	otherRef, err := b.ParseStackReference("organization/otherproj/bar")
+	require.NoError(t, err)
+	require.NoError(t, b.Restore(ctx, otherRef, bytes.NewReader(buff.Bytes()), false /* force */))
+
+	other, err := b.GetStack(ctx, otherRef)
+	require.NoError(t, err)
+	assert.Equal(t, tags, other.Tags())
+
+	snap, err := other.Snapshot(ctx, stack.DefaultSecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 1)
+	assert.Equal(t, tokens.QName("bar"), snap.Resources[0].URN.Stack())
+	assert.Equal(t, tokens.PackageName("otherproj"), snap.Resources[0].URN.Project())
+	secret := snap.Resources[0].Inputs["secret"]
+	require.True(t, secret.IsSecret())
+	assert.Equal(t, "s3cr3t", secret.SecretValue().Element.StringValue())
+
+	// The secrets provider record of the stack comes along too.
+	localRef, err := b.getReference(otherRef)
+	require.NoError(t, err)
+	exists, err := b.bucket.Exists(ctx, stackSecretsProviderPath(localRef))
+	require.NoError(t, err)
+	assert.True(t, exists)
+}
+
+// failingWriteBucket is a Bucket that fails to write the objects selected by fail.
+type failingWriteBucket struct {
+	Bucket
+
+	fail func(key string) bool
+}
+
+func (b *failingWriteBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	if b.fail(key) {
+		return fmt.Errorf("failed to write %v", key)
+	}
+	return b.Bucket.WriteAll(ctx, key, p, opts)
+}
+
+func TestRestore_forceRollback(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+	const phrase = "abc123"
+	const state = "v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA=="
+
+	src, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), project, nil)
+	require.NoError(t, err)
+	ref, err := src.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := src.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeployment("restored", phrase, state)
+	require.NoError(t, err)
+	require.NoError(t, src.ImportDeployment(ctx, stk, deployment))
+	require.NoError(t, src.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate, Message: "restored"}))
+
+	var buff bytes.Buffer
+	require.NoError(t, src.Backup(ctx, ref, &buff))
+	archive := buff.Bytes()
+
+	// The stack to restore over has a different checkpoint and history.
+	dst, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), project, nil)
+	require.NoError(t, err)
+	dstRef, err := dst.parseStackReference("foo")
+	require.NoError(t, err)
+	dstStack, err := dst.CreateStack(ctx, dstRef, "", nil)
+	require.NoError(t, err)
+	existing, err := makeUntypedDeployment("existing", phrase, state)
+	require.NoError(t, err)
+	require.NoError(t, dst.ImportDeployment(ctx, dstStack, existing))
+	require.NoError(t, dst.addToHistory(ctx, dstRef, backend.UpdateInfo{Kind: apitype.UpdateUpdate, Message: "existing"}))
+	want, err := dst.ExportDeployment(ctx, dstStack)
+	require.NoError(t, err)
+
+	// Fail the last write of the restore, that of the checkpoint.
+	chkpath := dst.stackPath(ctx, dstRef)
+	bucket := dst.bucket
+	dst.bucket = &failingWriteBucket{Bucket: bucket, fail: func(key string) bool { return key == chkpath }}
+	err = dst.Restore(ctx, dstRef, bytes.NewReader(archive), true /* force */)
+	assert.ErrorContains(t, err, "failed to write")
+	dst.bucket = bucket
+
+	// The existing stack is left as it was.
+	got, err := dst.ExportDeployment(ctx, dstStack)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want.Deployment), string(got.Deployment))
+	history, err := dst.GetHistory(ctx, dstRef, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "existing", history[0].Message)
+
+	// A successful restore replaces the history of the existing stack.
+	require.NoError(t, dst.Restore(ctx, dstRef, bytes.NewReader(archive), true /* force */))
+	history, err = dst.GetHistory(ctx, dstRef, 0 /* pageSize */, 0 /* page */)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "restored", history[0].Message)
+}
+
+func TestChecksum(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	assert.FileExists(t, filepath.Join(stacksDir, "foo.json.sha256"))
+
+	// Tamper with the checkpoint.
+	chkpath := filepath.Join(stacksDir, "foo.json")
+	data, err := os.ReadFile(chkpath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(chkpath, append(data, '\n'), 0o600))
+
+	_, err = b.ExportDeployment(ctx, stk)
+	assert.ErrorContains(t, err, "corrupt store: checksum mismatch")
+
+	// Verification can be skipped.
+	skip, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_SKIP_CHECKSUM_VERIFICATION": "true",
+		})})
+	require.NoError(t, err)
+	_, err = skip.ExportDeployment(ctx, stk)
+	assert.NoError(t, err)
+
+	// Checkpoints without a checksum are not verified.
+	require.NoError(t, os.Remove(chkpath+".sha256"))
+	_, err = b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+
+	// Renaming the stack moves the checksum along with the checkpoint.
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	renamed, err := b.RenameStack(ctx, stk, "bar")
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(stacksDir, "foo.json.sha256"))
+	assert.FileExists(t, filepath.Join(stacksDir, "bar.json.sha256"))
+
+	// Removing the stack removes the checksum.
+	stk, err = b.GetStack(ctx, renamed)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, stk, true /* force */)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(stacksDir, "bar.json.sha256"))
+}
+
+func TestChecksum_replacedCheckpoint(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	localRef, err := b.getReference(ref)
+	require.NoError(t, err)
+	chkpath := b.stackPath(ctx, localRef)
+	data, err := b.bucket.ReadAll(ctx, chkpath)
+	require.NoError(t, err)
+	replaced := append(data, '\n')
+
+	// While the checkpoint is replaced, both the old and the new checkpoint are accepted.
+	require.NoError(t, b.prepareChecksum(ctx, chkpath, replaced))
+	_, err = b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+
+	// Likewise if the save stops right after replacing the checkpoint.
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, replaced, nil))
+	_, err = b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+
+	// Anything else is still rejected.
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, append(replaced, '\n'), nil))
+	_, err = b.ExportDeployment(ctx, stk)
+	assert.ErrorContains(t, err, "corrupt store: checksum mismatch")
+
+	// A completed save only accepts the new checkpoint.
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	sums, err := b.bucket.ReadAll(ctx, checksumPath(chkpath))
+	require.NoError(t, err)
+	assert.Len(t, bytes.Fields(sums), 1)
+}
+
+// populateStacks creates a bucket with numStacks stacks, each with a single resource.
+func populateStacks(tb testing.TB, numStacks int) (stateDir string) {
+	stateDir = tb.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(tb), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(tb, err)
+
+	for i := 0; i < numStacks; i++ {
+		name := fmt.Sprintf("stack-%03d", i)
+		ref, err := b.ParseStackReference(name)
+		require.NoError(tb, err)
+		stk, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(tb, err)
+
+		deployment, err := makeUntypedDeployment(name, "abc123",
+			"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+		require.NoError(tb, err)
+		require.NoError(tb, b.ImportDeployment(ctx, stk, deployment))
+	}
+	return stateDir
+}
+
+// listStacks lists the stacks in the given bucket
+// reading up to parallel checkpoints at a time.
+func listStacks(tb testing.TB, stateDir string, parallel int) []string {
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(tb), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_PARALLEL": strconv.Itoa(parallel),
+		})})
+	require.NoError(tb, err)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(tb, err)
+
+	summaries := make([]string, len(stacks))
+	for i, stack := range stacks {
+		require.NotNil(tb, stack.ResourceCount())
+		summaries[i] = fmt.Sprintf("%v (%d resources)", stack.Name(), *stack.ResourceCount())
+	}
+	return summaries
+}
+
+func TestListStacks_parallel(t *testing.T) {
+	t.Parallel()
+
+	stateDir := populateStacks(t, 20)
+	serial := listStacks(t, stateDir, 1)
+	assert.Len(t, serial, 20)
+	assert.Equal(t, serial, listStacks(t, stateDir, 8))
+}
+
+func TestListStacks_summaryCache(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := populateStacks(t, 3)
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_SUMMARY_CACHE": "true",
+		})})
+	require.NoError(t, err)
+
+	// listResourceCounts lists the stacks and returns their resource counts,
+	// along with the number of objects read from the bucket to do so.
+	listResourceCounts := func() (map[string]int, int64) {
+		before := b.Stats().Reads
+		stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+		require.NoError(t, err)
+
+		counts := make(map[string]int)
+		for _, stack := range stacks {
+			require.NotNil(t, stack.ResourceCount())
+			counts[stack.Name().Name().String()] = *stack.ResourceCount()
+		}
+		return counts, b.Stats().Reads - before
+	}
+
+	want := map[string]int{"stack-000": 1, "stack-001": 1, "stack-002": 1}
+	counts, _ := listResourceCounts()
+	assert.Equal(t, want, counts)
+	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "summaries.json"))
+
+	// Only the cache is read when nothing changed.
+	counts, reads := listResourceCounts()
+	assert.Equal(t, want, counts)
+	assert.Equal(t, int64(1), reads)
+
+	// Changed stacks are read again.
+	ref, err := b.ParseStackReference("organization/testproj/stack-001")
+	require.NoError(t, err)
+	stk, err := b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, &apitype.UntypedDeployment{
+		Version:    3,
+		Deployment: json.RawMessage(`{}`),
+	}))
+
+	want["stack-001"] = 0
+	counts, reads = listResourceCounts()
+	assert.Equal(t, want, counts)
+	assert.Greater(t, reads, int64(1))
+}
+
+func BenchmarkListStacks(b *testing.B) {
+	stateDir := populateStacks(b, 400)
+	serial := listStacks(b, stateDir, 1)
+
+	for _, parallel := range []int{1, 4, 16} {
+		parallel := parallel
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				assert.Equal(b, serial, listStacks(b, stateDir, parallel))
+			}
+		})
+	}
+}
+
+func TestListStacks_cancelled(t *testing.T) {
+	t.Parallel()
+
+	stateDir := populateStacks(t, 5)
+	b, err := New(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestListStacks_invalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	stateDir := populateStacks(t, 2)
+	want := listStacks(t, stateDir, 1)
+
+	// Other tools sharing the bucket may leave behind objects
+	// whose keys aren't valid UTF-8.
+	for _, junk := range []string{
+		filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "\xff.json"),
+		filepath.Join(stateDir, ".pulumi", "stacks", "\xff", "dev.json"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(junk), 0o700); err != nil {
+			t.Skipf("file system does not support invalid UTF-8 names: %v", err)
+		}
+		if err := os.WriteFile(junk, []byte("{}"), 0o600); err != nil {
+			t.Skipf("file system does not support invalid UTF-8 names: %v", err)
+		}
+	}
+
+	assert.Equal(t, want, listStacks(t, stateDir, 1), "junk objects must be skipped")
+}
+
+func TestLegacyUpgrade_cancelled(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	bucket, err := fileblob.OpenBucket(stateDir, nil)
+	require.NoError(t, err)
+
+	require.NoError(t,
+		bucket.WriteAll(context.Background(), ".pulumi/stacks/foo.json", []byte(`{
+		"latest": {
+			"resources": [
+				{
+					"type": "package:module:resource",
+					"urn": "urn:pulumi:stack::project::package:module:resource::name"
+				}
+			]
+		}
+	}`), nil))
+
+	b, err := New(context.Background(), diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = b.Upgrade(ctx, nil /* opts */)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Nothing should have been moved.
+	exists, err := bucket.Exists(context.Background(), ".pulumi/stacks/foo.json")
+	require.NoError(t, err)
+	assert.True(t, exists, "legacy stack file must still exist")
+
+	exists, err = bucket.Exists(context.Background(), ".pulumi/stacks/project/foo.json")
+	require.NoError(t, err)
+	assert.False(t, exists, "upgraded stack file must not exist")
+}
+
+func TestExportDeploymentAt(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// Record two updates, each with a different resource.
+	var want []*apitype.UntypedDeployment
+	for _, name := range []string{"first", "second"} {
+		deployment, err := makeUntypedDeployment(name, "abc123",
+			"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+		require.NoError(t, err)
+		require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+		require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{
+			Kind:    apitype.UpdateUpdate,
+			Message: name,
+		}))
+
+		exported, err := b.ExportDeployment(ctx, stk)
+		require.NoError(t, err)
+		want = append(want, exported)
+	}
+
+	// Index 0 is the most recent update.
+	got, err := b.ExportDeploymentAt(ctx, stk, 0)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want[1].Deployment), string(got.Deployment))
+
+	got, err = b.ExportDeploymentAt(ctx, stk, 1)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(want[0].Deployment), string(got.Deployment))
+
+	_, err = b.ExportDeploymentAt(ctx, stk, 2)
+	assert.ErrorIs(t, err, backend.ErrNoPreviousDeployment)
+
+	_, err = b.ExportDeploymentAt(ctx, stk, -1)
+	assert.ErrorIs(t, err, backend.ErrNoPreviousDeployment)
+}
+
+// Readers must never observe a partially written checkpoint,
+// even while another writer is repeatedly replacing it.
+func TestSaveCheckpoint_concurrentReads(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	file := b.stackPath(ctx, ref)
+
+	const writes = 50
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Read through the backend so that the checksum of each checkpoint is verified too.
+				_, data, err := b.readCheckpoint(ctx, ref)
+				if !assert.NoError(t, err) {
+					return
+				}
+				if !assert.True(t, json.Valid(data), "read a partial checkpoint (%d bytes)", len(data)) {
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < writes; i++ {
+		// Vary the size so that partial writes can't go unnoticed.
+		padding, err := json.Marshal(strings.Repeat("x", (i%5)*64*1024))
+		require.NoError(t, err)
+		_, _, err = b.saveCheckpoint(ctx, ref, &apitype.VersionedCheckpoint{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Checkpoint: json.RawMessage(`{"stack":"foo","padding":` + string(padding) + `}`),
+		})
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+
+	// No temporary files should be left behind.
+	files, err := listBucket(ctx, b.bucket, filepath.Dir(file))
+	require.NoError(t, err)
+	for _, f := range files {
+		assert.NotContains(t, f.Key, ".tmp-")
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	for _, name := range []string{"a", "b", "c"} {
+		ref, err := b.parseStackReference(name)
+		require.NoError(t, err)
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+	}
+
+	before := b.Stats()
+	assert.NotZero(t, before.Writes)
+	assert.NotZero(t, before.BytesWritten)
+
+	_, _, err = b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+
+	after := b.Stats()
+	assert.Equal(t, before.Writes, after.Writes, "listing stacks must not write")
+	assert.Greater(t, after.Lists, before.Lists)
+	// Every stack's checkpoint is read to report its summary.
+	assert.GreaterOrEqual(t, after.Reads-before.Reads, int64(3))
+	assert.Greater(t, after.BytesRead, before.BytesRead)
+}
+
+//nolint:paralleltest // mutates environment variables
+func TestStackSecretsProvider(t *testing.T) {
+	// Renaming the stack decrypts its secrets.
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "abc123")
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A new stack has no secrets provider.
+	provider, err := b.GetStackSecretsProvider(ctx, ref)
+	require.NoError(t, err)
+	assert.Nil(t, provider)
+
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	provider, err = b.GetStackSecretsProvider(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, provider)
+	assert.Equal(t, "passphrase", provider.Type)
+	assert.NotContains(t, string(provider.State), "abc123")
+
+	exists, err := b.bucket.Exists(ctx, stackSecretsProviderPath(ref))
+	require.NoError(t, err)
+	assert.True(t, exists, "secrets provider must be recorded")
+
+	// Stacks saved before the secrets provider was recorded
+	// fall back to the checkpoint.
+	require.NoError(t, b.bucket.Delete(ctx, stackSecretsProviderPath(ref)))
+	provider, err = b.GetStackSecretsProvider(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, provider)
+	assert.Equal(t, "passphrase", provider.Type)
+
+	// Renaming the stack carries the record over.
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+	newRefI, err := b.RenameStack(ctx, stk, "bar")
+	require.NoError(t, err)
+	newRef := newRefI.(*localBackendReference)
+
+	exists, err = b.bucket.Exists(ctx, stackSecretsProviderPath(ref))
+	require.NoError(t, err)
+	assert.False(t, exists, "old secrets provider record must be removed")
+	exists, err = b.bucket.Exists(ctx, stackSecretsProviderPath(newRef))
+	require.NoError(t, err)
+	assert.True(t, exists, "new secrets provider record must exist")
+
+	// Removing the stack removes the record.
+	newStk, err := b.GetStack(ctx, newRef)
+	require.NoError(t, err)
+	_, err = b.RemoveStack(ctx, newStk, true)
+	require.NoError(t, err)
+	exists, err = b.bucket.Exists(ctx, stackSecretsProviderPath(newRef))
+	require.NoError(t, err)
+	assert.False(t, exists, "secrets provider record must be removed with the stack")
+}
+
+//nolint:paralleltest // mutates environment variables
+func TestRotateSecretsProvider(t *testing.T) {
+	ctx := context.Background()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("organization/project/a")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// A stack without a deployment has nothing to rotate.
+	_, newSM, err := passphrase.NewPassphraseSecretsManager("new-passphrase")
+	require.NoError(t, err)
+	require.NoError(t, b.RotateSecretsProvider(ctx, ref, newSM))
+
+	_, oldSM, err := passphrase.NewPassphraseSecretsManager("old-passphrase")
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeploymentSecretsManager("a", oldSM, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "old-passphrase")
+	require.NoError(t, b.RotateSecretsProvider(ctx, ref, newSM))
+
+	provider, err := b.GetStackSecretsProvider(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, provider)
+	assert.Equal(t, newSM.Type(), provider.Type)
+	assert.JSONEq(t, string(newSM.State()), string(provider.State))
+
+	// The secrets can now be decrypted with the new passphrase.
+	t.Setenv("PULUMI_CONFIG_PASSPHRASE", "new-passphrase")
+	snap, err := stk.Snapshot(ctx, stack.DefaultSecretsProvider)
+	require.NoError(t, err)
+	require.Len(t, snap.Resources, 1)
+	secret := snap.Resources[0].Inputs["secret"]
+	require.True(t, secret.IsSecret())
+	assert.Equal(t, "s3cr3t", secret.SecretValue().Element.StringValue())
+
+	// The lock was released.
+	require.NoError(t, b.RotateAllSecretsProviders(ctx, newSM))
+}
+
+func TestImportDeploymentReader(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, json.NewEncoder(&buf).Encode(deployment))
+	require.NoError(t, b.ImportDeploymentReader(ctx, stk, &buf))
+
+	got, err := b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+	assert.Equal(t, apitype.DeploymentSchemaVersionCurrent, got.Version)
+	assert.Contains(t, string(got.Deployment), "a:b:c")
+
+	t.Run("too new", func(t *testing.T) {
+		t.Parallel()
+
+		r := strings.NewReader(fmt.Sprintf(`{"version": %d, "deployment": {}}`,
+			apitype.DeploymentSchemaVersionCurrent+1))
+		err := b.ImportDeploymentReader(ctx, stk, r)
+		assert.ErrorIs(t, err, stack.ErrDeploymentSchemaVersionTooNew)
+	})
+
+	t.Run("too old", func(t *testing.T) {
+		t.Parallel()
+
+		err := b.ImportDeploymentReader(ctx, stk, strings.NewReader(`{"deployment": {}}`))
+		assert.ErrorIs(t, err, stack.ErrDeploymentSchemaVersionTooOld)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		t.Parallel()
+
+		err := b.ImportDeploymentReader(ctx, stk, strings.NewReader(`{"version":`))
+		assert.ErrorContains(t, err, "decoding deployment")
+	})
+}
+
+//nolint:paralleltest // mutates environment variables
+func TestNew_s3CompatibleEndpoint(t *testing.T) {
+	// Don't pick up credentials or configuration from the host.
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_REGION", "")
+
+	var (
+		mu       sync.Mutex
+		requests []*http.Request
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r)
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	endpoint := strings.TrimPrefix(server.URL, "http://")
+	u := fmt.Sprintf("s3://test-bucket?endpoint=%s&disableSSL=true&s3ForcePathStyle=true", endpoint)
+
+	// The fake endpoint doesn't implement S3, so we only care that requests reached it.
+	_, _ = New(context.Background(), diagtest.LogSink(t), u, nil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, requests, "no requests reached the fake endpoint")
+	for _, r := range requests {
+		// s3ForcePathStyle puts the bucket name in the path instead of the host.
+		assert.Equal(t, endpoint, r.Host)
+		assert.True(t, strings.HasPrefix(r.URL.Path, "/test-bucket"), "unexpected path %q", r.URL.Path)
+		// The default region is used to sign requests.
+		assert.Contains(t, r.Header.Get("Authorization"), "/us-east-1/s3/")
+	}
+}
+
+func TestNew_s3CompatibleEndpoint_badParam(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(context.Background(), diagtest.LogSink(t),
+		"s3://test-bucket?endpoint=localhost:9000&disableSSL=maybe", nil)
+	assert.ErrorContains(t, err, `invalid value for query parameter "disableSSL"`)
+}
+
+func TestStackTags(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+	assert.True(t, b.SupportsTags())
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	assert.Empty(t, stk.Tags())
+
+	tags := map[apitype.StackTagName]string{"owner": "platform", "env": "dev"}
+	require.NoError(t, b.UpdateStackTags(ctx, stk, tags))
+	assert.Equal(t, tags, stk.Tags())
+	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "foo.tags"))
+
+	// The tags file must not be mistaken for a stack.
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	assert.Len(t, stacks, 1)
+
+	stk, err = b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	assert.Equal(t, tags, stk.Tags())
+
+	// Renaming the stack moves its tags.
+	newRef, err := b.RenameStack(ctx, stk, "bar")
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "foo.tags"))
+	stk, err = b.GetStack(ctx, newRef)
+	require.NoError(t, err)
+	assert.Equal(t, tags, stk.Tags())
+
+	// Removing the stack removes its tags.
+	_, err = b.RemoveStack(ctx, stk, false /* force */)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "testproj", "bar.tags"))
+}
+
+func TestVerifyAll(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	createStack := func(name string) backend.Stack {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		stk, err := b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+		return stk
+	}
+
+	createStack("good")
+
+	// Import doesn't verify the deployment.
+	require.NoError(t, b.ImportDeployment(ctx, createStack("bad"), &apitype.UntypedDeployment{
+		Version: 3,
+		Deployment: json.RawMessage(`{
+			"resources": [
+				{
+					"urn": "urn:pulumi:stack::proj::type::name1",
+					"type": "type",
+					"parent": "urn:pulumi:stack::proj::type::name2"
+				},
+				{
+					"urn": "urn:pulumi:stack::proj::type::name2",
+					"type": "type"
+				}
+			]
+		}`),
+	}))
+
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+	require.NoError(t, os.WriteFile(filepath.Join(stacksDir, "corrupt.json"), []byte("not json"), 0o600))
+
+	// A removed stack leaves a backup behind; add a lock file for it too.
+	_, err = b.RemoveStack(ctx, createStack("gone"), false /* force */)
+	require.NoError(t, err)
+	lockFile := filepath.Join(stateDir, ".pulumi", "locks", "organization", "testproj", "gone", "abc.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(lockFile), 0o755))
+	require.NoError(t, os.WriteFile(lockFile, []byte("{}"), 0o600))
+
+	results, err := b.VerifyAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	bad := results[0]
+	assert.Equal(t, "organization/testproj/bad", bad.Stack.String())
+	assert.True(t, bad.Deserialized)
+	assert.NoError(t, bad.LoadErr)
+	assert.ErrorContains(t, bad.IntegrityErr, "comes after it")
+	assert.False(t, bad.OK())
+
+	corrupt := results[1]
+	assert.Equal(t, "organization/testproj/corrupt", corrupt.Stack.String())
+	assert.False(t, corrupt.Deserialized)
+	assert.Error(t, corrupt.LoadErr)
+	assert.False(t, corrupt.OK())
+
+	gone := results[2]
+	assert.Equal(t, "organization/testproj/gone", gone.Stack.String())
+	assert.False(t, gone.Deserialized)
+	assert.True(t, gone.Orphaned)
+	assert.NoError(t, gone.LoadErr)
+	assert.True(t, gone.OK())
+	assert.ElementsMatch(t, []string{
+		".pulumi/locks/organization/testproj/gone/abc.json",
+		".pulumi/stacks/testproj/gone.json.bak",
+	}, gone.DanglingFiles)
+
+	good := results[3]
+	assert.Equal(t, "organization/testproj/good", good.Stack.String())
+	assert.True(t, good.Deserialized)
+	assert.True(t, good.OK())
+	assert.Empty(t, good.DanglingFiles)
+}
+
+func TestCurrentUser_organizations(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()), nil, nil)
+		require.NoError(t, err)
+
+		_, orgs, _, err := b.CurrentUser()
+		require.NoError(t, err)
+		assert.Nil(t, orgs)
+		assert.False(t, b.SupportsOrganizations())
+
+		_, err = b.ParseStackReference("acme/proj/foo")
+		assert.ErrorContains(t, err, "organization name must be 'organization'")
+	})
+
+	t.Run("bucket file", func(t *testing.T) {
+		t.Parallel()
+
+		stateDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(stateDir, ".pulumi"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(stateDir, ".pulumi", "organizations.json"),
+			[]byte(`["acme", "globex"]`), 0o600))
+
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil, nil)
+		require.NoError(t, err)
+
+		_, orgs, _, err := b.CurrentUser()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"acme", "globex"}, orgs)
+		assert.True(t, b.SupportsOrganizations())
+
+		ref, err := b.ParseStackReference("acme/proj/foo")
+		require.NoError(t, err)
+		assert.Equal(t, tokens.QName("organization/proj/foo"), ref.FullyQualifiedName())
+	})
+
+	t.Run("env var", func(t *testing.T) {
+		t.Parallel()
+
+		stateDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(stateDir, ".pulumi"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(stateDir, ".pulumi", "organizations.json"),
+			[]byte(`["acme"]`), 0o600))
+
+		// The environment variable takes precedence over the bucket.
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+			&localBackendOptions{Env: env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_ORGS": "initech, hooli",
+			})})
+		require.NoError(t, err)
+
+		_, orgs, _, err := b.CurrentUser()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"initech", "hooli"}, orgs)
+
+		_, err = b.ParseStackReference("hooli/proj/foo")
+		assert.NoError(t, err)
+		_, err = b.ParseStackReference("acme/proj/foo")
+		assert.ErrorContains(t, err, "one of: initech, hooli")
+	})
+}
+
+func TestOrgDirs(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+		&workspace.Project{Name: "proj"},
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_ORGS":     "acme,globex",
+			"PULUMI_SELF_MANAGED_ORG_DIRS": "true",
+		})})
+	require.NoError(t, err)
+
+	for _, name := range []string{"organization/proj/dev", "acme/proj/dev", "globex/proj/dev"} {
+		ref, err := b.ParseStackReference(name)
+		require.NoError(t, err)
+		assert.Equal(t, tokens.QName(name), ref.FullyQualifiedName())
+		_, err = b.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err, "create %v", name)
+	}
+
+	// Each organization has a directory of its own.
+	assert.FileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "proj", "dev.json"))
+	assert.FileExists(t, filepath.Join(stateDir, "acme", ".pulumi", "stacks", "proj", "dev.json"))
+	assert.FileExists(t, filepath.Join(stateDir, "globex", ".pulumi", "stacks", "proj", "dev.json"))
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	var names []string
+	for _, stack := range stacks {
+		names = append(names, stack.Name().FullyQualifiedName().String())
+	}
+	assert.ElementsMatch(t, []string{"organization/proj/dev", "acme/proj/dev", "globex/proj/dev"}, names)
+
+	projects, err := b.ListProjects(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.Name{"proj"}, projects)
+
+	// Stacks of other organizations are never abbreviated.
+	acmeRef, err := b.ParseStackReference("acme/proj/dev")
+	require.NoError(t, err)
+	assert.Equal(t, "acme/proj/dev", acmeRef.String())
+
+	// Renaming to a bare name keeps the organization.
+	acme, err := b.GetStack(ctx, acmeRef)
+	require.NoError(t, err)
+	require.NotNil(t, acme)
+	newRef, err := b.RenameStack(ctx, acme, "prod")
+	require.NoError(t, err)
+	assert.Equal(t, tokens.QName("acme/proj/prod"), newRef.FullyQualifiedName())
+	assert.FileExists(t, filepath.Join(stateDir, "acme", ".pulumi", "stacks", "proj", "prod.json"))
+	assert.NoFileExists(t, filepath.Join(stateDir, ".pulumi", "stacks", "proj", "prod.json"))
+}
+
+func TestOrgDirs_invalidOrganization(t *testing.T) {
+	t.Parallel()
+
+	_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+		"file://"+filepath.ToSlash(t.TempDir()), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_ORGS":     ".pulumi",
+			"PULUMI_SELF_MANAGED_ORG_DIRS": "true",
+		})})
+	assert.ErrorContains(t, err, `invalid organization name ".pulumi"`)
+}
+
+// fakeClock is a Clock that tells a fixed time until it's moved.
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+	clock := &fakeClock{now: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Clock: clock})
+	require.NoError(t, err)
+
+	ref, err := b.parseStackReference("dev")
+	require.NoError(t, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	// History records are named after the time of the clock.
+	require.NoError(t, b.addToHistory(ctx, ref, backend.UpdateInfo{Kind: apitype.UpdateUpdate}))
+	historyFiles, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	require.NoError(t, err)
+	require.NotEmpty(t, historyFiles)
+	for _, file := range historyFiles {
+		assert.Contains(t, file.Key, fmt.Sprintf("dev-%d.", clock.now.UnixNano()))
+	}
+
+	// So is the lock.
+	require.NoError(t, b.Lock(ctx, ref))
+	content, err := b.bucket.ReadAll(ctx, b.lockPath(ref))
+	require.NoError(t, err)
+	var lock lockContent
+	require.NoError(t, json.Unmarshal(content, &lock))
+	assert.True(t, clock.now.Equal(lock.Timestamp), "lock taken at %v, want %v", lock.Timestamp, clock.now)
+
+	// Once the clock passes the TTL, another backend considers the lock stale.
+	other, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{
+			Env: env.NewEnv(env.MapStore{
+				"PULUMI_SELF_MANAGED_STATE_LOCK_TTL": "1h",
+			}),
+			Clock: clock,
+		})
+	require.NoError(t, err)
+	assert.Error(t, other.checkForLock(ctx, ref))
+
+	clock.now = clock.now.Add(2 * time.Hour)
+	require.NoError(t, other.Lock(ctx, ref))
+	other.Unlock(ctx, ref)
+}
+
+func TestStateEncoding_yaml(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_ENCODING": "yaml",
+		})})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	cfg := config.Map{config.MustMakeKey("testproj", "region"): config.NewValue("us-west-2")}
+	stk, err := b.CreateStack(ctx, ref, "", &backend.CreateStackOptions{Config: cfg})
+	require.NoError(t, err)
+
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	// The checkpoint is written as YAML, and nothing is left behind in JSON.
+	assert.FileExists(t, filepath.Join(stacksDir, "foo.yaml"))
+	assert.NoFileExists(t, filepath.Join(stacksDir, "foo.json"))
+	data, err := os.ReadFile(filepath.Join(stacksDir, "foo.yaml"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "version: 3\n")
+
+	got, err := b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(deployment.Deployment), string(got.Deployment))
+
+	localRef, err := b.getReference(ref)
+	require.NoError(t, err)
+	require.NoError(t, b.addToHistory(ctx, localRef, backend.UpdateInfo{Kind: apitype.UpdateUpdate, Config: cfg}))
+	history, err := b.GetHistory(ctx, ref, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, cfg, history[0].Config)
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+	require.NotNil(t, stacks[0].ResourceCount())
+	assert.Equal(t, 1, *stacks[0].ResourceCount())
+
+	// A backend configured for JSON still reads the YAML checkpoint,
+	// and switches it over to JSON on the next write.
+	b, err = newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project, nil)
+	require.NoError(t, err)
+	stk, err = b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	got, err = b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(deployment.Deployment), string(got.Deployment))
+
+	require.NoError(t, b.ImportDeployment(ctx, stk, got))
+	assert.FileExists(t, filepath.Join(stacksDir, "foo.json"))
+	assert.NoFileExists(t, filepath.Join(stacksDir, "foo.yaml"))
+}
+
+func TestStateEncoding_yml(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	stacksDir := filepath.Join(stateDir, ".pulumi", "stacks", "testproj")
+	ctx := context.Background()
+	project := &workspace.Project{Name: "testproj"}
+
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), project,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_ENCODING": "yaml",
+		})})
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeployment("foo", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	// Checkpoints written by other tools may use the .yml extension.
+	for _, ext := range []string{"", ChecksumExt} {
+		require.NoError(t, os.Rename(
+			filepath.Join(stacksDir, "foo.yaml"+ext),
+			filepath.Join(stacksDir, "foo.yml"+ext)))
+	}
+
+	stacks, _, err := b.ListStacks(ctx, backend.ListStacksFilter{}, nil /* inContToken */)
+	require.NoError(t, err)
+	require.Len(t, stacks, 1)
+
+	stk, err = b.GetStack(ctx, ref)
+	require.NoError(t, err)
+	require.NotNil(t, stk)
+	got, err := b.ExportDeployment(ctx, stk)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(deployment.Deployment), string(got.Deployment))
+
+	_, err = b.RemoveStack(ctx, stk, true /* force */)
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(stacksDir, "foo.yml"))
+}
+
+func TestStateEncoding_invalid(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+	_, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil,
+		&localBackendOptions{Env: env.NewEnv(env.MapStore{
+			"PULUMI_SELF_MANAGED_STATE_ENCODING": "toml",
+		})})
+	assert.ErrorContains(t, err, `unsupported value for PULUMI_SELF_MANAGED_STATE_ENCODING: "toml"`)
+}
+
+func TestGetCheckpoint_strict(t *testing.T) {
+	t.Parallel()
+
+	stateDir := t.TempDir()
+	ctx := context.Background()
+
+	newBackend := func(strict bool) *localBackend {
+		s := make(env.MapStore)
+		s[env.SelfManagedSkipChecksumVerification.Var().Name()] = "true"
+		if strict {
+			s[env.SelfManagedStrictCheckpoint.Var().Name()] = "true"
+		}
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir),
+			&workspace.Project{Name: "testproj"}, &localBackendOptions{Env: env.NewEnv(s)})
+		require.NoError(t, err)
+		return b
+	}
+	b := newBackend(true)
+
+	ref, err := b.parseStackReference("foo")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+	deployment, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, deployment))
+
+	// Checkpoints written by this version are accepted.
+	_, err = b.getCheckpoint(ctx, ref)
+	require.NoError(t, err)
+
+	// Add a field to the deployment, as a newer version might.
+	chkpath := b.stackPath(ctx, ref)
+	data, err := b.bucket.ReadAll(ctx, chkpath)
+	require.NoError(t, err)
+	var chk map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &chk))
+	checkpoint := chk["checkpoint"].(map[string]interface{})
+	checkpoint["latest"].(map[string]interface{})["futureField"] = true
+	data, err = json.Marshal(chk)
+	require.NoError(t, err)
+	require.NoError(t, b.bucket.WriteAll(ctx, chkpath, data, nil))
+
+	_, err = b.getCheckpoint(ctx, ref)
+	require.Error(t, err)
+	assert.ErrorContains(t, err, `unknown field "futureField"`)
+	assert.ErrorContains(t, err, "upgrade")
+
+	// By default, unknown fields are ignored.
+	_, err = newBackend(false).getCheckpoint(ctx, ref)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,374 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/edit"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// Layout of a stack backup archive:
+//
+//	checkpoint.json|yaml[.gz|.zst]  the current checkpoint of the stack
+//	stack.tags|secrets|config       the tags, secrets provider and initial configuration of the stack, if any
+//	history/*                       the contents of the stack's history directory
+const (
+	backupCheckpointName = "checkpoint"
+	backupHistoryDir     = "history"
+)
+
+// backupSidecars are the files stored next to the checkpoint of a stack that are included in its backups.
+var backupSidecars = []struct {
+	name string
+	path func(*localBackendReference) string
+}{
+	{"stack" + TagsExt, stackTagsPath},
+	{"stack" + SecretsProviderExt, stackSecretsProviderPath},
+	{"stack" + InitialConfigExt, stackInitialConfigPath},
+}
+
+// backupFile is a single file inside a stack backup archive.
+type backupFile struct {
+	name string
+	data []byte
+}
+
+func (b *localBackend) Backup(ctx context.Context, stackRef backend.StackReference, w io.Writer) error {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lock(ctx, ref)
+	if err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, ref)
+
+	chkpath, err := b.stackExists(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	checkpoint, err := b.bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		return fmt.Errorf("reading checkpoint: %w", err)
+	}
+	files := []backupFile{{
+		// Retain the extensions of the checkpoint so that Restore can write it back as-is.
+		name: backupCheckpointName + strings.TrimPrefix(chkpath, trimStateMarkupExt(chkpath)),
+		data: checkpoint,
+	}}
+
+	for _, sidecar := range backupSidecars {
+		data, err := b.bucket.ReadAll(ctx, sidecar.path(ref))
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			return fmt.Errorf("reading %s: %w", sidecar.name, err)
+		}
+		files = append(files, backupFile{name: sidecar.name, data: data})
+	}
+
+	historyFiles, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return fmt.Errorf("listing history: %w", err)
+	}
+	for _, file := range historyFiles {
+		if file.IsDir {
+			continue
+		}
+		data, err := b.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			return fmt.Errorf("reading history file %s: %w", file.Key, err)
+		}
+		files = append(files, backupFile{
+			name: path.Join(backupHistoryDir, objectName(file)),
+			data: data,
+		})
+	}
+
+	modTime := b.clock.Now()
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0o600,
+			Size:     int64(len(file.data)),
+			ModTime:  modTime,
+		})
+		if err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	return nil
+}
+
+func (b *localBackend) Restore(
+	ctx context.Context, stackRef backend.StackReference, r io.Reader, force bool,
+) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	// Read the entire archive before touching the bucket
+	// so that a malformed archive doesn't leave a partially restored stack behind.
+	var (
+		checkpoint *backupFile
+		sidecars   = make(map[string][]byte)
+		history    []backupFile
+	)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("reading backup: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		switch {
+		case stateMarshaler(name) != nil && trimStateMarkupExt(name) == backupCheckpointName:
+			checkpoint = &backupFile{name: name, data: data}
+		case isBackupSidecar(name):
+			sidecars[name] = data
+		case path.Dir(name) == backupHistoryDir:
+			history = append(history, backupFile{name: path.Base(name), data: data})
+		default:
+			return fmt.Errorf("unexpected file in backup: %q", hdr.Name)
+		}
+	}
+	if checkpoint == nil {
+		return errors.New("backup does not contain a checkpoint")
+	}
+	checkpointData, err := b.retargetCheckpoint(ctx, ref, *checkpoint)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lock(ctx, ref)
+	if err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, ref)
+
+	// If the stack already exists, keep its objects around
+	// so that they can be put back if the restore fails,
+	// and only remove the ones that weren't replaced once it succeeded.
+	var (
+		oldChkpath string
+		oldObjects map[string][]byte
+	)
+	if chkpath, err := b.stackExists(ctx, ref); err == nil {
+		if !force {
+			return &backend.StackAlreadyExistsError{StackName: string(ref.FullyQualifiedName())}
+		}
+		oldChkpath = chkpath
+		oldObjects, err = b.readStackObjects(ctx, ref, chkpath)
+		if err != nil {
+			return fmt.Errorf("reading existing stack: %w", err)
+		}
+		b.backupTarget(ctx, chkpath, true /* keepOriginal */)
+	} else if !errors.Is(err, errCheckpointNotFound) {
+		return err
+	}
+
+	// Write out the history first and the checkpoint last:
+	// the stack only exists once its checkpoint does.
+	// If anything fails along the way, undo everything we wrote.
+	var written []string
+	write := func(key string, data []byte) error {
+		if err := b.bucket.WriteAll(ctx, key, data, nil); err != nil {
+			for _, key := range written {
+				if data, ok := oldObjects[key]; ok {
+					if err := b.bucket.WriteAll(ctx, key, data, nil); err != nil {
+						logging.V(5).Infof("error putting back replaced object: %v (%v) skipping", key, err)
+					}
+				} else if err := b.bucket.Delete(ctx, key); err != nil {
+					logging.V(5).Infof("error deleting restored object: %v (%v) skipping", key, err)
+				}
+			}
+			return fmt.Errorf("restoring %s: %w", key, err)
+		}
+		written = append(written, key)
+		return nil
+	}
+
+	historyDir := ref.HistoryDir()
+	for _, file := range history {
+		// The filename format is <stack-name>-<timestamp>.[checkpoint|history].json[.gz],
+		// so retarget the stack name part in case we're restoring under a different name.
+		fileName := file.name
+		if dashIndex := strings.LastIndex(fileName, "-"); dashIndex != -1 {
+			fileName = ref.name.String() + fileName[dashIndex:]
+		}
+		if err := write(path.Join(historyDir, fileName), file.data); err != nil {
+			return err
+		}
+	}
+
+	for _, sidecar := range backupSidecars {
+		if data, ok := sidecars[sidecar.name]; ok {
+			if err := write(sidecar.path(ref), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	exts := strings.TrimPrefix(checkpoint.name, backupCheckpointName)
+	chkpath := filepath.ToSlash(ref.StackBasePath()) + exts
+	if err := write(checksumPath(chkpath), checksum(checkpointData)); err != nil {
+		return err
+	}
+	if err := write(chkpath, checkpointData); err != nil {
+		return err
+	}
+
+	if oldChkpath == "" {
+		return nil
+	}
+	replaced := make(map[string]bool, len(written))
+	for _, key := range written {
+		replaced[key] = true
+	}
+	for key := range oldObjects {
+		if replaced[key] {
+			continue
+		}
+		if err := b.bucket.Delete(ctx, key); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error deleting object of replaced stack: %v (%v) skipping", key, err)
+		}
+	}
+	return nil
+}
+
+func isBackupSidecar(name string) bool {
+	for _, sidecar := range backupSidecars {
+		if name == sidecar.name {
+			return true
+		}
+	}
+	return false
+}
+
+// retargetCheckpoint returns the checkpoint of a backup as it should be restored for the given stack.
+// The checkpoint names the stack it was taken from, so restoring it under another name or project
+// renames the stack in it the way RenameStack does, keeping the format of the checkpoint.
+func (b *localBackend) retargetCheckpoint(
+	ctx context.Context, ref *localBackendReference, file backupFile,
+) ([]byte, error) {
+	m := compressionForFile(file.name, file.data).Wrap(stateMarshaler(file.name))
+	chk, err := stack.UnmarshalVersionedCheckpointToLatestCheckpoint(m, file.data)
+	if err != nil {
+		return nil, fmt.Errorf("reading backup checkpoint: %w", err)
+	}
+	if chk.Stack == ref.FullyQualifiedName() {
+		return file.data, nil
+	}
+
+	snap, err := stack.DeserializeCheckpoint(ctx, stack.DefaultSecretsProvider, chk)
+	if err != nil {
+		return nil, fmt.Errorf("reading backup checkpoint: %w", err)
+	}
+	if snap != nil {
+		project, _ := ref.Project()
+		if err := edit.RenameStack(snap, ref.name, tokens.PackageName(project)); err != nil {
+			return nil, err
+		}
+	}
+
+	// We pass nil to re-use the existing secrets manager from the snapshot.
+	versioned, err := stack.SerializeCheckpoint(ref.FullyQualifiedName(), snap, nil, false /* showSecrets */)
+	if err != nil {
+		return nil, fmt.Errorf("serializing checkpoint: %w", err)
+	}
+	return m.Marshal(versioned)
+}
+
+// readStackObjects reads the checkpoint of the given stack, its checksum, its sidecar files and its history
+// into memory, keyed by their paths in the bucket.
+func (b *localBackend) readStackObjects(
+	ctx context.Context, ref *localBackendReference, chkpath string,
+) (map[string][]byte, error) {
+	keys := []string{chkpath, checksumPath(chkpath)}
+	for _, sidecar := range backupSidecars {
+		keys = append(keys, sidecar.path(ref))
+	}
+
+	objects := make(map[string][]byte)
+	for _, key := range keys {
+		data, err := b.bucket.ReadAll(ctx, key)
+		if err != nil {
+			if key != chkpath && gcerrors.Code(err) == gcerrors.NotFound {
+				continue
+			}
+			return nil, err
+		}
+		objects[key] = data
+	}
+
+	historyFiles, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		return nil, fmt.Errorf("listing history: %w", err)
+	}
+	for _, file := range historyFiles {
+		if file.IsDir {
+			continue
+		}
+		data, err := b.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			return nil, fmt.Errorf("reading history file %s: %w", file.Key, err)
+		}
+		objects[file.Key] = data
+	}
+	return objects, nil
+}
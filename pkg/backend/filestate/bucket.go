@@ -4,16 +4,30 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 
+	"github.com/opentracing/opentracing-go"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"gocloud.dev/blob"
+	"gocloud.dev/blob/azureblob"
+	"gocloud.dev/blob/fileblob"
+	"gocloud.dev/blob/gcsblob"
+	"gocloud.dev/blob/s3blob"
 )
 
 // Bucket is a wrapper around an underlying gocloud blob.Bucket.  It ensures that we pass all paths
 // to it normalized to forward-slash form like it requires.
+//
+// Whether WriteAll and Copy are atomic depends on the driver.
+// The S3, GCS, and Azure drivers only make an object visible once it's been fully uploaded,
+// and the file driver writes to a temporary file and renames it into place.
+// Other drivers (and some S3-compatible stores) may expose partially written objects to readers,
+// so on those, checkpoints are written with writeAtomic, which never writes to the destination key directly.
+// See hasAtomicWrites.
 type Bucket interface {
 	Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) (err error)
 	Delete(ctx context.Context, key string) (err error)
@@ -22,44 +36,192 @@ type Bucket interface {
 	ReadAll(ctx context.Context, key string) (_ []byte, err error)
 	WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) (err error)
 	Exists(ctx context.Context, key string) (bool, error)
+	Attributes(ctx context.Context, key string) (*blob.Attributes, error)
 }
 
 // wrappedBucket encapsulates a true gocloud blob.Bucket, but ensures that all paths we send to it
 // are appropriately normalized to use forward slashes as required by it.  Without this, we may use
 // filepath.join which can make paths like `c:\temp\etc`.  gocloud's fileblob then converts those
 // backslashes to the hex string __0x5c__, breaking things on windows completely.
+//
+// Every operation is also counted in stats, and traced with a span named after it.
+// Errors are wrapped with the name of the operation and the key it was for; see bucketError.
 type wrappedBucket struct {
 	bucket *blob.Bucket
+	stats  *bucketStats
 }
 
 func (b *wrappedBucket) Copy(ctx context.Context, dstKey, srcKey string, opts *blob.CopyOptions) (err error) {
-	return b.bucket.Copy(ctx, filepath.ToSlash(dstKey), filepath.ToSlash(srcKey), opts)
+	span, ctx := startBucketSpan(ctx, "Copy", dstKey)
+	defer span.Finish()
+	span.SetTag("srcKey", srcKey)
+
+	b.stats.copies.Add(1)
+	return bucketError("Copy", dstKey, b.bucket.Copy(ctx, filepath.ToSlash(dstKey), filepath.ToSlash(srcKey), opts))
 }
 
 func (b *wrappedBucket) Delete(ctx context.Context, key string) (err error) {
-	return b.bucket.Delete(ctx, filepath.ToSlash(key))
+	span, ctx := startBucketSpan(ctx, "Delete", key)
+	defer span.Finish()
+
+	b.stats.deletes.Add(1)
+	return bucketError("Delete", key, b.bucket.Delete(ctx, filepath.ToSlash(key)))
 }
 
 func (b *wrappedBucket) List(opts *blob.ListOptions) *blob.ListIterator {
+	// List doesn't take a context, so it can't be traced.
+	// Each call counts once, regardless of the number of pages it fetches.
+	// Its errors are returned by the iterator, so they're wrapped by the callers of Next instead.
+	b.stats.lists.Add(1)
+
 	optsCopy := *opts
 	optsCopy.Prefix = filepath.ToSlash(opts.Prefix)
 	return b.bucket.List(&optsCopy)
 }
 
 func (b *wrappedBucket) SignedURL(ctx context.Context, key string, opts *blob.SignedURLOptions) (string, error) {
-	return b.bucket.SignedURL(ctx, filepath.ToSlash(key), opts)
+	span, ctx := startBucketSpan(ctx, "SignedURL", key)
+	defer span.Finish()
+
+	b.stats.signedURLs.Add(1)
+	url, err := b.bucket.SignedURL(ctx, filepath.ToSlash(key), opts)
+	return url, bucketError("SignedURL", key, err)
 }
 
 func (b *wrappedBucket) ReadAll(ctx context.Context, key string) (_ []byte, err error) {
-	return b.bucket.ReadAll(ctx, filepath.ToSlash(key))
+	span, ctx := startBucketSpan(ctx, "ReadAll", key)
+	defer span.Finish()
+
+	b.stats.reads.Add(1)
+	data, err := b.bucket.ReadAll(ctx, filepath.ToSlash(key))
+	b.stats.bytesRead.Add(int64(len(data)))
+	span.SetTag("bytes", len(data))
+	return data, bucketError("ReadAll", key, err)
 }
 
 func (b *wrappedBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) (err error) {
-	return b.bucket.WriteAll(ctx, filepath.ToSlash(key), p, opts)
+	span, ctx := startBucketSpan(ctx, "WriteAll", key)
+	defer span.Finish()
+	span.SetTag("bytes", len(p))
+
+	b.stats.writes.Add(1)
+	if err := b.bucket.WriteAll(ctx, filepath.ToSlash(key), p, opts); err != nil {
+		return bucketError("WriteAll", key, err)
+	}
+	b.stats.bytesWritten.Add(int64(len(p)))
+	return nil
 }
 
 func (b *wrappedBucket) Exists(ctx context.Context, key string) (bool, error) {
-	return b.bucket.Exists(ctx, filepath.ToSlash(key))
+	span, ctx := startBucketSpan(ctx, "Exists", key)
+	defer span.Finish()
+
+	b.stats.exists.Add(1)
+	exists, err := b.bucket.Exists(ctx, filepath.ToSlash(key))
+	return exists, bucketError("Exists", key, err)
+}
+
+func (b *wrappedBucket) Attributes(ctx context.Context, key string) (*blob.Attributes, error) {
+	span, ctx := startBucketSpan(ctx, "Attributes", key)
+	defer span.Finish()
+
+	b.stats.attributes.Add(1)
+	attrs, err := b.bucket.Attributes(ctx, filepath.ToSlash(key))
+	return attrs, bucketError("Attributes", key, err)
+}
+
+// bucketError wraps an error returned by a bucket operation on the given key,
+// e.g. `filestate: WriteAll "proj/dev.json": ...`, so that failures can be traced back to the object.
+// The error is wrapped with %w, so gcerrors.Code still reports the code of the original error.
+// It returns nil if err is nil.
+func bucketError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("filestate: %s %q: %w", op, filepath.ToSlash(key), err)
+}
+
+// startBucketSpan starts a tracing span for a bucket operation on the given key.
+func startBucketSpan(ctx context.Context, op, key string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "filestate."+op)
+	span.SetTag("key", filepath.ToSlash(key))
+	return span, ctx
+}
+
+// BucketStats counts the operations made against the bucket of a self-managed backend.
+type BucketStats struct {
+	Reads      int64 // number of ReadAll calls
+	Writes     int64 // number of WriteAll calls
+	Lists      int64 // number of List calls
+	Exists     int64 // number of Exists calls
+	Deletes    int64 // number of Delete calls
+	Copies     int64 // number of Copy calls
+	SignedURLs int64 // number of SignedURL calls
+	Attributes int64 // number of Attributes calls
+
+	BytesRead    int64 // total bytes returned by ReadAll
+	BytesWritten int64 // total bytes written successfully by WriteAll
+}
+
+// bucketStats holds the counters behind BucketStats.
+// It's safe for concurrent use.
+type bucketStats struct {
+	reads, writes, lists, exists, deletes, copies, signedURLs, attributes atomic.Int64
+	bytesRead, bytesWritten                                               atomic.Int64
+}
+
+func (s *bucketStats) snapshot() BucketStats {
+	return BucketStats{
+		Reads:        s.reads.Load(),
+		Writes:       s.writes.Load(),
+		Lists:        s.lists.Load(),
+		Exists:       s.exists.Load(),
+		Deletes:      s.deletes.Load(),
+		Copies:       s.copies.Load(),
+		SignedURLs:   s.signedURLs.Load(),
+		Attributes:   s.attributes.Load(),
+		BytesRead:    s.bytesRead.Load(),
+		BytesWritten: s.bytesWritten.Load(),
+	}
+}
+
+// hasAtomicWrites reports whether the driver of the bucket at the given URL writes objects atomically,
+// as described on Bucket.
+func hasAtomicWrites(u *url.URL) bool {
+	switch u.Scheme {
+	case fileblob.Scheme, gcsblob.Scheme, azureblob.Scheme:
+		return true
+	case s3blob.Scheme:
+		return !isS3CompatibleURL(u)
+	default:
+		return false
+	}
+}
+
+// writeAtomic writes data to the given key
+// such that concurrent readers see either the old or the new contents, never a partial write.
+//
+// Buckets that write atomically already guarantee this, so the data is written directly.
+// Otherwise, the data is first written to a temporary key next to the destination,
+// and then copied over the destination.
+// The temporary key doesn't have a valid stack file extension,
+// so it's never mistaken for a stack if it's left behind.
+func (b *localBackend) writeAtomic(ctx context.Context, key string, data []byte) error {
+	if b.atomicWrites {
+		return b.bucket.WriteAll(ctx, key, data, nil)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", key, b.clock.Now().UnixNano())
+	if err := b.bucket.WriteAll(ctx, tmp, data, nil); err != nil {
+		return err
+	}
+	defer func() {
+		if err := b.bucket.Delete(ctx, tmp); err != nil {
+			logging.V(5).Infof("error deleting temporary file %v: %v skipping", tmp, err)
+		}
+	}()
+
+	return b.bucket.Copy(ctx, key, tmp, nil)
 }
 
 // listBucket returns a list of all files in the bucket within a given directory. go-cloud sorts the results by key
@@ -72,12 +234,16 @@ func listBucket(ctx context.Context, bucket Bucket, dir string) ([]*blob.ListObj
 	files := []*blob.ListObject{}
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		file, err := bucketIter.Next(ctx)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("could not list bucket: %w", err)
+			return nil, bucketError("List", dir+"/", err)
 		}
 		files = append(files, file)
 	}
@@ -85,6 +251,33 @@ func listBucket(ctx context.Context, bucket Bucket, dir string) ([]*blob.ListObj
 	return files, nil
 }
 
+// listBucketRecursive returns a list of all files under the given directory
+// of the bucket, including files in nested directories.
+func listBucketRecursive(ctx context.Context, bucket Bucket, dir string) ([]*blob.ListObject, error) {
+	bucketIter := bucket.List(&blob.ListOptions{
+		Prefix: dir + "/",
+	})
+
+	var files []*blob.ListObject
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		file, err := bucketIter.Next(ctx)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, bucketError("List", dir+"/", err)
+		}
+		if !file.IsDir {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
 // objectName returns the filename of a ListObject (an object from a bucket).
 func objectName(obj *blob.ListObject) string {
 	// If obj.Key ends in "/" we want to trim that to get the name just before
@@ -3,12 +3,17 @@ package filestate
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"gocloud.dev/blob"
+	"gocloud.dev/blob/memblob"
+	"gocloud.dev/gcerrors"
 )
 
 func mustNotHaveError(t *testing.T, context string, err error) {
@@ -96,3 +101,106 @@ func TestWrappedBucket(t *testing.T) {
 		}
 	})
 }
+
+func TestWrappedBucket_errors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	bucket := &wrappedBucket{bucket: memblob.OpenBucket(nil), stats: &bucketStats{}}
+
+	_, err := bucket.ReadAll(ctx, filepath.Join("proj", "dev.json"))
+	assert.ErrorContains(t, err, `filestate: ReadAll "proj/dev.json": `)
+	// The code of the underlying error is preserved.
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+
+	err = bucket.Delete(ctx, "proj/dev.json")
+	assert.ErrorContains(t, err, `filestate: Delete "proj/dev.json": `)
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+
+	err = bucket.Copy(ctx, "proj/dev.json.bak", "proj/dev.json", nil)
+	assert.ErrorContains(t, err, `filestate: Copy "proj/dev.json.bak": `)
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+
+	// Successful operations don't return an error.
+	assert.NoError(t, bucket.WriteAll(ctx, "proj/dev.json", []byte("{}"), nil))
+	_, err = bucket.ReadAll(ctx, "proj/dev.json")
+	assert.NoError(t, err)
+}
+
+func TestHasAtomicWrites(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"file:///tmp/state", true},
+		{"gs://bucket", true},
+		{"azblob://container", true},
+		{"s3://bucket", true},
+		{"s3://bucket?endpoint=http://localhost:9000", false},
+		{"mem://", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.url, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, hasAtomicWrites(u))
+		})
+	}
+}
+
+// recordingBucket is a Bucket that records the keys written to it.
+type recordingBucket struct {
+	Bucket
+
+	writes []string
+}
+
+func (b *recordingBucket) WriteAll(ctx context.Context, key string, p []byte, opts *blob.WriterOptions) error {
+	b.writes = append(b.writes, key)
+	return b.Bucket.WriteAll(ctx, key, p, opts)
+}
+
+func TestWriteAtomic(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc         string
+		atomicWrites bool
+		wantWrites   []string
+	}{
+		{desc: "atomic", atomicWrites: true, wantWrites: []string{"proj/dev.json"}},
+		// The temporary key is named after the time of the backend's clock.
+		{desc: "not atomic", atomicWrites: false, wantWrites: []string{"proj/dev.json.tmp-42"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			bucket := &recordingBucket{
+				Bucket: &wrappedBucket{bucket: memblob.OpenBucket(nil), stats: &bucketStats{}},
+			}
+			b := &localBackend{
+				bucket:       bucket,
+				clock:        &fakeClock{now: time.Unix(0, 42)},
+				atomicWrites: tt.atomicWrites,
+			}
+
+			require.NoError(t, b.writeAtomic(ctx, "proj/dev.json", []byte("{}")))
+			assert.Equal(t, tt.wantWrites, bucket.writes)
+
+			data, err := bucket.ReadAll(ctx, "proj/dev.json")
+			require.NoError(t, err)
+			assert.Equal(t, "{}", string(data))
+			exists, err := bucket.Exists(ctx, "proj/dev.json.tmp-42")
+			require.NoError(t, err)
+			assert.False(t, exists, "the temporary key must be removed")
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// projectBundleManifestFile is the name of the manifest in a project bundle.
+//
+// A project bundle is a tar archive with the manifest
+// and the latest checkpoint of each stack of the project in "stacks/<name>.json".
+const projectBundleManifestFile = "manifest.json"
+
+// projectBundleVersion is the version of the bundle format written by ExportProject.
+const projectBundleVersion = 1
+
+// projectBundleManifest is the manifest of a project bundle.
+type projectBundleManifest struct {
+	Version int      `json:"version"`
+	Project string   `json:"project"`
+	Stacks  []string `json:"stacks"`
+}
+
+func projectBundleStackFile(name string) string {
+	return path.Join("stacks", name+".json")
+}
+
+func (b *localBackend) ExportProject(ctx context.Context, project tokens.Name, w io.Writer) error {
+	store, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		return errors.New("exporting a project requires a project-scoped state store; " +
+			"run 'pulumi state upgrade' first")
+	}
+
+	refs, err := store.ListProjectReferences(ctx, project)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("no stacks found in project %q", project)
+	}
+
+	tw := tar.NewWriter(w)
+	writeFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(data))}); err != nil {
+			return fmt.Errorf("write %v: %w", name, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("write %v: %w", name, err)
+		}
+		return nil
+	}
+
+	manifest := projectBundleManifest{
+		Version: projectBundleVersion,
+		Project: project.String(),
+		Stacks:  make([]string, 0, len(refs)),
+	}
+	for _, ref := range refs {
+		chk, err := b.getCheckpoint(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("load checkpoint of %v: %w", ref, err)
+		}
+		raw, err := json.Marshal(chk)
+		if err != nil {
+			return fmt.Errorf("marshal checkpoint of %v: %w", ref, err)
+		}
+		data, err := json.Marshal(apitype.VersionedCheckpoint{
+			Version:    apitype.DeploymentSchemaVersionCurrent,
+			Checkpoint: raw,
+		})
+		if err != nil {
+			return fmt.Errorf("marshal checkpoint of %v: %w", ref, err)
+		}
+
+		name := ref.name.String()
+		if err := writeFile(projectBundleStackFile(name), data); err != nil {
+			return err
+		}
+		manifest.Stacks = append(manifest.Stacks, name)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+	if err := writeFile(projectBundleManifestFile, data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (b *localBackend) ImportProject(ctx context.Context, r io.Reader) error {
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	store, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		return errors.New("importing a project requires a project-scoped state store; " +
+			"run 'pulumi state upgrade' first")
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read project bundle: %w", err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("read %v: %w", hdr.Name, err)
+		}
+		files[hdr.Name] = data
+	}
+
+	data, ok := files[projectBundleManifestFile]
+	if !ok {
+		return fmt.Errorf("project bundle has no %v", projectBundleManifestFile)
+	}
+	var manifest projectBundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	if manifest.Version != projectBundleVersion {
+		return fmt.Errorf("unsupported project bundle version %d", manifest.Version)
+	}
+	if !tokens.IsName(manifest.Project) {
+		return fmt.Errorf("invalid project name %q in project bundle", manifest.Project)
+	}
+	project := tokens.Name(manifest.Project)
+
+	// Check every stack before writing anything
+	// so that a bad bundle doesn't leave the project partially imported.
+	refs := make([]*localBackendReference, len(manifest.Stacks))
+	checkpoints := make([]*apitype.VersionedCheckpoint, len(manifest.Stacks))
+	for i, name := range manifest.Stacks {
+		stackName, err := tokens.ParseStackNameMaxLength(name, effectiveMaxNameLength(store.maxNameLength))
+		if err != nil {
+			return fmt.Errorf("invalid stack name %q in project bundle: %w", name, err)
+		}
+		refs[i] = store.newReference(project, stackName)
+
+		file := projectBundleStackFile(name)
+		data, ok := files[file]
+		if !ok {
+			return fmt.Errorf("project bundle has no %v", file)
+		}
+		var versioned apitype.VersionedCheckpoint
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return fmt.Errorf("unmarshal %v: %w", file, err)
+		}
+		if versioned.Version > apitype.DeploymentSchemaVersionCurrent {
+			return fmt.Errorf("checkpoint of %v has version %d, which is newer than this version of "+
+				"the Pulumi CLI understands (%d)", name, versioned.Version, apitype.DeploymentSchemaVersionCurrent)
+		}
+
+		// The checkpoint records the name of its stack,
+		// which may be qualified differently in this backend.
+		var chk apitype.CheckpointV3
+		if err := json.Unmarshal(versioned.Checkpoint, &chk); err != nil {
+			return fmt.Errorf("unmarshal %v: %w", file, err)
+		}
+		chk.Stack = refs[i].FullyQualifiedName()
+		raw, err := json.Marshal(chk)
+		if err != nil {
+			return fmt.Errorf("marshal checkpoint of %v: %w", name, err)
+		}
+		checkpoints[i] = &apitype.VersionedCheckpoint{Version: versioned.Version, Checkpoint: raw}
+
+		exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, refs[i]))
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("a stack named %s already exists", refs[i].String())
+		}
+	}
+
+	for i, ref := range refs {
+		if _, _, err := b.saveCheckpoint(ctx, ref, checkpoints[i]); err != nil {
+			for _, written := range refs[:i] {
+				b.removeCheckpoint(ctx, written)
+			}
+			return fmt.Errorf("import %v: %w", ref, err)
+		}
+	}
+	return nil
+}
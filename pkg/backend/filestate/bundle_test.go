@@ -0,0 +1,97 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+func TestExportImportProject(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	newBackend := func() *localBackend {
+		b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+			&workspace.Project{Name: "testproj"}, nil)
+		require.NoError(t, err)
+		return b
+	}
+
+	src := newBackend()
+	for _, name := range []string{"dev", "prod"} {
+		ref, err := src.parseStackReference(name)
+		require.NoError(t, err)
+		stk, err := src.CreateStack(ctx, ref, "", nil)
+		require.NoError(t, err)
+
+		deployment, err := makeUntypedDeployment(name, "abc123",
+			"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+		require.NoError(t, err)
+		require.NoError(t, src.ImportDeployment(ctx, stk, deployment))
+	}
+
+	var bundle bytes.Buffer
+	require.NoError(t, src.ExportProject(ctx, "testproj", &bundle))
+
+	dst := newBackend()
+	require.NoError(t, dst.ImportProject(ctx, bytes.NewReader(bundle.Bytes())))
+
+	for _, name := range []string{"dev", "prod"} {
+		srcRef, err := src.parseStackReference(name)
+		require.NoError(t, err)
+		want, err := src.getCheckpoint(ctx, srcRef)
+		require.NoError(t, err)
+
+		dstRef, err := dst.parseStackReference(name)
+		require.NoError(t, err)
+		got, err := dst.getCheckpoint(ctx, dstRef)
+		require.NoError(t, err)
+
+		// Compare as JSON since raw fields may be reformatted.
+		wantJSON, err := json.Marshal(want)
+		require.NoError(t, err)
+		gotJSON, err := json.Marshal(got)
+		require.NoError(t, err)
+		assert.JSONEq(t, string(wantJSON), string(gotJSON), "checkpoint of %v", name)
+	}
+
+	// Importing the same stacks again must fail without touching them.
+	err := dst.ImportProject(ctx, bytes.NewReader(bundle.Bytes()))
+	assert.ErrorContains(t, err, "already exists")
+}
+
+func TestExportProject_noStacks(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(t.TempDir()),
+		&workspace.Project{Name: "testproj"}, nil)
+	require.NoError(t, err)
+
+	var bundle bytes.Buffer
+	err = b.ExportProject(ctx, tokens.Name("missing"), &bundle)
+	assert.ErrorContains(t, err, `no stacks found in project "missing"`)
+}
@@ -0,0 +1,198 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// checkpointSummary is what a stack summary needs to know about the latest checkpoint of a stack.
+type checkpointSummary struct {
+	// HasLatest is set if the checkpoint has a latest deployment.
+	// The other fields are only meaningful if it's set.
+	HasLatest bool
+
+	// LastUpdate is the time of the latest deployment, or zero if it's not recorded.
+	LastUpdate time.Time
+
+	// ResourceCount is the number of resources in the latest deployment.
+	ResourceCount int
+}
+
+// getCheckpointSummary reads the summary of the checkpoint of the given stack.
+//
+// Unlike getCheckpoint, it scans the checkpoint with a streaming decoder
+// and doesn't build the deployment or look at its secrets,
+// so it's cheap enough to use for every stack in a large bucket.
+func (b *localBackend) getCheckpointSummary(
+	ctx context.Context, ref *localBackendReference,
+) (*checkpointSummary, error) {
+	chkpath, data, err := b.readCheckpoint(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	data, err = compressionForFile(chkpath, data).Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompress %v: %w", chkpath, err)
+	}
+	if stateMarshaler(chkpath) == yamlState {
+		// The scanner only reads JSON, so YAML checkpoints need transcoding first.
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("read %v: %w", chkpath, err)
+		}
+	}
+
+	summary, err := scanCheckpointSummary(data)
+	if err != nil {
+		return nil, fmt.Errorf("read %v: %w", chkpath, err)
+	}
+	return summary, nil
+}
+
+// scanCheckpointSummary scans a JSON checkpoint for its summary.
+//
+// Versioned checkpoints hold the checkpoint in a "checkpoint" field,
+// and checkpoints from before versioning are the checkpoint itself.
+// All checkpoint versions keep the latest deployment in "latest",
+// with its time in "manifest.time" and its resources in "resources".
+func scanCheckpointSummary(data []byte) (*checkpointSummary, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var summary checkpointSummary
+
+	scanManifest := func(key string) error {
+		if key != "time" {
+			return skipJSONValue(dec)
+		}
+		return dec.Decode(&summary.LastUpdate)
+	}
+	scanLatest := func(key string) error {
+		switch key {
+		case "manifest":
+			_, err := scanJSONObject(dec, scanManifest)
+			return err
+		case "resources":
+			n, err := countJSONArray(dec)
+			summary.ResourceCount = n
+			return err
+		default:
+			return skipJSONValue(dec)
+		}
+	}
+	var scanCheckpoint func(key string) error
+	scanCheckpoint = func(key string) error {
+		var err error
+		switch key {
+		case "checkpoint":
+			_, err = scanJSONObject(dec, scanCheckpoint)
+		case "latest":
+			summary.HasLatest, err = scanJSONObject(dec, scanLatest)
+		default:
+			err = skipJSONValue(dec)
+		}
+		return err
+	}
+	if _, err := scanJSONObject(dec, scanCheckpoint); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// scanJSONObject reads a JSON object from dec, calling field for each key.
+// field must consume the value of the key.
+// It reports whether there was an object, as opposed to a null.
+func scanJSONObject(dec *json.Decoder, field func(key string) error) (bool, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return false, err
+	}
+	if tok == nil {
+		return false, nil
+	}
+	if tok != json.Delim('{') {
+		return false, fmt.Errorf("expected an object, got %v", tok)
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return false, fmt.Errorf("expected an object key, got %v", tok)
+		}
+		if err := field(key); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = dec.Token() // '}'
+	return true, err
+}
+
+// countJSONArray reads a JSON array from dec and returns the number of elements in it,
+// without decoding them.
+// A null is treated as an empty array.
+func countJSONArray(dec *json.Decoder) (int, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+	if tok == nil {
+		return 0, nil
+	}
+	if tok != json.Delim('[') {
+		return 0, fmt.Errorf("expected an array, got %v", tok)
+	}
+
+	n := 0
+	for dec.More() {
+		if err := skipJSONValue(dec); err != nil {
+			return 0, err
+		}
+		n++
+	}
+
+	_, err = dec.Token() // ']'
+	return n, err
+}
+
+// skipJSONValue reads the next JSON value from dec and discards it.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+			if depth < 0 {
+				return errors.New("unexpected end of JSON value")
+			}
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+)
+
+func TestScanCheckpointSummary(t *testing.T) {
+	t.Parallel()
+
+	updated := time.Date(2023, 11, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		desc string
+		give string
+		want checkpointSummary
+	}{
+		{
+			desc: "versioned",
+			give: `{
+				"version": 3,
+				"checkpoint": {
+					"stack": "organization/proj/dev",
+					"latest": {
+						"manifest": {"time": "2023-11-02T15:04:05Z", "magic": "abc", "version": "v3.0.0"},
+						"secrets_providers": {"type": "passphrase", "state": {"salt": "v1:..."}},
+						"resources": [
+							{"urn": "urn:pulumi:dev::proj::pulumi:pulumi:Stack::proj-dev", "outputs": {"a": [1, {}]}},
+							{"urn": "urn:pulumi:dev::proj::a:b:c::res", "inputs": {"secret": {
+								"4dabf18193072939515e22adb298388d": "1b47061264138c4ac30d75fd1eb44270",
+								"ciphertext": "v1:..."
+							}}}
+						]
+					}
+				}
+			}`,
+			want: checkpointSummary{HasLatest: true, LastUpdate: updated, ResourceCount: 2},
+		},
+		{
+			desc: "unversioned",
+			give: `{"latest": {"resources": [{"urn": "urn:pulumi:dev::proj::a:b:c::res"}]}}`,
+			want: checkpointSummary{HasLatest: true, ResourceCount: 1},
+		},
+		{
+			desc: "empty latest",
+			give: `{"version": 3, "checkpoint": {"latest": {}}}`,
+			want: checkpointSummary{HasLatest: true},
+		},
+		{
+			desc: "null latest",
+			give: `{"version": 3, "checkpoint": {"stack": "dev", "latest": null}}`,
+		},
+		{
+			desc: "no latest",
+			give: `{"version": 3, "checkpoint": {"stack": "dev"}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := scanCheckpointSummary([]byte(tt.give))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *got)
+		})
+	}
+}
+
+func TestScanCheckpointSummary_invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, give := range []string{
+		`[]`,
+		`{"version": 3, "checkpoint": {"latest": {"resources": {}}}}`,
+		`{"version": 3, "checkpoint": {"latest": {"resources": [`,
+	} {
+		_, err := scanCheckpointSummary([]byte(give))
+		assert.Error(t, err, "checkpoint %q", give)
+	}
+}
+
+func TestCompressionDecompress(t *testing.T) {
+	t.Parallel()
+
+	want := map[string]interface{}{"version": 3.0}
+	for _, c := range compressions {
+		data, err := c.Wrap(encoding.JSON).Marshal(want)
+		require.NoError(t, err)
+
+		plain, err := c.Decompress(data)
+		require.NoError(t, err, "codec %v", c)
+
+		var got map[string]interface{}
+		require.NoError(t, encoding.JSON.Unmarshal(plain, &got))
+		assert.Equal(t, want, got, "codec %v", c)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// ChecksumExt is the extension of the sidecar file
+// that holds the SHA-256 checksum of a checkpoint file.
+//
+// For example, the checksum of "foo.json.gz" is stored in "foo.json.gz.sha256".
+const ChecksumExt = ".sha256"
+
+func checksumPath(file string) string {
+	return file + ChecksumExt
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// writeChecksum writes the checksum sidecar for the checkpoint file with the given contents.
+func (b *localBackend) writeChecksum(ctx context.Context, file string, data []byte) error {
+	if err := b.bucket.WriteAll(ctx, checksumPath(file), checksum(data), nil); err != nil {
+		return fmt.Errorf("write checksum for %q: %w", file, err)
+	}
+	return nil
+}
+
+// prepareChecksum adds the checksum of the given contents
+// to the sidecar of a checkpoint file that is about to be replaced with them.
+//
+// A checkpoint and its sidecar can't be written atomically together,
+// so while the checkpoint is replaced, the sidecar holds one checksum per line
+// and accepts both the old and the new contents.
+// Once the new checkpoint is in place, writeChecksum drops the old checksum.
+// If the save is interrupted in between, the sidecar still accepts whichever checkpoint was left behind.
+//
+// A checkpoint without a sidecar isn't verified, so there's nothing to prepare for it.
+func (b *localBackend) prepareChecksum(ctx context.Context, file string, data []byte) error {
+	sums, err := b.bucket.ReadAll(ctx, checksumPath(file))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return fmt.Errorf("read checksum for %q: %w", file, err)
+	}
+
+	sums = append(append(bytes.TrimSpace(sums), '\n'), checksum(data)...)
+	if err := b.bucket.WriteAll(ctx, checksumPath(file), sums, nil); err != nil {
+		return fmt.Errorf("write checksum for %q: %w", file, err)
+	}
+	return nil
+}
+
+// verifyChecksum verifies the contents of a checkpoint file against its checksum sidecar.
+// The contents are valid if they match any of the checksums in the sidecar; see prepareChecksum.
+//
+// Checkpoints written before checksums were introduced don't have a sidecar,
+// so a missing sidecar is not an error.
+func (b *localBackend) verifyChecksum(ctx context.Context, file string, data []byte) error {
+	want, err := b.bucket.ReadAll(ctx, checksumPath(file))
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return fmt.Errorf("read checksum for %q: %w", file, err)
+	}
+
+	got := checksum(data)
+	sums := bytes.Fields(want)
+	for _, sum := range sums {
+		if bytes.Equal(sum, got) {
+			return nil
+		}
+	}
+	return fmt.Errorf("corrupt store: checksum mismatch for %q: expected %s, got %s; "+
+		"set PULUMI_SELF_MANAGED_STATE_SKIP_CHECKSUM_VERIFICATION=1 to skip this check",
+		file, bytes.Join(sums, []byte(" or ")), got)
+}
+
+// removeChecksum deletes the checksum sidecar for the given checkpoint file, if any.
+func (b *localBackend) removeChecksum(ctx context.Context, file string) {
+	err := b.bucket.Delete(ctx, checksumPath(file))
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting checksum for %v: %v skipping", file, err)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import "time"
+
+// Clock tells the time for a filestate backend.
+//
+// The backend takes the timestamps of updates, locks, backups and history records from its clock,
+// so a fake clock makes them deterministic.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// systemClock is a Clock that tells the system time.
+type systemClock struct{}
+
+var _ Clock = systemClock{}
+
+func (systemClock) Now() time.Time { return time.Now() }
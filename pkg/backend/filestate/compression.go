@@ -0,0 +1,148 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
+)
+
+// compression is a compression codec used for files written to the bucket.
+type compression int
+
+const (
+	noCompression compression = iota
+	gzipCompression
+	zstdCompression
+)
+
+// compressions lists all supported compression codecs.
+var compressions = []compression{noCompression, gzipCompression, zstdCompression}
+
+// compressionFromEnv picks the compression codec for new files
+// based on the environment.
+//
+// PULUMI_SELF_MANAGED_STATE_COMPRESSION takes precedence
+// over the older PULUMI_SELF_MANAGED_STATE_GZIP.
+func compressionFromEnv(e env.Env) (compression, error) {
+	switch v := strings.ToLower(e.GetString(env.SelfManagedCompression)); v {
+	case "":
+		if e.GetBool(env.SelfManagedGzip) {
+			return gzipCompression, nil
+		}
+		return noCompression, nil
+	case "none":
+		return noCompression, nil
+	case "gzip":
+		return gzipCompression, nil
+	case "zstd":
+		return zstdCompression, nil
+	default:
+		return noCompression, fmt.Errorf(
+			"unsupported value for %s: %q; expected one of: zstd, gzip, none",
+			env.SelfManagedCompression.Var().Name(), v)
+	}
+}
+
+// String returns the name of the codec, as accepted by PULUMI_SELF_MANAGED_STATE_COMPRESSION.
+func (c compression) String() string {
+	switch c {
+	case gzipCompression:
+		return "gzip"
+	case zstdCompression:
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// Ext returns the file extension for files compressed with this codec,
+// or an empty string if the codec does not compress.
+func (c compression) Ext() string {
+	switch c {
+	case gzipCompression:
+		return encoding.GZIPExt
+	case zstdCompression:
+		return encoding.ZSTDExt
+	default:
+		return ""
+	}
+}
+
+// Wrap wraps the given marshaler to compress with this codec.
+func (c compression) Wrap(m encoding.Marshaler) encoding.Marshaler {
+	switch c {
+	case gzipCompression:
+		return encoding.Gzip(m)
+	case zstdCompression:
+		return encoding.Zstd(m)
+	default:
+		return m
+	}
+}
+
+// Decompress returns the decompressed contents of data, which was compressed with this codec.
+func (c compression) Decompress(data []byte) ([]byte, error) {
+	if c == noCompression {
+		return data, nil
+	}
+	var raw rawBytes
+	if err := c.Wrap(&raw).Unmarshal(data, nil); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// rawBytes is an encoding.Marshaler that keeps the bytes it's given.
+// Wrapped with a compression codec, it decompresses or compresses data without decoding it.
+type rawBytes []byte
+
+func (r *rawBytes) Marshal(interface{}) ([]byte, error) { return *r, nil }
+
+func (r *rawBytes) Unmarshal(data []byte, _ interface{}) error {
+	*r = data
+	return nil
+}
+
+// compressionForFile determines the codec used to compress a file
+// based on its name, falling back to inspecting its contents.
+func compressionForFile(name string, data []byte) compression {
+	switch {
+	case strings.HasSuffix(name, encoding.GZIPExt):
+		return gzipCompression
+	case strings.HasSuffix(name, encoding.ZSTDExt):
+		return zstdCompression
+	case encoding.IsCompressed(data):
+		return gzipCompression
+	case encoding.IsZstdCompressed(data):
+		return zstdCompression
+	default:
+		return noCompression
+	}
+}
+
+// trimCompressionExt strips the extension of a supported compression codec
+// from the given file name, if any.
+func trimCompressionExt(name string) string {
+	for _, c := range compressions {
+		if ext := c.Ext(); ext != "" && strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
@@ -0,0 +1,130 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+// DeploymentDiff describes how importing a deployment would change the resources of a stack.
+// Each list of URNs is sorted.
+type DeploymentDiff struct {
+	// Added are the resources in the deployment that aren't in the stack.
+	Added []resource.URN
+	// Removed are the resources in the stack that aren't in the deployment.
+	Removed []resource.URN
+	// Changed are the resources in both whose state differs.
+	Changed []resource.URN
+}
+
+// Empty reports whether importing the deployment would leave the resources of the stack unchanged.
+func (d *DeploymentDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (b *localBackend) ImportDeploymentPreview(ctx context.Context, stk backend.Stack,
+	deployment *apitype.UntypedDeployment,
+) (*DeploymentDiff, error) {
+	localStackRef, err := b.getReference(stk.Ref())
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := stack.UnmarshalUntypedDeployment(ctx, deployment)
+	if err != nil {
+		return nil, fmt.Errorf("reading deployment: %w", err)
+	}
+
+	// This only reads the current state, so it doesn't need the stack's lock.
+	chk, err := b.getCheckpoint(ctx, localStackRef)
+	if err != nil {
+		return nil, fmt.Errorf("reading current state: %w", err)
+	}
+	var current []apitype.ResourceV3
+	if chk.Latest != nil {
+		current = chk.Latest.Resources
+	}
+
+	return diffDeploymentResources(current, next.Resources)
+}
+
+// diffDeploymentResources compares two lists of resources by URN.
+//
+// Resources are compared by their serialized state,
+// so a secret that was encrypted again with a different ciphertext counts as a change.
+// A URN may be shared by several resources, e.g. one pending deletion and its replacement,
+// in which case the URN is changed if any of them differ.
+func diffDeploymentResources(current, next []apitype.ResourceV3) (*DeploymentDiff, error) {
+	index := func(resources []apitype.ResourceV3) (map[resource.URN][]string, error) {
+		m := make(map[resource.URN][]string)
+		for _, res := range resources {
+			data, err := json.Marshal(res)
+			if err != nil {
+				return nil, fmt.Errorf("marshaling %s: %w", res.URN, err)
+			}
+			m[res.URN] = append(m[res.URN], string(data))
+		}
+		return m, nil
+	}
+	currentByURN, err := index(current)
+	if err != nil {
+		return nil, err
+	}
+	nextByURN, err := index(next)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff DeploymentDiff
+	for urn, nextStates := range nextByURN {
+		currentStates, ok := currentByURN[urn]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, urn)
+		case !equalStrings(currentStates, nextStates):
+			diff.Changed = append(diff.Changed, urn)
+		}
+	}
+	for urn := range currentByURN {
+		if _, ok := nextByURN[urn]; !ok {
+			diff.Removed = append(diff.Removed, urn)
+		}
+	}
+
+	for _, urns := range [][]resource.URN{diff.Added, diff.Removed, diff.Changed} {
+		sort.Slice(urns, func(i, j int) bool { return urns[i] < urns[j] })
+	}
+	return &diff, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+)
+
+func TestDiffDeploymentResources(t *testing.T) {
+	t.Parallel()
+
+	res := func(name, id string) apitype.ResourceV3 {
+		return apitype.ResourceV3{
+			URN:  resource.NewURN("stack", "proj", "", "a:b:c", name),
+			Type: "a:b:c",
+			ID:   resource.ID(id),
+		}
+	}
+
+	diff, err := diffDeploymentResources(
+		[]apitype.ResourceV3{res("same", "1"), res("changed", "1"), res("removed", "1")},
+		[]apitype.ResourceV3{res("same", "1"), res("changed", "2"), res("added", "1")},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{res("added", "").URN}, diff.Added)
+	assert.Equal(t, []resource.URN{res("removed", "").URN}, diff.Removed)
+	assert.Equal(t, []resource.URN{res("changed", "").URN}, diff.Changed)
+	assert.False(t, diff.Empty())
+
+	// A resource that's being replaced shares its URN with the resource pending deletion.
+	diff, err = diffDeploymentResources(
+		[]apitype.ResourceV3{res("replaced", "1")},
+		[]apitype.ResourceV3{res("replaced", "1"), res("replaced", "2")},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{res("replaced", "").URN}, diff.Changed)
+
+	diff, err = diffDeploymentResources(nil, nil)
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+}
+
+func TestImportDeploymentPreview(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	stateDir := t.TempDir()
+	b, err := New(ctx, diagtest.LogSink(t), "file://"+filepath.ToSlash(stateDir), nil)
+	require.NoError(t, err)
+
+	ref, err := b.ParseStackReference("organization/project/dev")
+	require.NoError(t, err)
+	stk, err := b.CreateStack(ctx, ref, "", nil)
+	require.NoError(t, err)
+
+	current, err := makeUntypedDeployment("a", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+	require.NoError(t, b.ImportDeployment(ctx, stk, current))
+
+	diff, err := b.ImportDeploymentPreview(ctx, stk, current)
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+
+	next, err := makeUntypedDeployment("b", "abc123",
+		"v1:4iF78gb0nF0=:v1:Co6IbTWYs/UdrjgY:FSrAWOFZnj9ealCUDdJL7LrUKXX9BA==")
+	require.NoError(t, err)
+
+	chkpath := filepath.Join(stateDir, ".pulumi", "stacks", "project", "dev.json")
+	before, err := os.ReadFile(chkpath)
+	require.NoError(t, err)
+
+	diff, err = b.ImportDeploymentPreview(ctx, stk, next)
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{resource.NewURN("a", "proj", "d:e:f", "a:b:c", "b")}, diff.Added)
+	assert.Equal(t, []resource.URN{resource.NewURN("a", "proj", "d:e:f", "a:b:c", "a")}, diff.Removed)
+	assert.Empty(t, diff.Changed)
+
+	// Nothing was written.
+	after, err := os.ReadFile(chkpath)
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
@@ -0,0 +1,103 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// InitialConfigExt is the extension of the file that holds the configuration a stack was created with,
+// stored next to its checkpoint.
+//
+// For example, the initial configuration of the stack in "myproject/dev.json"
+// is stored in "myproject/dev.config".
+// It's only used until the stack is first updated, which records its configuration in the history of the stack.
+// Like TagsExt, the extension is deliberately not that of a checkpoint format.
+const InitialConfigExt = ".config"
+
+func stackInitialConfigPath(ref *localBackendReference) string {
+	return filepath.ToSlash(ref.StackBasePath()) + InitialConfigExt
+}
+
+// getStackInitialConfig reads the configuration the given stack was created with.
+// It returns nil if the stack was created without configuration.
+func (b *localBackend) getStackInitialConfig(ctx context.Context, ref *localBackendReference) (config.Map, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	file := stackInitialConfigPath(ref)
+	data, err := b.bucket.ReadAll(ctx, file)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read initial configuration: %w", err)
+	}
+
+	var cfg config.Map
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", file, err)
+	}
+	return cfg, nil
+}
+
+// saveStackInitialConfig records the configuration the given stack was created with.
+func (b *localBackend) saveStackInitialConfig(ctx context.Context, ref *localBackendReference, cfg config.Map) error {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	if len(cfg) == 0 {
+		b.removeStackInitialConfig(ctx, ref)
+		return nil
+	}
+
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("marshal initial configuration: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, stackInitialConfigPath(ref), data, nil); err != nil {
+		return fmt.Errorf("write initial configuration: %w", err)
+	}
+	return nil
+}
+
+// moveStackInitialConfig moves the initial configuration of a stack, if any, from one reference to another.
+func (b *localBackend) moveStackInitialConfig(ctx context.Context, from, to *localBackendReference) error {
+	cfg, err := b.getStackInitialConfig(ctx, from)
+	if err != nil {
+		return err
+	}
+	if err := b.saveStackInitialConfig(ctx, to, cfg); err != nil {
+		return err
+	}
+	b.removeStackInitialConfig(ctx, from)
+	return nil
+}
+
+// removeStackInitialConfig deletes the initial configuration of the given stack, if any.
+func (b *localBackend) removeStackInitialConfig(ctx context.Context, ref *localBackendReference) {
+	file := stackInitialConfigPath(ref)
+	err := b.bucket.Delete(ctx, file)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting initial configuration %v: %v skipping", file, err)
+	}
+}
@@ -15,14 +15,18 @@
 package filestate
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/pulumi/pulumi/pkg/v3/backend"
@@ -30,7 +34,9 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"gocloud.dev/gcerrors"
 )
 
 type lockContent struct {
@@ -40,7 +46,7 @@ type lockContent struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
-func newLockContent() (*lockContent, error) {
+func newLockContent(now time.Time) (*lockContent, error) {
 	u, err := user.Current()
 	if err != nil {
 		return nil, err
@@ -53,7 +59,7 @@ func newLockContent() (*lockContent, error) {
 		Pid:       os.Getpid(),
 		Username:  u.Username,
 		Hostname:  hostname,
-		Timestamp: time.Now(),
+		Timestamp: now,
 	}, nil
 }
 
@@ -79,42 +85,270 @@ func (b *localBackend) checkForLock(ctx context.Context, stackRef backend.StackR
 		}
 	}
 
-	if len(lockKeys) > 0 {
-		errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
-			"process(es) to end or delete the lock file with `pulumi cancel`.", len(lockKeys))
+	var lockDescriptions []string
+	for _, lock := range lockKeys {
+		content, err := b.bucket.ReadAll(ctx, lock)
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				// The lock was released since we listed it.
+				continue
+			}
+			return err
+		}
+		l := &lockContent{}
+		err = json.Unmarshal(content, &l)
+		if err != nil {
+			return err
+		}
 
-		for _, lock := range lockKeys {
-			content, err := b.bucket.ReadAll(ctx, lock)
+		if b.isStaleLock(l) {
+			broken, err := b.breakStaleLock(ctx, lock, content, l)
 			if err != nil {
 				return err
 			}
-			l := &lockContent{}
-			err = json.Unmarshal(content, &l)
-			if err != nil {
-				return err
+			if broken {
+				continue
 			}
-
-			errorString += fmt.Sprintf("\n  %v: created by %v@%v (pid %v) at %v",
-				b.url+"/"+lock,
-				l.Username,
-				l.Hostname,
-				l.Pid,
-				l.Timestamp.Format(time.RFC3339),
-			)
 		}
 
-		return errors.New(errorString)
+		lockDescriptions = append(lockDescriptions, fmt.Sprintf("\n  %v: created by %v@%v (pid %v) at %v",
+			b.url+"/"+lock,
+			l.Username,
+			l.Hostname,
+			l.Pid,
+			l.Timestamp.Format(time.RFC3339),
+		))
+	}
+
+	if len(lockDescriptions) > 0 {
+		errorString := fmt.Sprintf("the stack is currently locked by %v lock(s). Either wait for the other "+
+			"process(es) to end or delete the lock file with `pulumi cancel`.", len(lockDescriptions))
+		errorString += strings.Join(lockDescriptions, "")
+		return &stackLockedError{message: errorString}
 	}
 	return nil
 }
 
+// stackLockedError is returned by Lock when another process holds the lock of the stack.
+type stackLockedError struct {
+	message string
+}
+
+func (e *stackLockedError) Error() string {
+	return e.message
+}
+
+// lockWithRetry is like Lock, but while another process holds the lock of the stack,
+// it keeps trying with increasing delays until the lock is released or timeout elapses.
+func (b *localBackend) lockWithRetry(
+	ctx context.Context, stackRef backend.StackReference, timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	delay := 50 * time.Millisecond
+	for {
+		err := b.Lock(ctx, stackRef)
+		var locked *stackLockedError
+		if !errors.As(err, &locked) {
+			return err
+		}
+
+		// Processes that try to take the lock at the same time see each other's locks and back off,
+		// so add some jitter to keep them from retrying in lockstep.
+		wait := delay + time.Duration(rand.Int63n(int64(delay))) //nolint:gosec // not security sensitive
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if delay < 2*time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// isStaleLock reports whether the given lock is older than the configured lock TTL.
+func (b *localBackend) isStaleLock(l *lockContent) bool {
+	return b.lockTTL > 0 && b.clock.Now().Sub(l.Timestamp) > b.lockTTL
+}
+
+// breakStaleLock deletes a stale lock held by another process.
+//
+// The lock is re-read before deleting it, and it's only deleted if it's unchanged
+// since the given content was read.
+// This guards against breaking a lock that was released and re-acquired in the meantime.
+// Returns true if the lock no longer exists.
+func (b *localBackend) breakStaleLock(ctx context.Context, key string, content []byte, l *lockContent) (bool, error) {
+	deleted, err := b.deleteLockIfUnchanged(ctx, key, content)
+	if err != nil || !deleted {
+		return deleted, err
+	}
+
+	b.d.Warningf(diag.Message("", "Breaking stale lock %v: created by %v@%v (pid %v) at %v, "+
+		"which is older than %v"),
+		b.url+"/"+key,
+		l.Username,
+		l.Hostname,
+		l.Pid,
+		l.Timestamp.Format(time.RFC3339),
+		b.lockTTL)
+	return true, nil
+}
+
+// deleteLockIfUnchanged deletes the given lock if its content is still the given one.
+// Returns true if the lock no longer exists.
+func (b *localBackend) deleteLockIfUnchanged(ctx context.Context, key string, content []byte) (bool, error) {
+	current, err := b.bucket.ReadAll(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			// The lock was released while we were looking at it.
+			return true, nil
+		}
+		return false, err
+	}
+	if !bytes.Equal(current, content) {
+		return false, nil
+	}
+
+	if err := b.bucket.Delete(ctx, key); err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// LockInfo describes a lock held on a stack in the bucket.
+type LockInfo struct {
+	// Stack is the fully qualified name of the locked stack.
+	Stack tokens.QName
+
+	// Key is the key of the lock file in the bucket.
+	Key string
+
+	// Pid, Username and Hostname identify the process that took the lock.
+	Pid      int
+	Username string
+	Hostname string
+
+	// Timestamp is the time the lock was taken.
+	Timestamp time.Time
+
+	// content is the raw content of the lock file,
+	// used to check that the lock is unchanged before deleting it.
+	content []byte
+
+	// modTime is the time the lock file was last written.
+	modTime time.Time
+}
+
+func (b *localBackend) ListLocks(ctx context.Context) ([]LockInfo, error) {
+	files, err := listBucketRecursive(ctx, b.bucket, lockDir())
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []LockInfo
+	for _, file := range files {
+		if path.Ext(file.Key) != ".json" {
+			continue
+		}
+
+		content, err := b.bucket.ReadAll(ctx, file.Key)
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				// The lock was released since we listed it.
+				continue
+			}
+			return nil, err
+		}
+
+		// Locks are stored in a directory named after the fully qualified name of their stack.
+		stack := path.Dir(strings.TrimPrefix(file.Key, lockDir()+"/"))
+		info := LockInfo{
+			Stack:   tokens.QName(stack),
+			Key:     file.Key,
+			content: content,
+			modTime: file.ModTime,
+		}
+
+		// A lock that can't be read still locks its stack,
+		// so report it without any details.
+		var l lockContent
+		if err := json.Unmarshal(content, &l); err != nil {
+			logging.V(5).Infof("error reading lock %v: %v", file.Key, err)
+		} else {
+			info.Pid = l.Pid
+			info.Username = l.Username
+			info.Hostname = l.Hostname
+			info.Timestamp = l.Timestamp
+		}
+		locks = append(locks, info)
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].Stack != locks[j].Stack {
+			return locks[i].Stack < locks[j].Stack
+		}
+		return locks[i].Key < locks[j].Key
+	})
+	return locks, nil
+}
+
+func (b *localBackend) PruneStaleLocks(ctx context.Context, olderThan time.Duration) ([]LockInfo, error) {
+	if olderThan <= 0 {
+		return nil, fmt.Errorf("lock age must be positive, got %v", olderThan)
+	}
+	if err := b.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	locks, err := b.ListLocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := b.clock.Now()
+	var pruned []LockInfo
+	for _, l := range locks {
+		// Our own locks are held by operations that are still running, however long ago they were taken.
+		if path.Base(l.Key) == b.lockID+".json" {
+			continue
+		}
+
+		// A lock that can't be read has no timestamp, so go by when it was written instead.
+		taken := l.Timestamp
+		if taken.IsZero() {
+			taken = l.modTime
+		}
+		if now.Sub(taken) <= olderThan {
+			continue
+		}
+
+		// Don't delete a lock that was released and re-acquired since it was listed.
+		deleted, err := b.deleteLockIfUnchanged(ctx, l.Key, l.content)
+		if err != nil {
+			return pruned, err
+		}
+		if deleted {
+			pruned = append(pruned, l)
+		}
+	}
+	return pruned, nil
+}
+
 func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference) error {
-	//
+	if b.readonly {
+		// Nothing can modify a read-only backend, so there's nothing to lock.
+		return nil
+	}
 	err := b.checkForLock(ctx, stackRef)
 	if err != nil {
 		return err
 	}
-	lockContent, err := newLockContent()
+	lockContent, err := newLockContent(b.clock.Now())
 	if err != nil {
 		return err
 	}
@@ -135,6 +369,9 @@ func (b *localBackend) Lock(ctx context.Context, stackRef backend.StackReference
 }
 
 func (b *localBackend) Unlock(ctx context.Context, stackRef backend.StackReference) {
+	if b.readonly {
+		return
+	}
 	err := b.bucket.Delete(ctx, b.lockPath(stackRef))
 	if err != nil {
 		b.d.Errorf(
@@ -0,0 +1,152 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
+)
+
+// stateMarkupExts lists the extensions of the markups that state files may be written in.
+// Files in any of them are read regardless of the configured markup.
+// ".yml" is never written, but files with it are read like those with encoding.YAMLExt,
+// since stacks are listed from any file that has an extension of encoding.Marshalers.
+var stateMarkupExts = []string{encoding.JSONExt, encoding.YAMLExt, ".yml"}
+
+// stateMarkupFromEnv picks the extension of the markup for new state files
+// based on the environment.
+func stateMarkupFromEnv(e env.Env) (string, error) {
+	switch v := strings.ToLower(e.GetString(env.SelfManagedStateEncoding)); v {
+	case "", "json":
+		return encoding.JSONExt, nil
+	case "yaml":
+		return encoding.YAMLExt, nil
+	default:
+		return "", fmt.Errorf(
+			"unsupported value for %s: %q; expected one of: json, yaml",
+			env.SelfManagedStateEncoding.Var().Name(), v)
+	}
+}
+
+// stateMarshaler returns the marshaler for state files with the given extension,
+// ignoring any compression extension.
+// It returns nil if the extension isn't a known markup.
+func stateMarshaler(name string) encoding.Marshaler {
+	switch filepath.Ext(trimCompressionExt(name)) {
+	case encoding.JSONExt:
+		return encoding.JSON
+	case encoding.YAMLExt, ".yml":
+		return yamlState
+	default:
+		return nil
+	}
+}
+
+// trimStateMarkupExt removes the markup extension and any compression extension
+// from the given file name.
+func trimStateMarkupExt(name string) string {
+	plain := trimCompressionExt(name)
+	if stateMarshaler(plain) == nil {
+		return name
+	}
+	return strings.TrimSuffix(plain, filepath.Ext(plain))
+}
+
+// yamlState is the marshaler for YAML state files.
+//
+// State is made of JSON documents, some of them kept verbatim in json.RawMessage fields,
+// which the YAML library doesn't know how to write.
+// So it transcodes the JSON form of values to and from YAML.
+var yamlState encoding.Marshaler = yamlStateMarshaler{}
+
+type yamlStateMarshaler struct{}
+
+func (yamlStateMarshaler) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(yamlNumbers(value)); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (yamlStateMarshaler) Unmarshal(data []byte, v interface{}) error {
+	data, err := yamlToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// yamlToJSON transcodes a YAML state file to JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("invalid YAML file: %w", err)
+	}
+	return json.Marshal(value)
+}
+
+// yamlNumbers replaces the json.Numbers in a decoded JSON value with ints or floats,
+// which would otherwise be written to YAML as strings.
+// Integers are kept as such so that they don't lose precision.
+func yamlNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = yamlNumbers(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = yamlNumbers(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -73,6 +73,24 @@ func ensurePulumiMeta(ctx context.Context, b Bucket, e env.Env) (*pulumiMeta, er
 	}
 
 	// If there's no metadata file, we need to create one.
+	meta, err = newPulumiMeta(ctx, b, e)
+	if err != nil {
+		return nil, err
+	}
+
+	// Implementation detail:
+	// For version 0, WriteTo won't write the metadata file.
+	// See [pulumiMeta.WriteTo] for details on why.
+	if err := meta.WriteTo(ctx, b); err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// newPulumiMeta picks the metadata for a bucket that doesn't have a metadata file yet
+// without writing it.
+func newPulumiMeta(ctx context.Context, b Bucket, e env.Env) (*pulumiMeta, error) {
 	// The version we pick for the new file decides how we lay out the state.
 	//
 	// - Version 0 is legacy mode, which is the old layout.
@@ -96,19 +114,9 @@ func ensurePulumiMeta(ctx context.Context, b Bucket, e env.Env) (*pulumiMeta, er
 	}
 
 	if useLegacy {
-		meta = &pulumiMeta{Version: 0}
-	} else {
-		meta = &pulumiMeta{Version: 1}
+		return &pulumiMeta{Version: 0}, nil
 	}
-
-	// Implementation detail:
-	// For version 0, WriteTo won't write the metadata file.
-	// See [pulumiMeta.WriteTo] for details on why.
-	if err := meta.WriteTo(ctx, b); err != nil {
-		return nil, err
-	}
-
-	return meta, nil
+	return &pulumiMeta{Version: 1}, nil
 }
 
 // readPulumiMeta loads the Pulumi state metadata from the bucket.
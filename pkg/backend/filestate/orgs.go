@@ -0,0 +1,93 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// defaultOrganization is the only organization of a filestate backend
+// unless others are configured.
+const defaultOrganization = "organization"
+
+// organizationsPath is the path of the file in the bucket
+// that lists the organization names accepted by the backend,
+// as a JSON array of strings.
+var organizationsPath = filepath.Join(workspace.BookkeepingDir, "organizations.json")
+
+// readOrganizations returns the organization names configured for the backend.
+//
+// Organizations are read from PULUMI_SELF_MANAGED_ORGS if set,
+// and from .pulumi/organizations.json in the bucket otherwise.
+// Returns nil if neither is present.
+//
+// By default, filestate backends don't separate stacks by organization:
+// stacks are always stored and locked under the default organization,
+// and the configured names are accepted in stack references in its place.
+// With PULUMI_SELF_MANAGED_ORG_DIRS set,
+// the stacks of each configured organization are stored in a directory of its own instead (see orgDir).
+func readOrganizations(ctx context.Context, b Bucket, e env.Env) ([]string, error) {
+	var orgs []string
+	if v := e.GetString(env.SelfManagedOrgs); v != "" {
+		for _, org := range strings.Split(v, ",") {
+			if org = strings.TrimSpace(org); org != "" {
+				orgs = append(orgs, org)
+			}
+		}
+	} else {
+		path := filepath.ToSlash(organizationsPath)
+		data, err := b.ReadAll(ctx, path)
+		if err != nil {
+			if gcerrors.Code(err) == gcerrors.NotFound {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("read %q: %w", path, err)
+		}
+		if err := json.Unmarshal(data, &orgs); err != nil {
+			return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", path, err)
+		}
+	}
+
+	for _, org := range orgs {
+		if org == "" || strings.Contains(org, "/") {
+			return nil, fmt.Errorf("invalid organization name %q", org)
+		}
+	}
+	return orgs, nil
+}
+
+// validateOrgDirs verifies that the given organization names
+// can be used as the names of directories at the root of the bucket.
+func validateOrgDirs(orgs []string) error {
+	for _, org := range orgs {
+		// Names starting with "." could clash with the .pulumi directory.
+		if !tokens.IsName(org) || strings.HasPrefix(org, ".") {
+			return fmt.Errorf("invalid organization name %q: "+
+				"organizations with their own directory may only contain alphanumerics, hyphens, underscores, "+
+				"and periods, and may not start with a period", org)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/resource/edit"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+func (b *localBackend) RenameProject(ctx context.Context, oldProject, newProject tokens.Name) error {
+	contract.Requiref(oldProject != "", "oldProject", "must not be empty")
+	contract.Requiref(newProject != "", "newProject", "must not be empty")
+
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+
+	store, ok := b.store.(*projectReferenceStore)
+	if !ok {
+		return errors.New("renaming a project requires a project-scoped state store; " +
+			"run 'pulumi state upgrade' first")
+	}
+	if oldProject == newProject {
+		return nil
+	}
+
+	olds, err := store.ListProjectReferences(ctx, oldProject)
+	if err != nil {
+		return err
+	}
+	if len(olds) == 0 {
+		return fmt.Errorf("no stacks found in project %q", oldProject)
+	}
+
+	news := make([]*localBackendReference, len(olds))
+	for i, old := range olds {
+		news[i] = store.newReference(newProject, old.name)
+		news[i].org = old.org
+	}
+
+	// Lock every stack in the project up front, along with its destination,
+	// so that nothing can update the stacks while they are being moved
+	// or create stacks in their place.
+	refs := append(append([]*localBackendReference{}, olds...), news...)
+	for i, ref := range refs {
+		if err := b.Lock(ctx, ref); err != nil {
+			for _, locked := range refs[:i] {
+				b.Unlock(ctx, locked)
+			}
+			return err
+		}
+	}
+	defer func() {
+		for _, ref := range refs {
+			b.Unlock(ctx, ref)
+		}
+	}()
+
+	for i := range news {
+		// Ensure none of the destination stacks already exist.
+		exists, err := b.bucket.Exists(ctx, b.stackPath(ctx, news[i]))
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("a stack named %s already exists", news[i].String())
+		}
+	}
+
+	// Write out the new checkpoints for all stacks before touching the old ones.
+	// If any of them fails, remove the ones we've already written
+	// so that the project is left exactly as it was.
+	for i, old := range olds {
+		if err := b.copyStackToProject(ctx, old, news[i]); err != nil {
+			for _, written := range news[:i] {
+				b.removeCheckpoint(ctx, written)
+			}
+			b.removeCheckpoint(ctx, news[i])
+			return fmt.Errorf("rename %v to %v: %w", old, news[i], err)
+		}
+	}
+
+	// Every new checkpoint is in place.
+	// Only now is it safe to remove the old project.
+	for i, old := range olds {
+		file := b.stackPath(ctx, old)
+		b.backupTarget(ctx, file, false)
+		b.removeChecksum(ctx, file)
+
+		tags, err := b.getStackTags(ctx, old)
+		if err != nil {
+			return err
+		}
+		if err := b.saveStackTags(ctx, news[i], tags); err != nil {
+			return err
+		}
+		b.removeStackTags(ctx, old)
+		b.removeStackSecretsProvider(ctx, old)
+		if err := b.moveStackInitialConfig(ctx, old, news[i]); err != nil {
+			return err
+		}
+
+		if err := b.renameHistory(ctx, old, news[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyStackToProject writes the checkpoint of oldRef to newRef,
+// rewriting the URNs inside it to use the project of newRef.
+// The checkpoint of oldRef is left untouched.
+func (b *localBackend) copyStackToProject(ctx context.Context, oldRef, newRef *localBackendReference) error {
+	snap, err := b.getSnapshot(ctx, stack.DefaultSecretsProvider, oldRef)
+	if err != nil {
+		return err
+	}
+
+	if snap != nil {
+		if err := edit.RenameStack(snap, newRef.name, tokens.PackageName(newRef.project)); err != nil {
+			return err
+		}
+	}
+
+	// We pass nil to re-use the existing secrets manager from the snapshot.
+	_, err = b.saveStack(ctx, newRef, snap, nil)
+	return err
+}
+
+// removeCheckpoint deletes the checkpoint of the given stack
+// along with the checksum and secrets provider record written with it.
+// Failures are logged and otherwise ignored.
+func (b *localBackend) removeCheckpoint(ctx context.Context, ref *localBackendReference) {
+	file := b.stackPath(ctx, ref)
+	if err := b.bucket.Delete(ctx, file); err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting %v: %v skipping", file, err)
+	}
+	b.removeChecksum(ctx, file)
+	b.removeStackSecretsProvider(ctx, ref)
+}
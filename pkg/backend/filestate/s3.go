@@ -0,0 +1,99 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"gocloud.dev/blob"
+	"gocloud.dev/blob/s3blob"
+)
+
+// s3CompatibleParams are the query parameters of s3:// URLs
+// that point the backend at an S3-compatible service (e.g. MinIO or Ceph)
+// instead of AWS S3.
+var s3CompatibleParams = []string{"endpoint", "disableSSL", "s3ForcePathStyle"}
+
+// s3DefaultRegion is the region used for S3-compatible services
+// if none is specified in the URL or the environment.
+// These services typically ignore the region, but the AWS SDK requires one.
+const s3DefaultRegion = "us-east-1"
+
+// isS3CompatibleURL reports whether the given URL
+// points to an S3-compatible service rather than AWS S3.
+func isS3CompatibleURL(u *url.URL) bool {
+	if u.Scheme != s3blob.Scheme {
+		return false
+	}
+	q := u.Query()
+	for _, param := range s3CompatibleParams {
+		if q.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// openS3CompatibleBucket opens a bucket on an S3-compatible service
+// configured explicitly by the query parameters of the given s3:// URL:
+//
+//   - endpoint: URL of the service, e.g. "http://localhost:9000"
+//   - disableSSL: whether to use HTTP instead of HTTPS if the endpoint has no scheme
+//   - s3ForcePathStyle: whether to address buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>
+//   - region: region of the bucket; defaults to "us-east-1"
+//   - profile: the profile to read from the shared AWS configuration
+func openS3CompatibleBucket(ctx context.Context, u *url.URL) (*blob.Bucket, error) {
+	opts := session.Options{SharedConfigState: session.SharedConfigEnable}
+	for param, values := range u.Query() {
+		value := values[0]
+		switch param {
+		case "endpoint":
+			opts.Config.Endpoint = aws.String(value)
+		case "disableSSL":
+			disableSSL, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for query parameter %q: %w", param, err)
+			}
+			opts.Config.DisableSSL = aws.Bool(disableSSL)
+		case "s3ForcePathStyle":
+			forcePathStyle, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for query parameter %q: %w", param, err)
+			}
+			opts.Config.S3ForcePathStyle = aws.Bool(forcePathStyle)
+		case "region":
+			opts.Config.Region = aws.String(value)
+		case "profile":
+			opts.Profile = value
+		default:
+			return nil, fmt.Errorf("unknown query parameter %q", param)
+		}
+	}
+
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("create AWS session: %w", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(s3DefaultRegion)
+	}
+
+	return s3blob.OpenBucket(ctx, sess, u.Host, nil /* opts */)
+}
@@ -0,0 +1,170 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/pkg/v3/secrets"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// SecretsProviderExt is the extension of the file that records the secrets provider of a stack,
+// stored next to its checkpoint.
+//
+// For example, the secrets provider of the stack in "myproject/dev.json"
+// is recorded in "myproject/dev.secrets".
+// The file holds the type and state of the provider as found in the checkpoint,
+// which never includes the key itself.
+const SecretsProviderExt = ".secrets"
+
+func stackSecretsProviderPath(ref *localBackendReference) string {
+	return filepath.ToSlash(ref.StackBasePath()) + SecretsProviderExt
+}
+
+func (b *localBackend) GetStackSecretsProvider(
+	ctx context.Context, stackRef backend.StackReference,
+) (*apitype.SecretsProvidersV1, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, err
+	}
+
+	file := stackSecretsProviderPath(ref)
+	data, err := b.bucket.ReadAll(ctx, file)
+	if err != nil {
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			return nil, fmt.Errorf("read stack secrets provider: %w", err)
+		}
+
+		// Checkpoints written before the secrets provider was recorded separately
+		// still have it in the checkpoint itself.
+		chk, err := b.getCheckpoint(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		if chk.Latest == nil {
+			return nil, nil
+		}
+		return chk.Latest.SecretsProviders, nil
+	}
+
+	var provider apitype.SecretsProvidersV1
+	if err := json.Unmarshal(data, &provider); err != nil {
+		return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", file, err)
+	}
+	return &provider, nil
+}
+
+// saveStackSecretsProvider records the secrets provider used by the given checkpoint,
+// or removes the record if the checkpoint doesn't use one.
+func (b *localBackend) saveStackSecretsProvider(
+	ctx context.Context, ref *localBackendReference, checkpoint *apitype.VersionedCheckpoint,
+) error {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	// Only decode the parts of the checkpoint we need.
+	var chk struct {
+		Latest *struct {
+			SecretsProviders *apitype.SecretsProvidersV1 `json:"secrets_providers,omitempty"`
+		} `json:"latest,omitempty"`
+	}
+	if err := json.Unmarshal(checkpoint.Checkpoint, &chk); err != nil {
+		return fmt.Errorf("unmarshal checkpoint: %w", err)
+	}
+	if chk.Latest == nil || chk.Latest.SecretsProviders == nil {
+		b.removeStackSecretsProvider(ctx, ref)
+		return nil
+	}
+
+	data, err := json.Marshal(chk.Latest.SecretsProviders)
+	if err != nil {
+		return fmt.Errorf("marshal stack secrets provider: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, stackSecretsProviderPath(ref), data, nil); err != nil {
+		return fmt.Errorf("write stack secrets provider: %w", err)
+	}
+	return nil
+}
+
+// removeStackSecretsProvider deletes the secrets provider record of the given stack, if any.
+func (b *localBackend) removeStackSecretsProvider(ctx context.Context, ref *localBackendReference) {
+	file := stackSecretsProviderPath(ref)
+	err := b.bucket.Delete(ctx, file)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting stack secrets provider %v: %v skipping", file, err)
+	}
+}
+
+func (b *localBackend) RotateSecretsProvider(
+	ctx context.Context, stackRef backend.StackReference, newManager secrets.Manager,
+) error {
+	contract.Requiref(newManager != nil, "newManager", "must not be nil")
+	if err := b.checkWritable(); err != nil {
+		return err
+	}
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Lock(ctx, ref); err != nil {
+		return err
+	}
+	defer b.Unlock(ctx, ref)
+
+	// The snapshot holds the decrypted values of all secrets,
+	// so writing it back with the new manager re-encrypts them.
+	snap, err := b.getSnapshot(ctx, stack.DefaultSecretsProvider, ref)
+	if err != nil {
+		return fmt.Errorf("decrypt stack %s: %w", ref, err)
+	}
+	if snap == nil {
+		// Nothing has been deployed to the stack yet,
+		// so it has no secrets to rotate.
+		return nil
+	}
+	snap.SecretsManager = newManager
+
+	if _, err := b.saveStack(ctx, ref, snap, newManager); err != nil {
+		return fmt.Errorf("save stack %s: %w", ref, err)
+	}
+	return nil
+}
+
+func (b *localBackend) RotateAllSecretsProviders(ctx context.Context, newManager secrets.Manager) error {
+	refs, err := b.getLocalStacks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := b.RotateSecretsProvider(ctx, ref, newManager); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -16,12 +16,24 @@ package filestate
 
 import (
 	"context"
+	"fmt"
+	"sync"
+	"time"
 
+	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 )
 
 // localSnapshotManager is a simple SnapshotManager implementation that persists snapshots
 // to disk on the local machine.
+//
+// By default every snapshot is written out as soon as it's saved.
+// If batchSize or flushInterval are set, snapshots are held in memory instead,
+// and only the latest one is written out once batchSize snapshots have been saved,
+// or flushInterval after the first snapshot that hasn't been written out.
+// Flush must be called at the end of an update to write out the final snapshot.
 type localSnapshotPersister struct {
 	// TODO[pulumi/pulumi#12593]:
 	// Remove this once SnapshotPersister is updated to take a context.
@@ -29,10 +41,95 @@ type localSnapshotPersister struct {
 
 	ref     *localBackendReference
 	backend *localBackend
+
+	batchSize     int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending *apitype.VersionedCheckpoint // latest checkpoint not yet written out, if any
+	count   int                          // number of snapshots saved since the last write
+	timer   *time.Timer                  // pending time-based flush, if any
+	err     error                        // error from a time-based flush, reported by the next call
 }
 
 func (sp *localSnapshotPersister) Save(snapshot *deploy.Snapshot) error {
-	_, err := sp.backend.saveStack(sp.ctx, sp.ref, snapshot, snapshot.SecretsManager)
+	if sp.batchSize <= 1 && sp.flushInterval == 0 {
+		_, err := sp.backend.saveStack(sp.ctx, sp.ref, snapshot, snapshot.SecretsManager)
+		return err
+	}
+
+	// Serialize the snapshot right away:
+	// the engine keeps mutating its resources after Save returns.
+	chk, err := stack.SerializeCheckpoint(sp.ref.FullyQualifiedName(), snapshot, snapshot.SecretsManager,
+		false /* showSecrets */)
+	if err != nil {
+		return fmt.Errorf("serializing checkpoint: %w", err)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	if err := sp.err; err != nil {
+		sp.err = nil
+		return err
+	}
+
+	sp.pending = chk
+	sp.count++
+
+	// Like saveStack, write out an invalid snapshot right away rather than holding it,
+	// since it may contain resource state updates, but report that it's invalid.
+	if !backend.DisableIntegrityChecking {
+		if verifyerr := snapshot.VerifyIntegrity(); verifyerr != nil {
+			if err := sp.flushLocked(); err != nil {
+				return err
+			}
+			return fmt.Errorf("snapshot integrity failure; it was already written, but is invalid: %w", verifyerr)
+		}
+	}
+
+	if sp.batchSize > 0 && sp.count >= sp.batchSize {
+		return sp.flushLocked()
+	}
+	if sp.flushInterval > 0 && sp.timer == nil {
+		sp.timer = time.AfterFunc(sp.flushInterval, func() {
+			sp.mu.Lock()
+			defer sp.mu.Unlock()
+
+			if err := sp.flushLocked(); err != nil && sp.err == nil {
+				sp.err = err
+			}
+		})
+	}
+	return nil
+}
+
+// Flush writes out the latest saved snapshot if it hasn't been written out yet.
+// It also reports errors from earlier time-based flushes.
+func (sp *localSnapshotPersister) Flush() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	err := sp.flushLocked()
+	if err == nil {
+		err = sp.err
+	}
+	sp.err = nil
+	return err
+}
+
+func (sp *localSnapshotPersister) flushLocked() error {
+	if sp.timer != nil {
+		sp.timer.Stop()
+		sp.timer = nil
+	}
+	if sp.pending == nil {
+		return nil
+	}
+
+	chk := sp.pending
+	sp.pending, sp.count = nil, 0
+	_, _, err := sp.backend.saveCheckpoint(sp.ctx, sp.ref, chk)
 	return err
 }
 
@@ -40,5 +137,11 @@ func (b *localBackend) newSnapshotPersister(
 	ctx context.Context,
 	ref *localBackendReference,
 ) *localSnapshotPersister {
-	return &localSnapshotPersister{ctx: ctx, ref: ref, backend: b}
+	return &localSnapshotPersister{
+		ctx:           ctx,
+		ref:           ref,
+		backend:       b,
+		batchSize:     b.checkpointBatchSize,
+		flushInterval: b.checkpointFlushInterval,
+	}
 }
@@ -0,0 +1,199 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/deploy"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/testing/diagtest"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// newTestPersister creates a stack in a new backend with the given environment
+// and returns a snapshot persister for it.
+func newTestPersister(tb testing.TB, vars env.MapStore) (*localBackend, *localSnapshotPersister) {
+	ctx := context.Background()
+	b, err := newLocalBackend(ctx, diagtest.LogSink(tb), "file://"+filepath.ToSlash(tb.TempDir()),
+		&workspace.Project{Name: "testproj"}, &localBackendOptions{Env: env.NewEnv(vars)})
+	require.NoError(tb, err)
+
+	ref, err := b.parseStackReference("dev")
+	require.NoError(tb, err)
+	_, err = b.CreateStack(ctx, ref, "", nil)
+	require.NoError(tb, err)
+
+	return b, b.newSnapshotPersister(ctx, ref)
+}
+
+// makeSnapshot builds a snapshot of the "dev" stack with the given number of resources.
+func makeSnapshot(numResources int) *deploy.Snapshot {
+	resources := make([]*resource.State, numResources)
+	for i := range resources {
+		resources[i] = &resource.State{
+			URN:    resource.NewURN("dev", "testproj", "", "a:b:c", fmt.Sprintf("res-%d", i)),
+			Type:   "a:b:c",
+			Custom: true,
+			ID:     resource.ID(strconv.Itoa(i)),
+			Outputs: resource.PropertyMap{
+				"value": resource.NewStringProperty(fmt.Sprintf("value-%d", i)),
+			},
+		}
+	}
+	return deploy.NewSnapshot(deploy.Manifest{}, nil, resources, nil)
+}
+
+// savedResources returns the number of resources in the checkpoint of the persister's stack.
+func savedResources(t *testing.T, sp *localSnapshotPersister) int {
+	t.Helper()
+
+	chk, err := sp.backend.getCheckpoint(context.Background(), sp.ref)
+	require.NoError(t, err)
+	if chk.Latest == nil {
+		return 0
+	}
+	return len(chk.Latest.Resources)
+}
+
+func TestSnapshotPersister_batchSize(t *testing.T) {
+	t.Parallel()
+
+	_, sp := newTestPersister(t, env.MapStore{
+		"PULUMI_SELF_MANAGED_CHECKPOINT_BATCH_SIZE": "3",
+	})
+
+	require.NoError(t, sp.Save(makeSnapshot(1)))
+	require.NoError(t, sp.Save(makeSnapshot(2)))
+	assert.Equal(t, 0, savedResources(t, sp), "snapshots must be held until the batch is full")
+
+	require.NoError(t, sp.Save(makeSnapshot(3)))
+	assert.Equal(t, 3, savedResources(t, sp), "a full batch must be written out")
+
+	require.NoError(t, sp.Save(makeSnapshot(4)))
+	assert.Equal(t, 3, savedResources(t, sp))
+
+	require.NoError(t, sp.Flush())
+	assert.Equal(t, 4, savedResources(t, sp), "Flush must write out the latest snapshot")
+
+	// Nothing left to flush.
+	require.NoError(t, sp.Flush())
+	assert.Equal(t, 4, savedResources(t, sp))
+}
+
+func TestSnapshotPersister_flushInterval(t *testing.T) {
+	t.Parallel()
+
+	_, sp := newTestPersister(t, env.MapStore{
+		"PULUMI_SELF_MANAGED_CHECKPOINT_FLUSH_INTERVAL": "10ms",
+	})
+
+	require.NoError(t, sp.Save(makeSnapshot(1)))
+	require.NoError(t, sp.Save(makeSnapshot(2)))
+	assert.Eventually(t, func() bool {
+		return savedResources(t, sp) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, sp.Flush())
+}
+
+func TestSnapshotPersister_default(t *testing.T) {
+	t.Parallel()
+
+	_, sp := newTestPersister(t, nil)
+
+	// Without batching, every snapshot is written out right away.
+	require.NoError(t, sp.Save(makeSnapshot(1)))
+	assert.Equal(t, 1, savedResources(t, sp))
+	require.NoError(t, sp.Save(makeSnapshot(2)))
+	assert.Equal(t, 2, savedResources(t, sp))
+}
+
+//nolint:paralleltest // mutates global state
+func TestSnapshotPersister_batchedIntegrity(t *testing.T) {
+	backend.DisableIntegrityChecking = false
+
+	_, sp := newTestPersister(t, env.MapStore{
+		"PULUMI_SELF_MANAGED_CHECKPOINT_BATCH_SIZE": "3",
+	})
+
+	require.NoError(t, sp.Save(makeSnapshot(1)))
+
+	// An invalid snapshot is written out right away and reported.
+	snap := makeSnapshot(2)
+	snap.Resources[0].Parent = snap.Resources[1].URN
+	err := sp.Save(snap)
+	assert.ErrorContains(t, err, "snapshot integrity failure")
+	assert.Equal(t, 2, savedResources(t, sp))
+}
+
+func TestSnapshotPersister_invalidConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		key, value string
+	}{
+		{"PULUMI_SELF_MANAGED_CHECKPOINT_BATCH_SIZE", "-1"},
+		{"PULUMI_SELF_MANAGED_CHECKPOINT_FLUSH_INTERVAL", "often"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.key, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := newLocalBackend(context.Background(), diagtest.LogSink(t),
+				"file://"+filepath.ToSlash(t.TempDir()), nil,
+				&localBackendOptions{Env: env.NewEnv(env.MapStore{tt.key: tt.value})})
+			assert.ErrorContains(t, err, "invalid value for "+tt.key)
+		})
+	}
+}
+
+// BenchmarkSnapshotPersister simulates an update of a large stack
+// that saves a snapshot after each step.
+func BenchmarkSnapshotPersister(b *testing.B) {
+	const numResources = 2000
+	snap := makeSnapshot(numResources)
+
+	for _, batchSize := range []int{1, 10, 100} {
+		batchSize := batchSize
+		b.Run(fmt.Sprintf("batch=%d", batchSize), func(b *testing.B) {
+			backend, sp := newTestPersister(b, env.MapStore{
+				"PULUMI_SELF_MANAGED_CHECKPOINT_BATCH_SIZE": strconv.Itoa(batchSize),
+			})
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				for step := 0; step < 100; step++ {
+					require.NoError(b, sp.Save(snap))
+				}
+				require.NoError(b, sp.Flush())
+			}
+
+			b.StopTimer()
+			b.ReportMetric(float64(backend.Stats().BytesWritten)/float64(b.N), "written-bytes/op")
+		})
+	}
+}
@@ -43,9 +43,11 @@ type localStack struct {
 	snapshot atomic.Pointer[*deploy.Snapshot]
 	// a pointer to the backend this stack belongs to.
 	b *localBackend
+	// the stack's tags, if any.
+	tags map[apitype.StackTagName]string
 }
 
-func newStack(ref *localBackendReference, b *localBackend) backend.Stack {
+func newStack(ref *localBackendReference, b *localBackend) *localStack {
 	contract.Requiref(ref != nil, "ref", "ref was nil")
 
 	return &localStack{
@@ -69,7 +71,7 @@ func (s *localStack) Snapshot(ctx context.Context, secretsProvider secrets.Provi
 	return snap, nil
 }
 func (s *localStack) Backend() backend.Backend              { return s.b }
-func (s *localStack) Tags() map[apitype.StackTagName]string { return nil }
+func (s *localStack) Tags() map[apitype.StackTagName]string { return s.tags }
 
 func (s *localStack) Remove(ctx context.Context, force bool) (bool, error) {
 	return backend.RemoveStack(ctx, s, force)
@@ -127,12 +129,12 @@ func (s *localStack) DefaultSecretManager(info *workspace.ProjectStack) (secrets
 }
 
 type localStackSummary struct {
-	name backend.StackReference
-	chk  *apitype.CheckpointV3
+	name    backend.StackReference
+	summary *checkpointSummary
 }
 
-func newLocalStackSummary(name backend.StackReference, chk *apitype.CheckpointV3) localStackSummary {
-	return localStackSummary{name: name, chk: chk}
+func newLocalStackSummary(name backend.StackReference, summary *checkpointSummary) localStackSummary {
+	return localStackSummary{name: name, summary: summary}
 }
 
 func (lss localStackSummary) Name() backend.StackReference {
@@ -140,8 +142,8 @@ func (lss localStackSummary) Name() backend.StackReference {
 }
 
 func (lss localStackSummary) LastUpdate() *time.Time {
-	if lss.chk != nil && lss.chk.Latest != nil {
-		if t := lss.chk.Latest.Manifest.Time; !t.IsZero() {
+	if lss.summary != nil && lss.summary.HasLatest {
+		if t := lss.summary.LastUpdate; !t.IsZero() {
 			return &t
 		}
 	}
@@ -149,8 +151,8 @@ func (lss localStackSummary) LastUpdate() *time.Time {
 }
 
 func (lss localStackSummary) ResourceCount() *int {
-	if lss.chk != nil && lss.chk.Latest != nil {
-		count := len(lss.chk.Latest.Resources)
+	if lss.summary != nil && lss.summary.HasLatest {
+		count := lss.summary.ResourceCount
 		return &count
 	}
 	return nil
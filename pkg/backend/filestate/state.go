@@ -15,12 +15,16 @@
 package filestate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +43,7 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/slice"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
@@ -187,65 +192,152 @@ func (b *localBackend) getSnapshot(ctx context.Context,
 
 // GetCheckpoint loads a checkpoint file for the given stack in this project, from the current project workspace.
 func (b *localBackend) getCheckpoint(ctx context.Context, ref *localBackendReference) (*apitype.CheckpointV3, error) {
-	chkpath := b.stackPath(ctx, ref)
-	bytes, err := b.bucket.ReadAll(ctx, chkpath)
+	chkpath, bytes, err := b.readCheckpoint(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
-	m := encoding.JSON
-	if encoding.IsCompressed(bytes) {
-		m = encoding.Gzip(m)
+	m := compressionForFile(chkpath, bytes).Wrap(stateMarshaler(chkpath))
+
+	if b.Env.GetBool(env.SelfManagedStrictCheckpoint) {
+		if err := checkStrictCheckpoint(m, bytes); err != nil {
+			return nil, fmt.Errorf("%s: %w; "+
+				"it may have been written by a newer version of the Pulumi CLI, please upgrade", chkpath, err)
+		}
 	}
 
 	return stack.UnmarshalVersionedCheckpointToLatestCheckpoint(m, bytes)
 }
 
+// checkStrictCheckpoint reports an error naming the first field of the given checkpoint
+// that isn't part of the checkpoint types known to this version of the CLI.
+//
+// Only the current checkpoint version is checked:
+// older versions were written by older CLIs, which don't add unknown fields.
+func checkStrictCheckpoint(m encoding.Marshaler, data []byte) error {
+	// Let the marshaler take care of decompression and markup,
+	// and check the JSON form of the checkpoint.
+	var raw json.RawMessage
+	if err := m.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	var versioned apitype.VersionedCheckpoint
+	if err := strictUnmarshalJSON(raw, &versioned); err != nil {
+		return err
+	}
+	if versioned.Version != apitype.DeploymentSchemaVersionCurrent {
+		return nil
+	}
+
+	// The checkpoint itself is kept as raw JSON in the versioned checkpoint,
+	// so it needs to be checked separately.
+	var checkpoint apitype.CheckpointV3
+	return strictUnmarshalJSON(versioned.Checkpoint, &checkpoint)
+}
+
+// strictUnmarshalJSON is like json.Unmarshal, but fails on fields that v has no place for.
+func strictUnmarshalJSON(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// readCheckpoint reads the checkpoint file of the given stack as stored in the bucket,
+// verifying its checksum unless that's disabled.
+// It returns the path of the file and its contents.
+func (b *localBackend) readCheckpoint(ctx context.Context, ref *localBackendReference) (string, []byte, error) {
+	chkpath := b.stackPath(ctx, ref)
+	bytes, err := b.bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		return "", nil, err
+	}
+	if !b.Env.GetBool(env.SelfManagedSkipChecksumVerification) {
+		if err := b.verifyChecksum(ctx, chkpath, bytes); err != nil {
+			// The checkpoint may have been replaced between reading it and reading its checksum,
+			// in which case reading both again gives a consistent pair.
+			if bytes, err = b.bucket.ReadAll(ctx, chkpath); err != nil {
+				return "", nil, err
+			}
+			if err := b.verifyChecksum(ctx, chkpath, bytes); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return chkpath, bytes, nil
+}
+
+func (b *localBackend) GetRawCheckpoint(
+	ctx context.Context, stackRef backend.StackReference,
+) ([]byte, string, error) {
+	ref, err := b.getReference(stackRef)
+	if err != nil {
+		return nil, "", err
+	}
+
+	chkpath, data, err := b.readCheckpoint(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+	codec := compressionForFile(chkpath, data)
+	data, err = codec.Decompress(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("decompress %v: %w", chkpath, err)
+	}
+
+	format := strings.TrimPrefix(filepath.Ext(trimCompressionExt(chkpath)), ".")
+	if codec != noCompression {
+		format += "+" + codec.String()
+	}
+	return data, format, nil
+}
+
 func (b *localBackend) saveCheckpoint(
 	ctx context.Context,
 	ref *localBackendReference,
 	checkpoint *apitype.VersionedCheckpoint,
 ) (backupFile string, file string, _ error) {
 	// Make a serializable stack and then use the encoder to encode it.
-	file = b.stackPath(ctx, ref)
-	m, ext := encoding.Detect(strings.TrimSuffix(file, ".gz"))
-	if m == nil {
-		return "", "", fmt.Errorf("resource serialization failed; illegal markup extension: '%v'", ext)
-	}
-	if filepath.Ext(file) == "" {
-		file = file + ext
-	}
-	if b.gzip {
-		if filepath.Ext(file) != encoding.GZIPExt {
-			file = file + ".gz"
-		}
-		m = encoding.Gzip(m)
-	} else {
-		file = strings.TrimSuffix(file, ".gz")
-	}
+	// New checkpoints are always written in the configured markup and compression,
+	// whichever ones the existing checkpoint uses.
+	existing := b.stackPath(ctx, ref)
+	filePlain := trimStateMarkupExt(existing) + b.markupExt
+	file = filePlain + b.compression.Ext()
+	m := b.compression.Wrap(stateMarshaler(filePlain))
 
 	byts, err := m.Marshal(checkpoint)
 	if err != nil {
 		return "", "", fmt.Errorf("An IO error occurred while marshalling the checkpoint: %w", err)
 	}
 
-	// Back up the existing file if it already exists. Don't delete the original, the following WriteAll will
+	// Back up the existing file if it already exists. Don't delete the original, the following writeAtomic will
 	// atomically replace it anyway and various other bits of the system depend on being able to find the
 	// .json file to know the stack currently exists (see https://github.com/pulumi/pulumi/issues/9033 for
 	// context).
-	filePlain := strings.TrimSuffix(file, ".gz")
-	fileGzip := filePlain + ".gz"
+	//
 	// We need to make sure that an out of date state file doesn't exist so we
 	// only keep the file of the type we are working with.
-	bckGzip := backupTarget(ctx, b.bucket, fileGzip, b.gzip)
-	bckPlain := backupTarget(ctx, b.bucket, filePlain, !b.gzip)
-	if b.gzip {
-		backupFile = bckGzip
-	} else {
-		backupFile = bckPlain
+	for _, c := range compressions {
+		bck := b.backupTarget(ctx, filePlain+c.Ext(), c == b.compression)
+		if c == b.compression {
+			backupFile = bck
+		} else {
+			b.removeChecksum(ctx, filePlain+c.Ext())
+		}
+	}
+	// Likewise for an existing checkpoint in another markup.
+	if trimCompressionExt(existing) != filePlain {
+		b.backupTarget(ctx, existing, false)
+		b.removeChecksum(ctx, existing)
+	}
+
+	// Let the checksum accept the new checkpoint before writing it,
+	// so that it can be read while it's replaced.
+	if err := b.prepareChecksum(ctx, file, byts); err != nil {
+		return backupFile, "", err
 	}
 
 	// And now write out the new snapshot file, overwriting that location.
-	if err = b.bucket.WriteAll(ctx, file, byts, nil); err != nil {
+	if err = b.writeAtomic(ctx, file, byts); err != nil {
 
 		b.mutex.Lock()
 		defer b.mutex.Unlock()
@@ -262,7 +354,7 @@ func (b *localBackend) saveCheckpoint(
 			Backoff:  &backoff,
 			Accept: func(try int, nextRetryTime time.Duration) (bool, interface{}, error) {
 				// And now write out the new snapshot file, overwriting that location.
-				err := b.bucket.WriteAll(ctx, file, byts, nil)
+				err := b.writeAtomic(ctx, file, byts)
 				if err != nil {
 					logging.V(7).Infof("Error while writing snapshot to: %s (attempt=%d, error=%s)", file, try, err)
 					if try > 10 {
@@ -278,11 +370,23 @@ func (b *localBackend) saveCheckpoint(
 		}
 	}
 
+	// Now that the checkpoint is written, the checksum only needs to accept it.
+	// If this fails, the prepared checksum still accepts the new checkpoint.
+	if err := b.writeChecksum(ctx, file, byts); err != nil {
+		return backupFile, "", err
+	}
+
+	// Record the secrets provider next to the checkpoint
+	// so that it can be reported without reading the whole checkpoint.
+	if err := b.saveStackSecretsProvider(ctx, ref, checkpoint); err != nil {
+		return backupFile, "", err
+	}
+
 	logging.V(7).Infof("Saved stack %s checkpoint to: %s (backup=%s)", ref.FullyQualifiedName(), file, backupFile)
 
 	// And if we are retaining historical checkpoint information, write it out again
 	if b.Env.GetBool(env.SelfManagedRetainCheckpoints) {
-		if err = b.bucket.WriteAll(ctx, fmt.Sprintf("%v.%v", file, time.Now().UnixNano()), byts, nil); err != nil {
+		if err = b.bucket.WriteAll(ctx, fmt.Sprintf("%v.%v", file, b.clock.Now().UnixNano()), byts, nil); err != nil {
 			return backupFile, "", fmt.Errorf("An IO error occurred while writing the new snapshot file: %w", err)
 		}
 	}
@@ -311,6 +415,11 @@ func (b *localBackend) saveStack(
 		// out the checkpoint file since it may contain resource state updates.  But we will warn the user that the
 		// file is already written and might be bad.
 		if verifyerr := snap.VerifyIntegrity(); verifyerr != nil {
+			if backup == "" {
+				return "", fmt.Errorf(
+					"%s: snapshot integrity failure; it was already written, but is invalid: %w",
+					file, verifyerr)
+			}
 			return "", fmt.Errorf(
 				"%s: snapshot integrity failure; it was already written, but is invalid (backup available at %s): %w",
 				file, backup, verifyerr)
@@ -326,7 +435,11 @@ func (b *localBackend) removeStack(ctx context.Context, ref *localBackendReferen
 
 	// Just make a backup of the file and don't write out anything new.
 	file := b.stackPath(ctx, ref)
-	backupTarget(ctx, b.bucket, file, false)
+	b.backupTarget(ctx, file, false)
+	b.removeChecksum(ctx, file)
+	b.removeStackTags(ctx, ref)
+	b.removeStackSecretsProvider(ctx, ref)
+	b.removeStackInitialConfig(ctx, ref)
 
 	historyDir := ref.HistoryDir()
 	return removeAllByPrefix(ctx, b.bucket, historyDir)
@@ -353,6 +466,22 @@ func backupTarget(ctx context.Context, bucket Bucket, file string, keepOriginal
 	return bck
 }
 
+// backupTarget is like the backupTarget function,
+// but only removes the original file (unless keepOriginal is set) if backups are disabled.
+// It returns the path of the backup, or "" if no backup was made.
+func (b *localBackend) backupTarget(ctx context.Context, file string, keepOriginal bool) string {
+	if !b.disableBackups {
+		return backupTarget(ctx, b.bucket, file, keepOriginal)
+	}
+
+	if !keepOriginal {
+		if err := b.bucket.Delete(ctx, file); err != nil {
+			logging.V(5).Infof("error deleting %v: %v skipping", file, err)
+		}
+	}
+	return ""
+}
+
 // backupStack copies the current Checkpoint file to ~/.pulumi/backups.
 func (b *localBackend) backupStack(ctx context.Context, ref *localBackendReference) error {
 	contract.Requiref(ref != nil, "ref", "must not be nil")
@@ -376,14 +505,14 @@ func (b *localBackend) backupStack(ctx context.Context, ref *localBackendReferen
 	stackFile := filepath.Base(stackPath)
 	ext := filepath.Ext(stackFile)
 	base := strings.TrimSuffix(stackFile, ext)
-	if ext2 := filepath.Ext(base); ext2 != "" && ext == encoding.GZIPExt {
+	if ext2 := filepath.Ext(base); ext2 != "" && trimCompressionExt(stackFile) != stackFile {
 		// base: stack-name.json, ext: .gz
 		// ->
 		// base: stack-name, ext: .json.gz
 		ext = ext2 + ext
 		base = strings.TrimSuffix(base, ext2)
 	}
-	backupFile := fmt.Sprintf("%s.%v%s", base, time.Now().UnixNano(), ext)
+	backupFile := fmt.Sprintf("%s.%v%s", base, b.clock.Now().UnixNano(), ext)
 	return b.bucket.WriteAll(ctx, filepath.Join(backupDir, backupFile), byts, nil)
 }
 
@@ -395,54 +524,157 @@ func (b *localBackend) stackPath(ctx context.Context, ref *localBackendReference
 	// We can't use listBucket here for as we need to do a partial prefix match on filename, while the
 	// "dir" option to listBucket is always suffixed with "/". Also means we don't need to save any
 	// results in a slice.
-	plainPath := filepath.ToSlash(ref.StackBasePath()) + ".json"
-	gzipedPath := plainPath + ".gz"
+	basePath := filepath.ToSlash(ref.StackBasePath())
+	candidates := make(map[string]struct{}, len(stateMarkupExts)*len(compressions))
+	for _, ext := range stateMarkupExts {
+		for _, c := range compressions {
+			candidates[basePath+ext+c.Ext()] = struct{}{}
+		}
+	}
+	plainPath := basePath + b.markupExt
 
 	bucketIter := b.bucket.List(&blob.ListOptions{
 		Delimiter: "/",
-		Prefix:    plainPath,
+		Prefix:    basePath + ".",
 	})
 
-	var plainObj *blob.ListObject
+	// The plain object will always come out first since objects are sorted by Key.
+	// Compressed objects win over the plain one unless the plain one was modified after them.
+	var found *blob.ListObject
 	for {
 		file, err := bucketIter.Next(ctx)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			// Error fetching the available ojects, assume .json
+			// Error fetching the available ojects, assume the configured markup.
 			return plainPath
 		}
 
-		// plainObj will always come out first since allObjs is sorted by Key
-		if file.Key == plainPath {
-			plainObj = file
-		} else if file.Key == gzipedPath {
-			// We have a plain .json file and it was modified after this gzipped one so use it.
-			if plainObj != nil && plainObj.ModTime.After(file.ModTime) {
-				return plainPath
-			}
-			// else use the gzipped object
-			return gzipedPath
+		if _, ok := candidates[file.Key]; !ok {
+			continue
 		}
+		if found == nil || !found.ModTime.After(file.ModTime) {
+			found = file
+		}
+	}
+	if found == nil {
+		// Couldn't find any objects, assume uncompressed path.
+		return plainPath
 	}
-	// Couldn't find any objects, assume nongzipped path?
-	return plainPath
+	return found.Key
 }
 
 // getHistory returns locally stored update history. The first element of the result will be
 // the most recent update record.
+//
+// If filter is non-nil, only the updates matching it are returned, and pages are made up of matching updates.
+// History records are then read one at a time until the requested page is full,
+// so total is only the number of matching updates up to the end of that page.
 func (b *localBackend) getHistory(
 	ctx context.Context,
 	stack *localBackendReference,
 	pageSize int, page int,
-) ([]backend.UpdateInfo, error) {
+	filter *HistoryFilter,
+) (_ []backend.UpdateInfo, total int, _ error) {
 	contract.Requiref(stack != nil, "stack", "must not be nil")
 
-	dir := stack.HistoryDir()
 	// TODO: we could consider optimizing the list operation using `page` and `pageSize`.
 	// Unfortunately, this is mildly invasive given the gocloud List API.
-	allFiles, err := listBucket(ctx, b.bucket, dir)
+	historyEntries, err := b.historyEntries(ctx, stack)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if filter != nil {
+		return b.getFilteredHistory(ctx, historyEntries, pageSize, page, filter)
+	}
+
+	start := 0
+	end := len(historyEntries) - 1
+	if pageSize > 0 {
+		if page < 1 {
+			page = 1
+		}
+		start = (page - 1) * pageSize
+		end = start + pageSize - 1
+		if end > len(historyEntries)-1 {
+			end = len(historyEntries) - 1
+		}
+	}
+
+	var updates []backend.UpdateInfo
+
+	for i := start; i <= end; i++ {
+		update, err := b.readHistoryEntry(ctx, historyEntries[i].Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		updates = append(updates, update)
+	}
+
+	return updates, len(historyEntries), nil
+}
+
+// getFilteredHistory implements getHistory for a non-nil filter.
+func (b *localBackend) getFilteredHistory(
+	ctx context.Context,
+	historyEntries []*blob.ListObject,
+	pageSize int, page int,
+	filter *HistoryFilter,
+) (_ []backend.UpdateInfo, total int, _ error) {
+	start := 0
+	if pageSize > 0 {
+		if page < 1 {
+			page = 1
+		}
+		start = (page - 1) * pageSize
+	}
+
+	var updates []backend.UpdateInfo
+	for _, file := range historyEntries {
+		if pageSize > 0 && len(updates) == pageSize {
+			break
+		}
+
+		update, err := b.readHistoryEntry(ctx, file.Key)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !filter.matches(update) {
+			continue
+		}
+
+		if total >= start {
+			updates = append(updates, update)
+		}
+		total++
+	}
+
+	return updates, total, nil
+}
+
+// readHistoryEntry reads the update record stored in the given history file.
+func (b *localBackend) readHistoryEntry(ctx context.Context, filepath string) (backend.UpdateInfo, error) {
+	var update backend.UpdateInfo
+	data, err := b.bucket.ReadAll(ctx, filepath)
+	if err != nil {
+		return update, fmt.Errorf("reading history file %s: %w", filepath, err)
+	}
+	m := compressionForFile(filepath, data).Wrap(stateMarshaler(filepath))
+	if err := m.Unmarshal(data, &update); err != nil {
+		return update, fmt.Errorf("reading history file %s: %w", filepath, err)
+	}
+	return update, nil
+}
+
+// historyEntries lists the .history.json and .history.yaml files of the given stack,
+// with the most recent update first.
+func (b *localBackend) historyEntries(
+	ctx context.Context,
+	stack *localBackendReference,
+) ([]*blob.ListObject, error) {
+	allFiles, err := listBucket(ctx, b.bucket, stack.HistoryDir())
 	if err != nil {
 		// History doesn't exist until a stack has been updated.
 		if gcerrors.Code(err) == gcerrors.NotFound {
@@ -461,51 +693,47 @@ func (b *localBackend) getHistory(
 		filepath := file.Key
 
 		// ignore checkpoints
-		if !strings.HasSuffix(filepath, ".history.json") &&
-			!strings.HasSuffix(filepath, ".history.json.gz") {
+		if stateMarshaler(filepath) == nil || !strings.HasSuffix(trimStateMarkupExt(filepath), ".history") {
 			continue
 		}
 
 		historyEntries = append(historyEntries, file)
 	}
 
-	start := 0
-	end := len(historyEntries) - 1
-	if pageSize > 0 {
-		if page < 1 {
-			page = 1
-		}
-		start = (page - 1) * pageSize
-		end = start + pageSize - 1
-		if end > len(historyEntries)-1 {
-			end = len(historyEntries) - 1
-		}
-	}
+	return historyEntries, nil
+}
 
-	var updates []backend.UpdateInfo
+// getHistoricalCheckpoint loads the checkpoint archived alongside the update
+// at the given index of the stack's history, where 0 is the most recent update.
+func (b *localBackend) getHistoricalCheckpoint(
+	ctx context.Context,
+	ref *localBackendReference,
+	updateIndex int,
+) (*apitype.CheckpointV3, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
 
-	for i := start; i <= end; i++ {
-		file := historyEntries[i]
-		filepath := file.Key
+	historyEntries, err := b.historyEntries(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	if updateIndex < 0 || updateIndex >= len(historyEntries) {
+		return nil, backend.ErrNoPreviousDeployment
+	}
 
-		var update backend.UpdateInfo
-		b, err := b.bucket.ReadAll(ctx, filepath)
-		if err != nil {
-			return nil, fmt.Errorf("reading history file %s: %w", filepath, err)
-		}
-		m := encoding.JSON
-		if encoding.IsCompressed(b) {
-			m = encoding.Gzip(m)
-		}
-		err = m.Unmarshal(b, &update)
-		if err != nil {
-			return nil, fmt.Errorf("reading history file %s: %w", filepath, err)
-		}
+	// addToHistory writes <prefix>.history.<markup>[.gz|.zst]
+	// alongside <prefix>.checkpoint.<markup>[.gz|.zst].
+	historyFile := historyEntries[updateIndex].Key
+	historyBase := trimStateMarkupExt(historyFile)
+	exts := strings.TrimPrefix(historyFile, historyBase)
+	chkpath := strings.TrimSuffix(historyBase, ".history") + ".checkpoint" + exts
 
-		updates = append(updates, update)
+	bytes, err := b.bucket.ReadAll(ctx, chkpath)
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint file %s: %w", chkpath, err)
 	}
+	m := compressionForFile(chkpath, bytes).Wrap(stateMarshaler(chkpath))
 
-	return updates, nil
+	return stack.UnmarshalVersionedCheckpointToLatestCheckpoint(m, bytes)
 }
 
 func (b *localBackend) renameHistory(ctx context.Context, oldName, newName *localBackendReference) error {
@@ -558,13 +786,10 @@ func (b *localBackend) addToHistory(ctx context.Context, ref *localBackendRefere
 	dir := ref.HistoryDir()
 
 	// Prefix for the update and checkpoint files.
-	pathPrefix := path.Join(dir, fmt.Sprintf("%s-%d", ref.name, time.Now().UnixNano()))
+	pathPrefix := path.Join(dir, fmt.Sprintf("%s-%d", ref.name, b.clock.Now().UnixNano()))
 
-	m, ext := encoding.JSON, "json"
-	if b.gzip {
-		m = encoding.Gzip(m)
-		ext += ".gz"
-	}
+	m := b.compression.Wrap(stateMarshaler(b.markupExt))
+	ext := strings.TrimPrefix(b.markupExt, ".") + b.compression.Ext()
 
 	// Save the history file.
 	byts, err := m.Marshal(&update)
@@ -581,3 +806,132 @@ func (b *localBackend) addToHistory(ctx context.Context, ref *localBackendRefere
 	checkpointFile := fmt.Sprintf("%s.checkpoint.%s", pathPrefix, ext)
 	return b.bucket.Copy(ctx, checkpointFile, b.stackPath(ctx, ref), nil)
 }
+
+// historyRecord is a single update record in the history directory of a stack.
+// Each record is made up of a <stack-name>-<timestamp>.history.json[.gz|.zst] file
+// and a matching .checkpoint.json[.gz|.zst] file.
+type historyRecord struct {
+	timestamp time.Time
+	keys      []string
+}
+
+// listHistoryRecords returns all update records in the history directory of the given stack,
+// sorted with the most recent record first.
+func (b *localBackend) listHistoryRecords(
+	ctx context.Context,
+	ref *localBackendReference,
+) ([]*historyRecord, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	allFiles, err := listBucket(ctx, b.bucket, ref.HistoryDir())
+	if err != nil {
+		// History doesn't exist until a stack has been updated.
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	// Records keyed by their <stack-name>-<timestamp> prefix.
+	records := make(map[string]*historyRecord)
+	for _, file := range allFiles {
+		if file.IsDir {
+			continue
+		}
+
+		// Skip files without valid extensions, but accept compressed files.
+		fileName := objectName(file)
+		base := trimCompressionExt(fileName)
+		ext := filepath.Ext(base)
+		if _, has := encoding.Marshalers[ext]; !has {
+			continue
+		}
+		base = strings.TrimSuffix(base, ext)
+
+		var prefix string
+		switch {
+		case strings.HasSuffix(base, ".history"):
+			prefix = strings.TrimSuffix(base, ".history")
+		case strings.HasSuffix(base, ".checkpoint"):
+			prefix = strings.TrimSuffix(base, ".checkpoint")
+		default:
+			continue
+		}
+
+		// The prefix is in the form <stack-name>-<timestamp>.
+		// If we find files that don't match this format, ignore them.
+		dashIndex := strings.LastIndex(prefix, "-")
+		if dashIndex == -1 || prefix[:dashIndex] != ref.name.String() {
+			continue
+		}
+		nanos, err := strconv.ParseInt(prefix[dashIndex+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		record, ok := records[prefix]
+		if !ok {
+			record = &historyRecord{timestamp: time.Unix(0, nanos)}
+			records[prefix] = record
+		}
+		record.keys = append(record.keys, file.Key)
+	}
+
+	result := slice.Prealloc[*historyRecord](len(records))
+	for _, record := range records {
+		sort.Strings(record.keys)
+		result = append(result, record)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].timestamp.After(result[j].timestamp)
+	})
+	return result, nil
+}
+
+// pruneHistory deletes update records from the history of the given stack
+// beyond the keepLast most recent ones, or older than olderThan.
+// It returns the keys of the deleted objects, or the keys it would delete if dryRun is set.
+//
+// The caller is responsible for holding the stack lock.
+func (b *localBackend) pruneHistory(
+	ctx context.Context,
+	ref *localBackendReference,
+	keepLast int, olderThan time.Duration, dryRun bool,
+) ([]string, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	records, err := b.listHistoryRecords(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("list history: %w", err)
+	}
+
+	var cutoff time.Time
+	if olderThan > 0 {
+		cutoff = b.clock.Now().Add(-olderThan)
+	}
+
+	var pruned []string
+	for idx, record := range records {
+		keep := true
+		if keepLast > 0 && idx >= keepLast {
+			keep = false
+		}
+		if !cutoff.IsZero() && record.timestamp.Before(cutoff) {
+			keep = false
+		}
+		if keep {
+			continue
+		}
+
+		for _, key := range record.keys {
+			if !dryRun {
+				if err := b.bucket.Delete(ctx, key); err != nil {
+					return pruned, fmt.Errorf("deleting history file %s: %w", key, err)
+				}
+			}
+			pruned = append(pruned, key)
+		}
+	}
+
+	return pruned, nil
+}
@@ -22,12 +22,14 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/slice"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 	"gocloud.dev/blob"
 )
@@ -56,23 +58,26 @@ type referenceStore interface {
 	// StackBasePath returns the base path to for the file
 	// where snapshots of this stack are stored.
 	//
-	// This must be under StacksDir.
+	// This must be under StacksDir,
+	// or under StacksDir within the directory of the stack's organization (see orgDir).
 	//
 	// This is the path to the file without the extension.
-	// The real file path is StackBasePath + ".json"
-	// or StackBasePath + ".json.gz".
+	// The real file path is StackBasePath + ".json",
+	// optionally followed by a compression extension like ".gz".
 	StackBasePath(*localBackendReference) string
 
 	// HistoryDir returns the path to the directory
 	// where history for this stack is stored.
 	//
-	// This must be under HistoriesDir.
+	// This must be under HistoriesDir,
+	// or under HistoriesDir within the directory of the stack's organization (see orgDir).
 	HistoryDir(*localBackendReference) string
 
 	// BackupDir returns the path to the directory
 	// where backups for this stack are stored.
 	//
-	// This must be under BackupsDir.
+	// This must be under BackupsDir,
+	// or under BackupsDir within the directory of the stack's organization (see orgDir).
 	BackupDir(*localBackendReference) string
 
 	// ListReferences lists all stack references in the store.
@@ -95,6 +100,18 @@ type projectReferenceStore struct {
 
 	// currentProject is a thread-safe way to get the current project.
 	currentProject func() *workspace.Project
+
+	// organizations are additional organization names accepted in stack references.
+	// References resolve to the default organization unless orgDirs is set.
+	organizations []string
+
+	// orgDirs is set when the stacks of the additional organizations
+	// are stored in a directory of their own instead of under the default organization.
+	orgDirs bool
+
+	// maxNameLength is the maximum length of project and stack names.
+	// Zero means the default limits of the tokens package.
+	maxNameLength int
 }
 
 var _ referenceStore = (*projectReferenceStore)(nil)
@@ -117,20 +134,44 @@ func (p *projectReferenceStore) newReference(project tokens.Name, name tokens.St
 	}
 }
 
+// orgDir returns the directory that holds the state of the given organization,
+// relative to the root of the bucket.
+//
+// Each organization directory has the same layout as the root of the bucket,
+// e.g. "team-a/.pulumi/stacks/myproject/dev.json".
+// The default organization, represented by an empty string, is stored at the root itself.
+func orgDir(org string) string {
+	return org
+}
+
 func (p *projectReferenceStore) StackBasePath(ref *localBackendReference) string {
 	contract.Requiref(ref.project != "", "ref.project", "must not be empty")
 	// No need for NamePath for the StackName because it's already constrained to characters that are valid for filenames.
-	return filepath.Join(StacksDir, fsutil.NamePath(ref.project), ref.name.String())
+	return filepath.Join(orgDir(ref.org), StacksDir, fsutil.NamePath(ref.project), ref.name.String())
 }
 
 func (p *projectReferenceStore) HistoryDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project != "", "ref.project", "must not be empty")
-	return filepath.Join(HistoriesDir, fsutil.NamePath(stack.project), stack.name.String())
+	return filepath.Join(orgDir(stack.org), HistoriesDir, fsutil.NamePath(stack.project), stack.name.String())
 }
 
 func (p *projectReferenceStore) BackupDir(stack *localBackendReference) string {
 	contract.Requiref(stack.project != "", "ref.project", "must not be empty")
-	return filepath.Join(BackupsDir, fsutil.NamePath(stack.project), stack.name.String())
+	return filepath.Join(orgDir(stack.org), BackupsDir, fsutil.NamePath(stack.project), stack.name.String())
+}
+
+// orgs returns the organizations whose stacks are stored in the bucket,
+// with an empty string for the default organization.
+func (p *projectReferenceStore) orgs() []string {
+	orgs := []string{""}
+	if p.orgDirs {
+		for _, org := range p.organizations {
+			if org != defaultOrganization {
+				orgs = append(orgs, org)
+			}
+		}
+	}
+	return orgs
 }
 
 func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendReference, error) {
@@ -140,7 +181,7 @@ func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendRe
 	// 2. <org-name>/<stack-name>
 	// 3. <org-name>/<project-name>/<stack-name>
 	//
-	// org-name must always be "organization".
+	// org-name must be "organization" or one of the configured organizations.
 	// This matches the behavior of the Pulumi Service storage backend.
 	if stackRef == "" {
 		return nil, errors.New("stack name must not be empty")
@@ -164,11 +205,15 @@ func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendRe
 	// infer them from the local environment.
 	if org == "" {
 		// Filestate organization MUST always be "organization"
-		org = "organization"
+		org = defaultOrganization
 	}
 
-	if org != "organization" {
-		return nil, errors.New("organization name must be 'organization'")
+	if !p.isOrganization(org) {
+		if len(p.organizations) == 0 {
+			return nil, errors.New("organization name must be 'organization'")
+		}
+		return nil, fmt.Errorf("organization name must be 'organization' or one of: %s",
+			strings.Join(p.organizations, ", "))
 	}
 
 	if project == "" {
@@ -182,49 +227,78 @@ func (p *projectReferenceStore) ParseReference(stackRef string) (*localBackendRe
 	}
 
 	if project != "" {
-		if err := tokens.ValidateProjectName(project); err != nil {
+		if err := tokens.ValidateProjectNameMaxLength(project, effectiveMaxNameLength(p.maxNameLength)); err != nil {
 			return nil, err
 		}
 	}
 
-	parsedName, err := tokens.ParseStackName(name)
+	parsedName, err := tokens.ParseStackNameMaxLength(name, effectiveMaxNameLength(p.maxNameLength))
 	if err != nil {
 		return nil, err
 	}
 
-	return p.newReference(tokens.Name(project), parsedName), nil
+	ref := p.newReference(tokens.Name(project), parsedName)
+	if p.orgDirs && org != defaultOrganization {
+		ref.org = org
+	}
+	return ref, nil
+}
+
+// isOrganization reports whether the given name is accepted
+// as the organization of a stack reference.
+func (p *projectReferenceStore) isOrganization(org string) bool {
+	if org == defaultOrganization {
+		return true
+	}
+	for _, o := range p.organizations {
+		if o == org {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *projectReferenceStore) ValidateReference(ref *localBackendReference) error {
 	if ref.project == "" {
 		return fmt.Errorf("bad stack reference, project was not set")
 	}
+	if ref.org != "" && !p.orgDirs {
+		return fmt.Errorf("bad stack reference, organization %q does not have its own directory", ref.org)
+	}
 	return nil
 }
 
 func (p *projectReferenceStore) ListProjects(ctx context.Context) ([]tokens.Name, error) {
-	path := StacksDir
-
-	files, err := listBucket(ctx, p.bucket, path)
-	if err != nil {
-		return nil, fmt.Errorf("error listing stacks: %w", err)
-	}
+	projects := []tokens.Name{}
+	seen := make(map[tokens.Name]struct{})
+	for _, org := range p.orgs() {
+		path := filepath.Join(orgDir(org), StacksDir)
 
-	projects := slice.Prealloc[tokens.Name](len(files))
-	for _, file := range files {
-		if !file.IsDir {
-			continue // ignore files
+		files, err := listBucket(ctx, p.bucket, path)
+		if err != nil {
+			return nil, fmt.Errorf("error listing stacks: %w", err)
 		}
 
-		projName := objectName(file)
-		if !tokens.IsName(projName) {
-			// If this isn't a valid Name
-			// it won't be a project directory,
-			// so skip it.
-			continue
-		}
+		for _, file := range files {
+			if !file.IsDir {
+				continue // ignore files
+			}
+
+			projName := objectName(file)
+			if !tokens.IsName(projName) {
+				// If this isn't a valid Name
+				// it won't be a project directory,
+				// so skip it.
+				continue
+			}
 
-		projects = append(projects, tokens.Name(projName))
+			// The same project may exist in several organizations.
+			if _, ok := seen[tokens.Name(projName)]; ok {
+				continue
+			}
+			seen[tokens.Name(projName)] = struct{}{}
+			projects = append(projects, tokens.Name(projName))
+		}
 	}
 
 	return projects, nil
@@ -233,23 +307,76 @@ func (p *projectReferenceStore) ListProjects(ctx context.Context) ([]tokens.Name
 func (p *projectReferenceStore) ProjectExists(ctx context.Context, projectName string) (bool, error) {
 	contract.Requiref(projectName != "", "projectName", "must not be empty")
 
-	path := path.Join(StacksDir, projectName)
+	for _, org := range p.orgs() {
+		path := path.Join(filepath.ToSlash(orgDir(org)), filepath.ToSlash(StacksDir), projectName)
 
-	files, err := listBucket(ctx, p.bucket, path)
-	if err != nil {
-		return false, fmt.Errorf("list stacks at %q: %w", path, err)
+		files, err := listBucket(ctx, p.bucket, path)
+		if err != nil {
+			return false, fmt.Errorf("list stacks at %q: %w", path, err)
+		}
+
+		// If files is empty, it means that project is not found in bucket
+		if len(files) > 0 {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	// If files is empty, it means that project is not found in bucket
-	return len(files) > 0, nil
+// projectDirs returns the directories of the bucket that hold the state of the given project
+// across all organizations: its stacks, history, and backups.
+func (p *projectReferenceStore) projectDirs(project tokens.Name) []string {
+	var dirs []string
+	for _, org := range p.orgs() {
+		for _, dir := range []string{StacksDir, HistoriesDir, BackupsDir} {
+			dirs = append(dirs, filepath.ToSlash(filepath.Join(orgDir(org), dir, fsutil.NamePath(project))))
+		}
+	}
+	return dirs
 }
 
 func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBackendReference, error) {
+	return p.listAllReferences(ctx, "" /* projectPrefix */)
+}
+
+// ListProjectReferences lists all stack references in the store
+// that belong to the given project.
+//
+// Unlike ListReferences, this only looks at the directory for that project.
+func (p *projectReferenceStore) ListProjectReferences(
+	ctx context.Context, project tokens.Name,
+) ([]*localBackendReference, error) {
+	contract.Requiref(project != "", "project", "must not be empty")
+	return p.listAllReferences(ctx, fsutil.NamePath(project)+"/")
+}
+
+// listAllReferences lists stack references under the given prefix of StacksDir
+// across all organizations.
+func (p *projectReferenceStore) listAllReferences(
+	ctx context.Context, projectPrefix string,
+) ([]*localBackendReference, error) {
+	var stacks []*localBackendReference
+	for _, org := range p.orgs() {
+		refs, err := p.listReferences(ctx, org, projectPrefix)
+		if err != nil {
+			return nil, err
+		}
+		stacks = append(stacks, refs...)
+	}
+	return stacks, nil
+}
+
+// listReferences lists stack references of the given organization
+// under the given prefix of StacksDir.
+// An empty prefix lists all stacks of the organization.
+func (p *projectReferenceStore) listReferences(
+	ctx context.Context, org, projectPrefix string,
+) ([]*localBackendReference, error) {
 	// The first level of the bucket is the project name.
 	// The second level of the bucket is the stack name.
-	prefix := filepath.ToSlash(StacksDir) + "/"
+	prefix := filepath.ToSlash(filepath.Join(orgDir(org), StacksDir)) + "/"
 	iter := p.bucket.List(&blob.ListOptions{
-		Prefix: prefix,
+		Prefix: prefix + projectPrefix,
 		// Don't set the Delimiter.
 		// This will treat the entire bucket as a flat list,
 		// returning only files under the prefix.
@@ -257,12 +384,16 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 
 	var stacks []*localBackendReference
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		file, err := iter.Next(ctx)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return nil, fmt.Errorf("list bucket: %w", err)
+			return nil, bucketError("List", prefix+projectPrefix, err)
 		}
 
 		if file.IsDir {
@@ -270,7 +401,7 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 		}
 
 		// Key is in the form,
-		//   $StacksDir/$projName/$stackName.json[.gz]
+		//   $StacksDir/$projName/$stackName.json[.gz|.zst]
 		// We want to extract projName and stackName from it.
 
 		parts := strings.Split(strings.TrimPrefix(file.Key, prefix), "/")
@@ -287,27 +418,14 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 			continue
 		}
 
-		// Skip files without valid extensions (e.g., *.bak files).
-		ext := filepath.Ext(objName)
-		// But accept gzip compression
-		if ext == encoding.GZIPExt {
-			objName = strings.TrimSuffix(objName, encoding.GZIPExt)
-			ext = filepath.Ext(objName)
-		}
-
-		if _, has := encoding.Marshalers[ext]; !has {
-			continue
-		}
-
-		// Read in this stack's information.
-		name := objName[:len(objName)-len(ext)]
-		parsedName, err := tokens.ParseStackName(name)
-		if err != nil {
-			// This looked like a stack file, but it wasn't a valid stack name so skip it.
+		parsedName, ok := parseStackObjectName(file.Key, objName, p.maxNameLength)
+		if !ok {
 			continue
 		}
 
-		stacks = append(stacks, p.newReference(tokens.Name(projName), parsedName))
+		ref := p.newReference(tokens.Name(projName), parsedName)
+		ref.org = org
+		stacks = append(stacks, ref)
 	}
 	return stacks, nil
 }
@@ -318,6 +436,10 @@ func (p *projectReferenceStore) ListReferences(ctx context.Context) ([]*localBac
 // This is the format we used before we introduced versioning.
 type legacyReferenceStore struct {
 	bucket Bucket
+
+	// maxNameLength is the maximum length of stack names.
+	// Zero means the default limit of the tokens package.
+	maxNameLength int
 }
 
 var _ referenceStore = (*legacyReferenceStore)(nil)
@@ -355,7 +477,7 @@ func (p *legacyReferenceStore) BackupDir(stack *localBackendReference) string {
 }
 
 func (p *legacyReferenceStore) ParseReference(stackRef string) (*localBackendReference, error) {
-	parsedName, err := tokens.ParseStackName(stackRef)
+	parsedName, err := tokens.ParseStackNameMaxLength(stackRef, effectiveMaxNameLength(p.maxNameLength))
 	if err != nil {
 		return nil, err
 	}
@@ -381,24 +503,8 @@ func (p *legacyReferenceStore) ListReferences(ctx context.Context) ([]*localBack
 			continue
 		}
 
-		objName := objectName(file)
-		// Skip files without valid extensions (e.g., *.bak files).
-		ext := filepath.Ext(objName)
-		// But accept gzip compression
-		if ext == encoding.GZIPExt {
-			objName = strings.TrimSuffix(objName, encoding.GZIPExt)
-			ext = filepath.Ext(objName)
-		}
-
-		if _, has := encoding.Marshalers[ext]; !has {
-			continue
-		}
-
-		// Read in this stack's information.
-		name := objName[:len(objName)-len(ext)]
-		parsedName, err := tokens.ParseStackName(name)
-		if err != nil {
-			// This looked like a stack file, but it wasn't a valid stack name so skip it.
+		parsedName, ok := parseStackObjectName(file.Key, objectName(file), p.maxNameLength)
+		if !ok {
 			continue
 		}
 
@@ -407,3 +513,47 @@ func (p *legacyReferenceStore) ListReferences(ctx context.Context) ([]*localBack
 
 	return stacks, nil
 }
+
+// parseStackObjectName returns the name of the stack whose checkpoint is stored in the object
+// with the given key and base name, or false if the object isn't a stack checkpoint.
+//
+// Buckets may be shared with other tools, so objects with names that aren't valid stack names
+// are skipped rather than treated as errors.
+func parseStackObjectName(key, objName string, maxNameLength int) (tokens.StackName, bool) {
+	// Skip files without valid extensions (e.g., *.bak files).
+	ext := filepath.Ext(objName)
+	// But accept compressed files.
+	if trimmed := trimCompressionExt(objName); trimmed != objName {
+		objName = trimmed
+		ext = filepath.Ext(objName)
+	}
+
+	if _, has := encoding.Marshalers[ext]; !has {
+		return tokens.StackName{}, false
+	}
+
+	// Stack name validation may be disabled,
+	// but a name that isn't even valid UTF-8 can never be used.
+	name := objName[:len(objName)-len(ext)]
+	if !utf8.ValidString(name) {
+		logging.V(5).Infof("skipping %q: not a valid UTF-8 stack name", key)
+		return tokens.StackName{}, false
+	}
+
+	parsedName, err := tokens.ParseStackNameMaxLength(name, effectiveMaxNameLength(maxNameLength))
+	if err != nil {
+		// This looked like a stack file, but it wasn't a valid stack name so skip it.
+		logging.V(5).Infof("skipping %q: %v", key, err)
+		return tokens.StackName{}, false
+	}
+	return parsedName, true
+}
+
+// effectiveMaxNameLength returns the given name length limit,
+// or the default limit of the tokens package if it's zero.
+func effectiveMaxNameLength(n int) int {
+	if n == 0 {
+		return tokens.MaxStackNameLength
+	}
+	return n
+}
@@ -16,6 +16,7 @@ package filestate
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -264,6 +265,15 @@ func TestLegacyReferenceStore_ListReferences(t *testing.T) {
 			},
 			want: []tokens.QName{"foo"},
 		},
+		{
+			desc: "invalid stack names",
+			files: []string{
+				".pulumi/stacks/foo.json",
+				".pulumi/stacks/b r.json",
+				".pulumi/stacks/ünïcödé.json",
+			},
+			want: []tokens.QName{"foo"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -355,6 +365,16 @@ func TestProjectReferenceStore_List(t *testing.T) {
 			stacks:   []tokens.QName{"organization/a/foo"},
 			projects: []tokens.Name{"a", "bar"},
 		},
+		{
+			desc: "invalid stack names",
+			files: []string{
+				".pulumi/stacks/a/foo.json",
+				".pulumi/stacks/a/b r.json",
+				".pulumi/stacks/a/ünïcödé.json",
+			},
+			stacks:   []tokens.QName{"organization/a/foo"},
+			projects: []tokens.Name{"a"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -469,3 +489,63 @@ func TestProjectReferenceStore_ProjectExists(t *testing.T) {
 		})
 	}
 }
+
+func TestProjectReferenceStore_ParseReference_organizations(t *testing.T) {
+	t.Parallel()
+
+	bucket := memblob.OpenBucket(nil)
+	store := newProjectReferenceStore(bucket, func() *workspace.Project {
+		return &workspace.Project{Name: "currentProject"}
+	})
+	store.organizations = []string{"acme", "globex"}
+
+	for _, give := range []string{"foo", "organization/foo", "acme/foo", "globex/currentProject/foo"} {
+		ref, err := store.ParseReference(give)
+		require.NoError(t, err, "ParseReference(%q)", give)
+		// Stacks are always stored under the default organization.
+		assert.Equal(t, tokens.QName("organization/currentProject/foo"), ref.FullyQualifiedName(), "%q", give)
+	}
+
+	_, err := store.ParseReference("initech/foo")
+	assert.ErrorContains(t, err, "organization name must be 'organization' or one of: acme, globex")
+}
+
+// BenchmarkProjectReferenceStore_ListReferences compares listing all stacks
+// with a single flat listing of the bucket, as ListReferences does,
+// against listing the projects and then the stacks of each project.
+func BenchmarkProjectReferenceStore_ListReferences(b *testing.B) {
+	const numProjects, stacksPerProject = 50, 10
+
+	ctx := context.Background()
+	bucket := memblob.OpenBucket(nil)
+	for i := 0; i < numProjects; i++ {
+		for j := 0; j < stacksPerProject; j++ {
+			key := fmt.Sprintf(".pulumi/stacks/proj-%02d/stack-%02d.json", i, j)
+			require.NoError(b, bucket.WriteAll(ctx, key, []byte("{}"), nil))
+		}
+	}
+	store := newProjectReferenceStore(bucket, func() *workspace.Project { return nil })
+
+	b.Run("flat", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			refs, err := store.ListReferences(ctx)
+			require.NoError(b, err)
+			require.Len(b, refs, numProjects*stacksPerProject)
+		}
+	})
+
+	b.Run("per-project", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			projects, err := store.ListProjects(ctx)
+			require.NoError(b, err)
+
+			var refs []*localBackendReference
+			for _, project := range projects {
+				projectRefs, err := store.ListProjectReferences(ctx, project)
+				require.NoError(b, err)
+				refs = append(refs, projectRefs...)
+			}
+			require.Len(b, refs, numProjects*stacksPerProject)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	"gocloud.dev/blob"
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// summaryCachePath is the path of the summary cache in the bucket.
+var summaryCachePath = path.Join(workspace.BookkeepingDir, "summaries.json")
+
+// summaryCache caches the summaries of checkpoints between listings of the stacks in a bucket,
+// so that only the checkpoints that changed since the last listing need to be read.
+//
+// Entries are keyed by the path of the checkpoint,
+// and are only used while the version of the checkpoint object is unchanged; see objectVersion.
+// It's safe for concurrent use.
+type summaryCache struct {
+	mu      sync.Mutex
+	entries map[string]summaryCacheEntry
+	seen    map[string]bool
+	dirty   bool
+}
+
+// summaryCacheEntry is the cached summary of a single checkpoint.
+type summaryCacheEntry struct {
+	// Version is the version of the checkpoint object the summary was read from.
+	Version string `json:"version"`
+	// Summary is the summary of the checkpoint.
+	Summary checkpointSummary `json:"summary"`
+}
+
+// loadSummaryCache reads the summary cache from the bucket.
+// A missing or unreadable cache is treated as empty.
+func (b *localBackend) loadSummaryCache(ctx context.Context) *summaryCache {
+	cache := &summaryCache{
+		entries: make(map[string]summaryCacheEntry),
+		seen:    make(map[string]bool),
+	}
+
+	data, err := b.bucket.ReadAll(ctx, summaryCachePath)
+	if err != nil {
+		if gcerrors.Code(err) != gcerrors.NotFound {
+			logging.V(5).Infof("error reading summary cache: %v", err)
+		}
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache.entries); err != nil {
+		logging.V(5).Infof("ignoring invalid summary cache: %v", err)
+		cache.entries = make(map[string]summaryCacheEntry)
+	}
+	return cache
+}
+
+// saveSummaryCache writes the summary cache back to the bucket if it changed.
+// If prune is set, entries for checkpoints that weren't looked up are dropped,
+// so that removed stacks don't accumulate in the cache.
+//
+// The cache is only an optimization, so errors are logged rather than returned,
+// and nothing is written to read-only backends.
+func (b *localBackend) saveSummaryCache(ctx context.Context, cache *summaryCache, prune bool) {
+	if b.checkWritable() != nil {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if prune {
+		for key := range cache.entries {
+			if !cache.seen[key] {
+				delete(cache.entries, key)
+				cache.dirty = true
+			}
+		}
+	}
+	if !cache.dirty {
+		return
+	}
+
+	data, err := json.Marshal(cache.entries)
+	if err != nil {
+		logging.V(5).Infof("error marshaling summary cache: %v", err)
+		return
+	}
+	if err := b.bucket.WriteAll(ctx, summaryCachePath, data, nil); err != nil {
+		logging.V(5).Infof("error writing summary cache: %v", err)
+	}
+}
+
+// getCachedCheckpointSummary is like getCheckpointSummary,
+// but returns the summary from cache if the checkpoint hasn't changed since it was cached,
+// and caches the summary otherwise.
+// A nil cache always reads the checkpoint.
+func (b *localBackend) getCachedCheckpointSummary(
+	ctx context.Context, cache *summaryCache, ref *localBackendReference,
+) (*checkpointSummary, error) {
+	if cache == nil {
+		return b.getCheckpointSummary(ctx, ref)
+	}
+
+	chkpath := b.stackPath(ctx, ref)
+	attrs, err := b.bucket.Attributes(ctx, chkpath)
+	if err != nil {
+		// Let getCheckpointSummary report the error, if there still is one.
+		return b.getCheckpointSummary(ctx, ref)
+	}
+	version := objectVersion(attrs)
+
+	cache.mu.Lock()
+	cache.seen[chkpath] = true
+	entry, ok := cache.entries[chkpath]
+	cache.mu.Unlock()
+	if ok && entry.Version == version {
+		summary := entry.Summary
+		return &summary, nil
+	}
+
+	// If the checkpoint changes between getting its attributes and reading it,
+	// the summary is cached under the old version, so the next listing reads it again.
+	summary, err := b.getCheckpointSummary(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mu.Lock()
+	cache.entries[chkpath] = summaryCacheEntry{Version: version, Summary: *summary}
+	cache.dirty = true
+	cache.mu.Unlock()
+	return summary, nil
+}
+
+// objectVersion returns a string that changes whenever the contents of an object do.
+// That's the ETag of the object if the store provides one,
+// and its modification time and size otherwise.
+func objectVersion(attrs *blob.Attributes) string {
+	if attrs.ETag != "" {
+		return attrs.ETag
+	}
+	return fmt.Sprintf("%d-%d", attrs.ModTime.UnixNano(), attrs.Size)
+}
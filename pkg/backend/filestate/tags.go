@@ -0,0 +1,93 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"gocloud.dev/gcerrors"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// TagsExt is the extension of the file that holds the tags of a stack,
+// stored next to its checkpoint.
+//
+// For example, the tags of the stack in "myproject/dev.json" are stored in "myproject/dev.tags".
+// The extension is deliberately not that of a checkpoint format
+// so that these files are never mistaken for stacks.
+const TagsExt = ".tags"
+
+func stackTagsPath(ref *localBackendReference) string {
+	return filepath.ToSlash(ref.StackBasePath()) + TagsExt
+}
+
+// getStackTags reads the tags of the given stack.
+// Stacks without a tags file have no tags.
+func (b *localBackend) getStackTags(
+	ctx context.Context, ref *localBackendReference,
+) (map[apitype.StackTagName]string, error) {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	file := stackTagsPath(ref)
+	data, err := b.bucket.ReadAll(ctx, file)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read stack tags: %w", err)
+	}
+
+	var tags map[apitype.StackTagName]string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("corrupt store: unmarshal %q: %w", file, err)
+	}
+	return tags, nil
+}
+
+// saveStackTags replaces the tags of the given stack.
+func (b *localBackend) saveStackTags(
+	ctx context.Context, ref *localBackendReference, tags map[apitype.StackTagName]string,
+) error {
+	contract.Requiref(ref != nil, "ref", "must not be nil")
+
+	if len(tags) == 0 {
+		b.removeStackTags(ctx, ref)
+		return nil
+	}
+
+	data, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("marshal stack tags: %w", err)
+	}
+	if err := b.bucket.WriteAll(ctx, stackTagsPath(ref), data, nil); err != nil {
+		return fmt.Errorf("write stack tags: %w", err)
+	}
+	return nil
+}
+
+// removeStackTags deletes the tags of the given stack, if any.
+func (b *localBackend) removeStackTags(ctx context.Context, ref *localBackendReference) {
+	file := stackTagsPath(ref)
+	err := b.bucket.Delete(ctx, file)
+	if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+		logging.V(5).Infof("error deleting stack tags %v: %v skipping", file, err)
+	}
+}
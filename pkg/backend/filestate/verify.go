@@ -0,0 +1,201 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package filestate
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/env"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+)
+
+// StackVerifyResult is the result of verifying a single stack with VerifyAll.
+type StackVerifyResult struct {
+	// Stack is the stack that was verified.
+	Stack backend.StackReference
+
+	// Deserialized reports whether the checkpoint of the stack
+	// could be read and deserialized into a snapshot.
+	// If not, LoadErr holds the reason.
+	Deserialized bool
+	LoadErr      error
+
+	// IntegrityErr is the error reported by the integrity check
+	// of the stack's snapshot, if any.
+	IntegrityErr error
+
+	// DanglingFiles lists leftover files for the stack:
+	// lock files, and backups of stacks that no longer have a checkpoint.
+	DanglingFiles []string
+
+	// Orphaned reports that the stack no longer has a checkpoint,
+	// and was only found through its dangling files.
+	Orphaned bool
+}
+
+// OK reports whether the stack passed verification.
+// Dangling files alone don't fail verification, even for orphaned stacks.
+func (r *StackVerifyResult) OK() bool {
+	return r.LoadErr == nil && r.IntegrityErr == nil
+}
+
+func (b *localBackend) VerifyAll(ctx context.Context) ([]StackVerifyResult, error) {
+	refs, err := b.getLocalStacks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stacks that still have a checkpoint, keyed by their base path.
+	results := make(map[string]*StackVerifyResult, len(refs))
+	for _, ref := range refs {
+		results[filepath.ToSlash(ref.StackBasePath())] = &StackVerifyResult{Stack: ref}
+	}
+
+	// Stacks without a checkpoint are only reported if they left files behind.
+	dangling := func(ref *localBackendReference, key string) {
+		basePath := filepath.ToSlash(ref.StackBasePath())
+		result, ok := results[basePath]
+		if !ok {
+			result = &StackVerifyResult{
+				Stack:    ref,
+				Orphaned: true,
+			}
+			results[basePath] = result
+		}
+		result.DanglingFiles = append(result.DanglingFiles, key)
+	}
+
+	// Lock files are stored in .pulumi/locks/<fully-qualified-stack-name>/<lock-id>.json.
+	lockFiles, err := listBucketRecursive(ctx, b.bucket, lockDir())
+	if err != nil {
+		return nil, fmt.Errorf("listing locks: %w", err)
+	}
+	for _, file := range lockFiles {
+		stackName := path.Dir(strings.TrimPrefix(file.Key, lockDir()+"/"))
+		ref, err := b.parseStackReference(stackName)
+		if err != nil {
+			continue // not a lock file we know about
+		}
+		dangling(ref, file.Key)
+	}
+
+	// Backups of removed stacks are left behind in .pulumi/stacks as <stack-path>.json|yaml[.gz|.zst].bak.
+	orgs := []string{""}
+	if store, ok := b.store.(*projectReferenceStore); ok {
+		orgs = store.orgs()
+	}
+	for _, org := range orgs {
+		stacksDir := filepath.ToSlash(filepath.Join(orgDir(org), StacksDir))
+		stackFiles, err := listBucketRecursive(ctx, b.bucket, stacksDir)
+		if err != nil {
+			return nil, fmt.Errorf("listing stacks: %w", err)
+		}
+		for _, file := range stackFiles {
+			if !strings.HasSuffix(file.Key, ".bak") {
+				continue
+			}
+			basePath := trimStateMarkupExt(strings.TrimSuffix(file.Key, ".bak"))
+			if _, ok := results[basePath]; ok {
+				continue // the stack still exists
+			}
+			if ref := b.referenceForStackBasePath(org, basePath); ref != nil {
+				dangling(ref, file.Key)
+			}
+		}
+	}
+
+	// Verify stacks that still have a checkpoint.
+	// We don't take locks here: checkpoints are written atomically,
+	// and a stack being updated shouldn't block verification.
+	pool := newWorkerPool(b.Env.GetInt(env.SelfManagedParallel), len(refs))
+	defer pool.Close()
+	for _, ref := range refs {
+		result := results[filepath.ToSlash(ref.StackBasePath())]
+		ref := ref
+		pool.Enqueue(func() error {
+			b.verifyStack(ctx, ref, result)
+			return nil
+		})
+	}
+	if err := pool.Wait(); err != nil {
+		return nil, err
+	}
+
+	sorted := make([]StackVerifyResult, 0, len(results))
+	for _, result := range results {
+		sorted = append(sorted, *result)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Stack.String() < sorted[j].Stack.String()
+	})
+	return sorted, nil
+}
+
+// verifyStack loads the checkpoint of the given stack and verifies its integrity,
+// recording the outcome in result.
+func (b *localBackend) verifyStack(ctx context.Context, ref *localBackendReference, result *StackVerifyResult) {
+	chk, err := b.getCheckpoint(ctx, ref)
+	if err != nil {
+		result.LoadErr = fmt.Errorf("load checkpoint: %w", err)
+		return
+	}
+
+	snapshot, err := stack.DeserializeCheckpoint(ctx, stack.DefaultSecretsProvider, chk)
+	if err != nil {
+		result.LoadErr = fmt.Errorf("deserialize checkpoint: %w", err)
+		return
+	}
+	result.Deserialized = true
+
+	if snapshot != nil {
+		result.IntegrityErr = snapshot.VerifyIntegrity()
+	}
+}
+
+// referenceForStackBasePath builds a reference to the stack of the given organization
+// stored at the given base path, e.g. ".pulumi/stacks/myproject/dev" for project-scoped stores.
+// It returns nil if the path does not belong to a valid stack.
+func (b *localBackend) referenceForStackBasePath(org, basePath string) *localBackendReference {
+	rel := strings.TrimPrefix(basePath, filepath.ToSlash(filepath.Join(orgDir(org), StacksDir))+"/")
+	switch store := b.store.(type) {
+	case *projectReferenceStore:
+		project, name, ok := strings.Cut(rel, "/")
+		if !ok || strings.Contains(name, "/") {
+			return nil
+		}
+		stackName, err := tokens.ParseStackNameMaxLength(name, effectiveMaxNameLength(store.maxNameLength))
+		if err != nil {
+			return nil
+		}
+		ref := store.newReference(tokens.Name(project), stackName)
+		ref.org = org
+		return ref
+	case *legacyReferenceStore:
+		stackName, err := tokens.ParseStackNameMaxLength(rel, effectiveMaxNameLength(store.maxNameLength))
+		if err != nil {
+			return nil
+		}
+		return store.newReference(stackName)
+	default:
+		return nil
+	}
+}
@@ -874,6 +874,9 @@ func (b *cloudBackend) CreateStack(
 	if opts == nil {
 		opts = &backend.CreateStackOptions{}
 	}
+	if len(opts.Config) > 0 {
+		return nil, backend.ErrInitialConfigNotSupported
+	}
 
 	stackID, err := b.getCloudStackIdentifier(stackRef)
 	if err != nil {
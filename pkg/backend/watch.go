@@ -36,11 +36,39 @@ import (
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
 )
 
+// WatchOptions control which file changes trigger an update in WatchWithOptions.
+// The zero value updates the stack on every change.
+type WatchOptions struct {
+	// Debounce is how long to wait for further changes before updating the stack.
+	// Changes within this interval of each other are coalesced into a single update.
+	Debounce time.Duration
+	// Include is a list of glob patterns. If it's not empty, only changes to matching files trigger an update.
+	Include []string
+	// Exclude is a list of glob patterns. Changes to matching files never trigger an update.
+	Exclude []string
+}
+
 // Watch watches the project's working directory for changes and automatically updates the active
 // stack.
 func Watch(ctx context.Context, b Backend, stack Stack, op UpdateOperation,
 	apply Applier, paths []string,
 ) result.Result {
+	return WatchWithOptions(ctx, b, stack, op, apply, paths, WatchOptions{})
+}
+
+// WatchWithOptions is like Watch, but only updates the stack for the changes selected by watchOpts.
+//
+// Patterns in watchOpts are matched with filepath.Match
+// against both the path of the changed file relative to the project root and its base name.
+func WatchWithOptions(ctx context.Context, b Backend, stack Stack, op UpdateOperation,
+	apply Applier, paths []string, watchOpts WatchOptions,
+) result.Result {
+	for _, pattern := range append(append([]string{}, watchOpts.Include...), watchOpts.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return result.FromError(fmt.Errorf("invalid watch pattern %q: %w", pattern, err))
+		}
+	}
+
 	opts := ApplierOptions{
 		DryRun:   false,
 		ShowLink: false,
@@ -73,11 +101,12 @@ func Watch(ctx context.Context, b Backend, stack Stack, op UpdateOperation,
 	}()
 
 	// Provided paths can be both relative and absolute.
-	events, stop, err := watchPaths(op.Root, paths)
+	rawEvents, stop, err := watchPaths(op.Root, paths)
 	if err != nil {
 		return result.FromError(err)
 	}
 	defer stop()
+	events := filterWatchEvents(op.Root, rawEvents, watchOpts)
 
 	fmt.Printf(op.Opts.Display.Color.Colorize(
 		colors.SpecHeadline+"Watching (%s):"+colors.Reset+"\n"), stack.Ref())
@@ -104,6 +133,76 @@ func Watch(ctx context.Context, b Backend, stack Stack, op UpdateOperation,
 	return nil
 }
 
+// filterWatchEvents forwards the events that match the patterns of opts.
+// Events that arrive within opts.Debounce of each other are coalesced,
+// and only the last of them is forwarded.
+// The returned channel is closed once events is closed.
+func filterWatchEvents(root string, events <-chan string, opts WatchOptions) <-chan string {
+	out := make(chan string)
+	go func() {
+		defer close(out)
+
+		var pending *string
+		var timer <-chan time.Time
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					if pending != nil {
+						out <- *pending
+					}
+					return
+				}
+				if !watchEventMatches(root, event, opts) {
+					continue
+				}
+				if opts.Debounce <= 0 {
+					out <- event
+					continue
+				}
+				pending = &event
+				timer = time.After(opts.Debounce)
+			case <-timer:
+				out <- *pending
+				pending, timer = nil, nil
+			}
+		}
+	}()
+	return out
+}
+
+// watchEventMatches reports whether a change to the file at path passes the filters of opts.
+func watchEventMatches(root, path string, opts WatchOptions) bool {
+	if len(opts.Include) == 0 && len(opts.Exclude) == 0 {
+		return true
+	}
+
+	rel := path
+	if filepath.IsAbs(path) {
+		if r, err := filepath.Rel(root, path); err == nil {
+			rel = r
+		}
+	}
+	rel = filepath.ToSlash(rel)
+
+	matchesAny := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, rel); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if matchesAny(opts.Exclude) {
+		return false
+	}
+	return len(opts.Include) == 0 || matchesAny(opts.Include)
+}
+
 func watchPaths(root string, paths []string) (chan string, func(), error) {
 	args := []string{"--origin", root}
 	for _, p := range paths {
@@ -0,0 +1,138 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collectWatchEvents sends the given events through filterWatchEvents
+// and returns the events it forwards.
+func collectWatchEvents(root string, opts WatchOptions, events ...string) []string {
+	in := make(chan string)
+	out := filterWatchEvents(root, in, opts)
+	go func() {
+		for _, e := range events {
+			in <- e
+		}
+		close(in)
+	}()
+
+	var got []string
+	for e := range out {
+		got = append(got, e)
+	}
+	return got
+}
+
+func TestFilterWatchEvents_default(t *testing.T) {
+	t.Parallel()
+
+	// Without options, every event is forwarded.
+	got := collectWatchEvents("/proj", WatchOptions{}, "/proj/a.ts", "/proj/b.ts", "/proj/a.ts")
+	assert.Equal(t, []string{"/proj/a.ts", "/proj/b.ts", "/proj/a.ts"}, got)
+}
+
+func TestFilterWatchEvents_debounce(t *testing.T) {
+	t.Parallel()
+
+	got := collectWatchEvents("/proj", WatchOptions{Debounce: time.Hour},
+		"/proj/a.ts", "/proj/b.ts", "/proj/c.ts")
+	assert.Equal(t, []string{"/proj/c.ts"}, got, "events within the debounce window must be coalesced")
+}
+
+func TestFilterWatchEvents_debounceFires(t *testing.T) {
+	t.Parallel()
+
+	in := make(chan string)
+	defer close(in)
+	out := filterWatchEvents("/proj", in, WatchOptions{Debounce: 10 * time.Millisecond})
+
+	in <- "/proj/a.ts"
+	in <- "/proj/b.ts"
+	select {
+	case got := <-out:
+		assert.Equal(t, "/proj/b.ts", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for debounced event")
+	}
+}
+
+func TestWatchEventMatches(t *testing.T) {
+	t.Parallel()
+
+	root := filepath.FromSlash("/proj")
+	tests := []struct {
+		desc string
+		path string
+		opts WatchOptions
+		want bool
+	}{
+		{
+			desc: "no patterns",
+			path: "/proj/index.ts",
+			want: true,
+		},
+		{
+			desc: "included by base name",
+			path: "/proj/src/index.ts",
+			opts: WatchOptions{Include: []string{"*.ts"}},
+			want: true,
+		},
+		{
+			desc: "not included",
+			path: "/proj/README.md",
+			opts: WatchOptions{Include: []string{"*.ts"}},
+			want: false,
+		},
+		{
+			desc: "included by relative path",
+			path: "/proj/src/index.ts",
+			opts: WatchOptions{Include: []string{"src/*"}},
+			want: true,
+		},
+		{
+			desc: "relative event",
+			path: "src/index.ts",
+			opts: WatchOptions{Include: []string{"src/*"}},
+			want: true,
+		},
+		{
+			desc: "excluded",
+			path: "/proj/index.ts~",
+			opts: WatchOptions{Exclude: []string{"*~"}},
+			want: false,
+		},
+		{
+			desc: "exclude wins over include",
+			path: "/proj/src/gen.ts",
+			opts: WatchOptions{Include: []string{"*.ts"}, Exclude: []string{"src/gen.ts"}},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, watchEventMatches(root, filepath.FromSlash(tt.path), tt.opts))
+		})
+	}
+}
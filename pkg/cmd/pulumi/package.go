@@ -18,6 +18,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -58,21 +59,14 @@ Subcommands of this command are useful to package authors during development.`,
 }
 
 // schemaFromPackageSource takes a schema source and returns its associated schema. A
-// schema source is either a file (ending with .[json|y[a]ml]) or a plugin with an
-// optional version:
+// schema source is either a file (ending with .[json|y[a]ml]), "-" to read a JSON or
+// YAML schema from stdin, or a plugin with an optional version:
 //
-//	FILE.[json|y[a]ml] | PLUGIN[@VERSION] | PATH_TO_PLUGIN
+//	FILE.[json|y[a]ml] | - | PLUGIN[@VERSION] | PATH_TO_PLUGIN
 func schemaFromSchemaSource(packageSource string) (*schema.Package, error) {
 	var spec schema.PackageSpec
-	bind := func(spec schema.PackageSpec) (*schema.Package, error) {
-		pkg, diags, err := schema.BindSpec(spec, nil)
-		if err != nil {
-			return nil, err
-		}
-		if diags.HasErrors() {
-			return nil, diags
-		}
-		return pkg, nil
+	if packageSource == "-" {
+		return schemaFromReader(os.Stdin)
 	}
 	if ext := filepath.Ext(packageSource); ext == ".yaml" || ext == ".yml" {
 		f, err := os.ReadFile(packageSource)
@@ -83,7 +77,7 @@ func schemaFromSchemaSource(packageSource string) (*schema.Package, error) {
 		if err != nil {
 			return nil, err
 		}
-		return bind(spec)
+		return bindSchemaSpec(spec)
 	} else if ext == ".json" {
 		f, err := os.ReadFile(packageSource)
 		if err != nil {
@@ -93,7 +87,7 @@ func schemaFromSchemaSource(packageSource string) (*schema.Package, error) {
 		if err != nil {
 			return nil, err
 		}
-		return bind(spec)
+		return bindSchemaSpec(spec)
 	}
 
 	p, err := providerFromSource(packageSource)
@@ -109,7 +103,38 @@ func schemaFromSchemaSource(packageSource string) (*schema.Package, error) {
 	if err != nil {
 		return nil, err
 	}
-	return bind(spec)
+	return bindSchemaSpec(spec)
+}
+
+// schemaFromReader reads a JSON or YAML schema from r and binds it.
+func schemaFromReader(r io.Reader) (*schema.Package, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read schema: %w", err)
+	}
+
+	var spec schema.PackageSpec
+	if json.Valid(data) {
+		err = json.Unmarshal(data, &spec)
+	} else {
+		err = yaml.Unmarshal(data, &spec)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal schema: %w", err)
+	}
+	return bindSchemaSpec(spec)
+}
+
+// bindSchemaSpec binds the given schema spec, failing if there are any error diagnostics.
+func bindSchemaSpec(spec schema.PackageSpec) (*schema.Package, error) {
+	pkg, diags, err := schema.BindSpec(spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return pkg, nil
 }
 
 // providerFromSource takes a plugin name or path.
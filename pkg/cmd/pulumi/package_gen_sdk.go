@@ -15,188 +15,1238 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/blang/semver"
 	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
 
 	javagen "github.com/pulumi/pulumi-java/pkg/codegen/java"
 
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
 	"github.com/pulumi/pulumi/pkg/v3/codegen/dotnet"
+	gogen "github.com/pulumi/pulumi/pkg/v3/codegen/go"
 	"github.com/pulumi/pulumi/pkg/v3/codegen/schema"
+	"github.com/pulumi/pulumi/pkg/v3/version"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 )
 
 func newGenSdkCommand() *cobra.Command {
 	var overlays string
 	var language string
 	var out string
+	var overwrite string
+	var targetVersion string
+	var pluginTimeout time.Duration
+	var writeGoMod bool
+	var goModulePath string
+	var resources string
+	var keepSchema bool
+	var overlay string
+	var overlayForce bool
+	var check bool
 	cmd := &cobra.Command{
 		Use:   "gen-sdk <schema_source>",
 		Args:  cobra.ExactArgs(1),
 		Short: "Generate SDK(s) from a package or schema",
 		Long: `Generate SDK(s) from a package or schema.
 
-<schema_source> can be a package name, the path to a plugin binary, or the path to a schema file.`,
+<schema_source> can be a package name, the path to a plugin binary, or the path to a schema file.
+Use - to read a JSON or YAML schema from stdin.
+
+--target-version generates SDKs that support older versions of a language's toolchain.
+It accepts a comma-separated list of <language>=<version> pairs,
+or just a version if a single language is generated:
+
+  - python: the minimum Python version, 3.7 or later (e.g. python=3.8)
+  - nodejs: the minimum Node.js major version, 14 or later (e.g. nodejs=16)
+  - dotnet: the target framework, net6.0 or later (e.g. dotnet=net6.0)
+
+Other languages don't support a target version.
+
+--resources generates partial SDKs that only contain the given resources,
+along with the types, resources, and functions they reference.
+It accepts a comma-separated list of resource tokens, each of which may be a glob
+(e.g. aws:s3/bucket:Bucket,aws:ec2/*).
+
+--overlay copies the files in a directory into every generated SDK, such as a README or a LICENSE.
+Files are written at the same relative path under the root of each SDK.
+It's an error for an overlay file to replace a generated file unless --overlay-force is set.
+
+--check only checks that the code generator of each language accepts the schema.
+The SDKs are generated but not written to the output directory,
+and the command fails if any language fails to generate.`,
 		Run: cmdutil.RunFunc(func(cmd *cobra.Command, args []string) error {
+			ctx := commandContext()
 			source := args[0]
 
+			// Validate the languages before doing any work
+			// so that we don't generate a partial set of SDKs.
+			languages, err := parseGenSDKLanguages(language)
+			if err != nil {
+				return err
+			}
+			overwriteMode, err := parseGenSDKOverwriteMode(overwrite)
+			if err != nil {
+				return err
+			}
+			targetVersions, err := parseGenSDKTargetVersions(targetVersion, languages)
+			if err != nil {
+				return err
+			}
+
 			pkg, err := schemaFromSchemaSource(source)
 			if err != nil {
 				return err
 			}
-			// Normalize from well known language names the the matching runtime names.
-			switch language {
-			case "csharp", "c#":
-				language = "dotnet"
-			case "typescript":
-				language = "nodejs"
+			if resources != "" {
+				pkg, err = pruneGenSDKResources(pkg, strings.Split(resources, ","))
+				if err != nil {
+					return err
+				}
 			}
 
-			if language == "all" {
-				for _, lang := range []string{"dotnet", "go", "java", "nodejs", "python"} {
-					err := genSDK(lang, out, pkg, overlays)
-					if err != nil {
-						return err
-					}
+			if check {
+				return checkGenSDKs(ctx, os.Stdout, languages, pkg, targetVersions, pluginTimeout)
+			}
+
+			var overlayFiles *genSDKOverlay
+			if overlay != "" {
+				files, err := readGenSDKOverlayDir(overlay)
+				if err != nil {
+					return err
 				}
-				return nil
+				overlayFiles = &genSDKOverlay{Files: files, Force: overlayForce}
 			}
-			return genSDK(language, out, pkg, overlays)
+
+			var goModule *genSDKGoModuleOptions
+			if writeGoMod {
+				goModule = &genSDKGoModuleOptions{ModulePath: goModulePath}
+			}
+
+			if len(languages) == 1 {
+				_, err := genSDK(ctx, languages[0], out, pkg, overlays, overwriteMode,
+					targetVersions[languages[0]], pluginTimeout, keepSchema, goModule, overlayFiles)
+				return err
+			}
+			return genSDKs(ctx, languages, out, pkg, overlays, overwriteMode, targetVersions, pluginTimeout,
+				keepSchema, goModule, overlayFiles)
 		}),
 	}
 	cmd.Flags().StringVarP(&language, "language", "", "all",
-		"The SDK language to generate: [nodejs|python|go|dotnet|java|all]")
+		"The SDK language to generate: [nodejs|python|go|dotnet|java|schema|all], "+
+			"or a comma-separated list of languages")
 	cmd.Flags().StringVarP(&out, "out", "o", "./sdk",
 		"The directory to write the SDK to")
+	cmd.Flags().StringVar(&overwrite, "overwrite", "true",
+		"Whether to replace existing SDKs in the output directory: [true|false|prompt]. "+
+			"With false, gen-sdk fails if the output directory for a language is not empty; "+
+			"with prompt, it asks for confirmation first")
+	cmd.Flag("overwrite").NoOptDefVal = "true"
+	cmd.Flags().StringVar(&targetVersion, "target-version", "",
+		"The language versions the SDKs must support, as a comma-separated list of <language>=<version> pairs, "+
+			"or just a version if a single language is generated; see above for accepted values")
+	cmd.Flags().DurationVar(&pluginTimeout, "plugin-timeout", 0,
+		"How long to wait for a language plugin to generate an SDK before giving up, e.g. 5m; "+
+			"0 waits indefinitely")
+	cmd.Flags().BoolVar(&keepSchema, "keep-schema", false,
+		"Write the schema given to each language plugin to a temporary file and print its path, "+
+			"to help debug language plugins")
+	cmd.Flags().BoolVar(&writeGoMod, "go-module", true,
+		"Whether to write a go.mod and README.md alongside the Go SDK so that it can be built as is")
+	cmd.Flags().StringVar(&goModulePath, "go-module-path", "",
+		"The module path to write to the go.mod of the Go SDK; "+
+			"by default it's derived from the package's Go import base path")
+	cmd.Flags().StringVar(&resources, "resources", "",
+		"Only generate the given resources and what they reference, "+
+			"as a comma-separated list of resource tokens or globs; see above")
+	cmd.Flags().StringVar(&overlay, "overlay", "",
+		"A directory of files to copy into every generated SDK, e.g. a README or a LICENSE; see above")
+	cmd.Flags().BoolVar(&overlayForce, "overlay-force", false,
+		"Allow files from --overlay to replace generated files")
+	cmd.Flags().BoolVar(&check, "check", false,
+		"Only check that the SDKs can be generated from the schema, without writing them; see above")
 	cmd.Flags().StringVar(&overlays, "overlays", "", "A folder of extra overlay files to copy to the generated SDK")
 	contract.AssertNoErrorf(cmd.Flags().MarkHidden("overlays"), `Could not mark "overlay" as hidden`)
 	return cmd
 }
 
-func genSDK(language, out string, pkg *schema.Package, overlays string) error {
+// genSDKAllLanguages are the languages generated by 'gen-sdk --language all'.
+var genSDKAllLanguages = []string{"dotnet", "go", "java", "nodejs", "python"}
+
+// normalizeGenSDKLanguage maps well known language names to the matching runtime names.
+func normalizeGenSDKLanguage(language string) string {
+	switch language {
+	case "csharp", "c#":
+		return "dotnet"
+	case "typescript":
+		return "nodejs"
+	default:
+		return language
+	}
+}
+
+// parseGenSDKLanguages parses the value of the --language flag of gen-sdk
+// into the list of languages to generate.
+//
+// The value is "all", a single language, or a comma-separated list of languages.
+// Unlike a single language, which may be any language with a plugin,
+// every entry in a list must be one of the languages known to gen-sdk.
+func parseGenSDKLanguages(language string) ([]string, error) {
+	if language == "all" {
+		return genSDKAllLanguages, nil
+	}
+	if !strings.Contains(language, ",") {
+		return []string{normalizeGenSDKLanguage(language)}, nil
+	}
+
+	known := append([]string{"schema"}, genSDKAllLanguages...)
+	isKnown := func(lang string) bool {
+		for _, k := range known {
+			if k == lang {
+				return true
+			}
+		}
+		return false
+	}
+
+	var languages []string
+	seen := make(map[string]bool)
+	for _, lang := range strings.Split(language, ",") {
+		lang = normalizeGenSDKLanguage(strings.TrimSpace(lang))
+		if !isKnown(lang) {
+			return nil, fmt.Errorf("unknown language %q; expected one of: %s", lang, strings.Join(known, ", "))
+		}
+		if !seen[lang] {
+			seen[lang] = true
+			languages = append(languages, lang)
+		}
+	}
+	return languages, nil
+}
+
+// parseGenSDKTargetVersions parses the value of the --target-version flag of gen-sdk
+// into the target version of each language, validating it for the languages that will be generated.
+func parseGenSDKTargetVersions(value string, languages []string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	targetVersions := make(map[string]string)
+	if !strings.Contains(value, "=") {
+		if len(languages) != 1 {
+			return nil, fmt.Errorf("--target-version must be a list of <language>=<version> pairs " +
+				"when generating more than one language")
+		}
+		targetVersions[languages[0]] = value
+	} else {
+		for _, pair := range strings.Split(value, ",") {
+			lang, version, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || lang == "" || version == "" {
+				return nil, fmt.Errorf("invalid value for --target-version: %q; expected <language>=<version>", pair)
+			}
+			targetVersions[normalizeGenSDKLanguage(lang)] = version
+		}
+	}
+
+	for lang, version := range targetVersions {
+		generated := false
+		for _, l := range languages {
+			generated = generated || l == lang
+		}
+		if !generated {
+			return nil, fmt.Errorf("--target-version was given for %s, but no %s SDK is being generated", lang, lang)
+		}
+		if _, _, err := genSDKTargetVersionOptions(lang, version); err != nil {
+			return nil, err
+		}
+	}
+	return targetVersions, nil
+}
+
+var (
+	genSDKPythonVersionRegexp = regexp.MustCompile(`^3\.(\d+)$`)
+	genSDKNodeVersionRegexp   = regexp.MustCompile(`^(\d+)$`)
+	genSDKDotnetVersionRegexp = regexp.MustCompile(`^net(\d+)\.0$`)
+)
+
+// genSDKTargetVersionOptions returns the language-specific options of the package schema
+// that make the SDK for language support the given target version,
+// along with the name of the language section of the schema they go in.
+//
+// It reports an error if the language doesn't support a target version,
+// or if the version isn't one the SDK can be generated for.
+func genSDKTargetVersionOptions(language, version string) (string, map[string]interface{}, error) {
+	// atLeast reports whether version matches re and the number it captures is at least min.
+	atLeast := func(re *regexp.Regexp, min int) bool {
+		m := re.FindStringSubmatch(version)
+		if m == nil {
+			return false
+		}
+		n, err := strconv.Atoi(m[1])
+		return err == nil && n >= min
+	}
+
+	switch language {
+	case "python":
+		if !atLeast(genSDKPythonVersionRegexp, 7) {
+			return "", nil, fmt.Errorf("invalid target version %q for python; expected 3.7 or later, e.g. 3.8", version)
+		}
+		return "python", map[string]interface{}{
+			"pythonRequires": ">=" + version,
+		}, nil
+	case "nodejs":
+		if !atLeast(genSDKNodeVersionRegexp, 14) {
+			return "", nil, fmt.Errorf("invalid target version %q for nodejs; expected 14 or later, e.g. 16", version)
+		}
+		return "nodejs", map[string]interface{}{
+			"engines": map[string]string{"node": ">=" + version},
+		}, nil
+	case "dotnet":
+		if !atLeast(genSDKDotnetVersionRegexp, 6) {
+			return "", nil, fmt.Errorf(
+				"invalid target version %q for dotnet; expected net6.0 or later, e.g. net8.0", version)
+		}
+		return "csharp", map[string]interface{}{
+			"targetFramework": version,
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("--target-version is not supported for %s SDKs", language)
+	}
+}
+
+// withGenSDKTargetVersion binds a copy of pkg whose language-specific options
+// make the SDK for language support the given target version.
+// Other options set by the schema are kept.
+func withGenSDKTargetVersion(pkg *schema.Package, language, version string) (*schema.Package, error) {
+	section, options, err := genSDKTargetVersionOptions(language, version)
+	if err != nil {
+		return nil, err
+	}
+
+	spec, err := pkg.MarshalSpec()
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+
+	merged := make(map[string]interface{})
+	if raw, ok := spec.Language[section]; ok {
+		if err := json.Unmarshal(raw, &merged); err != nil {
+			return nil, fmt.Errorf("unmarshal %s options: %w", section, err)
+		}
+	}
+	for k, v := range options {
+		merged[k] = v
+	}
+	raw, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s options: %w", section, err)
+	}
+	if spec.Language == nil {
+		spec.Language = make(map[string]schema.RawMessage)
+	}
+	spec.Language[section] = raw
+
+	targeted, diags, err := schema.BindSpec(*spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return targeted, nil
+}
+
+// pruneGenSDKResources binds a copy of pkg that only contains the resources
+// whose tokens match one of patterns, which are globs in the syntax of path.Match.
+// The types, resources, and functions referenced by those resources are kept too,
+// as are the provider and the types it and the package's config reference,
+// so that the pruned package is still valid.
+//
+// It reports an error if a pattern is malformed or doesn't match any resource.
+func pruneGenSDKResources(pkg *schema.Package, patterns []string) (*schema.Package, error) {
+	spec, err := pkg.MarshalSpec()
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+
+	p := genSDKPruner{
+		spec:      spec,
+		resources: make(map[string]bool),
+		types:     make(map[string]bool),
+		functions: make(map[string]bool),
+	}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		matched := false
+		for token := range spec.Resources {
+			ok, err := path.Match(pattern, token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for --resources: %q: %w", pattern, err)
+			}
+			if ok {
+				matched = true
+				p.addResource(token)
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no resources in package %s match %q", spec.Name, pattern)
+		}
+	}
+	p.addResourceSpec(spec.Provider)
+	for _, v := range spec.Config.Variables {
+		p.addTypeSpec(v.TypeSpec)
+	}
+
+	for token := range spec.Resources {
+		if !p.resources[token] {
+			delete(spec.Resources, token)
+		}
+	}
+	for token := range spec.Types {
+		if !p.types[token] {
+			delete(spec.Types, token)
+		}
+	}
+	for token := range spec.Functions {
+		if !p.functions[token] {
+			delete(spec.Functions, token)
+		}
+	}
+
+	pruned, diags, err := schema.BindSpec(*spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return pruned, nil
+}
+
+// genSDKPruner collects the tokens reachable from a set of resources in spec
+// for pruneGenSDKResources.
+type genSDKPruner struct {
+	spec      *schema.PackageSpec
+	resources map[string]bool
+	types     map[string]bool
+	functions map[string]bool
+}
+
+func (p *genSDKPruner) addResource(token string) {
+	r, ok := p.spec.Resources[token]
+	if !ok || p.resources[token] {
+		return
+	}
+	p.resources[token] = true
+	p.addResourceSpec(r)
+}
+
+func (p *genSDKPruner) addResourceSpec(r schema.ResourceSpec) {
+	p.addObjectTypeSpec(&r.ObjectTypeSpec)
+	p.addProperties(r.InputProperties)
+	p.addObjectTypeSpec(r.StateInputs)
+	for _, token := range r.Methods {
+		p.addFunction(token)
+	}
+}
+
+func (p *genSDKPruner) addFunction(token string) {
+	f, ok := p.spec.Functions[token]
+	if !ok || p.functions[token] {
+		return
+	}
+	p.functions[token] = true
+	p.addObjectTypeSpec(f.Inputs)
+	p.addObjectTypeSpec(f.Outputs)
+	if f.ReturnType != nil {
+		p.addObjectTypeSpec(f.ReturnType.ObjectTypeSpec)
+		if f.ReturnType.TypeSpec != nil {
+			p.addTypeSpec(*f.ReturnType.TypeSpec)
+		}
+	}
+}
+
+func (p *genSDKPruner) addObjectTypeSpec(o *schema.ObjectTypeSpec) {
+	if o != nil {
+		p.addProperties(o.Properties)
+	}
+}
+
+func (p *genSDKPruner) addProperties(properties map[string]schema.PropertySpec) {
+	for _, prop := range properties {
+		p.addTypeSpec(prop.TypeSpec)
+	}
+}
+
+func (p *genSDKPruner) addTypeSpec(t schema.TypeSpec) {
+	p.addRef(t.Ref)
+	if t.Items != nil {
+		p.addTypeSpec(*t.Items)
+	}
+	if t.AdditionalProperties != nil {
+		p.addTypeSpec(*t.AdditionalProperties)
+	}
+	for _, o := range t.OneOf {
+		p.addTypeSpec(o)
+	}
+	if t.Discriminator != nil {
+		for _, ref := range t.Discriminator.Mapping {
+			p.addRef(ref)
+		}
+	}
+}
+
+// addRef adds the type or resource referenced by ref.
+// References to other packages and to the provider need no pruning, so they're ignored.
+func (p *genSDKPruner) addRef(ref string) {
+	kind, token, ok := strings.Cut(strings.TrimPrefix(ref, "#/"), "/")
+	if !strings.HasPrefix(ref, "#/") || !ok {
+		return
+	}
+	if unescaped, err := url.PathUnescape(token); err == nil {
+		token = unescaped
+	}
+
+	switch kind {
+	case "resources":
+		p.addResource(token)
+	case "types":
+		t, ok := p.spec.Types[token]
+		if !ok || p.types[token] {
+			return
+		}
+		p.types[token] = true
+		p.addObjectTypeSpec(&t.ObjectTypeSpec)
+	}
+}
+
+// genSDKs generates the SDKs for multiple languages concurrently.
+// Each language is written to its own directory under out.
+//
+// Generation continues for the other languages if one of them fails,
+// and all errors are reported together.
+func genSDKs(
+	ctx context.Context, languages []string, out string, pkg *schema.Package, overlays string,
+	overwrite genSDKOverwriteMode, targetVersions map[string]string, pluginTimeout time.Duration, keepSchema bool,
+	goModule *genSDKGoModuleOptions, overlay *genSDKOverlay,
+) error {
+	var g errgroup.Group
+	g.SetLimit(len(languages))
+
+	errs := make([]error, len(languages))
+	for i, lang := range languages {
+		i, lang := i, lang
+
+		// Code generators import language-specific information into the package they're given,
+		// so every language needs its own copy.
+		langPkg, err := clonePackage(pkg)
+		if err != nil {
+			return err
+		}
+
+		g.Go(func() error {
+			if _, err := genSDK(ctx, lang, out, langPkg, overlays, overwrite, targetVersions[lang], pluginTimeout,
+				keepSchema, goModule, overlay); err != nil {
+				errs[i] = fmt.Errorf("generate %s SDK: %w", lang, err)
+			}
+			return nil
+		})
+	}
+
+	// Errors are recorded in errs; the group never fails.
+	contract.IgnoreError(g.Wait())
+	return errors.Join(errs...)
+}
+
+// checkGenSDKs generates the SDK for each of the given languages without writing it to out,
+// to check that the code generators accept pkg.
+// It reports whether each language succeeded to w,
+// and returns an error if any of them failed.
+func checkGenSDKs(
+	ctx context.Context, w io.Writer, languages []string, pkg *schema.Package,
+	targetVersions map[string]string, pluginTimeout time.Duration,
+) error {
+	var g errgroup.Group
+	g.SetLimit(len(languages))
+
+	errs := make([]error, len(languages))
+	for i, lang := range languages {
+		i, lang := i, lang
+
+		langPkg, err := clonePackage(pkg)
+		if err != nil {
+			return err
+		}
+
+		g.Go(func() error {
+			errs[i] = checkGenSDK(ctx, lang, langPkg, targetVersions[lang], pluginTimeout)
+			return nil
+		})
+	}
+
+	// Errors are recorded in errs; the group never fails.
+	contract.IgnoreError(g.Wait())
+
+	var failed []string
+	for i, lang := range languages {
+		if errs[i] != nil {
+			fmt.Fprintf(w, "%s: failed: %v\n", lang, errs[i])
+			failed = append(failed, lang)
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", lang)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to generate SDKs for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// checkGenSDK generates the SDK for language without keeping it.
+// Panics in code generators are reported as errors,
+// since they're how generators usually reject schema features they don't support.
+func checkGenSDK(
+	ctx context.Context, language string, pkg *schema.Package, targetVersion string, pluginTimeout time.Duration,
+) (err error) {
+	if targetVersion != "" {
+		pkg, err = withGenSDKTargetVersion(pkg, language, targetVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	var generatePackage func(string, *schema.Package, map[string][]byte) (map[string][]byte, error)
+	switch language {
+	case "dotnet":
+		generatePackage = dotnet.GeneratePackage
+	case "java":
+		generatePackage = javagen.GeneratePackage
+	case "schema":
+		generatePackage = generateSchemaPackage
+	default:
+		// Language plugins write the SDK to disk,
+		// so let them write it to a temporary directory.
+		cwd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("get current working directory: %w", err)
+		}
+		dir, err := os.MkdirTemp("", "pulumi-gen-sdk-check-*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		_, err = genSDKWithPlugin(ctx, cwd, language, dir, pkg, nil, pluginTimeout, false /* keepSchema */)
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("code generator panicked: %v", r)
+		}
+	}()
+	_, err = generatePackage("pulumi", pkg, nil)
+	return err
+}
+
+// clonePackage binds a new copy of pkg from its schema.
+func clonePackage(pkg *schema.Package) (*schema.Package, error) {
+	spec, err := pkg.MarshalSpec()
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+	clone, diags, err := schema.BindSpec(*spec, nil)
+	if err != nil {
+		return nil, err
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return clone, nil
+}
+
+var (
+	// genSDKPluginMu serializes SDK generation through language plugins.
+	// Each generation starts its own plugin host and schema loader server.
+	genSDKPluginMu sync.Mutex
+
+	// genSDKPromptMu serializes prompts for confirmation
+	// so that concurrent generations don't interleave them.
+	genSDKPromptMu sync.Mutex
+)
+
+// genSDKOverwriteMode controls what gen-sdk does
+// when the output directory for a language already has files in it.
+type genSDKOverwriteMode string
+
+const (
+	// genSDKOverwriteAlways replaces the existing files.
+	genSDKOverwriteAlways genSDKOverwriteMode = "true"
+	// genSDKOverwriteNever fails instead.
+	genSDKOverwriteNever genSDKOverwriteMode = "false"
+	// genSDKOverwritePrompt asks the user for confirmation,
+	// and fails if it can't ask.
+	genSDKOverwritePrompt genSDKOverwriteMode = "prompt"
+)
+
+func parseGenSDKOverwriteMode(s string) (genSDKOverwriteMode, error) {
+	switch mode := genSDKOverwriteMode(s); mode {
+	case genSDKOverwriteAlways, genSDKOverwriteNever, genSDKOverwritePrompt:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid value for --overwrite: %q; expected one of: true, false, prompt", s)
+	}
+}
+
+// checkGenSDKOverwrite reports an error if generating an SDK into directory
+// would replace existing files and the overwrite mode doesn't allow it.
+func checkGenSDKOverwrite(directory string, mode genSDKOverwriteMode) error {
+	if mode == genSDKOverwriteAlways {
+		return nil
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("read output directory: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if mode == genSDKOverwritePrompt && cmdutil.Interactive() {
+		genSDKPromptMu.Lock()
+		defer genSDKPromptMu.Unlock()
+
+		prompt := fmt.Sprintf("The directory %s is not empty. Its contents will be replaced.", directory)
+		opts := display.Options{Color: cmdutil.GetGlobalColorization()}
+		if confirmPrompt(prompt, "yes", opts) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("refusing to overwrite non-empty directory %s; "+
+		"remove it or pass --overwrite to replace it", directory)
+}
+
+// genSDK generates the SDK for the given language into the directory out/<language>.
+// If targetVersion is set, the SDK supports that version of the language; see --target-version.
+// Languages without a builtin code generator are generated by their language plugin;
+// see genSDKWithPlugin for pluginTimeout and keepSchema.
+// If goModule is set, a Go SDK is written as a standalone module; see writeGoModule.
+// If overlay is set, its files are written on top of the generated SDK; see writeGenSDKOverlay.
+// It returns the paths of the files it wrote, sorted.
+func genSDK(
+	ctx context.Context, language, out string, pkg *schema.Package, overlays string, overwrite genSDKOverwriteMode,
+	targetVersion string, pluginTimeout time.Duration, keepSchema bool, goModule *genSDKGoModuleOptions,
+	overlay *genSDKOverlay,
+) ([]string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
-		return fmt.Errorf("get current working directory: %w", err)
+		return nil, fmt.Errorf("get current working directory: %w", err)
+	}
+
+	root := filepath.Join(out, language)
+	if err := checkGenSDKOverwrite(root, overwrite); err != nil {
+		return nil, err
+	}
+
+	if targetVersion != "" {
+		pkg, err = withGenSDKTargetVersion(pkg, language, targetVersion)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	writeWrapper := func(
 		generatePackage func(string, *schema.Package, map[string][]byte) (map[string][]byte, error),
-	) func(string, *schema.Package, map[string][]byte) error {
-		return func(directory string, p *schema.Package, extraFiles map[string][]byte) error {
+	) func(string, *schema.Package, map[string][]byte) ([]string, error) {
+		return func(directory string, p *schema.Package, extraFiles map[string][]byte) ([]string, error) {
 			m, err := generatePackage("pulumi", p, extraFiles)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			err = os.RemoveAll(directory)
 			if err != nil && !os.IsNotExist(err) {
-				return err
+				return nil, err
 			}
+			paths := make([]string, 0, len(m))
 			for k, v := range m {
 				path := filepath.Join(directory, k)
 				err := os.MkdirAll(filepath.Dir(path), 0o700)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				err = os.WriteFile(path, v, 0o600)
 				if err != nil {
-					return err
+					return nil, err
 				}
+				paths = append(paths, path)
 			}
-			return nil
+			sort.Strings(paths)
+			return paths, nil
 		}
 	}
 
-	var generatePackage func(string, *schema.Package, map[string][]byte) error
+	var generatePackage func(string, *schema.Package, map[string][]byte) ([]string, error)
 	switch language {
 	case "dotnet":
 		generatePackage = writeWrapper(dotnet.GeneratePackage)
 	case "java":
 		generatePackage = writeWrapper(javagen.GeneratePackage)
+	case "schema":
+		generatePackage = writeWrapper(generateSchemaPackage)
 	default:
-		generatePackage = func(directory string, pkg *schema.Package, extraFiles map[string][]byte) error {
-			// Ensure the target directory is clean, but created.
-			err = os.RemoveAll(directory)
-			if err != nil && !os.IsNotExist(err) {
-				return err
-			}
-			err := os.MkdirAll(directory, 0o700)
-			if err != nil {
-				return err
-			}
+		generatePackage = func(directory string, pkg *schema.Package, extraFiles map[string][]byte) ([]string, error) {
+			return genSDKWithPlugin(ctx, cwd, language, directory, pkg, extraFiles, pluginTimeout, keepSchema)
+		}
+	}
 
-			jsonBytes, err := pkg.MarshalJSON()
-			if err != nil {
-				return err
-			}
+	extraFiles := make(map[string][]byte)
+	if overlays != "" {
+		extraFiles, err = readGenSDKOverlayDir(filepath.Join(overlays, language))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			pCtx, err := newPluginContext(cwd)
-			if err != nil {
-				return fmt.Errorf("create plugin context: %w", err)
-			}
-			defer contract.IgnoreClose(pCtx.Host)
+	paths, err := generatePackage(root, pkg, extraFiles)
+	if err != nil {
+		return nil, err
+	}
+	if language == "go" && goModule != nil {
+		written, err := writeGoModule(root, pkg, goModule.ModulePath)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, written...)
+		sort.Strings(paths)
+	}
+	if overlay != nil {
+		paths, err = writeGenSDKOverlay(root, paths, overlay)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
 
-			languagePlugin, err := pCtx.Host.LanguageRuntime(cwd, cwd, language, nil)
-			if err != nil {
-				return err
-			}
+// readGenSDKOverlayDir reads all the files under dir,
+// keyed by their slash-separated path relative to dir.
+func readGenSDKOverlayDir(dir string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	fsys := os.DirFS(dir)
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
 
-			loader := schema.NewPluginLoader(pCtx.Host)
-			loaderServer := schema.NewLoaderServer(loader)
-			grpcServer, err := plugin.NewServer(pCtx, schema.LoaderRegistration(loaderServer))
-			if err != nil {
-				return err
-			}
-			defer contract.IgnoreClose(grpcServer)
+		contents, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return fmt.Errorf("read overlay file %q: %w", path, err)
+		}
 
-			diags, err := languagePlugin.GeneratePackage(directory, string(jsonBytes), extraFiles, grpcServer.Addr())
-			if err != nil {
-				return err
-			}
+		files[path] = contents
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("read overlay directory %q: %w", dir, err)
+	}
+	return files, nil
+}
+
+// genSDKOverlay holds the files copied into every generated SDK with --overlay.
+type genSDKOverlay struct {
+	// Files are the contents of the overlay files,
+	// keyed by their slash-separated path relative to the root of the SDK.
+	Files map[string][]byte
+
+	// Force allows overlay files to replace generated files.
+	Force bool
+}
 
-			// These diagnostics come directly from the converter and so _should_ be user friendly. So we're just
-			// going to print them.
-			printDiagnostics(pCtx.Diag, diags)
-			if diags.HasErrors() {
-				// If we've got error diagnostics then package generation failed, we've printed the error above so
-				// just return a plain message here.
-				return fmt.Errorf("generation failed")
+// writeGenSDKOverlay writes the files of overlay under directory,
+// which holds an SDK made of the given generated files.
+//
+// Unlike the extra files given to code generators,
+// overlay files are written relative to the root of the SDK in every language.
+// Nothing is written if an overlay file would replace a generated file, unless overlay.Force is set.
+// It returns the paths of all the files in the SDK, sorted.
+func writeGenSDKOverlay(directory string, generated []string, overlay *genSDKOverlay) ([]string, error) {
+	isGenerated := make(map[string]bool, len(generated))
+	for _, path := range generated {
+		isGenerated[path] = true
+	}
+
+	names := make([]string, 0, len(overlay.Files))
+	for name := range overlay.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !overlay.Force {
+		for _, name := range names {
+			if isGenerated[filepath.Join(directory, filepath.FromSlash(name))] {
+				return nil, fmt.Errorf("overlay file %q would replace a generated file; "+
+					"use --overlay-force to replace it", name)
 			}
+		}
+	}
 
-			return nil
+	paths := generated
+	for _, name := range names {
+		path := filepath.Join(directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, overlay.Files[name], 0o600); err != nil {
+			return nil, err
+		}
+		if !isGenerated[path] {
+			paths = append(paths, path)
 		}
 	}
+	sort.Strings(paths)
+	return paths, nil
+}
 
-	extraFiles := make(map[string][]byte)
-	if overlays != "" {
-		fsys := os.DirFS(filepath.Join(overlays, language))
-		err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
-				return err
-			}
+// genSDKGoModuleOptions controls the go.mod written alongside a Go SDK.
+type genSDKGoModuleOptions struct {
+	// ModulePath is the path of the module.
+	// If empty, it's derived from the package's import base path.
+	ModulePath string
+}
 
-			contents, err := fs.ReadFile(fsys, path)
-			if err != nil {
-				return fmt.Errorf("read overlay file %q: %w", path, err)
-			}
+// goSDKMinimumGoVersion is the go directive written to the go.mod of Go SDKs.
+// It matches the Go version required by the Pulumi Go SDK.
+const goSDKMinimumGoVersion = "1.18"
 
-			extraFiles[path] = contents
-			return nil
-		})
+// writeGoModule writes a go.mod and a README.md into directory,
+// which holds the Go SDK generated for pkg,
+// so that the SDK can be built without further setup.
+// It returns the paths of the files it wrote.
+func writeGoModule(directory string, pkg *schema.Package, modulePath string) ([]string, error) {
+	files, err := goModuleFiles(pkg, modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(files))
+	for name, contents := range files {
+		dest := filepath.Join(directory, name)
+		if err := os.WriteFile(dest, contents, 0o600); err != nil {
+			return nil, fmt.Errorf("write %v: %w", name, err)
+		}
+		paths = append(paths, dest)
+	}
+	return paths, nil
+}
+
+// goModuleFiles returns the contents of the go.mod and README.md of the Go SDK generated for pkg.
+//
+// The module requires the major version of the Pulumi SDK set in the package's Go language settings,
+// at the version of this CLI if it has the same major version.
+func goModuleFiles(pkg *schema.Package, modulePath string) (map[string][]byte, error) {
+	var info gogen.GoPackageInfo
+	switch raw := pkg.Language["go"].(type) {
+	case gogen.GoPackageInfo:
+		info = raw
+	case json.RawMessage:
+		if err := json.Unmarshal(raw, &info); err != nil {
+			return nil, fmt.Errorf("unmarshal Go language settings: %w", err)
+		}
+	}
+
+	// The code generator writes the SDK into a directory named after the last element
+	// of the import base path, unless the root package name is set.
+	importBasePath := info.ImportBasePath
+	if importBasePath == "" {
+		importBasePath = fmt.Sprintf("github.com/pulumi/pulumi-%s/sdk%s/go/%s",
+			pkg.Name, goMajorVersionSuffix(pkg.Version), pkg.Name)
+	}
+	if modulePath == "" {
+		modulePath = importBasePath
+		if info.RootPackageName == "" {
+			modulePath = path.Dir(importBasePath)
+		}
+	}
+
+	sdkMajor := uint64(info.PulumiSDKVersion)
+	if sdkMajor == 0 {
+		sdkMajor = 3
+	}
+	sdkVersion := semver.Version{Major: sdkMajor}
+	if v, err := semver.ParseTolerant(version.Version); err == nil && v.Major == sdkMajor {
+		sdkVersion = semver.Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch}
+		// Development builds are ahead of the latest release, so require the last minor release instead.
+		if len(v.Pre) > 0 {
+			sdkVersion.Patch = 0
+		}
+	}
+
+	var gomod bytes.Buffer
+	fmt.Fprintf(&gomod, "module %s\n\n", modulePath)
+	fmt.Fprintf(&gomod, "go %s\n\n", goSDKMinimumGoVersion)
+	fmt.Fprintf(&gomod, "require github.com/pulumi/pulumi/sdk%s v%s\n",
+		goMajorVersionSuffix(&sdkVersion), sdkVersion)
+
+	var readme bytes.Buffer
+	fmt.Fprintf(&readme, "# %s\n\n", pkg.Name)
+	if pkg.Description != "" {
+		fmt.Fprintf(&readme, "%s\n\n", strings.TrimSpace(pkg.Description))
+	}
+	fmt.Fprintf(&readme, "This Go SDK was generated by `pulumi package gen-sdk`.\n\n")
+	fmt.Fprintf(&readme, "To use it, import `%s`, then run `go mod tidy`.\n", importBasePath)
+
+	return map[string][]byte{
+		"go.mod":    gomod.Bytes(),
+		"README.md": readme.Bytes(),
+	}, nil
+}
+
+// goMajorVersionSuffix returns the suffix of a module path for the given version, e.g. "/v2".
+// Versions before v2 have no suffix.
+func goMajorVersionSuffix(v *semver.Version) string {
+	if v == nil || v.Major < 2 {
+		return ""
+	}
+	return fmt.Sprintf("/v%d", v.Major)
+}
+
+// genSDKWithPlugin generates the SDK for the given language into directory using its language plugin.
+// The plugin is shut down if it doesn't finish within timeout; a zero timeout means no limit.
+// If keepSchema is set, the schema given to the plugin is also written to a temporary file,
+// whose path is printed and which is left in place, even if generation fails.
+//
+// The plugin's stderr is captured, and included in the returned error if generation fails.
+// On success it's written to os.Stderr as usual.
+func genSDKWithPlugin(
+	ctx context.Context, cwd, language, directory string, pkg *schema.Package, extraFiles map[string][]byte,
+	timeout time.Duration, keepSchema bool,
+) ([]string, error) {
+	genSDKPluginMu.Lock()
+	defer genSDKPluginMu.Unlock()
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stderr bytes.Buffer
+	// By the time runLanguagePlugin returns, the plugin host has been closed
+	// and the plugin's stderr fully drained into the buffer, so it's safe to read.
+	paths, err := runLanguagePlugin(ctx, cwd, language, directory, pkg, extraFiles, keepSchema, &stderr)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%s plugin did not finish generating the SDK within %v; "+
+			"increase --plugin-timeout to allow more time", language, timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w\n%s plugin output:\n%s", err, language, msg)
+		}
+		return nil, err
+	}
+	_, err = os.Stderr.Write(stderr.Bytes())
+	contract.IgnoreError(err)
+	return paths, nil
+}
+
+// runLanguagePlugin runs the language plugin for genSDKWithPlugin,
+// writing its stderr and diagnostics to stderr.
+func runLanguagePlugin(
+	ctx context.Context, cwd, language, directory string, pkg *schema.Package, extraFiles map[string][]byte,
+	keepSchema bool, stderr io.Writer,
+) ([]string, error) {
+	// Ensure the target directory is clean, but created.
+	err := os.RemoveAll(directory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err = os.MkdirAll(directory, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonBytes, err := pkg.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	if keepSchema {
+		schemaPath, err := writeGenSDKSchemaFile(jsonBytes)
 		if err != nil {
-			return fmt.Errorf("read overlay directory %q: %w", overlays, err)
+			return nil, err
 		}
+		fmt.Printf("Wrote the schema given to the %s plugin to %s\n", language, schemaPath)
 	}
 
-	root := filepath.Join(out, language)
-	err = generatePackage(root, pkg, extraFiles)
+	sink := diag.DefaultSink(os.Stderr, stderr, diag.FormatOptions{
+		Color: cmdutil.GetGlobalColorization(),
+	})
+	// Like plugin.NewContext, use the plugins configured by the current project, if any.
+	var plugins *workspace.Plugins
+	if projPath, err := workspace.DetectProjectPath(); err == nil && projPath != "" {
+		if project, err := workspace.LoadProject(projPath); err == nil {
+			plugins = project.Plugins
+		}
+	}
+	// Requests to the plugin are made with the plugin context's base context,
+	// so they're cancelled when ctx is.
+	pCtx, err := plugin.NewContextWithContext(ctx, sink, sink, nil, cwd, "", nil, true, nil, plugins, nil)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("create plugin context: %w", err)
 	}
-	return nil
+	// Closing the host shuts down the language plugin, even if it's still running.
+	defer contract.IgnoreClose(pCtx.Host)
+
+	languagePlugin, err := pCtx.Host.LanguageRuntime(cwd, cwd, language, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := schema.NewPluginLoader(pCtx.Host)
+	loaderServer := schema.NewLoaderServer(loader)
+	grpcServer, err := plugin.NewServer(pCtx, schema.LoaderRegistration(loaderServer))
+	if err != nil {
+		return nil, err
+	}
+	defer contract.IgnoreClose(grpcServer)
+
+	diags, err := languagePlugin.GeneratePackage(directory, string(jsonBytes), extraFiles, grpcServer.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	// These diagnostics come directly from the converter and so _should_ be user friendly. So we're just
+	// going to print them.
+	printDiagnostics(pCtx.Diag, diags)
+	if diags.HasErrors() {
+		// If we've got error diagnostics then package generation failed, we've printed the error above so
+		// just return a plain message here.
+		return nil, fmt.Errorf("generation failed")
+	}
+
+	return listGeneratedFiles(directory)
+}
+
+// writeGenSDKSchemaFile writes the schema given to a language plugin to a new temporary file
+// for --keep-schema, and returns its path.
+// The file has a .json extension so that editors and other tools recognize it.
+func writeGenSDKSchemaFile(schemaJSON []byte) (string, error) {
+	f, err := os.CreateTemp("", "pulumi-schema-*.json")
+	if err != nil {
+		return "", fmt.Errorf("create schema file: %w", err)
+	}
+	defer contract.IgnoreClose(f)
+
+	if _, err := f.Write(schemaJSON); err != nil {
+		contract.IgnoreError(os.Remove(f.Name()))
+		return "", fmt.Errorf("write schema file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// listGeneratedFiles returns the paths of all regular files under directory, sorted.
+// It is used for language plugins, which write their output directly to disk.
+func listGeneratedFiles(directory string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list generated files: %w", err)
+	}
+	return paths, nil
+}
+
+// schemaBindings is the manifest written to bindings.json by the "schema" language.
+// It indexes the tokens defined by a package.
+type schemaBindings struct {
+	Name      string   `json:"name"`
+	Version   string   `json:"version,omitempty"`
+	Resources []string `json:"resources"`
+	Functions []string `json:"functions"`
+}
+
+// generateSchemaPackage generates the files for the "schema" language:
+// the normalized schema of the package in schema.json,
+// and a manifest of the resources and functions it defines in bindings.json.
+//
+// The schema is validated by round-tripping it through schema.ImportSpec.
+func generateSchemaPackage(
+	_ string, pkg *schema.Package, extraFiles map[string][]byte,
+) (map[string][]byte, error) {
+	spec, err := pkg.MarshalSpec()
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+	normalized, err := schema.ImportSpec(*spec, nil)
+	if err != nil {
+		return nil, fmt.Errorf("validate schema: %w", err)
+	}
+
+	schemaJSON, err := normalized.MarshalJSON()
+	if err != nil {
+		return nil, fmt.Errorf("marshal schema: %w", err)
+	}
+
+	bindings := schemaBindings{
+		Name:      normalized.Name,
+		Resources: make([]string, 0, len(normalized.Resources)),
+		Functions: make([]string, 0, len(normalized.Functions)),
+	}
+	if normalized.Version != nil {
+		bindings.Version = normalized.Version.String()
+	}
+	for _, r := range normalized.Resources {
+		bindings.Resources = append(bindings.Resources, r.Token)
+	}
+	for _, f := range normalized.Functions {
+		bindings.Functions = append(bindings.Functions, f.Token)
+	}
+	sort.Strings(bindings.Resources)
+	sort.Strings(bindings.Functions)
+
+	var bindingsJSON bytes.Buffer
+	enc := json.NewEncoder(&bindingsJSON)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(bindings); err != nil {
+		return nil, fmt.Errorf("marshal bindings: %w", err)
+	}
+
+	files := make(map[string][]byte, len(extraFiles)+2)
+	for path, contents := range extraFiles {
+		files[path] = contents
+	}
+	files["schema.json"] = schemaJSON
+	files["bindings.json"] = bindingsJSON.Bytes()
+	return files, nil
 }
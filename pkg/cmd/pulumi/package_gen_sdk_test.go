@@ -0,0 +1,570 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/pkg/v3/codegen/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testGenSDKPackage(t *testing.T) *schema.Package {
+	t.Helper()
+
+	pkg, err := schema.ImportSpec(schema.PackageSpec{
+		Name:    "test",
+		Version: "1.2.3",
+		Resources: map[string]schema.ResourceSpec{
+			"test:index:Widget": {},
+			"test:index:Gadget": {},
+		},
+		Functions: map[string]schema.FunctionSpec{
+			"test:index:getWidget": {},
+		},
+	}, nil)
+	require.NoError(t, err)
+	return pkg
+}
+
+func TestGenerateSchemaPackage(t *testing.T) {
+	t.Parallel()
+
+	files, err := generateSchemaPackage("pulumi", testGenSDKPackage(t), map[string][]byte{
+		"README.md": []byte("overlay"),
+	})
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+	assert.Equal(t, "overlay", string(files["README.md"]))
+
+	var bindings schemaBindings
+	require.NoError(t, json.Unmarshal(files["bindings.json"], &bindings))
+	assert.Equal(t, schemaBindings{
+		Name:      "test",
+		Version:   "1.2.3",
+		Resources: []string{"test:index:Gadget", "test:index:Widget"},
+		Functions: []string{"test:index:getWidget"},
+	}, bindings)
+
+	// The schema must be importable as-is.
+	var spec schema.PackageSpec
+	require.NoError(t, json.Unmarshal(files["schema.json"], &spec))
+	_, err = schema.ImportSpec(spec, nil)
+	require.NoError(t, err)
+	assert.Len(t, spec.Resources, 2)
+	assert.Len(t, spec.Functions, 1)
+}
+
+func TestParseGenSDKLanguages(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give string
+		want []string
+	}{
+		{give: "all", want: []string{"dotnet", "go", "java", "nodejs", "python"}},
+		{give: "go", want: []string{"go"}},
+		{give: "typescript", want: []string{"nodejs"}},
+		// Single languages aren't validated; they may be provided by a plugin.
+		{give: "yaml", want: []string{"yaml"}},
+		{give: "go,python,nodejs", want: []string{"go", "python", "nodejs"}},
+		{give: "go, c#,go", want: []string{"go", "dotnet"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseGenSDKLanguages(tt.give)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseGenSDKLanguages_unknown(t *testing.T) {
+	t.Parallel()
+
+	_, err := parseGenSDKLanguages("go,cobol,python")
+	assert.ErrorContains(t, err, `unknown language "cobol"`)
+}
+
+func TestCheckGenSDKOverwrite(t *testing.T) {
+	t.Parallel()
+
+	empty := t.TempDir()
+	nonEmpty := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(nonEmpty, "index.ts"), []byte("// hand-edited"), 0o600))
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	for _, dir := range []string{empty, nonEmpty, missing} {
+		assert.NoError(t, checkGenSDKOverwrite(dir, genSDKOverwriteAlways), "overwrite %v", dir)
+	}
+
+	assert.NoError(t, checkGenSDKOverwrite(empty, genSDKOverwriteNever))
+	assert.NoError(t, checkGenSDKOverwrite(missing, genSDKOverwriteNever))
+	err := checkGenSDKOverwrite(nonEmpty, genSDKOverwriteNever)
+	assert.ErrorContains(t, err, "refusing to overwrite non-empty directory "+nonEmpty)
+}
+
+func TestGenSDK_noOverwrite(t *testing.T) {
+	t.Parallel()
+
+	out := t.TempDir()
+	existing := filepath.Join(out, "schema", "custom.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(existing), 0o700))
+	require.NoError(t, os.WriteFile(existing, []byte("hand-edited"), 0o600))
+
+	_, err := genSDK(context.Background(), "schema", out, testGenSDKPackage(t), "",
+		genSDKOverwriteNever, "", 0, false, nil, nil)
+	assert.ErrorContains(t, err, "refusing to overwrite")
+
+	// The existing SDK must be left untouched.
+	contents, err := os.ReadFile(existing)
+	require.NoError(t, err)
+	assert.Equal(t, "hand-edited", string(contents))
+
+	_, err = genSDK(context.Background(), "schema", out, testGenSDKPackage(t), "",
+		genSDKOverwriteAlways, "", 0, false, nil, nil)
+	require.NoError(t, err)
+	_, err = os.Stat(existing)
+	assert.True(t, os.IsNotExist(err), "existing file should have been removed")
+	_, err = os.Stat(filepath.Join(out, "schema", "bindings.json"))
+	assert.NoError(t, err)
+}
+
+func TestGenSDK_returnsWrittenFiles(t *testing.T) {
+	t.Parallel()
+
+	out := t.TempDir()
+	overlays := t.TempDir()
+	overlay := filepath.Join(overlays, "schema", "README.md")
+	require.NoError(t, os.MkdirAll(filepath.Dir(overlay), 0o700))
+	require.NoError(t, os.WriteFile(overlay, []byte("# test"), 0o600))
+
+	paths, err := genSDK(context.Background(), "schema", out, testGenSDKPackage(t), overlays,
+		genSDKOverwriteAlways, "", 0, false, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(out, "schema", "README.md"),
+		filepath.Join(out, "schema", "bindings.json"),
+		filepath.Join(out, "schema", "schema.json"),
+	}, paths)
+}
+
+func TestGenSDK_overlay(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"LICENSE":          "Apache-2.0",
+		"docs/usage.md":    "# usage",
+		"schema.json":      "{}",
+		"unrelated/x.json": "{}",
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+	files, err := readGenSDKOverlayDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 4)
+	assert.Equal(t, "# usage", string(files["docs/usage.md"]))
+
+	// schema.json is also generated by the schema "language".
+	out := t.TempDir()
+	_, err = genSDK(context.Background(), "schema", out, testGenSDKPackage(t), "",
+		genSDKOverwriteAlways, "", 0, false, nil, &genSDKOverlay{Files: files})
+	assert.ErrorContains(t, err, `overlay file "schema.json" would replace a generated file`)
+	_, err = os.Stat(filepath.Join(out, "schema", "LICENSE"))
+	assert.True(t, os.IsNotExist(err), "nothing should be written on collisions")
+
+	paths, err := genSDK(context.Background(), "schema", out, testGenSDKPackage(t), "",
+		genSDKOverwriteAlways, "", 0, false, nil, &genSDKOverlay{Files: files, Force: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(out, "schema", "LICENSE"),
+		filepath.Join(out, "schema", "bindings.json"),
+		filepath.Join(out, "schema", "docs", "usage.md"),
+		filepath.Join(out, "schema", "schema.json"),
+		filepath.Join(out, "schema", "unrelated", "x.json"),
+	}, paths)
+
+	contents, err := os.ReadFile(filepath.Join(out, "schema", "schema.json"))
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(contents))
+}
+
+func TestListGeneratedFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{"b.txt", filepath.Join("sub", "a.txt")} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, nil, 0o600))
+	}
+
+	paths, err := listGeneratedFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "b.txt"),
+		filepath.Join(dir, "sub", "a.txt"),
+	}, paths)
+}
+
+func TestParseGenSDKOverwriteMode(t *testing.T) {
+	t.Parallel()
+
+	for _, give := range []string{"true", "false", "prompt"} {
+		mode, err := parseGenSDKOverwriteMode(give)
+		require.NoError(t, err)
+		assert.Equal(t, genSDKOverwriteMode(give), mode)
+	}
+
+	_, err := parseGenSDKOverwriteMode("maybe")
+	assert.ErrorContains(t, err, `invalid value for --overwrite: "maybe"`)
+}
+
+func TestGenSDKs_reportsAllErrors(t *testing.T) {
+	t.Parallel()
+
+	out := t.TempDir()
+	for _, lang := range []string{"dotnet", "java"} {
+		existing := filepath.Join(out, lang, "custom.txt")
+		require.NoError(t, os.MkdirAll(filepath.Dir(existing), 0o700))
+		require.NoError(t, os.WriteFile(existing, []byte("hand-edited"), 0o600))
+	}
+
+	err := genSDKs(context.Background(), []string{"dotnet", "schema", "java"}, out, testGenSDKPackage(t), "",
+		genSDKOverwriteNever, nil, 0, false, nil, nil)
+	assert.ErrorContains(t, err, "generate dotnet SDK: refusing to overwrite")
+	assert.ErrorContains(t, err, "generate java SDK: refusing to overwrite")
+
+	// Languages that didn't fail are still generated.
+	_, err = os.Stat(filepath.Join(out, "schema", "bindings.json"))
+	assert.NoError(t, err)
+}
+
+func TestCheckGenSDKs(t *testing.T) {
+	t.Parallel()
+
+	var out bytes.Buffer
+	err := checkGenSDKs(context.Background(), &out, []string{"schema", "dotnet"}, testGenSDKPackage(t),
+		map[string]string{"dotnet": "net8.0"}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "schema: ok\ndotnet: ok\n", out.String())
+
+	// There's no language plugin for this language.
+	out.Reset()
+	err = checkGenSDKs(context.Background(), &out, []string{"schema", "notalanguage"}, testGenSDKPackage(t), nil, 0)
+	assert.ErrorContains(t, err, "failed to generate SDKs for: notalanguage")
+	assert.Contains(t, out.String(), "schema: ok\n")
+	assert.Contains(t, out.String(), "notalanguage: failed: ")
+}
+
+func TestParseGenSDKTargetVersions(t *testing.T) {
+	t.Parallel()
+
+	got, err := parseGenSDKTargetVersions("", []string{"python"})
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = parseGenSDKTargetVersions("3.8", []string{"python"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"python": "3.8"}, got)
+
+	got, err = parseGenSDKTargetVersions("python=3.11, typescript=16,c#=net8.0",
+		[]string{"python", "nodejs", "dotnet", "go"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"python": "3.11", "nodejs": "16", "dotnet": "net8.0"}, got)
+}
+
+func TestParseGenSDKTargetVersions_errors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give      string
+		languages []string
+		wantErr   string
+	}{
+		{"3.8", []string{"python", "go"}, "when generating more than one language"},
+		{"python=", []string{"python"}, `invalid value for --target-version: "python="`},
+		{"python=3.8", []string{"go"}, "no python SDK is being generated"},
+		{"go=1.20", []string{"go"}, "--target-version is not supported for go SDKs"},
+		{"python=2.7", []string{"python"}, `invalid target version "2.7" for python`},
+		{"python=3.6", []string{"python"}, `invalid target version "3.6" for python`},
+		{"nodejs=12", []string{"nodejs"}, `invalid target version "12" for nodejs`},
+		{"nodejs=v16", []string{"nodejs"}, `invalid target version "v16" for nodejs`},
+		{"dotnet=netcoreapp3.1", []string{"dotnet"}, `invalid target version "netcoreapp3.1" for dotnet`},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.give, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseGenSDKTargetVersions(tt.give, tt.languages)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestWithGenSDKTargetVersion(t *testing.T) {
+	t.Parallel()
+
+	pkg, err := schema.ImportSpec(schema.PackageSpec{
+		Name: "test",
+		Language: map[string]schema.RawMessage{
+			"nodejs": schema.RawMessage(`{"packageName": "@acme/test", "engines": {"node": ">=14"}}`),
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	targeted, err := withGenSDKTargetVersion(pkg, "nodejs", "18")
+	require.NoError(t, err)
+
+	spec, err := targeted.MarshalSpec()
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"packageName": "@acme/test", "engines": {"node": ">=18"}}`, string(spec.Language["nodejs"]))
+}
+
+func TestGenSDK_targetVersion(t *testing.T) {
+	t.Parallel()
+
+	out := t.TempDir()
+	_, err := genSDK(context.Background(), "dotnet", out, testGenSDKPackage(t), "",
+		genSDKOverwriteAlways, "net8.0", 0, false, nil, nil)
+	require.NoError(t, err)
+
+	project, err := os.ReadFile(filepath.Join(out, "dotnet", "Pulumi.Test.csproj"))
+	require.NoError(t, err)
+	assert.Contains(t, string(project), "<TargetFramework>net8.0</TargetFramework>")
+}
+
+func TestPruneGenSDKResources(t *testing.T) {
+	t.Parallel()
+
+	ref := func(ref string) schema.PropertySpec {
+		return schema.PropertySpec{TypeSpec: schema.TypeSpec{Ref: ref}}
+	}
+	pkg, err := schema.ImportSpec(schema.PackageSpec{
+		Name: "test",
+		Resources: map[string]schema.ResourceSpec{
+			"test:index:Widget": {
+				InputProperties: map[string]schema.PropertySpec{
+					"size":  ref("#/types/test:index:Size"),
+					"owner": ref("#/resources/test:index:Owner"),
+				},
+				Methods: map[string]string{"spin": "test:index:Widget/spin"},
+			},
+			"test:index:Owner":  {},
+			"test:other:Gadget": {},
+			"test:other:Gizmo": {
+				InputProperties: map[string]schema.PropertySpec{"color": ref("#/types/test:other:Color")},
+			},
+		},
+		Types: map[string]schema.ComplexTypeSpec{
+			"test:index:Size": {ObjectTypeSpec: schema.ObjectTypeSpec{
+				Type:       "object",
+				Properties: map[string]schema.PropertySpec{"unit": ref("#/types/test:index:Unit")},
+			}},
+			"test:index:Unit":  {ObjectTypeSpec: schema.ObjectTypeSpec{Type: "object"}},
+			"test:other:Color": {ObjectTypeSpec: schema.ObjectTypeSpec{Type: "object"}},
+		},
+		Functions: map[string]schema.FunctionSpec{
+			"test:index:Widget/spin": {
+				Inputs: &schema.ObjectTypeSpec{
+					Properties: map[string]schema.PropertySpec{"__self__": ref("#/resources/test:index:Widget")},
+				},
+			},
+			"test:index:getWidget": {},
+		},
+	}, nil)
+	require.NoError(t, err)
+
+	tokens := func(pkg *schema.Package) (resources, types, functions []string) {
+		spec, err := pkg.MarshalSpec()
+		require.NoError(t, err)
+		for token := range spec.Resources {
+			resources = append(resources, token)
+		}
+		for token := range spec.Types {
+			types = append(types, token)
+		}
+		for token := range spec.Functions {
+			functions = append(functions, token)
+		}
+		return resources, types, functions
+	}
+
+	pruned, err := pruneGenSDKResources(pkg, []string{"test:index:Widget"})
+	require.NoError(t, err)
+	resources, types, functions := tokens(pruned)
+	assert.ElementsMatch(t, []string{"test:index:Widget", "test:index:Owner"}, resources)
+	assert.ElementsMatch(t, []string{"test:index:Size", "test:index:Unit"}, types)
+	assert.ElementsMatch(t, []string{"test:index:Widget/spin"}, functions)
+
+	pruned, err = pruneGenSDKResources(pkg, []string{"test:other:*"})
+	require.NoError(t, err)
+	resources, types, functions = tokens(pruned)
+	assert.ElementsMatch(t, []string{"test:other:Gadget", "test:other:Gizmo"}, resources)
+	assert.ElementsMatch(t, []string{"test:other:Color"}, types)
+	assert.Empty(t, functions)
+
+	_, err = pruneGenSDKResources(pkg, []string{"test:index:Widget", "test:index:Missing"})
+	assert.ErrorContains(t, err, `no resources in package test match "test:index:Missing"`)
+}
+
+func TestWriteGenSDKSchemaFile(t *testing.T) {
+	t.Parallel()
+
+	path, err := writeGenSDKSchemaFile([]byte(`{"name": "test"}`))
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(path) })
+
+	assert.Equal(t, ".json", filepath.Ext(path))
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `{"name": "test"}`, string(contents))
+}
+
+func TestSchemaFromReader(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		give string
+	}{
+		{"json", `{"name": "test", "version": "1.2.3", "resources": {"test:index:Widget": {}}}`},
+		{"yaml", "name: test\nversion: 1.2.3\nresources:\n  test:index:Widget: {}\n"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, err := schemaFromReader(strings.NewReader(tt.give))
+			require.NoError(t, err)
+			assert.Equal(t, "test", pkg.Name)
+			assert.Equal(t, "1.2.3", pkg.Version.String())
+			assert.Len(t, pkg.Resources, 1)
+		})
+	}
+}
+
+//nolint:paralleltest // mutates global state
+func TestGenSdkCommand_stdin(t *testing.T) {
+	if _, err := exec.LookPath("pulumi-language-go"); err != nil {
+		t.Skip("pulumi-language-go is required to generate Go SDKs")
+	}
+
+	mockStdin(t, `{"name": "test", "version": "1.2.3", "resources": {"test:index:Widget": {}}}`)
+
+	out := t.TempDir()
+	cmd := newGenSdkCommand()
+	cmd.SetArgs([]string{"-", "--language", "go", "--out", out})
+	require.NoError(t, cmd.Execute())
+
+	paths, err := listGeneratedFiles(filepath.Join(out, "go"))
+	require.NoError(t, err)
+	assert.Contains(t, paths, filepath.Join(out, "go", "test", "widget.go"))
+	assert.Contains(t, paths, filepath.Join(out, "go", "go.mod"))
+}
+
+func TestGenSDKWithPlugin_timeout(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("pulumi-language-go"); err != nil {
+		t.Skip("pulumi-language-go is required to generate Go SDKs")
+	}
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	// The timeout expires before the plugin can do anything.
+	_, err = genSDKWithPlugin(context.Background(), cwd, "go", t.TempDir(), testGenSDKPackage(t), nil,
+		time.Nanosecond, false)
+	assert.ErrorContains(t, err, "go plugin did not finish generating the SDK within 1ns")
+}
+
+func TestGoModuleFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc       string
+		language   string
+		modulePath string
+		wantModule string
+		wantImport string
+	}{
+		{
+			desc:       "default import path",
+			wantModule: "github.com/pulumi/pulumi-test/sdk/go",
+			wantImport: "github.com/pulumi/pulumi-test/sdk/go/test",
+		},
+		{
+			desc:       "import base path",
+			language:   `{"importBasePath": "example.com/test/sdk/v2/go/test"}`,
+			wantModule: "example.com/test/sdk/v2/go",
+			wantImport: "example.com/test/sdk/v2/go/test",
+		},
+		{
+			desc:       "root package name",
+			language:   `{"importBasePath": "example.com/test", "rootPackageName": "test"}`,
+			wantModule: "example.com/test",
+			wantImport: "example.com/test",
+		},
+		{
+			desc:       "module path override",
+			modulePath: "example.com/override",
+			wantModule: "example.com/override",
+			wantImport: "github.com/pulumi/pulumi-test/sdk/go/test",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			spec := schema.PackageSpec{Name: "test", Version: "1.2.3"}
+			if tt.language != "" {
+				spec.Language = map[string]schema.RawMessage{"go": schema.RawMessage(tt.language)}
+			}
+			pkg, err := schema.ImportSpec(spec, nil)
+			require.NoError(t, err)
+
+			files, err := goModuleFiles(pkg, tt.modulePath)
+			require.NoError(t, err)
+
+			gomod := string(files["go.mod"])
+			assert.True(t, strings.HasPrefix(gomod, "module "+tt.wantModule+"\n"), "go.mod:\n%s", gomod)
+			assert.Contains(t, gomod, "\nrequire github.com/pulumi/pulumi/sdk/v3 v3.")
+			assert.Contains(t, string(files["README.md"]), "`"+tt.wantImport+"`")
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"github.com/pulumi/pulumi/pkg/v3/backend"
 	"github.com/pulumi/pulumi/pkg/v3/backend/display"
 	"github.com/pulumi/pulumi/pkg/v3/backend/state"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
@@ -75,7 +76,8 @@ func newStackRmCmd() *cobra.Command {
 
 			hasResources, err := s.Remove(ctx, force)
 			if err != nil {
-				if hasResources {
+				var notEmpty *backend.StackNotEmptyError
+				if hasResources || errors.As(err, &notEmpty) {
 					return fmt.Errorf(
 						"'%s' still has resources; removal rejected. Possible actions:\n"+
 							"- Make sure that '%[1]s' is the stack that you want to destroy\n"+
@@ -0,0 +1,124 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/result"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+
+	"github.com/spf13/cobra"
+)
+
+func newStateCheckCommand() *cobra.Command {
+	var sccmd stateCheckCmd
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Verifies the integrity of every stack in the current backend",
+		Long: `Verifies the integrity of every stack in the current backend
+
+Reads the state of every stack in the backend and verifies its integrity,
+reporting stacks that fail verification and leftover lock and backup files.
+Leftover files of stacks that no longer exist are reported as warnings.
+Verification continues past stacks that fail.
+
+This only has an effect on self-managed backends.
+`,
+		Args: cmdutil.NoArgs,
+		Run: cmdutil.RunResultFunc(func(cmd *cobra.Command, args []string) result.Result {
+			if err := sccmd.Run(commandContext()); err != nil {
+				return result.FromError(err)
+			}
+			return nil
+		}),
+	}
+	return cmd
+}
+
+// stateCheckCmd implements the 'pulumi state check' command.
+type stateCheckCmd struct {
+	Stdout io.Writer // defaults to os.Stdout
+
+	// Used to mock out the currentBackend function for testing.
+	// Defaults to currentBackend function.
+	currentBackend func(context.Context, *workspace.Project, display.Options) (backend.Backend, error)
+}
+
+func (cmd *stateCheckCmd) Run(ctx context.Context) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+
+	if cmd.currentBackend == nil {
+		cmd.currentBackend = currentBackend
+	}
+	currentBackend := cmd.currentBackend // shadow top-level currentBackend
+
+	dopts := display.Options{
+		Color:  cmdutil.GetGlobalColorization(),
+		Stdout: cmd.Stdout,
+	}
+
+	b, err := currentBackend(ctx, nil, dopts)
+	if err != nil {
+		return err
+	}
+
+	lb, ok := b.(filestate.Backend)
+	if !ok {
+		// Only the file state backend supports verification,
+		// but we don't want to error out here.
+		// Report the no-op.
+		fmt.Fprintln(cmd.Stdout, "Nothing to do")
+		return nil
+	}
+
+	results, err := lb.VerifyAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, r := range results {
+		switch {
+		case r.LoadErr != nil:
+			failed++
+			fmt.Fprintf(cmd.Stdout, "FAIL %v: %v\n", r.Stack, r.LoadErr)
+		case r.IntegrityErr != nil:
+			failed++
+			fmt.Fprintf(cmd.Stdout, "FAIL %v: %v\n", r.Stack, r.IntegrityErr)
+		case r.Orphaned:
+			fmt.Fprintf(cmd.Stdout, "WARN %v: no checkpoint, only leftover files\n", r.Stack)
+		default:
+			fmt.Fprintf(cmd.Stdout, "PASS %v\n", r.Stack)
+		}
+		for _, file := range r.DanglingFiles {
+			fmt.Fprintf(cmd.Stdout, "     dangling file: %v\n", file)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d stack(s) failed verification", failed, len(results))
+	}
+	return nil
+}
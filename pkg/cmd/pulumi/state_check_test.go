@@ -0,0 +1,85 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/pulumi/pulumi/pkg/v3/backend"
+	"github.com/pulumi/pulumi/pkg/v3/backend/display"
+	"github.com/pulumi/pulumi/pkg/v3/backend/filestate"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateCheckCommand_Run(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateCheckCmd{
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &stubFileBackend{
+				VerifyAllF: func(context.Context) ([]filestate.StackVerifyResult, error) {
+					return []filestate.StackVerifyResult{
+						{
+							Stack:        &backend.MockStackReference{StringV: "organization/proj/bad"},
+							Deserialized: true,
+							IntegrityErr: errors.New("resource has no parent"),
+						},
+						{
+							Stack:         &backend.MockStackReference{StringV: "organization/proj/good"},
+							Deserialized:  true,
+							DanglingFiles: []string{".pulumi/locks/organization/proj/good/1234.json"},
+						},
+						{
+							Stack:         &backend.MockStackReference{StringV: "organization/proj/gone"},
+							DanglingFiles: []string{".pulumi/stacks/proj/gone.json.bak"},
+							Orphaned:      true,
+						},
+					}, nil
+				},
+			}, nil
+		},
+		Stdout: &stdout,
+	}
+
+	err := cmd.Run(context.Background())
+	assert.ErrorContains(t, err, "1 of 3 stack(s) failed verification")
+	assert.Equal(t,
+		"FAIL organization/proj/bad: resource has no parent\n"+
+			"PASS organization/proj/good\n"+
+			"     dangling file: .pulumi/locks/organization/proj/good/1234.json\n"+
+			"WARN organization/proj/gone: no checkpoint, only leftover files\n"+
+			"     dangling file: .pulumi/stacks/proj/gone.json.bak\n",
+		stdout.String())
+}
+
+func TestStateCheckCommand_Run_notFileBackend(t *testing.T) {
+	t.Parallel()
+
+	var stdout bytes.Buffer
+	cmd := stateCheckCmd{
+		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
+			return &backend.MockBackend{}, nil
+		},
+		Stdout: &stdout,
+	}
+
+	assert.NoError(t, cmd.Run(context.Background()))
+	assert.Equal(t, "Nothing to do\n", stdout.String())
+}
@@ -114,8 +114,15 @@ func (cmd *stateUpgradeCmd) Run(ctx context.Context) error {
 	// for each stack that doesn't have one.
 	if cmdutil.Interactive() {
 		opts.ProjectsForDetachedStacks = cmd.projectsForDetachedStacks
+		opts.Progress = cmd.reportProgress
 	}
-	return lb.Upgrade(ctx, &opts)
+	_, err = lb.Upgrade(ctx, &opts)
+	return err
+}
+
+// reportProgress prints the progress of the upgrade to stderr.
+func (cmd *stateUpgradeCmd) reportProgress(done, total int, current string) {
+	fmt.Fprintf(cmd.Stderr, "[%d/%d] Processed stack %q\n", done, total, current)
 }
 
 func (cmd *stateUpgradeCmd) projectsForDetachedStacks(stacks []tokens.StackName) ([]tokens.Name, error) {
@@ -95,9 +95,9 @@ func TestStateUpgradeCommand_Run_upgrade(t *testing.T) {
 	cmd := stateUpgradeCmd{
 		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
 			return &stubFileBackend{
-				UpgradeF: func(context.Context, *filestate.UpgradeOptions) error {
+				UpgradeF: func(context.Context, *filestate.UpgradeOptions) ([]filestate.UpgradeMove, error) {
 					called = true
-					return nil
+					return nil, nil
 				},
 			}, nil
 		},
@@ -117,9 +117,9 @@ func TestStateUpgradeCommand_Run_upgradeRejected(t *testing.T) {
 	cmd := stateUpgradeCmd{
 		currentBackend: func(context.Context, *workspace.Project, display.Options) (backend.Backend, error) {
 			return &stubFileBackend{
-				UpgradeF: func(context.Context, *filestate.UpgradeOptions) error {
+				UpgradeF: func(context.Context, *filestate.UpgradeOptions) ([]filestate.UpgradeMove, error) {
 					t.Fatal("Upgrade should not be called")
-					return nil
+					return nil, nil
 				},
 			}, nil
 		},
@@ -339,11 +339,18 @@ func TestStateUpgradeProjectNameWidget_notATerminal(t *testing.T) {
 type stubFileBackend struct {
 	filestate.Backend
 
-	UpgradeF func(context.Context, *filestate.UpgradeOptions) error
+	UpgradeF   func(context.Context, *filestate.UpgradeOptions) ([]filestate.UpgradeMove, error)
+	VerifyAllF func(context.Context) ([]filestate.StackVerifyResult, error)
 }
 
 var _ filestate.Backend = (*stubFileBackend)(nil)
 
-func (f *stubFileBackend) Upgrade(ctx context.Context, opts *filestate.UpgradeOptions) error {
+func (f *stubFileBackend) Upgrade(
+	ctx context.Context, opts *filestate.UpgradeOptions,
+) ([]filestate.UpgradeMove, error) {
 	return f.UpgradeF(ctx, opts)
 }
+
+func (f *stubFileBackend) VerifyAll(ctx context.Context) ([]filestate.StackVerifyResult, error) {
+	return f.VerifyAllF(ctx)
+}
@@ -2231,6 +2231,11 @@ func genProjectFile(pkg *schema.Package,
 		}
 	}
 
+	targetFramework := "net6.0"
+	if info, ok := pkg.Language["csharp"].(CSharpPackageInfo); ok && info.TargetFramework != "" {
+		targetFramework = info.TargetFramework
+	}
+
 	w := &bytes.Buffer{}
 	err := csharpProjectFileTemplate.Execute(w, csharpProjectFileTemplateContext{
 		XMLDoc:            fmt.Sprintf(`.\%s.xml`, assemblyName),
@@ -2238,6 +2243,7 @@ func genProjectFile(pkg *schema.Package,
 		PackageReferences: packageReferences,
 		ProjectReferences: projectReferences,
 		Version:           version,
+		TargetFramework:   targetFramework,
 	})
 	if err != nil {
 		return nil, err
@@ -20,6 +20,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/hashicorp/hcl/v2"
@@ -43,6 +44,29 @@ type GenerateProgramOptions struct {
 	// new Bucket("name", new() { ... });
 	// The latter syntax is only available on .NET 6 or later
 	implicitResourceArgsTypeName bool
+	// Determines whether the generated files opt into nullable reference types.
+	// When set, every file starts with a `#nullable enable` directive
+	// and optional component inputs are declared as nullable, e.g. `Input<string>?`.
+	NullableReferenceTypes bool
+	// PackageVersions pins the versions of the packages referenced by the .csproj
+	// generated by GenerateProjectWithOptions.
+	// Keys are either NuGet package names (e.g. "Pulumi.Aws") or schema package names (e.g. "aws"),
+	// and take precedence over the versions of the packages used by the program.
+	PackageVersions map[string]string
+}
+
+// packageVersion returns the version to reference for the given package,
+// preferring a version pinned in the options over the given default.
+func (o GenerateProgramOptions) packageVersion(packageName, schemaName, defaultVersion string) string {
+	if v, ok := o.PackageVersions[packageName]; ok {
+		return v
+	}
+	if schemaName != "" {
+		if v, ok := o.PackageVersions[schemaName]; ok {
+			return v
+		}
+	}
+	return defaultVersion
 }
 
 type generator struct {
@@ -230,25 +254,43 @@ func GenerateProgramWithOptions(
 
 		componentGenerator.genComponentPostamble(&componentBuffer, component)
 		files[componentName+".cs"] = componentBuffer.Bytes()
+		g.diagnostics = append(g.diagnostics, componentGenerator.diagnostics...)
 	}
 
 	return files, g.diagnostics, nil
 }
 
+// GenerateProgram generates a C# program from the given PCL program.
+//
+// Constructs that can't be represented in C# don't fail code generation:
+// they're reported as warnings in the returned diagnostics, and the generated code does without them.
+// The error is only for failures that prevent generating the program at all.
 func GenerateProgram(program *pcl.Program) (map[string][]byte, hcl.Diagnostics, error) {
-	defaultOptions := GenerateProgramOptions{
+	return GenerateProgramWithOptions(program, defaultGenerateProgramOptions())
+}
+
+func defaultGenerateProgramOptions() GenerateProgramOptions {
+	return GenerateProgramOptions{
 		// by default, we generate C# code that targets .NET 6
 		implicitResourceArgsTypeName: true,
 	}
-
-	return GenerateProgramWithOptions(program, defaultOptions)
 }
 
 func GenerateProject(
 	directory string, project workspace.Project,
 	program *pcl.Program, localDependencies map[string]string,
 ) error {
-	files, diagnostics, err := GenerateProgram(program)
+	return GenerateProjectWithOptions(directory, project, program, localDependencies, defaultGenerateProgramOptions())
+}
+
+// GenerateProjectWithOptions is like GenerateProject
+// but generates the program with the given options.
+func GenerateProjectWithOptions(
+	directory string, project workspace.Project,
+	program *pcl.Program, localDependencies map[string]string,
+	options GenerateProgramOptions,
+) error {
+	files, diagnostics, err := GenerateProgramWithOptions(program, options)
 	if err != nil {
 		return err
 	}
@@ -275,17 +317,23 @@ func GenerateProject(
 	</PropertyGroup>
 
 	<ItemGroup>
-		<PackageReference Include="Pulumi" Version="3.*" />
 `)
+	fmt.Fprintf(&csproj, "		<PackageReference Include=\"Pulumi\" Version=\"%s\" />\n",
+		options.packageVersion("Pulumi", "", "3.*"))
 
 	// For each package add a PackageReference line
 	packages, err := program.CollectNestedPackageSnapshots()
 	if err != nil {
 		return err
 	}
+	// Packages are collected in a map,
+	// so sort the references to keep the output stable between runs.
+	type packageReference struct {
+		name    string
+		version string
+	}
+	var references []packageReference
 	for _, p := range packages {
-		packageTemplate := "		<PackageReference Include=\"%s\" Version=\"%s\" />\n"
-
 		if err := p.ImportLanguages(map[string]schema.Language{"csharp": Importer}); err != nil {
 			return err
 		}
@@ -301,11 +349,20 @@ func GenerateProject(
 				packageName = fmt.Sprintf("%s.%s", csharpInfo.GetRootNamespace(), namespace)
 			}
 		}
+		version := "*"
 		if p.Version != nil {
-			fmt.Fprintf(&csproj, packageTemplate, packageName, p.Version.String())
-		} else {
-			fmt.Fprintf(&csproj, packageTemplate, packageName, "*")
+			version = p.Version.String()
 		}
+		references = append(references, packageReference{
+			name:    packageName,
+			version: options.packageVersion(packageName, p.Name, version),
+		})
+	}
+	sort.Slice(references, func(i, j int) bool {
+		return references[i].name < references[j].name
+	})
+	for _, r := range references {
+		fmt.Fprintf(&csproj, "		<PackageReference Include=\"%s\" Version=\"%s\" />\n", r.name, r.version)
 	}
 
 	csproj.WriteString(`	</ItemGroup>
@@ -612,7 +669,16 @@ func collectObjectTypedConfigVariables(program *pcl.Program) map[string]*model.O
 	return objectTypes
 }
 
+// genNullableDirective opts the generated file into nullable reference types, if enabled.
+func (g *generator) genNullableDirective(w io.Writer) {
+	if g.generateOptions.NullableReferenceTypes {
+		g.Fprint(w, "#nullable enable\n\n")
+	}
+}
+
 func (g *generator) genComponentPreamble(w io.Writer, componentName string, component *pcl.Component) {
+	g.genNullableDirective(w)
+
 	// Accumulate other using statements for the various providers and packages. Don't emit them yet, as we need
 	// to sort them later on.
 	programUsings := g.usingStatements(component.Program)
@@ -689,6 +755,15 @@ func (g *generator) genComponentPreamble(w io.Writer, componentName string, comp
 						g.Fgenf(w, "%s/// </summary>\n", g.Indent)
 					}
 					g.Fprintf(w, "%s[Input(\"%s\")]\n", g.Indent, configVar.LogicalName())
+					if g.generateOptions.NullableReferenceTypes && configVar.DefaultValue == nil &&
+						(configVar.Nullable || model.IsOptionalType(configVar.Type())) {
+						// optional inputs without a default value are left unset
+						g.Fprintf(w, "%spublic %s? %s { get; set; }\n",
+							g.Indent,
+							inputType,
+							Title(configVar.Name()))
+						continue
+					}
 					g.Fprintf(w, "%spublic %s %s { get; set; } = ",
 						g.Indent,
 						inputType,
@@ -824,6 +899,8 @@ func (g *generator) genPreamble(w io.Writer, program *pcl.Program) {
 	pulumiUsings := programUsings.pulumiUsings
 	preambleHelperMethods := programUsings.pulumiHelperMethods
 
+	g.genNullableDirective(w)
+
 	if g.asyncInit {
 		systemUsings.Add("System.Threading.Tasks")
 	}
@@ -1153,6 +1230,15 @@ func (g *generator) genResourceOptions(opts *pcl.ResourceOptions, resourceOption
 	if opts.IgnoreChanges != nil {
 		appendOption("IgnoreChanges", opts.IgnoreChanges)
 	}
+	// The version option picks the version of the package reference in the project instead,
+	// but there's nowhere to put the plugin download URL.
+	if opts.PluginDownloadURL != nil {
+		g.diagnostics = append(g.diagnostics, &hcl.Diagnostic{
+			Severity: hcl.DiagWarning,
+			Summary:  "the pluginDownloadURL resource option is not supported in C# programs and was omitted",
+			Subject:  opts.PluginDownloadURL.SyntaxNode().Range().Ptr(),
+		})
+	}
 
 	if result.Len() != 0 {
 		g.Indent = g.Indent[:len(g.Indent)-4]
@@ -1,10 +1,21 @@
 package dotnet
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/hashicorp/hcl/v2"
 	"github.com/pulumi/pulumi/pkg/v3/codegen"
+	"github.com/pulumi/pulumi/pkg/v3/codegen/hcl2/syntax"
+	"github.com/pulumi/pulumi/pkg/v3/codegen/pcl"
 	"github.com/pulumi/pulumi/pkg/v3/codegen/testing/test"
+	"github.com/pulumi/pulumi/pkg/v3/codegen/testing/utils"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGenerateProgramVersionSelection(t *testing.T) {
@@ -48,3 +59,234 @@ func TestGenerateProgramVersionSelection(t *testing.T) {
 		},
 	)
 }
+
+// bindProgramFiles writes the given files into a temporary directory
+// and binds main.pp from that directory with components enabled.
+func bindProgramFiles(t *testing.T, files map[string]string) *pcl.Program {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+
+	parser := syntax.NewParser()
+	require.NoError(t, parser.ParseFile(strings.NewReader(files["main.pp"]), "main.pp"))
+	require.False(t, parser.Diagnostics.HasErrors(), "failed to parse: %v", parser.Diagnostics)
+
+	program, diags, err := pcl.BindProgram(parser.Files,
+		pcl.DirPath(dir),
+		pcl.ComponentBinder(pcl.ComponentProgramBinderFromFileSystem()))
+	require.NoError(t, err)
+	require.False(t, diags.HasErrors(), "failed to bind: %v", diags)
+	return program
+}
+
+func TestGenerateProgramNullableReferenceTypes(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"main.pp": `
+component greeter "./greeter" {
+	name = "world"
+}
+`,
+		"greeter/main.pp": `
+config name "string" { }
+
+config suffix "string" {
+	nullable = true
+}
+
+output greeting {
+	value = "hello ${name}"
+}
+`,
+	}
+
+	t.Run("default", func(t *testing.T) {
+		t.Parallel()
+
+		program := bindProgramFiles(t, files)
+		generated, diags, err := GenerateProgram(program)
+		require.NoError(t, err)
+		require.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+
+		assert.NotContains(t, string(generated["Program.cs"]), "#nullable enable")
+		component := string(generated["Greeter.cs"])
+		assert.NotContains(t, component, "#nullable enable")
+		assert.Contains(t, component, "public Input<string> Suffix { get; set; } = null!;")
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+
+		options := defaultGenerateProgramOptions()
+		options.NullableReferenceTypes = true
+
+		program := bindProgramFiles(t, files)
+		generated, diags, err := GenerateProgramWithOptions(program, options)
+		require.NoError(t, err)
+		require.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+
+		assert.True(t, strings.HasPrefix(string(generated["Program.cs"]), "#nullable enable\n"))
+		component := string(generated["Greeter.cs"])
+		assert.True(t, strings.HasPrefix(component, "#nullable enable\n"))
+		assert.Contains(t, component, "public Input<string> Name { get; set; } = null!;")
+		assert.Contains(t, component, "public Input<string>? Suffix { get; set; }")
+	})
+}
+
+func TestGenerateProjectPackageVersions(t *testing.T) {
+	t.Parallel()
+
+	program := bindProgramFiles(t, map[string]string{
+		"main.pp": `
+output greeting {
+	value = "hello"
+}
+`,
+	})
+
+	options := defaultGenerateProgramOptions()
+	options.PackageVersions = map[string]string{"Pulumi": "3.90.0"}
+
+	dir := t.TempDir()
+	project := workspace.Project{Name: tokens.PackageName("test")}
+	require.NoError(t, GenerateProjectWithOptions(dir, project, program, nil, options))
+
+	csproj, err := os.ReadFile(filepath.Join(dir, "test.csproj"))
+	require.NoError(t, err)
+	assert.Contains(t, string(csproj), `<PackageReference Include="Pulumi" Version="3.90.0" />`)
+}
+
+func TestGenerateProjectPackageReferenceOrder(t *testing.T) {
+	t.Parallel()
+
+	parser := syntax.NewParser()
+	require.NoError(t, parser.ParseFile(strings.NewReader(`
+resource key "tls:index/privateKey:PrivateKey" {
+	algorithm = "RSA"
+}
+
+resource pet "random:index/randomPet:RandomPet" { }
+`), "main.pp"))
+	program, diags, err := pcl.BindProgram(parser.Files,
+		pcl.PluginHost(utils.NewHost(filepath.Join("..", "testing", "test", "testdata"))))
+	require.NoError(t, err)
+	require.False(t, diags.HasErrors(), "failed to bind: %v", diags)
+
+	project := workspace.Project{Name: tokens.PackageName("test")}
+	generate := func() string {
+		dir := t.TempDir()
+		require.NoError(t, GenerateProject(dir, project, program, nil))
+		csproj, err := os.ReadFile(filepath.Join(dir, "test.csproj"))
+		require.NoError(t, err)
+		return string(csproj)
+	}
+
+	csproj := generate()
+	pulumi := strings.Index(csproj, `<PackageReference Include="Pulumi" `)
+	random := strings.Index(csproj, `<PackageReference Include="Pulumi.Random" `)
+	tls := strings.Index(csproj, `<PackageReference Include="Pulumi.Tls" `)
+	require.True(t, pulumi >= 0 && random >= 0 && tls >= 0, "missing package references:\n%s", csproj)
+	assert.Less(t, pulumi, random)
+	assert.Less(t, random, tls)
+
+	// Map iteration order is random, so a few runs are needed to catch instability.
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, csproj, generate())
+	}
+}
+
+func TestGenerateProgramOptionsPackageVersion(t *testing.T) {
+	t.Parallel()
+
+	options := GenerateProgramOptions{
+		PackageVersions: map[string]string{
+			"Pulumi.Aws": "5.0.0",
+			"azure":      "4.0.0",
+		},
+	}
+
+	tests := []struct {
+		desc        string
+		packageName string
+		schemaName  string
+		want        string
+	}{
+		{desc: "package name", packageName: "Pulumi.Aws", schemaName: "aws", want: "5.0.0"},
+		{desc: "schema name", packageName: "Pulumi.Azure", schemaName: "azure", want: "4.0.0"},
+		{desc: "unpinned", packageName: "Pulumi.Gcp", schemaName: "gcp", want: "6.1.0"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.want, options.packageVersion(tt.packageName, tt.schemaName, "6.1.0"))
+		})
+	}
+}
+
+func TestGenerateProgramDiagnostics(t *testing.T) {
+	t.Parallel()
+
+	t.Run("component", func(t *testing.T) {
+		t.Parallel()
+
+		// Warnings from components are reported along with those of the main program.
+		program := bindProgramFiles(t, map[string]string{
+			"main.pp": `
+component greeter "./greeter" {
+	names = ["a", "b"]
+}
+`,
+			"greeter/main.pp": `
+config names "list(string)" { }
+
+output greeting {
+	value = "%{ for name in names }${name}%{ endfor }"
+}
+`,
+		})
+
+		generated, diags, err := GenerateProgram(program)
+		require.NoError(t, err)
+		require.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+		assert.Contains(t, generated, "Greeter.cs")
+		var summaries []string
+		for _, d := range diags {
+			assert.Equal(t, hcl.DiagWarning, d.Severity)
+			summaries = append(summaries, d.Summary)
+		}
+		assert.Contains(t, summaries, "not yet implemented: TemplateJoinExpression")
+	})
+
+	t.Run("pluginDownloadURL", func(t *testing.T) {
+		t.Parallel()
+
+		parser := syntax.NewParser()
+		require.NoError(t, parser.ParseFile(strings.NewReader(`
+resource pet "random:index/randomPet:RandomPet" {
+	options {
+		pluginDownloadURL = "https://example.com/plugins"
+	}
+}
+`), "main.pp"))
+		program, bindDiags, err := pcl.BindProgram(parser.Files,
+			pcl.PluginHost(utils.NewHost(filepath.Join("..", "testing", "test", "testdata"))))
+		require.NoError(t, err)
+		require.False(t, bindDiags.HasErrors(), "failed to bind: %v", bindDiags)
+
+		generated, diags, err := GenerateProgram(program)
+		require.NoError(t, err)
+		assert.Contains(t, string(generated["Program.cs"]), "new Random.RandomPet(\"pet\"")
+		require.Len(t, diags, 1)
+		assert.Equal(t, hcl.DiagWarning, diags[0].Severity)
+		assert.Contains(t, diags[0].Summary, "pluginDownloadURL resource option is not supported")
+	})
+}
@@ -45,6 +45,9 @@ type CSharpPackageInfo struct {
 
 	// Allow the Pkg.Version field to filter down to emitted code.
 	RespectSchemaVersion bool `json:"respectSchemaVersion,omitempty"`
+
+	// The target framework of the generated project. This defaults to `net6.0`.
+	TargetFramework string `json:"targetFramework,omitempty"`
 }
 
 // Returns the root namespace, or "Pulumi" if not provided.
@@ -135,7 +135,7 @@ const csharpProjectFileTemplateText = `<Project Sdk="Microsoft.NET.Sdk">
     <Version>{{.Version}}</Version>
     {{- end }}
 
-    <TargetFramework>net6.0</TargetFramework>
+    <TargetFramework>{{.TargetFramework}}</TargetFramework>
     <Nullable>enable</Nullable>
   </PropertyGroup>
 
@@ -207,4 +207,5 @@ type csharpProjectFileTemplateContext struct {
 	PackageReferences map[string]string
 	ProjectReferences []string
 	Version           string
+	TargetFramework   string
 }
@@ -2369,6 +2369,7 @@ type npmPackage struct {
 	DevDependencies  map[string]string       `json:"devDependencies,omitempty"`
 	PeerDependencies map[string]string       `json:"peerDependencies,omitempty"`
 	Resolutions      map[string]string       `json:"resolutions,omitempty"`
+	Engines          map[string]string       `json:"engines,omitempty"`
 	Pulumi           plugin.PulumiPluginJSON `json:"pulumi,omitempty"`
 }
 
@@ -2406,6 +2407,7 @@ func genNPMPackageMetadata(pkg *schema.Package, info NodePackageInfo) string {
 			"build": "tsc",
 		},
 		DevDependencies: devDependencies,
+		Engines:         info.Engines,
 		Pulumi: plugin.PulumiPluginJSON{
 			Resource: true,
 			Server:   pkg.PluginDownloadURL,
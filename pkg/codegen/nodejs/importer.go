@@ -42,6 +42,8 @@ type NodePackageInfo struct {
 	PeerDependencies map[string]string `json:"peerDependencies,omitempty"`
 	// NPM resolutions to add to package.json
 	Resolutions map[string]string `json:"resolutions,omitempty"`
+	// NPM engines to add to package.json, e.g. the supported versions of Node.js.
+	Engines map[string]string `json:"engines,omitempty"`
 	// A specific version of TypeScript to include in package.json.
 	TypeScriptVersion string `json:"typescriptVersion,omitempty"`
 	// A map containing overrides for module names to package names.
@@ -46,6 +46,11 @@ type ComponentProgramBinderArgs struct {
 	BinderLoader                 schema.Loader
 	ComponentSource              string
 	ComponentNodeRange           hcl.Range
+	// The directories of the programs being bound, from the root program to the component being bound.
+	// Binders should pass this on to the component program with the ComponentStack option.
+	ComponentStack []string
+	// The maximum depth of nested components, passed on with the MaxComponentDepth option.
+	MaxComponentDepth int
 }
 
 type ComponentProgramBinder = func(ComponentProgramBinderArgs) (*Program, hcl.Diagnostics, error)
@@ -64,6 +69,11 @@ type bindOptions struct {
 	// which refer to a component resource in a relative directory
 	dirPath                string
 	componentProgramBinder ComponentProgramBinder
+	// the directories of the programs that are currently being bound
+	// from the root program down to this one, used to detect component cycles
+	componentStack []string
+	// the maximum depth of nested components, or 0 for DefaultMaxComponentDepth
+	maxComponentDepth int
 }
 
 func (opts bindOptions) modelOptions() []model.BindOption {
@@ -142,6 +152,26 @@ func ComponentBinder(binder ComponentProgramBinder) BindOption {
 	}
 }
 
+// DefaultMaxComponentDepth is the default maximum depth of nested components.
+const DefaultMaxComponentDepth = 16
+
+// MaxComponentDepth sets the maximum depth of nested components.
+// Binding a component nested deeper than this fails with a diagnostic.
+func MaxComponentDepth(depth int) BindOption {
+	return func(options *bindOptions) {
+		options.maxComponentDepth = depth
+	}
+}
+
+// ComponentStack sets the directories of the programs that are being bound,
+// from the root program down to the one being bound with this option.
+// Component binders use this to detect components that reference themselves.
+func ComponentStack(stack []string) BindOption {
+	return func(options *bindOptions) {
+		options.componentStack = stack
+	}
+}
+
 // NonStrictBindOptions returns a set of bind options that make the binder lenient about type checking.
 // Changing errors into warnings when possible
 func NonStrictBindOptions() []BindOption {
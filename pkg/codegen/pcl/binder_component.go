@@ -15,11 +15,14 @@
 package pcl
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/pulumi/pulumi/pkg/v3/codegen"
 	"github.com/pulumi/pulumi/pkg/v3/codegen/hcl2/model"
 	syntax "github.com/pulumi/pulumi/pkg/v3/codegen/hcl2/syntax"
 )
@@ -93,6 +96,8 @@ func (s *componentScopes) GetScopeForAttribute(attr *hclsyntax.Attribute) (*mode
 type componentInput struct {
 	key      string
 	required bool
+	// The declared type of the config variable that receives the input.
+	typ model.Type
 }
 
 func componentInputs(program *Program) map[string]componentInput {
@@ -103,6 +108,7 @@ func componentInputs(program *Program) map[string]componentInput {
 			inputs[node.LogicalName()] = componentInput{
 				required: node.DefaultValue == nil && !node.Nullable,
 				key:      node.LogicalName(),
+				typ:      node.Type(),
 			}
 		}
 	}
@@ -169,7 +175,9 @@ func ComponentProgramBinderFromFileSystem() ComponentProgramBinder {
 
 				diags := parser.Diagnostics
 				if diags.HasErrors() {
-					return nil, diagnostics, err
+					includeSourceDirectoryInDiagnostics(diags, componentSourceDir)
+					diagnostics = diagnostics.Extend(diags)
+					return nil, diagnostics, nil
 				}
 			}
 		}
@@ -178,6 +186,8 @@ func ComponentProgramBinderFromFileSystem() ComponentProgramBinder {
 			Loader(loader),
 			DirPath(componentSourceDir),
 			ComponentBinder(ComponentProgramBinderFromFileSystem()),
+			ComponentStack(args.ComponentStack),
+			MaxComponentDepth(args.MaxComponentDepth),
 		}
 
 		if args.AllowMissingVariables {
@@ -227,6 +237,47 @@ func includeSourceDirectoryInDiagnostics(diags hcl.Diagnostics, componentSourceD
 	}
 }
 
+// pushComponent returns the component stack to bind the program of the given component with.
+// It fails if the component is already being bound further up the stack,
+// or if it is nested deeper than the maximum component depth.
+func (b *binder) pushComponent(node *Component) ([]string, hcl.Diagnostics) {
+	stack := b.options.componentStack
+	if len(stack) == 0 {
+		stack = []string{filepath.Clean(b.options.dirPath)}
+	}
+	root := stack[0]
+	source := filepath.Join(b.options.dirPath, node.source)
+
+	for i, dir := range stack {
+		if dir != source {
+			continue
+		}
+
+		var cycle []string
+		for _, dir := range append(stack[i:], source) {
+			if rel, err := filepath.Rel(root, dir); err == nil {
+				dir = filepath.ToSlash(rel)
+			}
+			cycle = append(cycle, dir)
+		}
+		return nil, hcl.Diagnostics{errorf(node.SyntaxNode().Range(),
+			"component cycle detected: %s", strings.Join(cycle, " -> "))}
+	}
+
+	maxDepth := b.options.maxComponentDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxComponentDepth
+	}
+	if len(stack) > maxDepth {
+		return nil, hcl.Diagnostics{errorf(node.SyntaxNode().Range(),
+			"component %q exceeds the maximum component depth of %d", node.source, maxDepth)}
+	}
+
+	result := make([]string, 0, len(stack)+1)
+	result = append(result, stack...)
+	return append(result, source), nil
+}
+
 func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 	// When options { range = <expr> } is present
 	// We create a new scope for binding the component.
@@ -273,6 +324,10 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 		}
 	}
 
+	// Like resources, components tolerate references to outputs they don't have
+	// when resource type checking is skipped.
+	node.LenientTraversal = b.options.skipResourceTypecheck
+
 	scopes := newComponentScopes(b.root, node, rangeKeyType, rangeValueType)
 
 	block, diagnostics := model.BindBlock(node.syntax, scopes, b.tokens, b.options.modelOptions()...)
@@ -291,6 +346,12 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 		return diagnostics
 	}
 
+	componentStack, stackDiags := b.pushComponent(node)
+	if stackDiags.HasErrors() {
+		node.VariableType = model.DynamicType
+		return diagnostics.Extend(stackDiags)
+	}
+
 	componentProgram, programDiags, err := b.options.componentProgramBinder(ComponentProgramBinderArgs{
 		AllowMissingVariables:        b.options.allowMissingVariables,
 		AllowMissingProperties:       b.options.allowMissingProperties,
@@ -302,6 +363,8 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 		BinderDirPath:                b.options.dirPath,
 		ComponentSource:              node.source,
 		ComponentNodeRange:           node.SyntaxNode().Range(),
+		ComponentStack:               componentStack,
+		MaxComponentDepth:            b.options.maxComponentDepth,
 	})
 	if err != nil {
 		diagnostics = diagnostics.Append(errorf(node.SyntaxNode().Range(), err.Error()))
@@ -310,11 +373,18 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 	}
 
 	if programDiags.HasErrors() || componentProgram == nil {
-		diagnostics = diagnostics.Append(errorf(node.SyntaxNode().Range(), programDiags.Error()))
+		message := programDiags.Error()
+		if !programDiags.HasErrors() {
+			message = fmt.Sprintf("failed to load component %q", node.source)
+		}
+		diagnostics = diagnostics.Append(errorf(node.SyntaxNode().Range(), message))
 		node.VariableType = model.DynamicType
 		return diagnostics
 	}
 
+	// Surface any warnings from binding the component program.
+	diagnostics = diagnostics.Extend(programDiags)
+
 	node.Program = componentProgram
 	programVariableType := componentVariableType(componentProgram)
 	node.VariableType = transformComponentType(programVariableType)
@@ -338,11 +408,23 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 				continue
 			}
 			// all other attributes are part of the inputs
-			_, knownInput := componentInputs[item.Name]
+			input, knownInput := componentInputs[item.Name]
 
 			if !knownInput {
 				diagnostics = append(diagnostics, unsupportedAttribute(item.Name, item.Syntax.NameRange))
-				return diagnostics
+				continue
+			}
+
+			// check that the input can be assigned to the config variable of the component
+			if input.typ != nil {
+				typ := model.InputType(input.typ)
+				if typ.ConversionFrom(item.Value.Type()) == model.NoConversion {
+					diag := model.ExprNotConvertible(typ, item.Value)
+					if b.options.skipResourceTypecheck {
+						diag.Severity = hcl.DiagWarning
+					}
+					diagnostics = append(diagnostics, diag)
+				}
 			}
 
 			node.Inputs = append(node.Inputs, item)
@@ -362,8 +444,8 @@ func (b *binder) bindComponent(node *Component) hcl.Diagnostics {
 	}
 
 	// check that all required inputs are actually set
-	for inputKey, componentInput := range componentInputs {
-		if componentInput.required && !contains(providedInputs, inputKey) {
+	for _, inputKey := range codegen.SortedKeys(componentInputs) {
+		if componentInputs[inputKey].required && !contains(providedInputs, inputKey) {
 			diagnostics = append(diagnostics, missingRequiredAttribute(inputKey, node.SyntaxNode().Range()))
 		}
 	}
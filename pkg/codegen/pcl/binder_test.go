@@ -547,3 +547,246 @@ resource randomPet "random:index/randomPet:RandomPet" {
 	assert.Equal(t, 2, len(diags), "There are two diagnostics")
 	assert.Nil(t, strictProgram)
 }
+
+// bindWithComponents writes the given files into a temporary directory
+// and binds main.pp from that directory with components enabled.
+func bindWithComponents(
+	t *testing.T, files map[string]string, options ...pcl.BindOption,
+) (*pcl.Program, hcl.Diagnostics, error) {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	}
+
+	options = append(options,
+		pcl.DirPath(dir),
+		pcl.ComponentBinder(pcl.ComponentProgramBinderFromFileSystem()))
+	return ParseAndBindProgram(t, files["main.pp"], "main.pp", options...)
+}
+
+func TestBindComponentInputs(t *testing.T) {
+	t.Parallel()
+
+	program, diags, err := bindWithComponents(t, map[string]string{
+		"main.pp": `
+component first "./child" {
+	unknownOne = "a"
+	unknownTwo = "b"
+}
+`,
+		"child/main.pp": `
+config name "string" { }
+
+output greeting {
+	value = "hello ${name}"
+}
+`,
+	})
+	assert.Error(t, err)
+	assert.Nil(t, program)
+
+	var messages []string
+	for _, diag := range diags {
+		messages = append(messages, diag.Summary)
+	}
+	assert.ElementsMatch(t, []string{
+		"unsupported attribute 'unknownOne'",
+		"unsupported attribute 'unknownTwo'",
+		"missing required attribute 'name'",
+	}, messages)
+}
+
+func TestBindComponentOutputTraversal(t *testing.T) {
+	t.Parallel()
+
+	child := `
+output greeting {
+	value = "hello"
+}
+
+output settings {
+	value = {
+		key = "value"
+	}
+}
+`
+
+	t.Run("known outputs", func(t *testing.T) {
+		t.Parallel()
+
+		program, diags, err := bindWithComponents(t, map[string]string{
+			"main.pp": `
+component first "./child" { }
+
+output viaAttr {
+	value = first.greeting
+}
+
+output viaIndex {
+	value = first["greeting"]
+}
+
+output nested {
+	value = first.settings.key
+}
+`,
+			"child/main.pp": child,
+		})
+		require.NoError(t, err)
+		require.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+
+		outputs := program.OutputVariables()
+		require.Len(t, outputs, 3)
+		for _, output := range outputs {
+			typ := output.Value.Type()
+			assert.True(t, model.NewOutputType(model.StringType).Equals(typ),
+				"output %v: unexpected type %v", output.Name(), typ)
+		}
+	})
+
+	t.Run("unknown output", func(t *testing.T) {
+		t.Parallel()
+
+		files := map[string]string{
+			"main.pp": `
+component first "./child" { }
+
+output missing {
+	value = first.missing
+}
+`,
+			"child/main.pp": child,
+		}
+
+		_, diags, err := bindWithComponents(t, files)
+		assert.Error(t, err)
+		require.True(t, diags.HasErrors())
+		assert.Contains(t, diags.Error(), "unknown property 'missing'")
+
+		// Like resources, components allow unknown outputs when resource type checking is skipped.
+		program, diags, err := bindWithComponents(t, files, pcl.SkipResourceTypechecking)
+		require.NoError(t, err)
+		require.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+		outputs := program.OutputVariables()
+		require.Len(t, outputs, 1)
+		assert.Equal(t, model.DynamicType, outputs[0].Value.Type())
+	})
+}
+
+func TestBindComponentParseErrors(t *testing.T) {
+	t.Parallel()
+
+	program, diags, err := bindWithComponents(t, map[string]string{
+		"main.pp": `
+component first "./child" { }
+`,
+		"child/main.pp": `
+output greeting {
+`,
+	})
+	assert.Error(t, err)
+	assert.Nil(t, program)
+	require.True(t, diags.HasErrors())
+	// The parse error of the component program must be reported,
+	// not swallowed into an empty message.
+	assert.NotEmpty(t, diags[0].Summary)
+	assert.NotContains(t, diags[0].Summary, "failed to load component")
+}
+
+func TestBindComponentInputTypes(t *testing.T) {
+	t.Parallel()
+
+	child := `
+config name "string" { }
+
+config ports "list(int)" { }
+
+output greeting {
+	value = "hello ${name}"
+}
+`
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		program, diags, err := bindWithComponents(t, map[string]string{
+			"main.pp": `
+component first "./child" {
+	name = "world"
+	ports = [80, 443]
+}
+`,
+			"child/main.pp": child,
+		})
+		require.NoError(t, err)
+		assert.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+		assert.NotNil(t, program)
+	})
+
+	t.Run("wrong type", func(t *testing.T) {
+		t.Parallel()
+
+		program, diags, err := bindWithComponents(t, map[string]string{
+			"main.pp": `
+component first "./child" {
+	name = "world"
+	ports = { http = 80 }
+}
+`,
+			"child/main.pp": child,
+		})
+		assert.Error(t, err)
+		assert.Nil(t, program)
+		require.Len(t, diags, 1)
+		assert.Contains(t, diags[0].Summary, "cannot assign")
+	})
+}
+
+func TestBindComponentCycle(t *testing.T) {
+	t.Parallel()
+
+	_, diags, err := bindWithComponents(t, map[string]string{
+		"main.pp": `
+component first "./a" { }
+`,
+		"a/main.pp": `
+component second "../b" { }
+`,
+		"b/main.pp": `
+component third "../a" { }
+`,
+	})
+	assert.Error(t, err)
+	require.True(t, diags.HasErrors())
+	assert.Contains(t, diags.Error(), "component cycle detected: a -> b -> a")
+}
+
+func TestBindComponentMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"main.pp": `
+component first "./a" { }
+`,
+		"a/main.pp": `
+component second "./b" { }
+`,
+		"a/b/main.pp": `
+output value {
+	value = "hello"
+}
+`,
+	}
+
+	_, diags, err := bindWithComponents(t, files, pcl.MaxComponentDepth(1))
+	assert.Error(t, err)
+	assert.Contains(t, diags.Error(), "exceeds the maximum component depth of 1")
+
+	_, diags, err = bindWithComponents(t, files, pcl.MaxComponentDepth(2))
+	require.NoError(t, err)
+	assert.False(t, diags.HasErrors(), "unexpected errors: %v", diags)
+}
@@ -57,6 +57,10 @@ type Component struct {
 
 	// The component resource's options, if any.
 	Options *ResourceOptions
+
+	// LenientTraversal, like Resource.LenientTraversal,
+	// makes traversals of outputs the component doesn't have resolve to dynamic types instead of failing.
+	LenientTraversal bool
 }
 
 // SyntaxNode returns the syntax node associated with the component.
@@ -98,18 +102,54 @@ func (c *Component) DeclarationName() string {
 	return componentName
 }
 
+// Type returns the type of the component's result.
+// This is the VariableType computed during binding if there is one.
+// Otherwise it is an object type derived from the outputs of the component program.
 func (c *Component) Type() model.Type {
-	return c.VariableType
+	if c == nil {
+		return model.DynamicType
+	}
+	if c.VariableType != nil {
+		return c.VariableType
+	}
+	if c.Program != nil {
+		return componentVariableType(c.Program)
+	}
+	return model.DynamicType
 }
 
+// Traverse resolves the given traverser against the component's result type,
+// so that expressions like `myComponent.someOutput` or `myComponent["someOutput"]`
+// resolve to the type of that output.
 func (c *Component) Traverse(traverser hcl.Traverser) (model.Traversable, hcl.Diagnostics) {
-	if c == nil || c.VariableType == nil {
+	traversable, diags := c.Type().Traverse(traverser)
+	if diags.HasErrors() && c != nil && c.LenientTraversal {
 		return model.DynamicType.Traverse(traverser)
 	}
-
-	return c.VariableType.Traverse(traverser)
+	return traversable, diags
 }
 
+// VisitExpressions visits the expressions in the component's definition and inputs.
+// Inputs that are part of the definition are visited only once.
 func (c *Component) VisitExpressions(pre, post model.ExpressionVisitor) hcl.Diagnostics {
-	return model.VisitExpressions(c.Definition, pre, post)
+	var diagnostics hcl.Diagnostics
+
+	visited := map[*model.Attribute]bool{}
+	if c.Definition != nil && c.Definition.Body != nil {
+		for _, item := range c.Definition.Body.Items {
+			if attr, ok := item.(*model.Attribute); ok {
+				visited[attr] = true
+			}
+		}
+		diagnostics = append(diagnostics, model.VisitExpressions(c.Definition, pre, post)...)
+	}
+
+	for _, input := range c.Inputs {
+		if visited[input] {
+			continue
+		}
+		diagnostics = append(diagnostics, model.VisitExpressions(input, pre, post)...)
+	}
+
+	return diagnostics
 }
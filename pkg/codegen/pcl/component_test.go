@@ -0,0 +1,170 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcl
+
+import (
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/pulumi/pulumi/pkg/v3/codegen/hcl2/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestComponentType(t *testing.T) {
+	t.Parallel()
+
+	t.Run("variable type", func(t *testing.T) {
+		t.Parallel()
+
+		typ := model.NewListType(model.StringType)
+		c := &Component{VariableType: typ}
+		assert.Equal(t, typ, c.Type())
+	})
+
+	t.Run("from program outputs", func(t *testing.T) {
+		t.Parallel()
+
+		c := &Component{
+			Program: &Program{
+				Nodes: []Node{
+					&OutputVariable{logicalName: "url", typ: model.StringType},
+				},
+			},
+		}
+		assert.Equal(t, &model.ObjectType{
+			Properties: map[string]model.Type{
+				"url": model.NewOutputType(model.StringType),
+			},
+		}, c.Type())
+	})
+
+	t.Run("unbound", func(t *testing.T) {
+		t.Parallel()
+
+		assert.Equal(t, model.DynamicType, (&Component{}).Type())
+		assert.Equal(t, model.DynamicType, (*Component)(nil).Type())
+	})
+}
+
+func TestComponentTraverse(t *testing.T) {
+	t.Parallel()
+
+	c := &Component{
+		Program: &Program{
+			Nodes: []Node{
+				&OutputVariable{logicalName: "url", typ: model.StringType},
+			},
+		},
+	}
+
+	t.Run("known output", func(t *testing.T) {
+		t.Parallel()
+
+		typ, diags := c.Traverse(hcl.TraverseAttr{Name: "url"})
+		require.Empty(t, diags)
+		assert.Equal(t, model.NewOutputType(model.StringType), typ)
+	})
+
+	t.Run("missing output", func(t *testing.T) {
+		t.Parallel()
+
+		typ, diags := c.Traverse(hcl.TraverseAttr{Name: "missing"})
+		assert.True(t, diags.HasErrors(), "expected an error for an unknown output")
+		assert.Equal(t, model.DynamicType, typ)
+	})
+}
+
+func TestComponentTypeUnify(t *testing.T) {
+	t.Parallel()
+
+	// The result of a component unifies field by field with object types,
+	// e.g. those of resource inputs, rather than degrading to a dynamic type.
+	c := &Component{
+		Program: &Program{
+			Nodes: []Node{
+				&OutputVariable{logicalName: "url", typ: model.StringType},
+			},
+		},
+	}
+	input := model.NewObjectType(map[string]model.Type{
+		"url": model.StringType,
+	})
+
+	safeType, _ := model.UnifyTypes(c.Type(), input)
+	want := model.NewObjectType(map[string]model.Type{
+		"url": model.NewOutputType(model.StringType),
+	})
+	assert.True(t, want.Equals(safeType), "unexpected type %v", safeType)
+}
+
+func TestComponentVisitExpressions(t *testing.T) {
+	t.Parallel()
+
+	newInput := func(name, value string) *model.Attribute {
+		return &model.Attribute{
+			Name:  name,
+			Value: &model.LiteralValueExpression{Value: cty.StringVal(value)},
+		}
+	}
+
+	tests := []struct {
+		desc      string
+		component func(inputs []*model.Attribute) *Component
+	}{
+		{
+			desc: "inputs in definition",
+			component: func(inputs []*model.Attribute) *Component {
+				items := make([]model.BodyItem, len(inputs))
+				for i, input := range inputs {
+					items[i] = input
+				}
+				return &Component{
+					Definition: &model.Block{Type: "component", Body: &model.Body{Items: items}},
+					Inputs:     inputs,
+				}
+			},
+		},
+		{
+			desc: "no definition",
+			component: func(inputs []*model.Attribute) *Component {
+				return &Component{Inputs: inputs}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Parallel()
+
+			inputs := []*model.Attribute{newInput("foo", "a"), newInput("bar", "b")}
+			c := tt.component(inputs)
+
+			seen := map[model.Expression]int{}
+			diags := c.VisitExpressions(func(x model.Expression) (model.Expression, hcl.Diagnostics) {
+				seen[x]++
+				return x, nil
+			}, nil)
+			require.Empty(t, diags)
+
+			assert.Len(t, seen, len(inputs))
+			for _, input := range inputs {
+				assert.Equal(t, 1, seen[input.Value], "input %q", input.Name)
+			}
+		})
+	}
+}
@@ -42,7 +42,8 @@ type Event struct {
 type EventPayload interface {
 	StdoutEventPayload | DiagEventPayload | PreludeEventPayload | SummaryEventPayload |
 		ResourcePreEventPayload | ResourceOutputsEventPayload | ResourceOperationFailedPayload |
-		PolicyViolationEventPayload | PolicyRemediationEventPayload | PolicyLoadEventPayload
+		PolicyViolationEventPayload | PolicyRemediationEventPayload | PolicyLoadEventPayload |
+		PermalinkUnavailableEventPayload
 }
 
 func NewCancelEvent() Event {
@@ -72,6 +73,8 @@ func NewEvent[T EventPayload](payload T) Event {
 		typ = PolicyRemediationEvent
 	case PolicyLoadEventPayload:
 		typ = PolicyLoadEvent
+	case PermalinkUnavailableEventPayload:
+		typ = PermalinkUnavailableEvent
 	default:
 		contract.Failf("unknown event type %v", typ)
 	}
@@ -96,6 +99,8 @@ const (
 	PolicyViolationEvent    EventType = "policy-violation"
 	PolicyRemediationEvent  EventType = "policy-remediation"
 	PolicyLoadEvent         EventType = "policy-load"
+
+	PermalinkUnavailableEvent EventType = "permalink-unavailable"
 )
 
 func (e Event) Payload() interface{} {
@@ -151,6 +156,13 @@ type PolicyRemediationEventPayload struct {
 // PolicyLoadEventPayload is the payload for an event with type `policy-load`.
 type PolicyLoadEventPayload struct{}
 
+// PermalinkUnavailableEventPayload is the payload for an event with type `permalink-unavailable`.
+// Backends send it after an update when they can't create a permalink to the state of the stack.
+type PermalinkUnavailableEventPayload struct {
+	Stack string // the stack that was updated.
+	Error string // why the permalink couldn't be created.
+}
+
 type StdoutEventPayload struct {
 	Message string
 	Color   colors.Colorization
@@ -123,6 +123,41 @@ func (r *Resource) GetChild(typ string, name string) (*Resource, bool) {
 	return nil, false
 }
 
+// LoggableResources returns the URNs of the resources in the tree rooted at this resource,
+// including this resource itself, that an operations provider can get logs for.
+// Each of them can be used as the ResourceFilter of a LogQuery.
+// The URNs are sorted.
+func (r *Resource) LoggableResources() []resource.URN {
+	var urns []resource.URN
+	var visit func(r *Resource)
+	visit = func(r *Resource) {
+		if r.State != nil && providesLogs(r.State.Type) {
+			urns = append(urns, r.State.URN)
+		}
+		for _, child := range r.Children {
+			visit(child)
+		}
+	}
+	visit(r)
+
+	sort.Slice(urns, func(i, j int) bool { return urns[i] < urns[j] })
+	return urns
+}
+
+// providesLogs reports whether the operations provider for resources of the given type
+// knows how to get logs for them.
+// This must be kept in sync with the GetLogs implementations of the providers.
+func providesLogs(typ tokens.Type) bool {
+	switch typ {
+	case cloudFunctionType, cloudLogCollectorType, cloudServiceType, cloudTaskType,
+		awsFunctionType, awsLogGroupType,
+		gcpFunctionType:
+		return true
+	default:
+		return false
+	}
+}
+
 // OperationsProvider gets an OperationsProvider for this resource.
 func (r *Resource) OperationsProvider(config map[config.Key]string) Provider {
 	return &resourceOperations{
@@ -24,6 +24,8 @@ import (
 
 	"github.com/pulumi/pulumi/pkg/v3/resource/stack"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 )
 
 func getPulumiResources(t *testing.T, path string) *Resource {
@@ -115,3 +117,52 @@ func TestCrawler(t *testing.T) {
 	assert.Equal(t, 1, len(function.State.Inputs))
 	assert.Equal(t, 3, len(function.Children))
 }
+
+func TestLoggableResources(t *testing.T) {
+	t.Parallel()
+
+	urn := func(typ tokens.Type, name string) resource.URN {
+		return resource.NewURN("dev", "proj", "", typ, name)
+	}
+	stackURN := urn("pulumi:pulumi:Stack", "proj-dev")
+	appURN := urn("my:app:App", "app")
+	functionURN := urn("cloud:function:Function", "fn")
+	lambdaURN := urn("aws:lambda/function:Function", "fn")
+	tableURN := urn("aws:dynamodb/table:Table", "table")
+	logGroupURN := urn("aws:cloudwatch/logGroup:LogGroup", "logs")
+	gcpFunctionURN := urn("gcp:cloudfunctions/function:Function", "gfn")
+
+	tree := NewResourceTree([]*resource.State{
+		{URN: stackURN, Type: stackURN.Type()},
+		{URN: appURN, Type: appURN.Type(), Parent: stackURN},
+		{URN: functionURN, Type: functionURN.Type(), Parent: appURN},
+		{URN: lambdaURN, Type: lambdaURN.Type(), Parent: functionURN},
+		{URN: tableURN, Type: tableURN.Type(), Parent: appURN},
+		{URN: logGroupURN, Type: logGroupURN.Type(), Parent: stackURN},
+		{URN: gcpFunctionURN, Type: gcpFunctionURN.Type(), Parent: stackURN},
+	})
+
+	assert.Equal(t, []resource.URN{
+		logGroupURN,
+		lambdaURN,
+		functionURN,
+		gcpFunctionURN,
+	}, tree.LoggableResources())
+
+	// Only the subtree of a component is considered.
+	stk, ok := tree.GetChild("pulumi:pulumi:Stack", "proj-dev")
+	if !assert.True(t, ok) {
+		return
+	}
+	app, ok := stk.GetChild("my:app:App", "app")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, []resource.URN{lambdaURN, functionURN}, app.LoggableResources())
+
+	table, ok := app.GetChild("aws:dynamodb/table:Table", "table")
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Empty(t, table.LoggableResources())
+}
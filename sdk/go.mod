@@ -13,6 +13,7 @@ require (
 	github.com/golang/protobuf v1.5.3
 	github.com/grpc-ecosystem/grpc-opentracing v0.0.0-20180507213350-8e809c8a8645
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/klauspost/compress v1.15.1
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/nxadm/tail v1.4.8
 	github.com/opentracing/opentracing-go v1.2.0
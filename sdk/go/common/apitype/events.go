@@ -198,6 +198,13 @@ type ResOpFailedEvent struct {
 // PolicyLoadEvent is emitted when a policy starts loading
 type PolicyLoadEvent struct{}
 
+// PermalinkUnavailableEvent is emitted after an update when the backend couldn't create
+// a permalink to the state of the stack, e.g. because its bucket doesn't support signed URLs.
+type PermalinkUnavailableEvent struct {
+	Stack string `json:"stack"`
+	Error string `json:"error"`
+}
+
 // EngineEvent describes a Pulumi engine event, such as a change to a resource or diagnostic
 // message. EngineEvent is a discriminated union of all possible event types, and exactly one
 // field will be non-nil.
@@ -225,6 +232,8 @@ type EngineEvent struct {
 	PolicyEvent            *PolicyEvent            `json:"policyEvent,omitempty"`
 	PolicyRemediationEvent *PolicyRemediationEvent `json:"policyRemediationEvent,omitempty"`
 	PolicyLoadEvent        *PolicyLoadEvent        `json:"policyLoadEvent,omitempty"`
+
+	PermalinkUnavailableEvent *PermalinkUnavailableEvent `json:"permalinkUnavailableEvent,omitempty"`
 }
 
 // EngineEventBatch is a group of engine events.
@@ -22,6 +22,8 @@ import (
 	"io"
 	"path/filepath"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/yamlutil"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -30,6 +32,7 @@ var (
 	JSONExt = ".json"
 	YAMLExt = ".yaml"
 	GZIPExt = ".gz"
+	ZSTDExt = ".zst"
 )
 
 // Exts contains a list of all the valid marshalable extension types.
@@ -175,3 +178,47 @@ func Gzip(m Marshaler) Marshaler {
 	}
 	return &gzipMarshaller{m}
 }
+
+// zstdEncoder and zstdDecoder are shared by all zstd marshalers,
+// since EncodeAll and DecodeAll are safe for concurrent use.
+// Their constructors only fail on invalid options.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+)
+
+type zstdMarshaller struct {
+	inner Marshaler
+}
+
+func (m *zstdMarshaller) Marshal(v interface{}) ([]byte, error) {
+	b, err := m.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return zstdEncoder.EncodeAll(b, nil), nil
+}
+
+func (m *zstdMarshaller) Unmarshal(data []byte, v interface{}) error {
+	inflated, err := zstdDecoder.DecodeAll(data, nil)
+	if err != nil {
+		return err
+	}
+	return m.inner.Unmarshal(inflated, v)
+}
+
+// IsZstdCompressed returns if data is zstd compressed.
+func IsZstdCompressed(buf []byte) bool {
+	// The zstd frame magic number, 0xFD2FB528 in little-endian.
+	return len(buf) >= 4 && buf[0] == 0x28 && buf[1] == 0xb5 && buf[2] == 0x2f && buf[3] == 0xfd
+}
+
+// Zstd returns a marshaler that compresses the output of m with zstd,
+// and decompresses data before handing it to m.
+func Zstd(m Marshaler) Marshaler {
+	_, alreadyZstd := m.(*zstdMarshaller)
+	if alreadyZstd {
+		return m
+	}
+	return &zstdMarshaller{m}
+}
@@ -83,17 +83,79 @@ var (
 	SelfManagedStateNoLegacyWarning = env.Bool("SELF_MANAGED_STATE_NO_LEGACY_WARNING",
 		"Disables the warning about legacy stack files mixed with project-scoped stack files.")
 
+	SelfManagedSuppressLegacyWarning = env.Bool("SELF_MANAGED_SUPPRESS_LEGACY_WARNING",
+		"Disables the warning about legacy stack files mixed with project-scoped stack files. "+
+			"Same as PULUMI_SELF_MANAGED_STATE_NO_LEGACY_WARNING.")
+
 	SelfManagedStateLegacyLayout = env.Bool("SELF_MANAGED_STATE_LEGACY_LAYOUT",
 		"Uses the legacy layout for new buckets, which currently default to project-scoped stacks.")
 
 	SelfManagedGzip = env.Bool("SELF_MANAGED_STATE_GZIP",
 		"Enables gzip compression when writing state files.")
 
+	SelfManagedCompression = env.String("SELF_MANAGED_STATE_COMPRESSION",
+		"Selects the compression used when writing state files: zstd, gzip, or none. "+
+			"Takes precedence over PULUMI_SELF_MANAGED_STATE_GZIP.")
+
+	SelfManagedStateEncoding = env.String("SELF_MANAGED_STATE_ENCODING",
+		"Selects the markup used when writing state files: json (the default) or yaml.")
+
 	SelfManagedRetainCheckpoints = env.Bool("RETAIN_CHECKPOINTS",
 		"If set every checkpoint will be duplicated to a timestamped file.")
 
 	SelfManagedDisableCheckpointBackups = env.Bool("DISABLE_CHECKPOINT_BACKUPS",
 		"If set checkpoint backups will not be written the to the backup folder.")
+
+	SelfManagedDisableBackups = env.Bool("SELF_MANAGED_DISABLE_BACKUPS",
+		"Disables writing .bak copies of state files before they are replaced or removed. "+
+			"Removing a stack then requires --force.")
+
+	SelfManagedCheckpointBatchSize = env.Int("SELF_MANAGED_CHECKPOINT_BATCH_SIZE",
+		"If set, the state is written out only every N changes during an update, instead of after each change. "+
+			"The final state is always written out.")
+
+	SelfManagedCheckpointFlushInterval = env.String("SELF_MANAGED_CHECKPOINT_FLUSH_INTERVAL",
+		"If set to a duration (e.g. \"10s\"), the state is written out at most this often during an update, "+
+			"instead of after each change. The final state is always written out.")
+
+	SelfManagedLockTTL = env.String("SELF_MANAGED_STATE_LOCK_TTL",
+		"If set to a duration (e.g. \"2h\"), stack locks older than this are considered stale and broken.")
+
+	SelfManagedReadOnly = env.Bool("SELF_MANAGED_READONLY",
+		"Opens the self-managed backend in read-only mode: operations that would modify the state fail.")
+
+	SelfManagedPermalinkExpiry = env.String("SELF_MANAGED_PERMALINK_EXPIRY",
+		"If set to a duration (e.g. \"24h\"), permalinks to state files in cloud storage stay valid this long. "+
+			"Durations longer than 7 days are clamped to 7 days.")
+
+	SelfManagedSkipChecksumVerification = env.Bool("SELF_MANAGED_STATE_SKIP_CHECKSUM_VERIFICATION",
+		"Skips verifying the checksums of state files when reading them.")
+
+	SelfManagedOrgs = env.String("SELF_MANAGED_ORGS",
+		"Comma-separated list of organization names accepted in stack references, "+
+			"in addition to \"organization\". Overrides .pulumi/organizations.json in the bucket.")
+
+	SelfManagedOrgDirs = env.Bool("SELF_MANAGED_ORG_DIRS",
+		"Stores the stacks of each organization listed in PULUMI_SELF_MANAGED_ORGS in a directory of its own "+
+			"at the root of the bucket, instead of under the default organization.")
+
+	SelfManagedMaxNameLength = env.Int("SELF_MANAGED_MAX_NAME_LENGTH",
+		"The maximum length of project and stack names. Defaults to 100, and may be at most 200.")
+
+	SelfManagedParallel = env.Int("SELF_MANAGED_STATE_PARALLEL",
+		"The number of state files to read concurrently when listing stacks. Defaults to GOMAXPROCS.")
+
+	SelfManagedSummaryCache = env.Bool("SELF_MANAGED_STATE_SUMMARY_CACHE",
+		"Caches the resource counts and update times of stacks in the bucket, "+
+			"so that listing stacks only reads the state files that changed since the last listing.")
+
+	SelfManagedStrictCheckpoint = env.Bool("SELF_MANAGED_STRICT_CHECKPOINT",
+		"Refuses to read state files with fields this version of the CLI doesn't know about, "+
+			"such as those written by newer versions, instead of silently ignoring them.")
+
+	SelfManagedCaseInsensitive = env.Bool("SELF_MANAGED_STATE_CASE_INSENSITIVE",
+		"Refuses to create or rename a stack whose name differs only by case from an existing stack. "+
+			"Always enabled for file:// backends on macOS and Windows.")
 )
 
 // Environment variables which affect Pulumi AI integrations
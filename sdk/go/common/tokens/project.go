@@ -14,7 +14,13 @@
 
 package tokens
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxProjectNameLength is the maximum length of project names accepted by ValidateProjectName.
+const MaxProjectNameLength = 100
 
 // ValidateProjectName validates that the given string is a valid project name.
 // The string must meet the following criteria:
@@ -26,11 +32,17 @@ import "errors"
 //
 // Returns a descriptive error if the string is not a valid project name.
 func ValidateProjectName(s string) error {
+	return ValidateProjectNameMaxLength(s, MaxProjectNameLength)
+}
+
+// ValidateProjectNameMaxLength is like ValidateProjectName,
+// but accepts project names up to maxLength characters long.
+func ValidateProjectNameMaxLength(s string, maxLength int) error {
 	switch {
 	case s == "":
 		return errors.New("project names may not be empty")
-	case len(s) > 100:
-		return errors.New("project names are limited to 100 characters")
+	case len(s) > maxLength:
+		return fmt.Errorf("project names are limited to %d characters", maxLength)
 	case !IsName(s):
 		return errors.New("project names may only contain alphanumerics, hyphens, underscores, and periods")
 	}
@@ -21,6 +21,16 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func TestValidateProjectNameMaxLength(t *testing.T) {
+	t.Parallel()
+
+	assert.NoError(t, ValidateProjectNameMaxLength(strings.Repeat("a", 150), 150))
+	assert.EqualError(t, ValidateProjectNameMaxLength(strings.Repeat("a", 151), 150),
+		"project names are limited to 150 characters")
+	assert.EqualError(t, ValidateProjectNameMaxLength("foo bar", 150),
+		"project names may only contain alphanumerics, hyphens, underscores, and periods")
+}
+
 func TestValidateProjectName(t *testing.T) {
 	t.Parallel()
 
@@ -49,8 +49,17 @@ func (sn StackName) Q() QName {
 
 var stackNameRegex = regexp.MustCompile("^[A-Za-z0-9_.-]*")
 
+// MaxStackNameLength is the maximum length of stack names accepted by ParseStackName.
+const MaxStackNameLength = 100
+
 // ParseStackName parses a stack name from a string.
 func ParseStackName(s string) (StackName, error) {
+	return ParseStackNameMaxLength(s, MaxStackNameLength)
+}
+
+// ParseStackNameMaxLength is like ParseStackName,
+// but accepts stack names up to maxLength characters long.
+func ParseStackNameMaxLength(s string, maxLength int) (StackName, error) {
 	// Temporary flag to allow stack names validation to be disabled for the time being. Be sure to update the
 	// DisableValidation help text when this is removed.
 	if env.DisableValidation.Value() {
@@ -60,8 +69,8 @@ func ParseStackName(s string) (StackName, error) {
 	if s == "" {
 		return StackName{}, fmt.Errorf("a stack name may not be empty")
 	}
-	if len(s) > 100 {
-		return StackName{}, fmt.Errorf("a stack name cannot exceed 100 characters")
+	if len(s) > maxLength {
+		return StackName{}, fmt.Errorf("a stack name cannot exceed %d characters", maxLength)
 	}
 
 	failure := -1
@@ -15,6 +15,7 @@
 package tokens
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -85,3 +86,17 @@ func TestParseStackName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseStackNameMaxLength(t *testing.T) {
+	t.Parallel()
+
+	sn, err := ParseStackNameMaxLength(strings.Repeat("a", 150), 150)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Repeat("a", 150), sn.String())
+
+	_, err = ParseStackNameMaxLength(strings.Repeat("a", 151), 150)
+	assert.EqualError(t, err, "a stack name cannot exceed 150 characters")
+
+	_, err = ParseStackNameMaxLength("my bad", 150)
+	assert.ErrorContains(t, err, "invalid character ' ' at position 2")
+}
@@ -17,10 +17,30 @@ package internal
 import (
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 )
 
+// MissingFieldsError is returned by MapStructTypes when fields of the source struct type
+// have no counterpart in the destination struct type.
+//
+// This usually means that a hand-written Args struct has drifted from the generated types.
+type MissingFieldsError struct {
+	From, To reflect.Type
+
+	// Fields are the names of the fields of From that are missing from To.
+	Fields []string
+}
+
+func (e *MissingFieldsError) Error() string {
+	if len(e.Fields) == 1 {
+		return fmt.Sprintf("unknown field %v when marshaling inputs of type %v to %v", e.Fields[0], e.From, e.To)
+	}
+	return fmt.Sprintf("unknown fields %v when marshaling inputs of type %v to %v",
+		strings.Join(e.Fields, ", "), e.From, e.To)
+}
+
 // MapStructTypes returns a function that maps the fields of struct type 'from'
 // to the fields of struct type 'to'.
 //
@@ -28,7 +48,9 @@ import (
 // and an index of a field in 'from',
 // and returns the corresponding field in 'to'.
 // The value may be omitted if just the field's type information is needed.
-func MapStructTypes(from, to reflect.Type) func(reflect.Value, int) (reflect.StructField, reflect.Value) {
+//
+// Returns a *MissingFieldsError if any fields in 'from' are missing from 'to'.
+func MapStructTypes(from, to reflect.Type) (func(reflect.Value, int) (reflect.StructField, reflect.Value), error) {
 	contract.Assertf(from.Kind() == reflect.Struct, "from must be a struct type, got %v (%v)", from, from.Kind())
 	contract.Assertf(to.Kind() == reflect.Struct, "to must be a struct type, got %v (%v)", to, to.Kind())
 
@@ -39,7 +61,7 @@ func MapStructTypes(from, to reflect.Type) func(reflect.Value, int) (reflect.Str
 				fv = v.Field(i)
 			}
 			return to.Field(i), fv
-		}
+		}, nil
 	}
 
 	nameToIndex := map[string]int{}
@@ -48,12 +70,20 @@ func MapStructTypes(from, to reflect.Type) func(reflect.Value, int) (reflect.Str
 		nameToIndex[to.Field(i).Name] = i
 	}
 
-	return func(v reflect.Value, i int) (reflect.StructField, reflect.Value) {
-		fieldName := from.Field(i).Name
-		j, ok := nameToIndex[fieldName]
-		if !ok {
-			panic(fmt.Errorf("unknown field %v when marshaling inputs of type %v to %v", fieldName, from, to))
+	// Report all missing fields at once rather than one at a time.
+	var missing []string
+	numFromFields := from.NumField()
+	for i := 0; i < numFromFields; i++ {
+		if _, ok := nameToIndex[from.Field(i).Name]; !ok {
+			missing = append(missing, from.Field(i).Name)
 		}
+	}
+	if len(missing) > 0 {
+		return nil, &MissingFieldsError{From: from, To: to, Fields: missing}
+	}
+
+	return func(v reflect.Value, i int) (reflect.StructField, reflect.Value) {
+		j := nameToIndex[from.Field(i).Name]
 
 		field := to.Field(j)
 		var fieldValue reflect.Value
@@ -61,5 +91,5 @@ func MapStructTypes(from, to reflect.Type) func(reflect.Value, int) (reflect.Str
 			fieldValue = v.Field(j)
 		}
 		return field, fieldValue
-	}
+	}, nil
 }
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMapStructTypes(t *testing.T) {
@@ -36,7 +37,8 @@ func TestMapStructTypes(t *testing.T) {
 
 	atype := reflect.TypeOf(A{})
 	btype := reflect.TypeOf(B{})
-	getMappedField := MapStructTypes(atype, btype)
+	getMappedField, err := MapStructTypes(atype, btype)
+	require.NoError(t, err)
 
 	// We'll build two structs with the same fields
 	// but in different orders.
@@ -63,7 +65,8 @@ func TestMapStructTypes_sameType(t *testing.T) {
 	}
 
 	atype := reflect.TypeOf(A{})
-	getMappedField := MapStructTypes(atype, atype)
+	getMappedField, err := MapStructTypes(atype, atype)
+	require.NoError(t, err)
 
 	// Values returned by getMappedField
 	// should match the same indexes in the original struct.
@@ -77,3 +80,29 @@ func TestMapStructTypes_sameType(t *testing.T) {
 		assert.Equal(t, wantValue.Interface(), gotValue.Interface())
 	}
 }
+
+func TestMapStructTypes_missingFields(t *testing.T) {
+	t.Parallel()
+
+	type A struct {
+		Foo string
+		Bar int
+		Baz bool
+	}
+
+	type B struct {
+		Bar int
+	}
+
+	atype := reflect.TypeOf(A{})
+	btype := reflect.TypeOf(B{})
+	_, err := MapStructTypes(atype, btype)
+
+	var missingErr *MissingFieldsError
+	require.ErrorAs(t, err, &missingErr)
+	assert.Equal(t, atype, missingErr.From)
+	assert.Equal(t, btype, missingErr.To)
+	assert.Equal(t, []string{"Foo", "Baz"}, missingErr.Fields)
+	assert.EqualError(t, err,
+		"unknown fields Foo, Baz when marshaling inputs of type internal.A to internal.B")
+}
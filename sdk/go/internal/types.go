@@ -929,7 +929,10 @@ func awaitInputs(ctx context.Context, v, resolved reflect.Value) (bool, bool, []
 		}
 	case reflect.Struct:
 		typ := v.Type()
-		getMappedField := MapStructTypes(typ, resolved.Type())
+		getMappedField, mapErr := MapStructTypes(typ, resolved.Type())
+		if mapErr != nil {
+			return false, false, nil, mapErr
+		}
 		numFields := typ.NumField()
 		for i := 0; i < numFields; i++ {
 			_, field := getMappedField(resolved, i)
@@ -64,6 +64,7 @@ type Context struct {
 	keepOutputValues    bool       // true if outputs should be marshaled as strongly-type output values.
 	supportsDeletedWith bool       // true if deletedWith supported by pulumi
 	supportsAliasSpecs  bool       // true if full alias specification is supported by pulumi
+	strictResourceRefs  bool       // true if references to unregistered resource packages are errors.
 	rpcs                int        // the number of outstanding RPC requests.
 	rpcsDone            *sync.Cond // an event signaling completion of RPCs.
 	rpcsLock            sync.Mutex // a lock protecting the RPC count and event.
@@ -238,6 +239,14 @@ func (ctx *Context) Parallel() int { return ctx.info.Parallel }
 // DryRun is true when evaluating a program for purposes of planning, instead of performing a true deployment.
 func (ctx *Context) DryRun() bool { return ctx.info.DryRun }
 
+// SetStrictResourceReferences controls how references to resources of packages that aren't registered
+// with RegisterResourcePackage or RegisterResourceModule are unmarshaled.
+//
+// By default, such references become resources that only know their URN and ID.
+// In strict mode, unmarshaling them fails with an error naming the missing package and its version,
+// so that missing provider SDKs can be detected early.
+func (ctx *Context) SetStrictResourceReferences(strict bool) { ctx.strictResourceRefs = strict }
+
 // RunningWithMocks is true if the program is running using a Mock monitor instead of a real Pulumi engine.
 func (ctx *Context) RunningWithMocks() bool {
 	_, isMockMonitor := ctx.monitor.(*mockMonitor)
@@ -303,7 +312,7 @@ func (ctx *Context) Invoke(tok string, args interface{}, result interface{}, opt
 	if args == nil {
 		args = struct{}{}
 	}
-	resolvedArgs, _, err := marshalInput(args, anyType, false)
+	resolvedArgs, _, err := marshalInput(args, anyType, false, ctx.keepOutputValues)
 	if err != nil {
 		return fmt.Errorf("marshaling arguments: %w", err)
 	}
@@ -422,7 +431,7 @@ func (ctx *Context) Call(tok string, args Input, output Output, self Resource, o
 		}
 
 		// Serialize all args, first by awaiting them, and then marshaling them to the requisite gRPC values.
-		resolvedArgs, argDeps, _, err := marshalInputs(args)
+		resolvedArgs, argDeps, _, err := marshalInputs(args, ctx.keepOutputValues)
 		if err != nil {
 			return nil, fmt.Errorf("marshaling args: %w", err)
 		}
@@ -430,7 +439,7 @@ func (ctx *Context) Call(tok string, args Input, output Output, self Resource, o
 		// If we have a value for self, add it to the arguments.
 		if self != nil {
 			var deps []URN
-			resolvedSelf, selfDeps, err := marshalInput(self, reflect.TypeOf(self), true)
+			resolvedSelf, selfDeps, err := marshalInput(self, reflect.TypeOf(self), true, ctx.keepOutputValues)
 			if err != nil {
 				return nil, fmt.Errorf("marshaling __self__: %w", err)
 			}
@@ -1542,7 +1551,9 @@ func (ctx *Context) prepareResourceInputs(res Resource, props Input, t string, o
 	}
 
 	// Serialize all properties, first by awaiting them, and then marshaling them to the requisite gRPC values.
-	resolvedProps, propertyDeps, rpcDeps, err := marshalInputs(props)
+	// To initially scope the use of output values, they're only kept when remote is true (for multi-lang components).
+	keepOutputValues := remote && ctx.keepOutputValues
+	resolvedProps, propertyDeps, rpcDeps, err := marshalInputs(props, keepOutputValues)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling properties: %w", err)
 	}
@@ -1551,11 +1562,9 @@ func (ctx *Context) prepareResourceInputs(res Resource, props Input, t string, o
 	rpcProps, err := plugin.MarshalProperties(
 		resolvedProps,
 		ctx.withKeepOrRejectUnknowns(plugin.MarshalOptions{
-			KeepSecrets:   true,
-			KeepResources: ctx.keepResources,
-			// To initially scope the use of this new feature, we only keep output values when
-			// remote is true (for multi-lang components).
-			KeepOutputValues: remote && ctx.keepOutputValues,
+			KeepSecrets:      true,
+			KeepResources:    ctx.keepResources,
+			KeepOutputValues: keepOutputValues,
 		}))
 	if err != nil {
 		return nil, fmt.Errorf("marshaling properties: %w", err)
@@ -1788,7 +1797,7 @@ func (ctx *Context) RegisterResourceOutputs(resource Resource, outs Map) error {
 			return
 		}
 
-		outsResolved, _, err := marshalInput(outs, anyType, true)
+		outsResolved, _, err := marshalInput(outs, anyType, true, false /*keepOutputValues*/)
 		if err != nil {
 			return
 		}
@@ -16,8 +16,11 @@ package internals
 
 import (
 	"context"
+	"errors"
+	"reflect"
 	_ "unsafe" // unsafe is needed to use go:linkname
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
@@ -48,3 +51,36 @@ func UnsafeAwaitOutput(ctx context.Context, o pulumi.Output) (UnsafeAwaitOutputR
 		Dependencies: deps,
 	}, err
 }
+
+//go:linkname unmarshalOutputWithDeps github.com/pulumi/pulumi/sdk/v3/go/pulumi.unmarshalOutputWithDeps
+func unmarshalOutputWithDeps(
+	ctx *pulumi.Context, v resource.PropertyValue, dest reflect.Value,
+) (bool, []resource.URN, error)
+
+// UnsafeUnmarshalOutputResult describes a property value unmarshaled with UnsafeUnmarshalOutput.
+//
+// This is a low level API and should be used with care.
+type UnsafeUnmarshalOutputResult struct {
+	Secret       bool           // True if any part of the value was a secret.
+	Dependencies []resource.URN // The dependencies of all output values in the value, sorted.
+}
+
+// UnsafeUnmarshalOutput unmarshals a property value into dest, which must be a non-nil pointer.
+// In addition to whether the value was secret, it returns the dependencies of any output values
+// encountered so that they can be reattached to outputs built from the result.
+//
+// This is a low level API and should be used with care.
+func UnsafeUnmarshalOutput(
+	ctx *pulumi.Context, v resource.PropertyValue, dest interface{},
+) (UnsafeUnmarshalOutputResult, error) {
+	rv := reflect.ValueOf(dest)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return UnsafeUnmarshalOutputResult{}, errors.New("dest must be a non-nil pointer")
+	}
+
+	secret, deps, err := unmarshalOutputWithDeps(ctx, v, rv.Elem())
+	return UnsafeUnmarshalOutputResult{
+		Secret:       secret,
+		Dependencies: deps,
+	}, err
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -63,3 +64,57 @@ func TestBasicOutputs(t *testing.T) {
 		assert.Nil(t, v)
 	}
 }
+
+func TestUnsafeUnmarshalOutput(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := pulumi.NewContext(context.Background(), pulumi.RunInfo{
+		Project: "proj",
+		Stack:   "stack",
+	})
+	require.NoError(t, err)
+
+	urnA := resource.URN("urn:pulumi:stack::proj::test:index:res::a")
+	urnB := resource.URN("urn:pulumi:stack::proj::test:index:res::b")
+	urnC := resource.URN("urn:pulumi:stack::proj::test:index:res::c")
+
+	v := resource.NewObjectProperty(resource.PropertyMap{
+		"name": resource.NewOutputProperty(resource.Output{
+			Element:      resource.NewStringProperty("foo"),
+			Known:        true,
+			Secret:       true,
+			Dependencies: []resource.URN{urnB},
+		}),
+		"tags": resource.NewArrayProperty([]resource.PropertyValue{
+			resource.NewOutputProperty(resource.Output{
+				Element:      resource.NewStringProperty("bar"),
+				Known:        true,
+				Dependencies: []resource.URN{urnA, urnB},
+			}),
+			// Unknown values still carry dependencies.
+			resource.NewOutputProperty(resource.Output{
+				Dependencies: []resource.URN{urnC},
+			}),
+		}),
+	})
+
+	var dest struct {
+		Name string   `pulumi:"name"`
+		Tags []string `pulumi:"tags"`
+	}
+	result, err := UnsafeUnmarshalOutput(ctx, v, &dest)
+	require.NoError(t, err)
+	assert.True(t, result.Secret)
+	assert.Equal(t, []resource.URN{urnA, urnB, urnC}, result.Dependencies)
+	assert.Equal(t, "foo", dest.Name)
+	assert.Equal(t, []string{"bar", ""}, dest.Tags)
+
+	// Dependencies are also collected when unmarshaling into an untyped value.
+	var untyped interface{}
+	result, err = UnsafeUnmarshalOutput(ctx, v, &untyped)
+	require.NoError(t, err)
+	assert.Equal(t, []resource.URN{urnA, urnB, urnC}, result.Dependencies)
+
+	_, err = UnsafeUnmarshalOutput(ctx, v, dest)
+	assert.ErrorContains(t, err, "dest must be a non-nil pointer")
+}
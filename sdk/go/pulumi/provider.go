@@ -152,7 +152,7 @@ func construct(ctx context.Context, req *pulumirpc.ConstructRequest, engineConn
 	}
 
 	// Serialize all state properties, first by awaiting them, and then marshaling them to the requisite gRPC values.
-	resolvedProps, propertyDeps, _, err := marshalInputs(state)
+	resolvedProps, propertyDeps, _, err := marshalInputs(state, false /*keepOutputValues*/)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling properties: %w", err)
 	}
@@ -805,7 +805,7 @@ func call(ctx context.Context, req *pulumirpc.CallRequest, engineConn *grpc.Clie
 	}
 
 	// Serialize all result properties, first by awaiting them, and then marshaling them to the requisite gRPC values.
-	resolvedProps, propertyDeps, _, err := marshalInputs(result)
+	resolvedProps, propertyDeps, _, err := marshalInputs(result, false /*keepOutputValues*/)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling properties: %w", err)
 	}
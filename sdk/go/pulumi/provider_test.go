@@ -1709,7 +1709,7 @@ func TestConstructResult(t *testing.T) {
 	_, state, err := newConstructResult(component)
 	assert.NoError(t, err)
 
-	resolvedProps, _, _, err := marshalInputs(state)
+	resolvedProps, _, _, err := marshalInputs(state, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 
 	assert.Equal(t, resource.PropertyMap{
@@ -1735,7 +1735,7 @@ func TestSerdeNilNestedResource(t *testing.T) {
 	_, state, err := newConstructResult(component)
 	assert.NoError(t, err)
 
-	_, _, _, err = marshalInputs(state)
+	_, _, _, err = marshalInputs(state, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 }
 
@@ -15,6 +15,8 @@
 package pulumi
 
 import (
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -22,11 +24,16 @@ import (
 	"sync"
 
 	"github.com/blang/semver"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	"golang.org/x/net/context"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/plugin"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 	"github.com/pulumi/pulumi/sdk/v3/go/internal"
 )
 
@@ -59,7 +66,15 @@ import (
 // * Cust4 because it is a child of a custom resource
 // * Comp2 because it is a non-remote component resoruce
 // * Comp3 and Cust5 because Comp3 is a child of a remote component resource
+//
+// A component resource that is its own descendant is reported as an error
+// rather than recursing forever.
 func addDependency(ctx context.Context, deps urnSet, res, from Resource) error {
+	return addDependencyOnPath(ctx, deps, res, from, resourceSet{})
+}
+
+// addDependencyOnPath is addDependency for a resource reached through the component resources in path.
+func addDependencyOnPath(ctx context.Context, deps urnSet, res, from Resource, path resourceSet) error {
 	if _, custom := res.(CustomResource); !custom {
 		// If `res` is the same as `from`, exit early to avoid depending on
 		// children that haven't been registered yet.
@@ -67,8 +82,18 @@ func addDependency(ctx context.Context, deps urnSet, res, from Resource) error {
 			return nil
 		}
 
+		if _, cycle := path[res]; cycle {
+			urn, _, _, err := res.URN().awaitURN(ctx)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("dependency cycle: resource %v is its own descendant", urn)
+		}
+		path.add(res)
+		defer delete(path, res)
+
 		for _, child := range res.getChildren() {
-			if err := addDependency(ctx, deps, child, from); err != nil {
+			if err := addDependencyOnPath(ctx, deps, child, from, path); err != nil {
 				return err
 			}
 		}
@@ -98,8 +123,13 @@ func expandDependencies(ctx context.Context, deps []Resource) (urnSet, error) {
 	return urns, nil
 }
 
+// MissingFieldsError is returned when marshaling an input struct
+// that has fields missing from the struct type it is marshaled as.
+type MissingFieldsError = internal.MissingFieldsError
+
 // marshalInputs turns resource property inputs into a map suitable for marshaling.
-func marshalInputs(props Input) (resource.PropertyMap, map[string][]URN, []URN, error) {
+// See marshalInputImpl for keepOutputValues.
+func marshalInputs(props Input, keepOutputValues bool) (resource.PropertyMap, map[string][]URN, []URN, error) {
 	deps := urnSet{}
 	pmap, pdeps := resource.PropertyMap{}, map[string][]URN{}
 
@@ -109,9 +139,14 @@ func marshalInputs(props Input) (resource.PropertyMap, map[string][]URN, []URN,
 
 	marshalProperty := func(pname string, pv interface{}, pt reflect.Type) error {
 		// Get the underlying value, possibly waiting for an output to arrive.
-		v, resourceDeps, err := marshalInput(pv, pt, true)
+		v, resourceDeps, err := marshalInput(pv, pt, true, keepOutputValues)
 		if err != nil {
-			return fmt.Errorf("awaiting input property %q: %w", pname, err)
+			// Report the path to the nested value that failed, if any.
+			path := pname
+			if perr, ok := err.(*inputPathError); ok {
+				path, err = pname+perr.path, perr.err
+			}
+			return fmt.Errorf("awaiting input property %q: %w", path, err)
 		}
 
 		// Record all dependencies accumulated from reading this property.
@@ -150,17 +185,13 @@ func marshalInputs(props Input) (resource.PropertyMap, map[string][]URN, []URN,
 		if rt.Kind() == reflect.Ptr {
 			rt = rt.Elem()
 		}
-		getMappedField := internal.MapStructTypes(pt, rt)
+		fields, err := taggedStructFields(pv, rt, false /*alloc*/)
+		if err != nil {
+			return nil, nil, nil, err
+		}
 		// Now, marshal each field in the input.
-		numFields := pt.NumField()
-		for i := 0; i < numFields; i++ {
-			destField, _ := getMappedField(reflect.Value{}, i)
-			tag := destField.Tag.Get("pulumi")
-			tag = strings.Split(tag, ",")[0] // tagName,flag => tagName
-			if tag == "" {
-				continue
-			}
-			err := marshalProperty(tag, pv.Field(i).Interface(), destField.Type)
+		for _, field := range fields {
+			err := marshalProperty(field.tag, field.value.Interface(), field.destType)
 			if err != nil {
 				return nil, nil, nil, err
 			}
@@ -184,6 +215,183 @@ func marshalInputs(props Input) (resource.PropertyMap, map[string][]URN, []URN,
 	return pmap, pdeps, deps.values(), nil
 }
 
+// collectDependencies returns the URNs of the resources that the given inputs depend on,
+// without marshaling their values.
+//
+// The result is the same set of dependencies as the one returned by marshalInputs:
+// outputs are awaited only to learn their dependencies, their values aren't inspected,
+// and every dependency is expanded with addDependency, so the rules for custom resources,
+// local component resources and remote component resources described there apply.
+func collectDependencies(props Input) ([]URN, error) {
+	deps := urnSet{}
+	if err := collectValueDependencies(context.TODO(), deps, props); err != nil {
+		return nil, err
+	}
+	return deps.sortedValues(), nil
+}
+
+// collectValueDependencies adds the dependencies of v, an input or a plain value that may contain inputs, to deps.
+func collectValueDependencies(ctx context.Context, deps urnSet, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case Output:
+		_, _, _, outputDeps, err := awaitWithContext(ctx, v)
+		if err != nil {
+			return err
+		}
+		for _, dep := range outputDeps {
+			if err := addDependency(ctx, deps, dep, nil /* from */); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Resource:
+		return addDependency(ctx, deps, v, nil /* from */)
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return collectValueDependencies(ctx, deps, rv.Elem().Interface())
+	case reflect.Array, reflect.Slice:
+		// Slices of plain values, e.g. json.RawMessage, can't contain any inputs.
+		switch rv.Type().Elem().Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Array, reflect.Slice, reflect.Map:
+		default:
+			return nil
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := collectValueDependencies(ctx, deps, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := collectValueDependencies(ctx, deps, iter.Value().Interface()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < rv.NumField(); i++ {
+			if field := rv.Field(i); field.CanInterface() {
+				if err := collectValueDependencies(ctx, deps, field.Interface()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// structField is a field of a struct with a `pulumi` tag, or a `json` tag in its stead; see structFieldTag.
+type structField struct {
+	// tag is the property name from the tag of the field.
+	tag string
+	// value is the value of the field.
+	value reflect.Value
+	// destType is the type the field is marshaled as.
+	destType reflect.Type
+}
+
+// taggedStructFields returns the fields of the struct v that have a property name per structFieldTag,
+// mapping each field to the field with the same name in destType to find its tag and type.
+//
+// Fields promoted from embedded structs without a tag are included.
+// As with promoted fields in Go, a field shadows any field with the same tag
+// that's more deeply embedded, so the outermost definition wins.
+// Nil embedded struct pointers are skipped, or allocated if alloc is set and the field can be set.
+func taggedStructFields(v reflect.Value, destType reflect.Type, alloc bool) ([]structField, error) {
+	type embeddedStruct struct {
+		value    reflect.Value
+		destType reflect.Type
+	}
+
+	var fields []structField
+	seen := map[string]bool{}
+
+	// Visit structs in order of depth so that outer fields are seen first.
+	queue := []embeddedStruct{{v, destType}}
+	for len(queue) > 0 {
+		level := queue
+		queue = nil
+
+		// Tags found at this depth shadow the ones at greater depths, but not each other.
+		found := map[string]bool{}
+		for _, s := range level {
+			typ := s.value.Type()
+			getMappedField, err := internal.MapStructTypes(typ, s.destType)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < typ.NumField(); i++ {
+				destField, _ := getMappedField(reflect.Value{}, i)
+				if tag := structFieldTag(destField); tag != "" {
+					if !seen[tag] && !found[tag] {
+						found[tag] = true
+						fields = append(fields, structField{tag: tag, value: s.value.Field(i), destType: destField.Type})
+					}
+					continue
+				}
+				if !destField.Anonymous {
+					continue
+				}
+
+				fv, ft := s.value.Field(i), destField.Type
+				if fv.Kind() == reflect.Ptr {
+					if fv.IsNil() {
+						if !alloc || !fv.CanSet() {
+							continue
+						}
+						fv.Set(reflect.New(fv.Type().Elem()))
+					}
+					fv = fv.Elem()
+				}
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if fv.Kind() == reflect.Struct && ft.Kind() == reflect.Struct {
+					queue = append(queue, embeddedStruct{fv, ft})
+				}
+			}
+		}
+		for tag := range found {
+			seen[tag] = true
+		}
+	}
+	return fields, nil
+}
+
+// structFieldTag returns the property name of a struct field, or "" if the field isn't a property.
+//
+// The name comes from the `pulumi` tag of the field.
+// Fields without a `pulumi` tag fall back to their `json` tag, if any, following the rules of encoding/json:
+// the name defaults to the name of the field, and fields tagged "-" are skipped.
+// Embedded structs without a name in their `json` tag aren't properties themselves,
+// so that their fields are promoted as with encoding/json.
+func structFieldTag(field reflect.StructField) string {
+	if tag, ok := field.Tag.Lookup("pulumi"); ok {
+		return strings.Split(tag, ",")[0] // tagName,flag => tagName
+	}
+
+	tag, ok := field.Tag.Lookup("json")
+	if !ok || tag == "-" || !field.IsExported() {
+		return ""
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		if field.Anonymous {
+			return ""
+		}
+		name = field.Name
+	}
+	return name
+}
+
 // `gosec` thinks these are credentials, but they are not.
 //
 //nolint:gosec
@@ -191,16 +399,56 @@ const rpcTokenUnknownValue = "04da6b54-80e4-46f7-96ec-b56ff0331ba9"
 
 const cannotAwaitFmt = "cannot marshal Output value of type %T; please use Apply to access the Output's value"
 
+// inputPathError is an error marshaling a value nested inside an input.
+// It records the path from the input to that value, e.g. ".template.containers[0].image".
+type inputPathError struct {
+	path string
+	err  error
+}
+
+func (e *inputPathError) Error() string {
+	return fmt.Sprintf("%s: %v", strings.TrimPrefix(e.path, "."), e.err)
+}
+
+func (e *inputPathError) Unwrap() error {
+	return e.err
+}
+
+// withInputPath prepends the path element elem to the path of err.
+func withInputPath(elem string, err error) error {
+	if perr, ok := err.(*inputPathError); ok {
+		return &inputPathError{path: elem + perr.path, err: perr.err}
+	}
+	return &inputPathError{path: elem, err: err}
+}
+
+// inexactIntegerError is returned when marshaling an integer that a number property can't hold exactly.
+//
+// Number properties are float64s, so integers are only exact up to 2^53 in magnitude,
+// plus larger ones with enough trailing zero bits.
+// Rather than silently round things like IDs and Unix nanosecond timestamps, they're rejected.
+func inexactIntegerError(v interface{}) error {
+	return fmt.Errorf("integer %d cannot be represented exactly as a number; pass it as a string instead", v)
+}
+
 // marshalInput marshals an input value, returning its raw serializable value along with any dependencies.
-func marshalInput(v interface{}, destType reflect.Type, await bool) (resource.PropertyValue, []Resource, error) {
-	return marshalInputImpl(v, destType, await, false /*skipInputCheck*/)
+// See marshalInputImpl for keepOutputValues.
+func marshalInput(
+	v interface{}, destType reflect.Type, await, keepOutputValues bool,
+) (resource.PropertyValue, []Resource, error) {
+	return marshalInputImpl(v, destType, await, false /*skipInputCheck*/, keepOutputValues)
 }
 
 // marshalInputImpl marshals an input value, returning its raw serializable value along with any dependencies.
+//
+// If keepOutputValues is false, outputs are never marshaled as output values, for the sake of providers that predate
+// them: known values are marshaled as plain (or secret) values and unknown values as computed values.
+// The dependencies of those outputs are still returned.
 func marshalInputImpl(v interface{},
 	destType reflect.Type,
 	await,
-	skipInputCheck bool,
+	skipInputCheck,
+	keepOutputValues bool,
 ) (resource.PropertyValue, []Resource, error) {
 	var deps []Resource
 	for {
@@ -250,7 +498,7 @@ func marshalInputImpl(v interface{},
 				// Get the underlying value, if known.
 				var element resource.PropertyValue
 				if known {
-					element, _, err = marshalInputImpl(ov, destType, await, true /*skipInputCheck*/)
+					element, _, err = marshalInputImpl(ov, destType, await, true /*skipInputCheck*/, keepOutputValues)
 					if err != nil {
 						return resource.PropertyValue{}, nil, err
 					}
@@ -261,6 +509,20 @@ func marshalInputImpl(v interface{},
 					}
 				}
 
+				// If output values aren't wanted, collapse the output and return its deps on the side.
+				if !keepOutputValues {
+					switch {
+					case !known && secret:
+						return resource.MakeSecret(resource.MakeComputed(resource.NewStringProperty(""))), outputDeps, nil
+					case !known:
+						return resource.MakeComputed(resource.NewStringProperty("")), outputDeps, nil
+					case secret:
+						return resource.MakeSecret(element), outputDeps, nil
+					default:
+						return element, outputDeps, nil
+					}
+				}
+
 				// Expand dependencies.
 				urnSet, err := expandDependencies(context.TODO(), outputDeps)
 				if err != nil {
@@ -302,6 +564,18 @@ func marshalInputImpl(v interface{},
 
 		// Look for some well known types.
 		switch v := v.(type) {
+		case json.RawMessage:
+			pv, err := unmarshalJSONValue(v)
+			if err != nil {
+				return resource.PropertyValue{}, nil, err
+			}
+			return pv, deps, nil
+		case *structpb.Value:
+			pv, err := plugin.UnmarshalPropertyValue("", v, jsonMarshalOptions)
+			if err != nil {
+				return resource.PropertyValue{}, nil, err
+			}
+			return *pv, deps, nil
 		case *asset:
 			if v.invalid {
 				return resource.PropertyValue{}, nil, fmt.Errorf("invalid asset")
@@ -320,7 +594,7 @@ func marshalInputImpl(v interface{},
 			if as := v.Assets(); as != nil {
 				assets = make(map[string]interface{})
 				for k, a := range as {
-					aa, _, err := marshalInput(a, anyType, await)
+					aa, _, err := marshalInputImpl(a, anyType, await, false /*skipInputCheck*/, keepOutputValues)
 					if err != nil {
 						return resource.PropertyValue{}, nil, err
 					}
@@ -355,6 +629,15 @@ func marshalInputImpl(v interface{},
 			return resource.MakeComponentResourceReference(resource.URN(urn), ""), deps, nil
 		}
 
+		// Prefer a marshaler registered for this type over reflection.
+		if marshal, ok := customMarshalers.loadInput(reflect.TypeOf(v)); ok {
+			pv, err := marshal(v)
+			if err != nil {
+				return resource.PropertyValue{}, nil, fmt.Errorf("marshaling %v: %w", reflect.TypeOf(v), err)
+			}
+			return pv, deps, nil
+		}
+
 		if destType.Kind() == reflect.Interface {
 			// This happens in the case of Any.
 			if valueType.Kind() == reflect.Interface {
@@ -379,9 +662,17 @@ func marshalInputImpl(v interface{},
 		case reflect.Bool:
 			return resource.NewBoolProperty(rv.Bool()), deps, nil
 		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			return resource.NewNumberProperty(float64(rv.Int())), deps, nil
+			f := float64(rv.Int())
+			if f >= 1<<63 || int64(f) != rv.Int() {
+				return resource.PropertyValue{}, nil, inexactIntegerError(rv.Int())
+			}
+			return resource.NewNumberProperty(f), deps, nil
 		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			return resource.NewNumberProperty(float64(rv.Uint())), deps, nil
+			f := float64(rv.Uint())
+			if f >= 1<<64 || uint64(f) != rv.Uint() {
+				return resource.PropertyValue{}, nil, inexactIntegerError(rv.Uint())
+			}
+			return resource.NewNumberProperty(f), deps, nil
 		case reflect.Float32, reflect.Float64:
 			return resource.NewNumberProperty(rv.Float()), deps, nil
 		case reflect.Ptr, reflect.Interface:
@@ -397,7 +688,8 @@ func marshalInputImpl(v interface{},
 		case reflect.String:
 			return resource.NewStringProperty(rv.String()), deps, nil
 		case reflect.Array, reflect.Slice:
-			if rv.IsNil() {
+			// Arrays are never nil; only slices are.
+			if rv.Kind() == reflect.Slice && rv.IsNil() {
 				return resource.PropertyValue{}, deps, nil
 			}
 
@@ -407,9 +699,9 @@ func marshalInputImpl(v interface{},
 			var arr []resource.PropertyValue
 			for i := 0; i < rv.Len(); i++ {
 				elem := rv.Index(i)
-				e, d, err := marshalInput(elem.Interface(), destElem, await)
+				e, d, err := marshalInputImpl(elem.Interface(), destElem, await, false /*skipInputCheck*/, keepOutputValues)
 				if err != nil {
-					return resource.PropertyValue{}, nil, err
+					return resource.PropertyValue{}, nil, withInputPath(fmt.Sprintf("[%d]", i), err)
 				}
 				if !e.IsNull() {
 					arr = append(arr, e)
@@ -418,9 +710,10 @@ func marshalInputImpl(v interface{},
 			}
 			return resource.NewArrayProperty(arr), deps, nil
 		case reflect.Map:
-			if rv.Type().Key().Kind() != reflect.String {
+			keyType := rv.Type().Key()
+			if keyType.Kind() != reflect.String && !keyType.Implements(textMarshalerType) {
 				return resource.PropertyValue{}, nil,
-					fmt.Errorf("expected map keys to be strings; got %v", rv.Type().Key())
+					fmt.Errorf("expected map keys to be strings; got %v", keyType)
 			}
 
 			if rv.IsNil() {
@@ -432,36 +725,37 @@ func marshalInputImpl(v interface{},
 			// For maps, only support string-based keys, and recurse into the values.
 			obj := resource.PropertyMap{}
 			for _, key := range rv.MapKeys() {
-				value := rv.MapIndex(key)
-				mv, d, err := marshalInput(value.Interface(), destElem, await)
+				keyname, err := marshalMapKey(key)
 				if err != nil {
 					return resource.PropertyValue{}, nil, err
 				}
+
+				value := rv.MapIndex(key)
+				mv, d, err := marshalInputImpl(value.Interface(), destElem, await, false /*skipInputCheck*/, keepOutputValues)
+				if err != nil {
+					return resource.PropertyValue{}, nil, withInputPath("."+keyname, err)
+				}
 				if !mv.IsNull() {
-					obj[resource.PropertyKey(key.String())] = mv
+					obj[resource.PropertyKey(keyname)] = mv
 				}
 				deps = append(deps, d...)
 			}
 			return resource.NewObjectProperty(obj), deps, nil
 		case reflect.Struct:
 			obj := resource.PropertyMap{}
-			typ := rv.Type()
-			getMappedField := internal.MapStructTypes(typ, destType)
-			for i := 0; i < typ.NumField(); i++ {
-				destField, _ := getMappedField(reflect.Value{}, i)
-				tag := destField.Tag.Get("pulumi")
-				tag = strings.Split(tag, ",")[0] // tagName,flag => tagName
-				if tag == "" {
-					continue
-				}
-
-				fv, d, err := marshalInput(rv.Field(i).Interface(), destField.Type, await)
+			fields, err := taggedStructFields(rv, destType, false /*alloc*/)
+			if err != nil {
+				return resource.PropertyValue{}, nil, err
+			}
+			for _, field := range fields {
+				fv, d, err := marshalInputImpl(field.value.Interface(), field.destType, await,
+					false /*skipInputCheck*/, keepOutputValues)
 				if err != nil {
-					return resource.PropertyValue{}, nil, err
+					return resource.PropertyValue{}, nil, withInputPath("."+field.tag, err)
 				}
 
 				if !fv.IsNull() {
-					obj[resource.PropertyKey(tag)] = fv
+					obj[resource.PropertyKey(field.tag)] = fv
 				}
 				deps = append(deps, d...)
 			}
@@ -471,6 +765,74 @@ func marshalInputImpl(v interface{},
 	}
 }
 
+// jsonMarshalOptions are the options used to convert between free-form JSON and property values.
+// Secrets are kept, encoded as secret signature objects in the JSON.
+var jsonMarshalOptions = plugin.MarshalOptions{KeepSecrets: true}
+
+// unmarshalJSONValue parses free-form JSON into a property value.
+func unmarshalJSONValue(data json.RawMessage) (resource.PropertyValue, error) {
+	var pb structpb.Value
+	if err := protojson.Unmarshal(data, &pb); err != nil {
+		return resource.PropertyValue{}, fmt.Errorf("parsing JSON input: %w", err)
+	}
+	pv, err := plugin.UnmarshalPropertyValue("", &pb, jsonMarshalOptions)
+	if err != nil {
+		return resource.PropertyValue{}, err
+	}
+	return *pv, nil
+}
+
+// marshalJSONValue serializes a property value to free-form JSON.
+func marshalJSONValue(v resource.PropertyValue) (json.RawMessage, error) {
+	pb, err := plugin.MarshalPropertyValue("", v, jsonMarshalOptions)
+	if err != nil {
+		return nil, err
+	}
+	return protojson.Marshal(pb)
+}
+
+var (
+	jsonRawMessageType = reflect.TypeOf(json.RawMessage{})
+	structpbValueType  = reflect.TypeOf(structpb.Value{})
+
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// marshalMapKey returns the string form of a map key.
+// Keys are either strings or implement encoding.TextMarshaler.
+func marshalMapKey(key reflect.Value) (string, error) {
+	// As with encoding/json, prefer the string value of string-based keys.
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+
+	tm, ok := key.Interface().(encoding.TextMarshaler)
+	contract.Assertf(ok, "map key of type %v must implement encoding.TextMarshaler", key.Type())
+	text, err := tm.MarshalText()
+	if err != nil {
+		return "", fmt.Errorf("marshaling map key %v: %w", key, err)
+	}
+	return string(text), nil
+}
+
+// unmarshalMapKey parses a map key of type keyType from its string form.
+// keyType is either string-based or its pointer type implements encoding.TextUnmarshaler.
+func unmarshalMapKey(k string, keyType reflect.Type) (reflect.Value, error) {
+	key := reflect.New(keyType)
+	if keyType.Kind() == reflect.String {
+		key.Elem().SetString(k)
+		return key.Elem(), nil
+	}
+
+	tu, ok := key.Interface().(encoding.TextUnmarshaler)
+	contract.Assertf(ok, "map key of type %v must implement encoding.TextUnmarshaler", keyType)
+	if err := tu.UnmarshalText([]byte(k)); err != nil {
+		return reflect.Value{}, fmt.Errorf("unmarshaling map key %q: %w", k, err)
+	}
+	return key.Elem(), nil
+}
+
 func unmarshalResourceReference(ctx *Context, ref resource.ResourceReference) (Resource, error) {
 	version := nullVersion
 	if len(ref.PackageVersion) > 0 {
@@ -487,25 +849,42 @@ func unmarshalResourceReference(ctx *Context, ref resource.ResourceReference) (R
 	isProvider := tokens.Token(resType).HasModuleMember() && resType.Module() == "pulumi:providers"
 	if isProvider {
 		pkgName := resType.Name().String()
-		if resourcePackageV, ok := resourcePackages.Load(pkgName, version); ok {
+		if resourcePackageV, ok := resourcePackages.loadCompatible(pkgName, version); ok {
 			resourcePackage := resourcePackageV.(ResourcePackage)
 			return resourcePackage.ConstructProvider(ctx, resName, string(resType), string(ref.URN))
 		}
+		if ctx.strictResourceRefs {
+			return nil, unregisteredResourcePackageError(ref, pkgName)
+		}
 		id, _ := ref.IDString()
 		return ctx.newDependencyProviderResource(URN(ref.URN), ID(id)), nil
 	}
 
 	modName := resType.Module().String()
-	if resourceModuleV, ok := resourceModules.Load(modName, version); ok {
+	if resourceModuleV, ok := resourceModules.loadCompatible(modName, version); ok {
 		resourceModule := resourceModuleV.(ResourceModule)
 		return resourceModule.Construct(ctx, resName, string(resType), string(ref.URN))
 	}
+	if ctx.strictResourceRefs {
+		return nil, unregisteredResourcePackageError(ref, resType.Package().String())
+	}
 	if id, hasID := ref.IDString(); hasID {
 		return ctx.newDependencyCustomResource(URN(ref.URN), ID(id)), nil
 	}
 	return ctx.newDependencyResource(URN(ref.URN)), nil
 }
 
+// unregisteredResourcePackageError returns the error reported in strict mode
+// for a reference to a resource of a package that isn't registered.
+func unregisteredResourcePackageError(ref resource.ResourceReference, pkg string) error {
+	version := ref.PackageVersion
+	if version == "" {
+		version = "any version"
+	}
+	return fmt.Errorf("cannot unmarshal reference to resource %s: package %s (%s) is not registered; "+
+		"make sure its SDK is imported by the program", ref.URN, pkg, version)
+}
+
 func unmarshalPropertyValue(ctx *Context, v resource.PropertyValue) (interface{}, bool, error) {
 	switch {
 	case v.IsComputed():
@@ -596,8 +975,64 @@ func unmarshalPropertyValue(ctx *Context, v resource.PropertyValue) (interface{}
 // unmarshalOutput unmarshals a single output variable into its runtime representation.
 // returning a bool that indicates secretness
 func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value) (bool, error) {
+	return unmarshalOutputImpl(ctx, v, dest, nil /* deps */)
+}
+
+// unmarshalOutputWithDeps is like unmarshalOutput,
+// but also returns the dependencies of any output values encountered while unmarshaling.
+// These are otherwise lost when unmarshaling into plain Go types.
+func unmarshalOutputWithDeps(
+	ctx *Context, v resource.PropertyValue, dest reflect.Value,
+) (bool, []resource.URN, error) {
+	deps := urnSet{}
+	secret, err := unmarshalOutputImpl(ctx, v, dest, deps)
+	if err != nil {
+		return false, nil, err
+	}
+
+	var urns []resource.URN
+	if len(deps) > 0 {
+		urns = make([]resource.URN, len(deps))
+		for i, urn := range deps.sortedValues() {
+			urns[i] = resource.URN(urn)
+		}
+	}
+	return secret, urns, nil
+}
+
+// addOutputDependencies adds the dependencies of all output values in v to deps.
+func addOutputDependencies(deps urnSet, v resource.PropertyValue) {
+	switch {
+	case v.IsOutput():
+		for _, urn := range v.OutputValue().Dependencies {
+			deps.add(URN(urn))
+		}
+		addOutputDependencies(deps, v.OutputValue().Element)
+	case v.IsSecret():
+		addOutputDependencies(deps, v.SecretValue().Element)
+	case v.IsArray():
+		for _, e := range v.ArrayValue() {
+			addOutputDependencies(deps, e)
+		}
+	case v.IsObject():
+		for _, e := range v.ObjectValue() {
+			addOutputDependencies(deps, e)
+		}
+	}
+}
+
+// unmarshalOutputImpl implements unmarshalOutput.
+// If deps is non-nil, the dependencies of output values encountered are added to it.
+func unmarshalOutputImpl(ctx *Context, v resource.PropertyValue, dest reflect.Value, deps urnSet) (bool, error) {
 	contract.Requiref(dest.CanSet(), "dest", "value must be settable")
 
+	// Unknown outputs still carry dependencies.
+	if deps != nil && v.IsOutput() {
+		for _, urn := range v.OutputValue().Dependencies {
+			deps.add(URN(urn))
+		}
+	}
+
 	// Check for nils and unknowns. The destination will be left with the zero value.
 	if v.IsNull() || v.IsComputed() || (v.IsOutput() && !v.OutputValue().Known) {
 		return false, nil
@@ -635,7 +1070,7 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 		dest.Set(reflect.ValueOf(archive))
 		return secret, nil
 	case v.IsSecret():
-		if _, err := unmarshalOutput(ctx, v.SecretValue().Element, dest); err != nil {
+		if _, err := unmarshalOutputImpl(ctx, v.SecretValue().Element, dest, deps); err != nil {
 			return false, err
 		}
 		return true, nil
@@ -651,12 +1086,50 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 		dest.Set(resV)
 		return secret, nil
 	case v.IsOutput():
-		if _, err := unmarshalOutput(ctx, v.OutputValue().Element, dest); err != nil {
+		if _, err := unmarshalOutputImpl(ctx, v.OutputValue().Element, dest, deps); err != nil {
 			return false, err
 		}
 		return v.OutputValue().Secret, nil
 	}
 
+	// Free-form JSON destinations receive the value as-is, including any nested secrets.
+	switch dest.Type() {
+	case jsonRawMessageType:
+		data, err := marshalJSONValue(v)
+		if err != nil {
+			return false, err
+		}
+		dest.SetBytes(data)
+		return v.ContainsSecrets(), nil
+	case structpbValueType:
+		pb, err := plugin.MarshalPropertyValue("", v, jsonMarshalOptions)
+		if err != nil {
+			return false, err
+		}
+		proto.Merge(dest.Addr().Interface().(*structpb.Value), pb)
+		return v.ContainsSecrets(), nil
+	}
+
+	// Prefer an unmarshaler registered for the destination type over reflection.
+	if unmarshal, ok := customMarshalers.loadOutput(dest.Type()); ok {
+		result, err := unmarshal(v)
+		if err != nil {
+			return false, fmt.Errorf("unmarshaling %v: %w", dest.Type(), err)
+		}
+		if deps != nil {
+			addOutputDependencies(deps, v)
+		}
+		if result == nil {
+			return false, nil
+		}
+		rv := reflect.ValueOf(result)
+		if !rv.Type().AssignableTo(dest.Type()) {
+			return false, fmt.Errorf("unmarshaler for %v returned a value of type %v", dest.Type(), rv.Type())
+		}
+		dest.Set(rv)
+		return false, nil
+	}
+
 	// Unmarshal based on the desired type.
 	switch dest.Kind() {
 	case reflect.Bool:
@@ -706,7 +1179,7 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 		slice := reflect.MakeSlice(dest.Type(), len(arr), len(arr))
 		secret := false
 		for i, e := range arr {
-			isecret, err := unmarshalOutput(ctx, e, slice.Index(i))
+			isecret, err := unmarshalOutputImpl(ctx, e, slice.Index(i), deps)
 			if err != nil {
 				return false, err
 			}
@@ -720,7 +1193,7 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 		}
 
 		keyType, elemType := dest.Type().Key(), dest.Type().Elem()
-		if keyType.Kind() != reflect.String {
+		if keyType.Kind() != reflect.String && !reflect.PtrTo(keyType).Implements(textUnmarshalerType) {
 			return false, fmt.Errorf("map keys must be assignable from type string")
 		}
 
@@ -731,14 +1204,16 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 				continue
 			}
 			elem := reflect.New(elemType).Elem()
-			esecret, err := unmarshalOutput(ctx, e, elem)
+			esecret, err := unmarshalOutputImpl(ctx, e, elem, deps)
 			if err != nil {
 				return false, err
 			}
 			secret = secret || esecret
 
-			key := reflect.New(keyType).Elem()
-			key.SetString(string(k))
+			key, err := unmarshalMapKey(string(k), keyType)
+			if err != nil {
+				return false, err
+			}
 
 			result.SetMapIndex(key, elem)
 		}
@@ -775,6 +1250,9 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 		if err != nil {
 			return false, err
 		}
+		if deps != nil {
+			addOutputDependencies(deps, v)
+		}
 		dest.Set(reflect.ValueOf(result))
 		return secret, nil
 	case reflect.Struct:
@@ -785,24 +1263,22 @@ func unmarshalOutput(ctx *Context, v resource.PropertyValue, dest reflect.Value)
 
 		obj := v.ObjectValue()
 		secret := false
-		for i := 0; i < typ.NumField(); i++ {
-			fieldV := dest.Field(i)
+		fields, err := taggedStructFields(dest, typ, true /*alloc*/)
+		if err != nil {
+			return false, err
+		}
+		for _, field := range fields {
+			fieldV := field.value
 			if !fieldV.CanSet() {
 				continue
 			}
 
-			tag := typ.Field(i).Tag.Get("pulumi")
-			tag = strings.Split(tag, ",")[0] // tagName,flag => tagName
-			if tag == "" {
-				continue
-			}
-
-			e, ok := obj[resource.PropertyKey(tag)]
+			e, ok := obj[resource.PropertyKey(field.tag)]
 			if !ok {
 				continue
 			}
 
-			osecret, err := unmarshalOutput(ctx, e, fieldV)
+			osecret, err := unmarshalOutputImpl(ctx, e, fieldV, deps)
 			secret = secret || osecret
 			if err != nil {
 				return false, err
@@ -856,6 +1332,68 @@ func (vm *versionedMap) Load(key string, version semver.Version) (Versioned, boo
 	return bestVersion, bestVersion != nil
 }
 
+// LoadRange returns the highest version registered for key that satisfies the given range.
+// Unlike Load, matches are not constrained to a single major version.
+func (vm *versionedMap) LoadRange(key string, r semver.Range) (Versioned, bool) {
+	vm.RLock()
+	defer vm.RUnlock()
+
+	var bestVersion Versioned
+	for _, v := range vm.versions[key] {
+		if !r(v.Version()) {
+			continue
+		}
+		if bestVersion == nil || v.Version().GT(bestVersion.Version()) {
+			bestVersion = v
+		}
+	}
+
+	return bestVersion, bestVersion != nil
+}
+
+// loadCompatible returns the version registered for key that best matches the given version.
+//
+// It prefers the same matches as Load: an exact match, or else the highest version with the same major version.
+// Failing that, it falls back to an adjacent major version
+// so that references recorded by a newer or older release of a package can still be resolved.
+// The nearest lower major version is preferred, and the next higher one is only used if there's no lower one.
+// Adjacent major versions may be incompatible,
+// so a resource resolved this way may not match the schema of the version it was recorded with;
+// this is logged at debug level.
+func (vm *versionedMap) loadCompatible(key string, version semver.Version) (Versioned, bool) {
+	if v, ok := vm.Load(key, version); ok {
+		return v, true
+	}
+	if version.EQ(nullVersion) {
+		return nil, false
+	}
+
+	for _, r := range compatibleVersionRanges(version) {
+		if v, ok := vm.LoadRange(key, r); ok {
+			logging.V(9).Infof("resolving %q version %v using registered version %v from another major version",
+				key, version, v.Version())
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// compatibleVersionRanges returns the ranges of versions loadCompatible falls back to for the given version,
+// in order of preference: ">=(X-1).0.0 <X.0.0" and then ">=(X+1).0.0 <(X+2).0.0", where X is its major version.
+func compatibleVersionRanges(version semver.Version) []semver.Range {
+	majorRange := func(major uint64) semver.Range {
+		return func(v semver.Version) bool {
+			return v.Major == major
+		}
+	}
+
+	var ranges []semver.Range
+	if version.Major > 0 {
+		ranges = append(ranges, majorRange(version.Major-1))
+	}
+	return append(ranges, majorRange(version.Major+1))
+}
+
 func (vm *versionedMap) Store(key string, value Versioned) error {
 	vm.Lock()
 	defer vm.Unlock()
@@ -912,7 +1450,73 @@ func RegisterResourceModule(pkg, mod string, module ResourceModule) {
 	}
 }
 
+// marshalerMap holds the marshalers registered for custom Go types.
+type marshalerMap struct {
+	sync.RWMutex
+	inputs  map[reflect.Type]func(interface{}) (resource.PropertyValue, error)
+	outputs map[reflect.Type]func(resource.PropertyValue) (interface{}, error)
+}
+
+func (mm *marshalerMap) loadInput(t reflect.Type) (func(interface{}) (resource.PropertyValue, error), bool) {
+	mm.RLock()
+	defer mm.RUnlock()
+
+	fn, ok := mm.inputs[t]
+	return fn, ok
+}
+
+func (mm *marshalerMap) loadOutput(t reflect.Type) (func(resource.PropertyValue) (interface{}, error), bool) {
+	mm.RLock()
+	defer mm.RUnlock()
+
+	fn, ok := mm.outputs[t]
+	return fn, ok
+}
+
+var customMarshalers marshalerMap
+
+// RegisterInputMarshaler registers a function that converts values of type t to a PropertyValue
+// when they are used as resource inputs. Values of types without a registered marshaler are marshaled
+// by reflecting over their structure, which loses information for types like time.Time or big.Int.
+//
+// Marshalers must be registered before any resources that use them are registered, e.g. in an init function.
+func RegisterInputMarshaler(t reflect.Type, fn func(interface{}) (resource.PropertyValue, error)) {
+	contract.Requiref(t != nil, "t", "must not be nil")
+	contract.Requiref(fn != nil, "fn", "must not be nil")
+
+	customMarshalers.Lock()
+	defer customMarshalers.Unlock()
+
+	if _, exists := customMarshalers.inputs[t]; exists {
+		panic(fmt.Errorf("existing input marshaler for %v", t))
+	}
+	customMarshalers.inputs[t] = fn
+}
+
+// RegisterOutputUnmarshaler registers a function that converts a PropertyValue to a value of type t
+// when unmarshaling resource outputs. It is the reverse of RegisterInputMarshaler:
+// registering both for the same type allows its values to round-trip.
+// The function must return a value assignable to t, or nil to leave the destination unset.
+//
+// Unmarshalers must be registered before any resources that use them are registered, e.g. in an init function.
+func RegisterOutputUnmarshaler(t reflect.Type, fn func(resource.PropertyValue) (interface{}, error)) {
+	contract.Requiref(t != nil, "t", "must not be nil")
+	contract.Requiref(fn != nil, "fn", "must not be nil")
+
+	customMarshalers.Lock()
+	defer customMarshalers.Unlock()
+
+	if _, exists := customMarshalers.outputs[t]; exists {
+		panic(fmt.Errorf("existing output unmarshaler for %v", t))
+	}
+	customMarshalers.outputs[t] = fn
+}
+
 func init() {
 	resourcePackages = versionedMap{versions: make(map[string][]Versioned)}
 	resourceModules = versionedMap{versions: make(map[string][]Versioned)}
+	customMarshalers = marshalerMap{
+		inputs:  make(map[reflect.Type]func(interface{}) (resource.PropertyValue, error)),
+		outputs: make(map[reflect.Type]func(resource.PropertyValue) (interface{}, error)),
+	}
 }
@@ -17,9 +17,13 @@ package pulumi
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/blang/semver"
 	structpb "github.com/golang/protobuf/ptypes/struct"
@@ -233,7 +237,7 @@ func TestMarshalRoundtrip(t *testing.T) {
 	}
 
 	// Marshal those inputs.
-	resolved, pdeps, deps, err := marshalInputs(inputs)
+	resolved, pdeps, deps, err := marshalInputs(inputs, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 
 	if assert.NoError(t, err) {
@@ -438,7 +442,7 @@ func TestResourceState(t *testing.T) {
 			Foo: String("bar"),
 			Bar: Int(42),
 		},
-	})
+	}, true /*keepOutputValues*/)
 	s, err := plugin.MarshalProperties(
 		resolved,
 		plugin.MarshalOptions{KeepUnknowns: true})
@@ -459,7 +463,7 @@ func TestResourceState(t *testing.T) {
 		String:  theResource.String,
 		Nested:  theResource.Nested,
 	}
-	resolved, pdeps, deps, err := marshalInputs(input)
+	resolved, pdeps, deps, err := marshalInputs(input, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 	assert.Equal(t, map[string][]URN{
 		"urn":     {"foo"},
@@ -578,7 +582,7 @@ func TestMarshalRoundtripNestedSecret(t *testing.T) {
 	}
 
 	// Marshal those inputs.
-	resolved, pdeps, deps, err := marshalInputs(inputs)
+	resolved, pdeps, deps, err := marshalInputs(inputs, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 
 	if assert.NoError(t, err) {
@@ -667,7 +671,7 @@ func TestMapInputMarshalling(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		resolved, _, depUrns, err := marshalInputs(c.inputs)
+		resolved, _, depUrns, err := marshalInputs(c.inputs, true /*keepOutputValues*/)
 		assert.NoError(t, err)
 		if c.expectOutputValue {
 			assert.Equal(t, "outputty", resolved["prop"].OutputValue().Element.StringValue())
@@ -765,6 +769,82 @@ func TestVersionedMap(t *testing.T) {
 	}
 }
 
+func TestVersionedMapLoadRange(t *testing.T) {
+	t.Parallel()
+
+	resourceModules := versionedMap{
+		versions: map[string][]Versioned{},
+	}
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("3.9.0")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("4.1.0")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("4.2.0")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("4.5.1")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("5.0.0")})
+	_ = resourceModules.Store("unrelated", &testResourcePackage{version: semver.MustParse("4.3.0")})
+
+	tests := []struct {
+		name            string
+		pkg             string
+		rng             string
+		expectFound     bool
+		expectedVersion semver.Version
+	}{
+		{
+			name:        "unknown not found",
+			pkg:         "unknown",
+			rng:         ">=1.0.0",
+			expectFound: false,
+		},
+		{
+			name:            "highest within major",
+			pkg:             "test",
+			rng:             ">=4.2.0 <5.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.5.1"),
+		},
+		{
+			name:            "spans majors",
+			pkg:             "test",
+			rng:             ">=3.0.0 <4.5.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.2.0"),
+		},
+		{
+			name:            "open ended",
+			pkg:             "test",
+			rng:             ">=4.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("5.0.0"),
+		},
+		{
+			name:            "exact",
+			pkg:             "test",
+			rng:             "=4.1.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.1.0"),
+		},
+		{
+			name:        "no version satisfies",
+			pkg:         "test",
+			rng:         ">4.5.1 <5.0.0",
+			expectFound: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, found := resourceModules.LoadRange(tt.pkg, semver.MustParseRange(tt.rng))
+			assert.Equal(t, tt.expectFound, found)
+			if tt.expectFound {
+				assert.Equal(t, tt.expectedVersion, pkg.Version())
+			}
+		})
+	}
+}
+
 func TestRegisterResourcePackage(t *testing.T) {
 	t.Parallel()
 
@@ -836,6 +916,67 @@ func TestRegisterResourceModule(t *testing.T) {
 	}
 }
 
+// testTimestamp is a type that would lose its value if it were marshaled by reflection.
+type testTimestamp struct {
+	t time.Time
+}
+
+func TestRegisterInputMarshaler(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	typ := reflect.TypeOf(testTimestamp{})
+	RegisterInputMarshaler(typ, func(v interface{}) (resource.PropertyValue, error) {
+		return resource.NewStringProperty(v.(testTimestamp).t.Format(time.RFC3339)), nil
+	})
+	RegisterOutputUnmarshaler(typ, func(v resource.PropertyValue) (interface{}, error) {
+		if !v.IsString() {
+			return nil, fmt.Errorf("expected a string, got a %s", v.TypeString())
+		}
+		ts, err := time.Parse(time.RFC3339, v.StringValue())
+		return testTimestamp{t: ts}, err
+	})
+	assert.Panics(t, func() {
+		RegisterInputMarshaler(typ, func(interface{}) (resource.PropertyValue, error) {
+			return resource.PropertyValue{}, nil
+		})
+	})
+	assert.Panics(t, func() {
+		RegisterOutputUnmarshaler(typ, func(resource.PropertyValue) (interface{}, error) {
+			return nil, nil
+		})
+	})
+
+	give := testTimestamp{t: time.Date(2023, 12, 5, 10, 30, 0, 0, time.UTC)}
+
+	v, _, err := marshalInput(give, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, resource.NewStringProperty("2023-12-05T10:30:00Z"), v)
+
+	// Pointers are dereferenced before looking up the marshaler.
+	pv, _, err := marshalInput(&give, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, v, pv)
+
+	var got testTimestamp
+	_, err = unmarshalOutput(ctx, v, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.True(t, give.t.Equal(got.t), "expected %v, got %v", give.t, got.t)
+
+	// Secretness is preserved around the unmarshaler.
+	var gotSecret testTimestamp
+	secret, err := unmarshalOutput(ctx, resource.MakeSecret(v), reflect.ValueOf(&gotSecret).Elem())
+	require.NoError(t, err)
+	assert.True(t, secret)
+	assert.True(t, give.t.Equal(gotSecret.t), "expected %v, got %v", give.t, gotSecret.t)
+
+	// Errors from the unmarshaler are reported.
+	_, err = unmarshalOutput(ctx, resource.NewNumberProperty(42), reflect.ValueOf(&got).Elem())
+	assert.ErrorContains(t, err, "expected a string, got a number")
+}
+
 func TestInvalidAsset(t *testing.T) {
 	t.Parallel()
 
@@ -848,7 +989,7 @@ func TestInvalidAsset(t *testing.T) {
 	require.NotNil(t, d)
 	require.True(t, d.(*asset).invalid)
 
-	_, _, err = marshalInput(d, assetType, true)
+	_, _, err = marshalInput(d, assetType, true, true /*keepOutputValues*/)
 	assert.Error(t, err)
 }
 
@@ -864,7 +1005,7 @@ func TestInvalidArchive(t *testing.T) {
 	require.NotNil(t, d)
 	require.True(t, d.(*archive).invalid)
 
-	_, _, err = marshalInput(d, archiveType, true)
+	_, _, err = marshalInput(d, archiveType, true, true /*keepOutputValues*/)
 	assert.Error(t, err)
 }
 
@@ -920,6 +1061,41 @@ func TestDependsOnComponent(t *testing.T) {
 	assert.Equal(t, []string{"resG"}, deps)
 }
 
+func TestExpandDependencies_cycle(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	newComponent := func(name string) *simpleComponentResource {
+		urn := URN("urn:pulumi:stack::project::test:index:Comp::" + name)
+		return newSimpleComponentResource(ctx, urn).(*simpleComponentResource)
+	}
+	res := newSimpleCustomResource(ctx, "urn:pulumi:stack::project::test:index:Res::res", "id")
+
+	// A component reachable along two paths is not a cycle.
+	top, left, right, bottom := newComponent("top"), newComponent("left"), newComponent("right"), newComponent("bottom")
+	top.addChild(left)
+	top.addChild(right)
+	left.addChild(bottom)
+	right.addChild(bottom)
+	bottom.addChild(res)
+
+	urns, err := expandDependencies(context.Background(), []Resource{top})
+	require.NoError(t, err)
+	assert.Equal(t, []URN{"urn:pulumi:stack::project::test:index:Res::res"}, urns.sortedValues())
+
+	// But a component that is its own descendant is.
+	comp1, comp2 := newComponent("comp1"), newComponent("comp2")
+	comp1.addChild(res)
+	comp1.addChild(comp2)
+	comp2.addChild(comp1)
+
+	_, err = expandDependencies(context.Background(), []Resource{comp1})
+	assert.ErrorContains(t, err,
+		"dependency cycle: resource urn:pulumi:stack::project::test:index:Comp::comp1 is its own descendant")
+}
+
 func TestOutputValueMarshalling(t *testing.T) {
 	t.Parallel()
 
@@ -976,7 +1152,7 @@ func TestOutputValueMarshalling(t *testing.T) {
 					name := fmt.Sprintf("value=%v, known=%v, secret=%v, deps=%v", value, known, secret, deps)
 					//nolint:paralleltest // very small test, parallel parent
 					t.Run(name, func(t *testing.T) {
-						actual, _, _, err := marshalInputs(inputs)
+						actual, _, _, err := marshalInputs(inputs, true /*keepOutputValues*/)
 						assert.NoError(t, err)
 						assert.Equal(t, expected, actual)
 					})
@@ -1498,7 +1674,7 @@ func TestOutputValueMarshallingNested(t *testing.T) {
 			inputs := Map{"value": tt.input}
 			expected := resource.PropertyMap{"value": tt.expected}
 
-			actual, _, _, err := marshalInputs(inputs)
+			actual, _, _, err := marshalInputs(inputs, true /*keepOutputValues*/)
 			assert.NoError(t, err)
 			assert.Equal(t, expected, actual)
 		})
@@ -1751,7 +1927,7 @@ func TestOutputValueMarshallingEnums(t *testing.T) {
 			inputs := Map{"value": tt.input}
 			expected := resource.PropertyMap{"value": tt.expected}
 
-			actual, _, _, err := marshalInputs(inputs)
+			actual, _, _, err := marshalInputs(inputs, true /*keepOutputValues*/)
 			assert.NoError(t, err)
 			assert.Equal(t, expected, actual)
 		})
@@ -1764,7 +1940,7 @@ func TestMarshalInputsPropertyDependencies(t *testing.T) {
 	pmap, pdeps, deps, err := marshalInputs(testInputs{
 		S: String("a string"),
 		A: Bool(true),
-	})
+	}, true /*keepOutputValues*/)
 	assert.NoError(t, err)
 	assert.Equal(t, resource.PropertyMap{
 		"s": resource.NewStringProperty("a string"),
@@ -1774,3 +1950,563 @@ func TestMarshalInputsPropertyDependencies(t *testing.T) {
 	// Expect a non-empty property deps map, even when there aren't any deps.
 	assert.Equal(t, map[string][]URN{"s": nil, "a": nil}, pdeps)
 }
+
+func TestMarshalInputsErrorPath(t *testing.T) {
+	t.Parallel()
+
+	_, _, _, err := marshalInputs(Map{
+		"spec": Map{
+			"containers": Array{
+				Map{"image": String("nginx")},
+				Map{"image": &asset{invalid: true}},
+			},
+		},
+	}, true /*keepOutputValues*/)
+	assert.EqualError(t, err, `awaiting input property "spec.containers[1].image": invalid asset`)
+
+	// Outside of marshalInputs, the path is part of the error message.
+	_, _, err = marshalInput(Array{Map{"image": &asset{invalid: true}}}, anyType, true, true /*keepOutputValues*/)
+	assert.EqualError(t, err, "[0].image: invalid asset")
+}
+
+// testMapKey is a map key that is not a string
+// but can be converted to and from one.
+type testMapKey struct {
+	region, zone string
+}
+
+func (k testMapKey) MarshalText() ([]byte, error) {
+	return []byte(k.region + "/" + k.zone), nil
+}
+
+func (k *testMapKey) UnmarshalText(text []byte) error {
+	region, zone, ok := strings.Cut(string(text), "/")
+	if !ok {
+		return fmt.Errorf("expected region/zone, got %q", text)
+	}
+	k.region, k.zone = region, zone
+	return nil
+}
+
+func TestMarshalTextMapKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	give := map[testMapKey]string{
+		{region: "us-west-2", zone: "a"}: "foo",
+		{region: "eu-west-1", zone: "b"}: "bar",
+	}
+
+	v, _, err := marshalInput(give, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, resource.NewObjectProperty(resource.PropertyMap{
+		"us-west-2/a": resource.NewStringProperty("foo"),
+		"eu-west-1/b": resource.NewStringProperty("bar"),
+	}), v)
+
+	var got map[testMapKey]string
+	_, err = unmarshalOutput(ctx, v, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, give, got)
+
+	// Keys that can't be parsed are reported.
+	_, err = unmarshalOutput(ctx, resource.NewObjectProperty(resource.PropertyMap{
+		"nozone": resource.NewStringProperty("foo"),
+	}), reflect.ValueOf(&got).Elem())
+	assert.ErrorContains(t, err, `unmarshaling map key "nozone"`)
+
+	// Other key types are still rejected.
+	_, _, err = marshalInput(map[int]string{1: "foo"}, anyType, true, true /*keepOutputValues*/)
+	assert.ErrorContains(t, err, "expected map keys to be strings")
+}
+
+// driftedInputs is an Args struct with a field
+// that the type it resolves to doesn't have.
+type driftedInputs struct {
+	S     StringInput
+	Extra StringInput
+}
+
+func (driftedInputs) ElementType() reflect.Type {
+	return reflect.TypeOf(struct {
+		S string `pulumi:"s"`
+	}{})
+}
+
+func TestMarshalInputsMissingFields(t *testing.T) {
+	t.Parallel()
+
+	_, _, _, err := marshalInputs(driftedInputs{S: String("foo")}, true /*keepOutputValues*/)
+
+	var missingErr *MissingFieldsError
+	require.ErrorAs(t, err, &missingErr)
+	assert.Equal(t, []string{"Extra"}, missingErr.Fields)
+	assert.ErrorContains(t, err, "unknown field Extra when marshaling inputs of type pulumi.driftedInputs")
+}
+
+func TestMarshalJSONPassthrough(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	give := json.RawMessage(`{
+		"name": "foo",
+		"nested": {
+			"password": {
+				"4dabf18193072939515e22adb298388d": "1b47061264138c4ac30d75fd1eb44270",
+				"value": "s3cr3t"
+			},
+			"ports": [80, 443]
+		}
+	}`)
+	want := resource.NewObjectProperty(resource.PropertyMap{
+		"name": resource.NewStringProperty("foo"),
+		"nested": resource.NewObjectProperty(resource.PropertyMap{
+			"password": resource.MakeSecret(resource.NewStringProperty("s3cr3t")),
+			"ports": resource.NewArrayProperty([]resource.PropertyValue{
+				resource.NewNumberProperty(80),
+				resource.NewNumberProperty(443),
+			}),
+		}),
+	})
+
+	v, _, err := marshalInput(give, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, want, v)
+
+	var got json.RawMessage
+	secret, err := unmarshalOutput(ctx, v, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.True(t, secret)
+	assert.JSONEq(t, string(give), string(got))
+
+	// *structpb.Value round-trips the same way.
+	var gotpb *structpb.Value
+	secret, err = unmarshalOutput(ctx, v, reflect.ValueOf(&gotpb).Elem())
+	require.NoError(t, err)
+	assert.True(t, secret)
+
+	pv, _, err := marshalInput(gotpb, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, want, pv)
+
+	_, _, err = marshalInput(json.RawMessage(`{"unterminated"`), anyType, true, true /*keepOutputValues*/)
+	assert.ErrorContains(t, err, "parsing JSON input")
+}
+
+func TestVersionedMapLoadCompatible(t *testing.T) {
+	t.Parallel()
+
+	resourceModules := versionedMap{
+		versions: map[string][]Versioned{},
+	}
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("3.9.0")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("4.1.0")})
+	_ = resourceModules.Store("test", &testResourcePackage{version: semver.MustParse("4.2.0")})
+	_ = resourceModules.Store("old", &testResourcePackage{version: semver.MustParse("1.2.0")})
+	_ = resourceModules.Store("between", &testResourcePackage{version: semver.MustParse("4.0.0")})
+	_ = resourceModules.Store("between", &testResourcePackage{version: semver.MustParse("6.0.0")})
+
+	tests := []struct {
+		name            string
+		pkg             string
+		version         string
+		expectFound     bool
+		expectedVersion semver.Version
+	}{
+		{
+			name:            "exact match preferred",
+			pkg:             "test",
+			version:         "4.1.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.1.0"),
+		},
+		{
+			name:            "same major preferred",
+			pkg:             "test",
+			version:         "3.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("3.9.0"),
+		},
+		{
+			name:            "next major",
+			pkg:             "test",
+			version:         "5.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.2.0"),
+		},
+		{
+			name:            "previous major",
+			pkg:             "old",
+			version:         "0.5.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("1.2.0"),
+		},
+		{
+			name:            "lower major preferred over higher",
+			pkg:             "between",
+			version:         "5.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.0.0"),
+		},
+		{
+			name:            "higher major without lower",
+			pkg:             "between",
+			version:         "3.0.0",
+			expectFound:     true,
+			expectedVersion: semver.MustParse("4.0.0"),
+		},
+		{
+			name:        "too far apart",
+			pkg:         "test",
+			version:     "6.0.0",
+			expectFound: false,
+		},
+		{
+			name:        "unknown not found",
+			pkg:         "unknown",
+			version:     "1.0.0",
+			expectFound: false,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, found := resourceModules.loadCompatible(tt.pkg, semver.MustParse(tt.version))
+			assert.Equal(t, tt.expectFound, found)
+			if tt.expectFound {
+				assert.Equal(t, tt.expectedVersion, pkg.Version())
+			}
+		})
+	}
+}
+
+func TestMarshalInputWithoutOutputValues(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	dep := newSimpleCustomResource(ctx, "fakeURN", "fakeID")
+	stringOutputType := reflect.TypeOf((*StringOutput)(nil)).Elem()
+	newStringOutput := func(v string, known, secret bool) StringOutput {
+		out := ctx.newOutput(stringOutputType).(StringOutput)
+		internal.ResolveOutput(out, v, known, secret, resourcesToInternal([]Resource{dep}))
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		input    Input
+		expected resource.PropertyValue
+	}{
+		{
+			name:     "known",
+			input:    newStringOutput("foo", true, false),
+			expected: resource.NewStringProperty("foo"),
+		},
+		{
+			name:     "known secret",
+			input:    newStringOutput("foo", true, true),
+			expected: resource.MakeSecret(resource.NewStringProperty("foo")),
+		},
+		{
+			name:     "unknown",
+			input:    newStringOutput("", false, false),
+			expected: resource.MakeComputed(resource.NewStringProperty("")),
+		},
+		{
+			name:     "unknown secret",
+			input:    newStringOutput("", false, true),
+			expected: resource.MakeSecret(resource.MakeComputed(resource.NewStringProperty(""))),
+		},
+		{
+			name:  "nested",
+			input: Map{"a": Array{newStringOutput("foo", true, false)}},
+			expected: resource.NewObjectProperty(resource.PropertyMap{
+				"a": resource.NewArrayProperty([]resource.PropertyValue{resource.NewStringProperty("foo")}),
+			}),
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			v, deps, err := marshalInput(tt.input, anyType, true, false /*keepOutputValues*/)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, v)
+			assert.Equal(t, []Resource{dep}, deps, "dependencies must still be returned")
+		})
+	}
+}
+
+func TestCollectDependencies(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	res1 := newSimpleCustomResource(ctx, "urn:pulumi:stack::project::test:index:Res::res1", "id1")
+	res2 := newSimpleCustomResource(ctx, "urn:pulumi:stack::project::test:index:Res::res2", "id2")
+	res3 := newSimpleCustomResource(ctx, "urn:pulumi:stack::project::test:index:Res::res3", "id3")
+
+	stringOutputType := reflect.TypeOf((*StringOutput)(nil)).Elem()
+	withDeps := ctx.newOutput(stringOutputType).(StringOutput)
+	internal.ResolveOutput(withDeps, "foo", true, false, resourcesToInternal([]Resource{res1}))
+	unknown := ctx.newOutput(stringOutputType).(StringOutput)
+	internal.ResolveOutput(unknown, "", false, false, resourcesToInternal([]Resource{res2}))
+	nested := ctx.newOutput(stringOutputType).(StringOutput)
+	internal.ResolveOutput(nested, "baz", true, false, resourcesToInternal([]Resource{res3}))
+
+	props := Map{
+		"plain":   String("bar"),
+		"output":  withDeps,
+		"unknown": unknown,
+		"nested":  Array{Map{"value": nested}},
+	}
+
+	got, err := collectDependencies(props)
+	require.NoError(t, err)
+	assert.Equal(t, []URN{
+		"urn:pulumi:stack::project::test:index:Res::res1",
+		"urn:pulumi:stack::project::test:index:Res::res2",
+		"urn:pulumi:stack::project::test:index:Res::res3",
+	}, got)
+
+	// The dependencies must match the ones found by marshaling the inputs.
+	_, _, want, err := marshalInputs(props, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, want, got)
+}
+
+func TestMarshalInputIntegerPrecision(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		give    interface{}
+		want    float64
+		wantErr string
+	}{
+		{give: int64(1 << 53), want: 1 << 53},
+		{give: int64(-1 << 53), want: -1 << 53},
+		{give: uint64(1 << 53), want: 1 << 53},
+		// Larger integers are fine as long as a float64 holds them exactly.
+		{give: int64(1 << 60), want: 1 << 60},
+		{give: uint64(1 << 63), want: 1 << 63},
+		{give: int64(math.MinInt64), want: math.MinInt64},
+		{give: int32(math.MaxInt32), want: math.MaxInt32},
+		{
+			give:    int64(1<<53 + 1),
+			wantErr: "integer 9007199254740993 cannot be represented exactly as a number",
+		},
+		{
+			give:    int64(-1<<53 - 1),
+			wantErr: "integer -9007199254740993 cannot be represented exactly as a number",
+		},
+		{
+			give:    int64(math.MaxInt64),
+			wantErr: "integer 9223372036854775807 cannot be represented exactly as a number",
+		},
+		{
+			give:    uint64(math.MaxUint64),
+			wantErr: "integer 18446744073709551615 cannot be represented exactly as a number",
+		},
+		{
+			give:    Int(1<<53 + 1),
+			wantErr: "integer 9007199254740993 cannot be represented exactly as a number",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(fmt.Sprintf("%T(%v)", tt.give, tt.give), func(t *testing.T) {
+			t.Parallel()
+
+			v, _, err := marshalInput(tt.give, anyType, true, true /*keepOutputValues*/)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, resource.NewNumberProperty(tt.want), v)
+		})
+	}
+}
+
+func TestMarshalInputFixedSizeArray(t *testing.T) {
+	t.Parallel()
+
+	type args struct {
+		Names [3]string `pulumi:"names"`
+	}
+	give := args{Names: [3]string{"a", "b", "c"}}
+
+	v, _, err := marshalInput(give, reflect.TypeOf(give), true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	want := resource.NewArrayProperty([]resource.PropertyValue{
+		resource.NewStringProperty("a"),
+		resource.NewStringProperty("b"),
+		resource.NewStringProperty("c"),
+	})
+	assert.Equal(t, resource.NewObjectProperty(resource.PropertyMap{"names": want}), v)
+
+	// Arrays are unmarshaled as slices.
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+	var got []string
+	_, err = unmarshalOutput(ctx, want, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, got)
+}
+
+func TestUnmarshalResourceReferenceStrict(t *testing.T) {
+	t.Parallel()
+
+	customURN := resource.NewURN("stack", "project", "", "unregistered:index:custom", "test")
+	providerURN := resource.NewURN("stack", "project", "", "pulumi:providers:unregistered", "test")
+	custom := resource.MakeCustomResourceReference(customURN, "id", "1.2.3")
+	provider := resource.MakeCustomResourceReference(providerURN, "id", "")
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	// By default, references to unregistered packages degrade to dependency resources.
+	v, _, err := unmarshalPropertyValue(ctx, custom)
+	require.NoError(t, err)
+	assert.IsType(t, &CustomResourceState{}, v)
+	v, _, err = unmarshalPropertyValue(ctx, provider)
+	require.NoError(t, err)
+	assert.IsType(t, &ProviderResourceState{}, v)
+
+	ctx.SetStrictResourceReferences(true)
+	_, _, err = unmarshalPropertyValue(ctx, custom)
+	assert.ErrorContains(t, err, "package unregistered (1.2.3) is not registered")
+	_, _, err = unmarshalPropertyValue(ctx, provider)
+	assert.ErrorContains(t, err, "package unregistered (any version) is not registered")
+}
+
+// jsonTaggedArgs only has `json` tags, as types reused from API models often do.
+type jsonTaggedArgs struct {
+	Name     string   `json:"name"`
+	Tags     []string `json:"tags,omitempty"`
+	Region   string   `json:",omitempty"`
+	Password string   `json:"-"`
+	Untagged string
+	Both     string `pulumi:"fromPulumi" json:"fromJSON"`
+}
+
+func TestMarshalStructJSONTags(t *testing.T) {
+	t.Parallel()
+
+	give := jsonTaggedArgs{
+		Name:     "widget",
+		Tags:     []string{"a"},
+		Region:   "us-west-2",
+		Password: "hunter2",
+		Untagged: "ignored",
+		Both:     "both",
+	}
+	v, _, err := marshalInput(give, reflect.TypeOf(give), true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	want := resource.NewObjectProperty(resource.PropertyMap{
+		"name":       resource.NewStringProperty("widget"),
+		"tags":       resource.NewArrayProperty([]resource.PropertyValue{resource.NewStringProperty("a")}),
+		"Region":     resource.NewStringProperty("us-west-2"),
+		"fromPulumi": resource.NewStringProperty("both"),
+	})
+	assert.Equal(t, want, v)
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+	var got jsonTaggedArgs
+	_, err = unmarshalOutput(ctx, want, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, jsonTaggedArgs{
+		Name:   "widget",
+		Tags:   []string{"a"},
+		Region: "us-west-2",
+		Both:   "both",
+	}, got)
+}
+
+// EmbeddedTestArgs is embedded in other structs to test promoted fields.
+// It's exported so that pointers to it can be allocated when unmarshaling.
+type EmbeddedTestArgs struct {
+	Name  string `pulumi:"name"`
+	Count int    `pulumi:"count"`
+}
+
+type embeddingTestArgs struct {
+	EmbeddedTestArgs
+	// Count shadows the field of the same name in EmbeddedTestArgs.
+	Count float64 `pulumi:"count"`
+	Extra string  `pulumi:"extra"`
+}
+
+type embeddingPtrTestArgs struct {
+	*EmbeddedTestArgs
+	Extra string `pulumi:"extra"`
+}
+
+func TestMarshalEmbeddedStruct(t *testing.T) {
+	t.Parallel()
+
+	give := embeddingTestArgs{
+		EmbeddedTestArgs: EmbeddedTestArgs{Name: "foo", Count: 1},
+		Count:            2,
+		Extra:            "bar",
+	}
+	v, _, err := marshalInput(give, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, resource.NewObjectProperty(resource.PropertyMap{
+		"name":  resource.NewStringProperty("foo"),
+		"count": resource.NewNumberProperty(2),
+		"extra": resource.NewStringProperty("bar"),
+	}), v)
+
+	// Nil embedded pointers contribute nothing.
+	v, _, err = marshalInput(embeddingPtrTestArgs{Extra: "bar"}, anyType, true, true /*keepOutputValues*/)
+	require.NoError(t, err)
+	assert.Equal(t, resource.NewObjectProperty(resource.PropertyMap{
+		"extra": resource.NewStringProperty("bar"),
+	}), v)
+}
+
+func TestUnmarshalEmbeddedStruct(t *testing.T) {
+	t.Parallel()
+
+	ctx, err := NewContext(context.Background(), RunInfo{})
+	require.NoError(t, err)
+
+	obj := resource.NewObjectProperty(resource.PropertyMap{
+		"name":  resource.NewStringProperty("foo"),
+		"count": resource.NewNumberProperty(2),
+		"extra": resource.NewStringProperty("bar"),
+	})
+
+	var got embeddingTestArgs
+	_, err = unmarshalOutput(ctx, obj, reflect.ValueOf(&got).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, embeddingTestArgs{
+		// The outer Count takes the value; the shadowed one is left alone.
+		EmbeddedTestArgs: EmbeddedTestArgs{Name: "foo"},
+		Count:            2,
+		Extra:            "bar",
+	}, got)
+
+	var gotPtr embeddingPtrTestArgs
+	_, err = unmarshalOutput(ctx, obj, reflect.ValueOf(&gotPtr).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, embeddingPtrTestArgs{
+		EmbeddedTestArgs: &EmbeddedTestArgs{Name: "foo", Count: 2},
+		Extra:            "bar",
+	}, gotPtr)
+}